@@ -0,0 +1,403 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nealwon/optool/common"
+)
+
+// earlyCommands sub commands run right after configure is parsed, hosts are not needed
+var earlyCommands map[string]command
+
+func init() {
+	earlyCommands = map[string]command{
+		"completion": {
+			usage: "completion bash|zsh|fish",
+			help:  "Print shell completion script. Commands, flags, host groups, tags and profiles are completed from the loaded config.",
+			run:   runCompletion,
+		},
+		"__complete": {
+			usage: "__complete commands|flags|groups|tags|profiles",
+			run:   runComplete,
+		},
+		"help": {
+			usage: "help [command]",
+			help:  "Print help of a command, or all flags and commands.",
+			run:   runHelp,
+		},
+		"man": {
+			usage: "man",
+			help:  "Print man page in roff format, eg. optool man > /usr/local/share/man/man1/optool.1",
+			run:   runMan,
+		},
+		"replay": {
+			usage: "replay <run id> [--failed]",
+			help:  "Run a recorded run again with its args, configure, working dir and hosts, putting the same file bytes and deploy artifact from cache. --failed runs only hosts failed in it.",
+			run:   runReplay,
+		},
+		"approve": {
+			usage: "approve list|<run id>",
+			help:  "Approve deploys of a run waiting for approval (approval.groups). The user who started the run cannot approve it. list prints approvals of all runs.",
+			run:   runApprove,
+		},
+		"reject": {
+			usage: "reject <run id> [--reason <text>]",
+			help:  "Reject deploys of a run waiting for approval, the run fails with the reason.",
+			run:   runReject,
+		},
+		"token": {
+			usage: "token new <id>",
+			help:  "Generate a token for OPTOOL_TOKEN and print it with the rbac tokens entry holding its sha256. To rotate a token add the new entry and set expires of the old one. rbac of /etc/optool/rbac.yml, owned by root, replaces the one of the configure so that -config of another file can not drop roles.",
+			run:   runToken,
+		},
+		"lint": {
+			usage: "lint",
+			help:  "Check pipelines and inventory without connecting to any host: undefined {vars}, cycles, steps never run, missing profiles and files, unknown groups and hosts in no group. Exits non-zero if an issue is found.",
+			run:   runLint,
+		},
+		"graph": {
+			usage: "graph <pipeline> [--format dot|mermaid]",
+			help:  "Print stages of a pipeline as a DOT (default) or Mermaid diagram: dependencies, host groups, steps and deploy strategy, one cluster per parameter set of its matrix. eg. optool graph release | dot -Tsvg > release.svg",
+			run:   runGraph,
+		},
+		"durations": {
+			usage: "durations",
+			help:  "Print historical durations of deploy batches and pipeline steps kept in the state dir: samples, median, max and the slowest host. ETAs of rollouts are estimated from them.",
+			run:   runDurations,
+		},
+		"state": {
+			usage: "state export <file> [--artifacts]|import <file>",
+			help:  "Export releases, history, quarantined hosts and run records of the state dir into a file, and merge it into the state dir of a colleague or CI runner, so rollbacks, drift checks and replays work wherever the last deploy ran. --artifacts includes cached artifacts of the last two releases of every group.",
+			run:   runState,
+		},
+		"pause": {
+			usage: "pause <run id>",
+			help:  "Pause a rolling deploy or pipeline running in another terminal after its current batch or step, until resumed.",
+			run:   runControl(common.ControlPause),
+		},
+		"resume": {
+			usage: "resume <run id>",
+			help:  "Resume a paused run.",
+			run:   runControl(common.ControlResume),
+		},
+		"abort": {
+			usage: "abort <run id>",
+			help:  "Stop a run after its current batch or step. Atomic rolling deploys roll back every host deployed so far.",
+			run:   runControl(common.ControlAbort),
+		},
+		"credential": {
+			usage: "credential set|delete <name>",
+			help:  "Store a password or key passphrase in the OS keychain (macOS Keychain, Windows Credential Manager, libsecret), prompted without echo. auth.password_credential and auth.private_key_phrase_credential refer to it by name.",
+			run:   runCredential,
+		},
+		"self-update": {
+			usage: "self-update [--insecure]",
+			help:  "Check update.url for a newer release, verify its checksum and signature, and replace the running binary. Without update.public_key it is refused unless --insecure is given.",
+			run:   runSelfUpdate,
+		},
+	}
+}
+
+// printUsage print flags and commands, used as flag.Usage
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:\n  optool [flags] [command] [args]")
+	fmt.Fprintln(os.Stderr, "Flags:")
+	flag.PrintDefaults()
+	printCommands()
+}
+
+func runHelp(hosts []string, args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return nil
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		return fmt.Errorf("Unknown command: %s", args[0])
+	}
+	fmt.Printf("Usage:\n  optool [flags] %s\n\n%s\n", cmd.usage, cmd.help)
+	return nil
+}
+
+// roffEscape escape text for roff
+func roffEscape(s string) string {
+	s = strings.Replace(s, "\\", "\\e", -1)
+	s = strings.Replace(s, "-", "\\-", -1)
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, ".") || strings.HasPrefix(l, "'") {
+			l = "\\&" + l
+		}
+		lines[i] = l
+	}
+	return strings.Join(lines, "\n")
+}
+
+// manDate date of man page, from SOURCE_DATE_EPOCH if set or the build date, so that builds are reproducible
+func manDate() string {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		if sec, err := strconv.ParseInt(epoch, 10, 64); err == nil {
+			return time.Unix(sec, 0).UTC().Format("2006-01-02")
+		}
+	}
+	if len(common.BuildDate) >= 10 {
+		if t, err := time.Parse("2006-01-02", common.BuildDate[:10]); err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return common.BuildDate
+}
+
+// runMan print man page generated from flags and commands
+func runMan(hosts []string, args []string) error {
+	fmt.Printf(".TH OPTOOL 1 \"%s\" \"optool %s\" \"User Commands\"\n", manDate(), common.Version)
+	fmt.Println(".SH NAME")
+	fmt.Println("optool \\- execute commands, transfer files and deploy on multiple remote hosts")
+	fmt.Println(".SH SYNOPSIS")
+	fmt.Println(".B optool")
+	fmt.Println("[\\fIflags\\fR] [\\fIcommand\\fR] [\\fIargs\\fR]")
+	fmt.Println(".SH DESCRIPTION")
+	fmt.Println("Without a command, optool executes \\fB\\-x\\fR, \\fB\\-t\\fR or \\fB\\-s\\fR on hosts, or transfers files by \\fB\\-put\\fR/\\fB\\-get\\fR.")
+	fmt.Println("Hosts are the default group of the configure unless \\fB\\-g\\fR, \\fB\\-host\\fR, \\fB\\-hosts\\-file\\fR or \\fB\\-hosttag\\fR is set.")
+	fmt.Println(".SH OPTIONS")
+	flag.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		fmt.Println(".TP")
+		if name != "" {
+			fmt.Printf("\\fB\\-%s\\fR \\fI%s\\fR\n", roffEscape(f.Name), name)
+		} else {
+			fmt.Printf("\\fB\\-%s\\fR\n", roffEscape(f.Name))
+		}
+		fmt.Println(roffEscape(usage))
+	})
+	fmt.Println(".SH COMMANDS")
+	for _, n := range commandNames() {
+		cmd, _ := lookupCommand(n)
+		fmt.Println(".TP")
+		fmt.Printf("\\fB%s\\fR\n", roffEscape(cmd.usage))
+		fmt.Println(roffEscape(cmd.help))
+	}
+	fmt.Println(".SH FILES")
+	fmt.Println(".TP")
+	fmt.Println("\\fI./optool.yml\\fR, \\fI~/optool.yml\\fR, \\fI/etc/optool.yml\\fR")
+	fmt.Println("configure, the first one found is used unless \\fB\\-config\\fR is set")
+	fmt.Println(".TP")
+	fmt.Println("\\fI~/.optool/\\fR")
+	fmt.Println("local state: recorded releases and runs, artifact cache and build cache keys")
+	return nil
+}
+
+func runSelfUpdate(hosts []string, args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	insecure := fs.Bool("insecure", false, "update without update.public_key")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	latest, asset, err := common.CheckUpdate()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Latest release:", latest.Version)
+	if err = common.SelfUpdate(latest, asset, *insecure); err == common.ErrUpToDate {
+		fmt.Println("Already up to date:", common.Version)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Updated to", latest.Version)
+	return nil
+}
+
+func runReplay(hosts []string, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	failed := fs.Bool("failed", false, "run only failed hosts")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	return common.Replay(args[0], *failed)
+}
+
+func runApprove(hosts []string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if args[0] == "list" {
+		list, err := common.LoadApprovals("")
+		if err != nil {
+			return err
+		}
+		for _, a := range list {
+			fmt.Fprintf(common.Stdout, "%s %-10s %-8s %s %s %s\n", a.RunID, a.Group, a.State,
+				a.Requested.Format("2006-01-02 15:04:05"), a.RequestedBy, a.Command)
+		}
+		return nil
+	}
+	return printDecided(common.DecideApproval(args[0], true, ""))
+}
+
+func runReject(hosts []string, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("reject", flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the deploy is rejected")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	return printDecided(common.DecideApproval(args[0], false, *reason))
+}
+
+// printDecided print approvals decided
+func printDecided(decided []common.Approval, err error) error {
+	for _, a := range decided {
+		fmt.Fprintf(common.Stdout, "%s %s: %s by %s\n", a.RunID, a.Group, a.State, a.DecidedBy)
+	}
+	return err
+}
+
+func runToken(hosts []string, args []string) error {
+	if len(args) != 2 || args[0] != "new" {
+		return errUsage
+	}
+	token, sum, err := common.NewToken()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(common.Stdout, "%s=%s\n", common.TokenEnv, token)
+	fmt.Fprintf(common.Stdout, "tokens:\n  - id: %s\n    sha256: %s\n", args[1], sum)
+	return nil
+}
+
+func runCredential(hosts []string, args []string) error {
+	if len(args) != 2 || (args[0] != "set" && args[0] != "delete") {
+		return errUsage
+	}
+	kc, err := common.Keychain()
+	if err != nil {
+		return err
+	}
+	if args[0] == "delete" {
+		return kc.Delete(args[1])
+	}
+	secret, err := askPass(fmt.Sprintf("Secret of %s: ", args[1]))
+	if err != nil {
+		return err
+	}
+	if err = kc.Set(args[1], secret); err != nil {
+		return err
+	}
+	fmt.Fprintf(common.Stdout, "Credential %s stored in keychain\n", args[1])
+	return nil
+}
+
+func runLint(hosts []string, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	issues := common.Lint()
+	for _, li := range issues {
+		fmt.Fprintln(common.Stdout, li)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d lint issue(s)", len(issues))
+	}
+	fmt.Fprintln(common.Stdout, "No issues found")
+	return nil
+}
+
+func runGraph(hosts []string, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("graph", flag.ContinueOnError)
+	format := fs.String("format", common.GraphDOT, "dot or mermaid")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	graph, err := common.PipelineGraph(args[0], *format)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(common.Stdout, graph)
+	return nil
+}
+
+func runDurations(hosts []string, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	stats := common.DurationStats()
+	if len(stats) == 0 {
+		fmt.Fprintln(common.Stdout, "No durations recorded")
+		return nil
+	}
+	for _, st := range stats {
+		fmt.Fprintf(common.Stdout, "%s\n  %d host(s), %d sample(s), median %s, max %s, slowest %s\n", st.Step, st.Hosts,
+			st.Samples, st.Median.Round(time.Second), st.Max.Round(time.Second), st.Slowest)
+	}
+	return nil
+}
+
+func runState(hosts []string, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	switch args[0] {
+	case "export":
+		fs := flag.NewFlagSet("state export", flag.ContinueOnError)
+		artifacts := fs.Bool("artifacts", false, "include cached artifacts of releases")
+		if err := fs.Parse(args[2:]); err != nil || fs.NArg() > 0 {
+			return errUsage
+		}
+		st, err := common.ExportState(args[1], *artifacts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(common.Stdout, "Exported %d group(s), %d release(s), %d quarantined host(s), %d run(s), %d artifact(s) to %s\n",
+			len(st.Releases), len(st.History), len(st.Quarantine), len(st.Runs), len(st.Artifacts), args[1])
+		return nil
+	case "import":
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := common.Authorize("", common.RoleDeployer); err != nil {
+			return err
+		}
+		st, n, err := common.ImportState(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(common.Stdout, "State exported by %s at %s\n", st.By, st.Exported.Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(common.Stdout, "Imported %d group(s), %d release(s), %d quarantined host(s), %d run(s), %d artifact(s)\n",
+			n.Releases, n.History, n.Quarantine, n.Runs, n.Artifacts)
+		return nil
+	}
+	return errUsage
+}
+
+// runControl run of pause, resume or abort
+func runControl(control string) func(hosts []string, args []string) error {
+	return func(hosts []string, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := common.Authorize("", common.RoleDeployer); err != nil {
+			return err
+		}
+		if err := common.SetControl(args[0], control); err != nil {
+			return err
+		}
+		fmt.Fprintf(common.Stdout, "Run %s: %s\n", args[0], control)
+		return nil
+	}
+}
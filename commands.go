@@ -0,0 +1,1093 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nealwon/optool/common"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// errUsage returned by sub commands when args are invalid
+var errUsage = errors.New("invalid arguments")
+
+// command sub command run after configure and hosts are resolved
+type command struct {
+	usage    string
+	help     string
+	run      func(hosts []string, args []string) error
+	ownHosts bool   // hosts are selected by the command, no host group is needed
+	role     string // least rbac role needed on host group, deployer if empty. * role is checked if ownHosts
+}
+
+var commands = map[string]command{
+	"put": {
+		usage: "put <local> <remote>",
+		help:  "Put a file to hosts, same as -put <local> -path <remote>. Transfer flags like -r, -mode, -staged, -verify and -extract apply.",
+		run:   runPut,
+	},
+	"get": {
+		usage: "get <remote> <local dir>",
+		help:  "Get a file from hosts into local dir, same as -get <remote> -path <local dir>. Files are renamed with host address.",
+		run:   runGet,
+	},
+	"exec": {
+		usage: "exec <command>",
+		help:  "Execute command on hosts, same as -x <command>.",
+		run:   runExec,
+	},
+	"ping": {
+		usage: "ping",
+		help:  "Connect to every host and run a no-op, printing ssh connect latency.",
+		run:   runPing,
+		role:  common.RoleViewer,
+	},
+	"deploy": {
+		usage: "deploy",
+		help:  "Deploy deploy.artifact with deploy.strategy (rolling or bluegreen) and record the release of the host group.",
+		run:   runDeploy,
+	},
+	"rollback": {
+		usage: "rollback",
+		help:  "Roll back the host group. bluegreen flips traffic back to the old color, rolling deploys the previous recorded release from cache.",
+		run:   runRollback,
+	},
+	"history": {
+		usage: "history [group]",
+		help:  "List recorded releases, newest first.",
+		run:   runHistory,
+		role:  common.RoleViewer,
+	},
+	"bluegreen": {
+		usage: "bluegreen deploy|rollback|status",
+		help:  "Deploy into the inactive color, health check it and flip traffic. rollback flips back, status prints live colors.",
+		run:   runBlueGreen,
+	},
+	"rolling": {
+		usage: "rolling [batch size]",
+		help:  "Deploy batch by batch, draining each host from the load balancer. -atomic rolls back all hosts on any failure.",
+		run:   runRolling,
+	},
+	"maintenance": {
+		usage: "maintenance on|off|exec <command>",
+		help:  "Toggle maintenance page. exec runs command with maintenance page on and always turns it off afterwards.",
+		run:   runMaintenance,
+	},
+	"restart": {
+		usage: "restart",
+		help:  "Restart deploy.services of hosts, stopping them in reverse dependency order and starting them in order with health checks between.",
+		run:   runRestart,
+	},
+	"clock": {
+		usage: "clock",
+		help:  "Measure clock skew of hosts against this machine, timed over open connections. Skew beyond clock.max_skew seconds is flagged, deploys, sync puts and config pushes check it before they start.",
+		run:   runClock,
+		role:  common.RoleViewer,
+	},
+	"status": {
+		usage: "status",
+		help:  "Query deploy.services on every host running them and print a matrix of hosts by services: up, DOWN, ERROR if the host could not be queried, - if the service does not run there. status commands default by kind, systemctl is-active or docker ps. Exits non-zero if a service is not up.",
+		run:   runStatus,
+		role:  common.RoleViewer,
+	},
+	"build": {
+		usage: "build",
+		help:  "Run deploy.build.command unless its sources are unchanged since last build.",
+		run:   runBuild,
+	},
+	"crossdeploy": {
+		usage: "crossdeploy",
+		help:  "Cross compile deploy.go_build for every detected host platform and deploy the matching binary. Gated like deploy: approval, change ticket and policy apply, groups in deploy.signature.protected refuse the unsigned binaries.",
+		run:   runCrossDeploy,
+	},
+	"promote": {
+		usage: "promote <from group> <to group>",
+		help:  "Deploy the exact artifact bytes last deployed to one group to another group.",
+		run:   runPromote,
+	},
+	"cache": {
+		usage: "cache list|gc",
+		help:  "List cached artifacts or remove least recently used ones beyond cache.max_size.",
+		run:   runCache,
+		role:  common.RoleAdmin,
+	},
+	"run": {
+		usage: "run <profile>",
+		help:  "Run a named transfer profile from configure.",
+		run:   runProfile,
+	},
+	"keys": {
+		usage: "keys push [--pubkey <file>]|rotate [--finish]",
+		help:  "With push, append a public key (default ~/.ssh/id_ed25519.pub or id_rsa.pub) to authorized_keys of the auth user on hosts, logging in by password. Keys already present are skipped, ~/.ssh permissions are fixed. With rotate, generate a new auth.private_key, authorize it on hosts, verify login with it and remove the old key from authorized_keys; a rotation left unfinished by failed hosts is resumed by running it again, and the new key replaces the old one locally once every host is done. The old key is kept as <key>.old and still offered, so hosts left out of the rotation can be reached and rotated, until rotate --finish verifies login by the new key alone on hosts and stops offering it.",
+		run:   runKeys,
+		role:  common.RoleAdmin,
+	},
+	"bootstrap": {
+		usage: "bootstrap",
+		help:  "Prepare fresh hosts as root or by sudo: create bootstrap.user with its public key, create deploy.root/releases and shared owned by the user, and check bootstrap.sudo rules.",
+		run:   runBootstrap,
+		role:  common.RoleAdmin,
+	},
+	"drift": {
+		usage: "drift",
+		help:  "Compare deploy metadata and artifact checksum of every host with the last release recorded for the host group, flagging hosts modified out-of-band or missing a release.",
+		run:   runDrift,
+		role:  common.RoleViewer,
+	},
+	"collect-logs": {
+		usage: "collect-logs [--since <duration>] [--paths <globs>] [--units <units>] [--out <file>]",
+		help:  "Gather log slices of hosts since a duration ago (default 1h) into one gzipped tar support bundle, a dir per host and collect.json listing hosts and errors. --paths are comma separated globs of log files, cut from the first line stamped at or after since; --units are journald units read by journalctl --since.",
+		run:   runCollectLogs,
+		role:  common.RoleViewer,
+	},
+	"env": {
+		usage: "env diff|apply",
+		help:  "Render env_file from vars and secrets for the host group and show changes of the remote file, secret values are redacted. apply writes it on changed hosts and runs env_file.changed there.",
+		run:   runEnv,
+	},
+	"config": {
+		usage: "config deploy <name>",
+		help:  "Render a file of configs for the host group, upload it next to its remote path, validate it, swap it into place and reload. A failed validation keeps or rolls back the old file, hosts with an unchanged file are not reloaded.",
+		run:   runConfig,
+	},
+	"cert": {
+		usage: "cert deploy <name>|expiry [<name>...]|renew [--force] [--daemon] [--every <duration>] [<name>...]",
+		help:  "With deploy, push certificate, key and chain of certs with the key readable by its owner only, verify the key, expiry and chain with openssl on hosts, swap them into place and reload, hosts with unchanged files are not reloaded. With expiry, report days until expiry of installed certs, all certs if no name is given, and fail if any expired or expires within warn_days. With renew, obtain certs with domains expiring within acme.renew_days (all with --force) from the ACME CA by DNS-01 and deploy them, all certs with domains if no name is given; --daemon renews every --every, 12h by default.",
+		run:   runCert,
+	},
+	"bench": {
+		usage:    "bench <host> [--size <bytes>]",
+		help:     "Measure ssh handshake time and sftp put and get throughput of a host with several buffer and concurrency settings, and print recommended transfer_buffer and sftp values. --size defaults to 32MB.",
+		run:      runBench,
+		ownHosts: true,
+		role:     common.RoleViewer,
+	},
+	"diff-releases": {
+		usage:    "diff-releases <host> <release> <release>",
+		help:     "List files added (+), removed (-) and modified (~) between two release dirs on a host, compared by sha256. A release is a release id under deploy.root/releases, current, previous or an absolute path.",
+		run:      runDiffReleases,
+		ownHosts: true,
+		role:     common.RoleViewer,
+	},
+	"quarantine": {
+		usage:    "quarantine list|add <host> --reason <text> [--for <duration>]|remove <host>",
+		help:     "Exclude a known-broken host from all runs until it is removed or --for (eg. 72h) expires, so it does not fail every rollout. Quarantined hosts are skipped with a warning showing the reason.",
+		run:      runQuarantine,
+		ownHosts: true,
+		role:     common.RoleAdmin,
+	},
+	"pipeline": {
+		usage:    "pipeline <name>",
+		help:     "Run a pipeline from configure. Stages run steps against their host group once the stages they depend on succeeded, independent stages run at the same time.",
+		run:      runPipeline,
+		ownHosts: true,
+		role:     common.RoleViewer,
+	},
+	"bundle": {
+		usage:    "bundle keygen <private key file>|create <file> [--pipeline <name>]|apply <file>",
+		help:     "Pack the deploy artifact, or a pipeline with the artifact and files its profiles put, with their sha256 into one archive signed by bundle.private_key. apply verifies it by bundle.public_key and deploys the host group or runs the pipeline from it, without network access besides hosts. keygen writes a private key and prints the public key.",
+		run:      runBundle,
+		ownHosts: true,
+		role:     common.RoleViewer,
+	},
+}
+
+// authorize check rbac role of user on host group for sub command, or for direct command and transfer
+func authorize() error {
+	need, group := common.RoleDeployer, hostGroup()
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		if cmd.role != "" {
+			need = cmd.role
+		}
+		if cmd.ownHosts {
+			group = ""
+		}
+	}
+	return common.Authorize(group, need)
+}
+
+// lookupCommand find sub command by name
+func lookupCommand(name string) (command, bool) {
+	if cmd, ok := commands[name]; ok {
+		return cmd, true
+	}
+	cmd, ok := earlyCommands[name]
+	return cmd, ok
+}
+
+// commandNames get sorted names of all public sub commands
+func commandNames() []string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	for name := range earlyCommands {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runCommand run sub command named by args[0]
+func runCommand(hosts []string, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printCommands()
+		return fmt.Errorf("Unknown command: %s", args[0])
+	}
+	err := cmd.run(hosts, args[1:])
+	if err == errUsage {
+		return errors.New("Usage: optool [flags] " + cmd.usage)
+	}
+	return err
+}
+
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, name := range commandNames() {
+		cmd, _ := lookupCommand(name)
+		fmt.Fprintf(os.Stderr, "  %-36s %s\n", cmd.usage, strings.TrimSuffix(strings.SplitN(cmd.help, ". ", 2)[0], "."))
+	}
+	fmt.Fprintln(os.Stderr, "Run 'optool help <command>' for more information on a command.")
+}
+
+func runPut(hosts []string, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return startTransfer(common.NewTransfer(common.TransferPut, args[0], args[1], hosts))
+}
+
+func runGet(hosts []string, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return startTransfer(common.NewTransfer(common.TransferGet, args[1], args[0], hosts))
+}
+
+func runExec(hosts []string, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	return execCommand(hosts, strings.Join(args, " "))
+}
+
+func runPing(hosts []string, args []string) error {
+	result := common.Ping(hosts)
+	failed := 0
+	for _, h := range hosts {
+		r := result[h]
+		if r.Err != nil {
+			failed++
+			fmt.Fprintf(common.Stdout, "%21s: ERROR %s\n", h, r.Err)
+			continue
+		}
+		fmt.Fprintf(common.Stdout, "%21s: ok %dms\n", h, r.Latency.Nanoseconds()/1e6)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d host(s) unreachable", failed)
+	}
+	return nil
+}
+
+func runDeploy(hosts []string, args []string) error {
+	if err := reportDeploy(hostGroup(), "", func() error { return deploy(hosts) }); err != nil {
+		return err
+	}
+	recordRelease(hostGroup())
+	return nil
+}
+
+func runRollback(hosts []string, args []string) error {
+	if common.C.Deploy.Strategy == common.StrategyBlueGreen {
+		return runBlueGreen(hosts, []string{"rollback"})
+	}
+	group := hostGroup()
+	if group == "" {
+		return errors.New("Rollback needs a host group, -host and -hosts-file are not supported")
+	}
+	rel, err := common.PreviousRelease(group)
+	if err != nil {
+		return err
+	}
+	artifact := common.CacheLookup(rel.Checksum)
+	if artifact == "" {
+		return fmt.Errorf("Artifact %s of previous release is not in cache", rel.Checksum)
+	}
+	fmt.Fprintln(common.Stdout, "Rolling back to:", rel.Artifact, rel.Checksum, rel.Deployed.Format("2006-01-02 15:04:05"))
+	common.C.Deploy.Artifact = artifact
+	common.C.Deploy.Build.Command = ""
+	if err = reportDeploy(group, rel.Revision, func() error { return deploy(hosts) }); err != nil {
+		return err
+	}
+	recordRelease(group)
+	return nil
+}
+
+func runHistory(hosts []string, args []string) error {
+	history, err := common.LoadHistory()
+	if err != nil {
+		return err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		rel := history[i]
+		if len(args) > 0 && rel.Group != args[0] {
+			continue
+		}
+		fmt.Fprintf(common.Stdout, "%s %-12s %-12s %-22s %s\n", rel.Deployed.Format("2006-01-02 15:04:05"), rel.Group, common.ShortSum(rel.Checksum), rel.RunID, rel.Artifact)
+	}
+	return nil
+}
+
+func runBlueGreen(hosts []string, args []string) (err error) {
+	if len(args) < 1 {
+		return errUsage
+	}
+	bg := common.NewBlueGreen(hosts)
+	switch args[0] {
+	case "deploy":
+		if err = reportDeploy(hostGroup(), "", bg.Deploy); err == nil {
+			recordRelease(hostGroup())
+		}
+	case "rollback":
+		// the previous color is kept untouched on hosts, its artifact was verified when it was deployed
+		err = reportDeployVerified(hostGroup(), "", nil, bg.Rollback)
+	case "status":
+		err = bg.Detect()
+	default:
+		return errUsage
+	}
+	bg.PrettyPrint()
+	return
+}
+
+func runRolling(hosts []string, args []string) (err error) {
+	var batch int
+	if len(args) > 0 {
+		if batch, err = strconv.Atoi(args[0]); err != nil {
+			return errUsage
+		}
+	}
+	r, err := common.NewRolling(hosts, batch)
+	if err != nil {
+		return err
+	}
+	if err = reportDeploy(hostGroup(), "", r.Start); err == nil {
+		recordRelease(hostGroup())
+	}
+	r.PrettyPrint()
+	return
+}
+
+func runMaintenance(hosts []string, args []string) (err error) {
+	if len(args) < 1 {
+		return errUsage
+	}
+	m := common.NewMaintenance(hosts)
+	switch args[0] {
+	case "on":
+		err = m.Enable()
+	case "off":
+		err = m.Disable()
+	case "exec":
+		if len(args) < 2 {
+			return errUsage
+		}
+		// risky command runs with maintenance page on, turned off whatever the result is
+		err = m.Wrap(func() error {
+			rc := common.NewRemoteCommand(hosts, strings.Join(args[1:], " "))
+			if err := rc.Start(); err != nil {
+				return err
+			}
+			rc.PrettyPrint(common.Stdout, common.Stderr, false, false)
+			if len(rc.Error) > 0 {
+				return fmt.Errorf("Command failed on %d host(s)", len(rc.Error))
+			}
+			return nil
+		})
+	default:
+		return errUsage
+	}
+	m.PrettyPrint()
+	return
+}
+
+func runRestart(hosts []string, args []string) error {
+	if len(common.C.Deploy.Services) == 0 {
+		return errors.New("deploy.services is not configured")
+	}
+	rs := common.NewRestart(hosts)
+	if err := rs.Start(map[string]string{"dir": path.Join(common.C.Deploy.Root, common.CurrentLink)}); err != nil {
+		return err
+	}
+	rs.PrettyPrint()
+	if len(rs.Failed) > 0 {
+		return fmt.Errorf("Restart failed on %d host(s)", len(rs.Failed))
+	}
+	return nil
+}
+
+func runClock(hosts []string, args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	skews, errs := common.MeasureClocks(hosts)
+	max := time.Duration(common.C.Clock.MaxSkew) * time.Second
+	skewed := 0
+	for _, h := range hosts {
+		if e, ok := errs[h]; ok {
+			fmt.Fprintf(common.Stdout, "%21s: ERROR %s\n", h, e)
+			continue
+		}
+		cs := skews[h]
+		if max > 0 && cs.Exceeds(max) {
+			skewed++
+			fmt.Fprintf(common.Stdout, "%21s: %s SKEWED\n", h, cs)
+			continue
+		}
+		fmt.Fprintf(common.Stdout, "%21s: %s\n", h, cs)
+	}
+	if skewed > 0 || len(errs) > 0 {
+		return fmt.Errorf("%d host(s) skewed beyond %s, %d failed", skewed, max, len(errs))
+	}
+	return nil
+}
+
+func runStatus(hosts []string, args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	if len(common.C.Deploy.Services) == 0 {
+		return errors.New("deploy.services is not configured")
+	}
+	sm, err := common.ServiceStatus(hosts, map[string]string{"dir": path.Join(common.C.Deploy.Root, common.CurrentLink)})
+	if err != nil {
+		return err
+	}
+	sm.Render(common.Stdout, os.Getenv("NO_COLOR") == "" && terminal.IsTerminal(int(os.Stdout.Fd())))
+	if n := sm.Unhealthy(); n > 0 {
+		return fmt.Errorf("%d of %d host(s) unhealthy", n, len(hosts))
+	}
+	return nil
+}
+
+func runBuild(hosts []string, args []string) error {
+	if common.C.Deploy.Build.Command == "" {
+		return errors.New("deploy.build.command is not configured")
+	}
+	skipped, err := common.Build()
+	if err != nil {
+		return err
+	}
+	if skipped {
+		fmt.Fprintln(common.Stdout, "Sources unchanged, build skipped:", common.C.Deploy.Artifact)
+	} else {
+		fmt.Fprintln(common.Stdout, "Built:", common.C.Deploy.Artifact)
+	}
+	return nil
+}
+
+func runCrossDeploy(hosts []string, args []string) error {
+	return reportDeployVerified(hostGroup(), "", common.VerifyCrossBuild, func() error {
+		deployed, errs, err := common.CrossDeploy(hosts)
+		for _, h := range hosts {
+			if e, ok := errs[h]; ok {
+				fmt.Fprintf(common.Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+			} else if p, ok := deployed[h]; ok {
+				fmt.Fprintf(common.Stdout, "%21s: %s\n", h, p)
+			}
+		}
+		if err == nil && len(errs) > 0 {
+			err = fmt.Errorf("%d host(s) failed", len(errs))
+		}
+		return err
+	})
+}
+
+// hostGroup get group of hosts to run on, empty if hosts are set by -host or -hosts-file
+func hostGroup() string {
+	if *pHost != "" || *pHostsFile != "" {
+		return ""
+	}
+	return common.C.Server.DefaultGroup
+}
+
+// recordRelease record deployed artifact of group so that it can be promoted
+func recordRelease(group string) {
+	if group == "" || common.C.Deploy.Artifact == "" {
+		return
+	}
+	rel, err := common.RecordRelease(group, common.C.Deploy.Artifact)
+	if err != nil {
+		log.Println("Record release:", err)
+		return
+	}
+	fmt.Fprintln(common.Stdout, "Release:", rel.Group, rel.Artifact, rel.Checksum, "run", rel.RunID)
+}
+
+// reportDeploy run deploy of revision to group, reporting its start and result to GitHub and change tickets and
+// alerting failures of critical groups if configured. the user must be authorized, the artifact signature valid and
+// the deploy approved if group needs it. revision defaults to HEAD of local working dir. failed reports never fail
+// the deploy, a missing or unapproved change ticket of a protected group does
+func reportDeploy(group, revision string, fn func() error) error {
+	return reportDeployVerified(group, revision, common.VerifyArtifact, fn)
+}
+
+// reportDeployVerified reportDeploy checking what is deployed by verify instead of the deploy.artifact signature,
+// nothing is checked if verify is nil
+func reportDeployVerified(group, revision string, verify func(string) error, fn func() error) error {
+	if err := common.Authorize(group, common.RoleDeployer); err != nil {
+		return err
+	}
+	if verify != nil {
+		if err := verify(group); err != nil {
+			return err
+		}
+	}
+	if err := common.WaitApproval(group); err != nil {
+		return err
+	}
+	ct, err := common.StartChange(group, *pChange)
+	if err != nil {
+		return err
+	}
+	ticket := *pChange
+	if ct != nil {
+		ticket = ct.ID
+	}
+	if err = common.CheckDeploy(group, ticket); err != nil {
+		if e := ct.Finish(err); e != nil {
+			log.Println("Change:", e)
+		}
+		return err
+	}
+	gd, err := common.StartGitHubDeploy(group, revision)
+	if err != nil {
+		log.Println("GitHub:", err)
+	}
+	err = fn()
+	if e := gd.Finish(err); e != nil {
+		log.Println("GitHub:", e)
+	}
+	if e := ct.Finish(err); e != nil {
+		log.Println("Change:", e)
+	}
+	if e := common.AlertDeploy(group, err); e != nil {
+		log.Println("Alert:", e)
+	}
+	return err
+}
+
+// deploy deploy with configured strategy
+func deploy(hosts []string) error {
+	switch common.C.Deploy.Strategy {
+	case "", common.StrategyRolling:
+		r, err := common.NewRolling(hosts, 0)
+		if err != nil {
+			return err
+		}
+		err = r.Start()
+		r.PrettyPrint()
+		return err
+	case common.StrategyBlueGreen:
+		bg := common.NewBlueGreen(hosts)
+		err := bg.Deploy()
+		bg.PrettyPrint()
+		return err
+	}
+	return fmt.Errorf("Unknown deploy strategy: %s", common.C.Deploy.Strategy)
+}
+
+func runPromote(hosts []string, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	artifact, err := common.PromoteArtifact(args[0])
+	if err != nil {
+		return err
+	}
+	to, ok := common.C.Server.Hosts[args[1]]
+	if !ok {
+		return fmt.Errorf("Host group not found. Group: %s", args[1])
+	}
+	if to, err = common.ExpandHosts(to); err != nil {
+		return err
+	}
+	// the identical bytes tested in source group are deployed, never rebuild
+	common.C.Deploy.Artifact = artifact
+	common.C.Deploy.Build.Command = ""
+	releases, err := common.LoadReleases()
+	if err != nil {
+		return err
+	}
+	if err = reportDeploy(args[1], releases[args[0]].Revision, func() error { return deploy(to) }); err != nil {
+		return err
+	}
+	recordRelease(args[1])
+	return nil
+}
+
+func runCache(hosts []string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var list []common.CachedArtifact
+	var err error
+	switch args[0] {
+	case "list":
+		list, err = common.CacheList()
+	case "gc":
+		list, err = common.CacheGC()
+		fmt.Fprintln(common.Stdout, "Removed:")
+	default:
+		return errUsage
+	}
+	for _, a := range list {
+		fmt.Fprintf(common.Stdout, "%s %12d %s %s\n", common.ShortSum(a.Checksum), a.Size, a.Used.Format("2006-01-02 15:04:05"), a.Path)
+	}
+	return err
+}
+
+func runProfile(hosts []string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	t, err := common.NewProfileTransfer(args[0], hosts)
+	if err != nil {
+		return err
+	}
+	if common.C.TransferMaxSize < 1 {
+		common.C.TransferMaxSize = common.TransferDefaultMaxSize
+	}
+	err = t.Start()
+	t.PrettyPrint()
+	return err
+}
+
+func runKeys(hosts []string, args []string) error {
+	if len(args) == 1 && args[0] == "rotate" {
+		return runKeysRotate(hosts)
+	}
+	if len(args) == 2 && args[0] == "rotate" && args[1] == "--finish" {
+		return runKeysFinish(hosts)
+	}
+	if len(args) < 1 || args[0] != "push" {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("keys push", flag.ContinueOnError)
+	pubkey := fs.String("pubkey", "", "public key file")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	key, err := common.ReadPublicKey(*pubkey)
+	if err != nil {
+		return err
+	}
+	result, errs := common.PushKey(hosts, key)
+	for _, h := range hosts {
+		if e, ok := errs[h]; ok {
+			fmt.Fprintf(common.Stdout, "%21s: ERROR %s\n", h, e)
+			continue
+		}
+		fmt.Fprintf(common.Stdout, "%21s: %s\n", h, result[h])
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Key push failed on %d host(s)", len(errs))
+	}
+	return nil
+}
+
+func runKeysRotate(hosts []string) error {
+	kr, phases, errs, err := common.RotateKey(hosts)
+	if err != nil {
+		return err
+	}
+	var all []string
+	for h := range kr.Hosts {
+		all = append(all, h)
+	}
+	sort.Strings(all)
+	pending := 0
+	for _, h := range all {
+		if e, ok := errs[h]; ok {
+			fmt.Fprintf(common.Stdout, "%21s: ERROR %s (%s)\n", h, strings.TrimSpace(e), kr.Hosts[h])
+		} else if p, ok := phases[h]; ok {
+			fmt.Fprintf(common.Stdout, "%21s: %s\n", h, p)
+		} else {
+			fmt.Fprintf(common.Stdout, "%21s: %s before\n", h, kr.Hosts[h])
+		}
+		if kr.Hosts[h] != common.RotateDone {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("Key rotation unfinished on %d host(s), run keys rotate again to resume", pending)
+	}
+	fmt.Fprintf(common.Stdout, "Key rotated, old key kept at %s.old and offered until keys rotate --finish\n", kr.Key)
+	return nil
+}
+
+func runKeysFinish(hosts []string) error {
+	errs, err := common.FinishRotation(hosts)
+	for _, h := range hosts {
+		if e, ok := errs[h]; ok {
+			fmt.Fprintf(common.Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(common.Stdout, "Key rotation finished, the old key is no longer offered")
+	return nil
+}
+
+func runBootstrap(hosts []string, args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	output, errs, err := common.Bootstrap(hosts)
+	if err != nil {
+		return err
+	}
+	for _, h := range hosts {
+		for _, line := range strings.Split(strings.TrimSpace(output[h]), "\n") {
+			if line != "" {
+				fmt.Fprintf(common.Stdout, "%21s: %s\n", h, line)
+			}
+		}
+		if e, ok := errs[h]; ok {
+			fmt.Fprintf(common.Stdout, "%21s: ERROR %s\n", h, e)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Bootstrap failed on %d host(s)", len(errs))
+	}
+	return nil
+}
+
+func runEnv(hosts []string, args []string) error {
+	if len(args) != 1 || (args[0] != "diff" && args[0] != "apply") {
+		return errUsage
+	}
+	changes, errs, err := common.EnvFile(hosts, hostGroup(), args[0] == "apply")
+	if err != nil {
+		return err
+	}
+	common.PrintEnvChanges(hosts, changes, errs)
+	if len(errs) > 0 {
+		return fmt.Errorf("Env file failed on %d host(s)", len(errs))
+	}
+	return nil
+}
+
+func runConfig(hosts []string, args []string) error {
+	if len(args) != 2 || args[0] != "deploy" {
+		return errUsage
+	}
+	output, errs, err := common.PushConfig(hosts, args[1], hostGroup())
+	if err != nil {
+		return err
+	}
+	common.PrintConfigResult(hosts, output, errs)
+	if len(errs) > 0 {
+		return fmt.Errorf("Config failed on %d host(s)", len(errs))
+	}
+	return nil
+}
+
+func runCert(hosts []string, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "deploy":
+		if len(args) != 2 {
+			return errUsage
+		}
+		output, errs, err := common.DeployCert(hosts, args[1])
+		if err != nil {
+			return err
+		}
+		common.PrintConfigResult(hosts, output, errs)
+		if len(errs) > 0 {
+			return fmt.Errorf("Cert failed on %d host(s)", len(errs))
+		}
+		return nil
+	case "expiry":
+		names, err := common.CertNames(args[1:])
+		if err != nil {
+			return err
+		}
+		expiries, errs, err := common.CertExpiries(hosts, names)
+		if err != nil {
+			return err
+		}
+		if n := common.PrintCertExpiry(hosts, names, expiries, errs); n > 0 {
+			return fmt.Errorf("%d certificate(s) expired or expiring soon", n)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("Reading certs failed on %d host(s)", len(errs))
+		}
+		return nil
+	case "renew":
+		fs := flag.NewFlagSet("cert renew", flag.ContinueOnError)
+		force := fs.Bool("force", false, "renew certs not expiring yet")
+		daemon := fs.Bool("daemon", false, "keep running and renew periodically")
+		every := fs.Duration("every", 12*time.Hour, "interval of renewals with --daemon")
+		if err := fs.Parse(args[1:]); err != nil || *every <= 0 {
+			return errUsage
+		}
+		names, err := common.ACMENames(fs.Args())
+		if err != nil {
+			return err
+		}
+		for {
+			err = common.RenewCerts(context.Background(), hosts, names, *force)
+			if !*daemon {
+				return err
+			}
+			if err != nil {
+				log.Println("Warning:", err)
+			}
+			*force = false
+			time.Sleep(*every)
+		}
+	}
+	return errUsage
+}
+
+func runCollectLogs(hosts []string, args []string) error {
+	fs := flag.NewFlagSet("collect-logs", flag.ContinueOnError)
+	since := fs.Duration("since", time.Hour, "collect logs written since duration ago")
+	paths := fs.String("paths", "", "globs of log files, separated by comma")
+	units := fs.String("units", "", "journald units, separated by comma")
+	out := fs.String("out", "", "bundle file, default logs-<run id>.tar.gz")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *since <= 0 {
+		return errUsage
+	}
+	if *out == "" {
+		*out = "logs-" + common.RunID + ".tar.gz"
+	}
+	lc, err := common.CollectLogs(hosts, *since, common.SplitHosts(*paths), common.SplitHosts(*units), *out)
+	if err != nil {
+		return err
+	}
+	for _, h := range hosts {
+		if e, ok := lc.Failed[h]; ok {
+			fmt.Fprintf(common.Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+			continue
+		}
+		fmt.Fprintf(common.Stdout, "%21s: %d file(s)\n", h, lc.Files[h])
+	}
+	fmt.Fprintln(common.Stdout, "Bundle:", *out)
+	if len(lc.Failed) > 0 {
+		return fmt.Errorf("Collecting logs failed on %d host(s)", len(lc.Failed))
+	}
+	return nil
+}
+
+func runDrift(hosts []string, args []string) error {
+	group := hostGroup()
+	if len(args) > 0 || group == "" {
+		return errUsage
+	}
+	result, errs, err := common.Drift(hosts, group)
+	if err != nil {
+		return err
+	}
+	drifted := 0
+	for _, h := range hosts {
+		if e, ok := errs[h]; ok {
+			fmt.Fprintf(common.Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+			continue
+		}
+		dr := result[h]
+		if dr.Drifted {
+			drifted++
+			fmt.Fprintf(common.Stdout, "%21s: DRIFT %s\n", h, dr.Reason)
+			continue
+		}
+		fmt.Fprintf(common.Stdout, "%21s: %s\n", h, dr.Reason)
+	}
+	if drifted > 0 || len(errs) > 0 {
+		return fmt.Errorf("%d host(s) drifted, %d failed", drifted, len(errs))
+	}
+	return nil
+}
+
+func runBench(hosts []string, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	size := fs.Int64("size", common.BenchDefaultSize, "bytes transferred by every setting")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	br, err := common.Bench(args[0], *size)
+	if err != nil {
+		return err
+	}
+	br.PrettyPrint()
+	if br.Best() == nil {
+		return errors.New("All bench settings failed")
+	}
+	return nil
+}
+
+func runDiffReleases(hosts []string, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+	changes, err := common.DiffReleases(args[0], args[1], args[2])
+	if err != nil {
+		return err
+	}
+	count := make(map[string]int)
+	for _, c := range changes {
+		count[c.Kind]++
+		fmt.Fprintf(common.Stdout, "%s %s\n", c.Kind, c.Path)
+	}
+	fmt.Fprintf(common.Stdout, "%d added, %d removed, %d modified\n",
+		count[common.ChangeAdded], count[common.ChangeRemoved], count[common.ChangeModified])
+	return nil
+}
+
+func runQuarantine(hosts []string, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "list":
+		if len(args) > 1 {
+			return errUsage
+		}
+		list, err := common.QuarantineList()
+		if err != nil {
+			return err
+		}
+		for _, q := range list {
+			fmt.Fprintf(common.Stdout, "%21s: %s\n", q.Host, q)
+		}
+		return nil
+	case "add":
+		if len(args) < 2 {
+			return errUsage
+		}
+		fs := flag.NewFlagSet("quarantine add", flag.ContinueOnError)
+		reason := fs.String("reason", "", "why the host is quarantined")
+		d := fs.Duration("for", 0, "expire after duration, eg. 72h")
+		if err := fs.Parse(args[2:]); err != nil || fs.NArg() > 0 || *reason == "" {
+			return errUsage
+		}
+		q, err := common.QuarantineHost(args[1], *reason, *d)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(common.Stdout, "%21s: %s\n", q.Host, q)
+		return nil
+	case "remove":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return common.ReleaseQuarantine(args[1])
+	}
+	return errUsage
+}
+
+func runBundle(hosts []string, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	switch args[0] {
+	case "keygen":
+		if len(args) != 2 {
+			return errUsage
+		}
+		pub, err := common.BundleKeygen(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(common.Stdout, "Public key:", pub)
+		return nil
+	case "create":
+		fs := flag.NewFlagSet("bundle create", flag.ContinueOnError)
+		pipeline := fs.String("pipeline", "", "pipeline run by apply, deploy if empty")
+		if err := fs.Parse(args[2:]); err != nil || fs.NArg() > 0 {
+			return errUsage
+		}
+		m, err := common.CreateBundle(args[1], *pipeline)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for name := range m.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(common.Stdout, "%21s: %s\n", name, m.Files[name])
+		}
+		fmt.Fprintln(common.Stdout, "Bundle:", args[1])
+		return nil
+	case "apply":
+		if len(args) != 2 {
+			return errUsage
+		}
+		m, err := common.ApplyBundle(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(common.Stdout, "Bundle: created by %s at %s\n", m.By, m.Created.Format("2006-01-02 15:04:05"))
+		if m.Pipeline != "" {
+			return runPipeline(hosts, []string{m.Pipeline})
+		}
+		if len(hosts) == 0 {
+			return errors.New("Bundle deploys a host group, set -g")
+		}
+		return runDeploy(hosts, nil)
+	}
+	return errUsage
+}
+
+func runPipeline(hosts []string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	runs, err := common.RunPipeline(args[0], func(group string, hosts []string) error {
+		if err := reportDeploy(group, "", func() error { return deploy(hosts) }); err != nil {
+			return err
+		}
+		recordRelease(group)
+		return nil
+	})
+	for _, pr := range runs {
+		if pr.Label != "" {
+			fmt.Fprintln(common.Stdout, "Matrix:", pr.Label)
+		}
+		for _, st := range pr.Pipeline.Stages {
+			name := st.StageName()
+			e, ran := pr.Result[name]
+			if !ran {
+				continue
+			}
+			if e != nil {
+				fmt.Fprintf(common.Stdout, "%21s: ERROR %s\n", name, e)
+			} else {
+				fmt.Fprintf(common.Stdout, "%21s: ok\n", name)
+			}
+		}
+	}
+	return err
+}
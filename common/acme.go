@@ -0,0 +1,340 @@
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// ACMEConfig account and DNS-01 hooks obtaining certs with domains from an ACME CA, eg. Let's Encrypt
+type ACMEConfig struct {
+	Directory   string `yaml:"directory"`   // directory url, Let's Encrypt production if empty
+	Email       string `yaml:"email"`       // contact of account
+	AccountKey  string `yaml:"account_key"` // created if missing, default <state dir>/acme-account.key
+	Present     string `yaml:"present"`     // local command creating TXT record {fqdn} with {value} for {domain}
+	Cleanup     string `yaml:"cleanup"`     // local command removing it, same vars
+	Propagation int    `yaml:"propagation"` // seconds waited for the TXT record to resolve, default 120
+	RenewDays   int    `yaml:"renew_days"`  // renew certs expiring within days, default 30
+}
+
+// renewDays days before expiry certs are renewed
+func (ac ACMEConfig) renewDays() int {
+	if ac.RenewDays <= 0 {
+		return 30
+	}
+	return ac.RenewDays
+}
+
+// NeedsRenewal check if local cert name is missing or expires within acme.renew_days, the expiry found is returned
+func NeedsRenewal(name string) (bool, time.Time, error) {
+	cc, ok := C.Certs[name]
+	if !ok {
+		return false, time.Time{}, fmt.Errorf("No such cert: %s", name)
+	}
+	if len(cc.Domains) == 0 {
+		return false, time.Time{}, fmt.Errorf("Cert %s has no domains", name)
+	}
+	data, err := ioutil.ReadFile(expandHome(cc.Cert))
+	if os.IsNotExist(err) {
+		return true, time.Time{}, nil
+	}
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return true, time.Time{}, nil
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true, time.Time{}, nil
+	}
+	renew := time.Until(leaf.NotAfter) < time.Duration(C.ACME.renewDays())*24*time.Hour
+	return renew, leaf.NotAfter, nil
+}
+
+// ObtainCert order a certificate of domains of cert name by DNS-01 challenges and write it, a new key and the chain
+// into its local files. the chain goes after the certificate if cert has no chain file
+func ObtainCert(ctx context.Context, name string) error {
+	cc, ok := C.Certs[name]
+	if !ok {
+		return fmt.Errorf("No such cert: %s", name)
+	}
+	if len(cc.Domains) == 0 {
+		return fmt.Errorf("Cert %s has no domains", name)
+	}
+	if cc.Cert == "" || cc.Key == "" {
+		return fmt.Errorf("Cert %s requires cert, key and dir", name)
+	}
+	if C.ACME.Present == "" {
+		return errors.New("acme.present is not configured")
+	}
+	client, err := acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(cc.Domains...))
+	if err != nil {
+		return err
+	}
+	for _, u := range order.AuthzURLs {
+		if err = authorizeDNS(ctx, client, u); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	req := &x509.CertificateRequest{Subject: pkix.Name{CommonName: cc.Domains[0]}, DNSNames: cc.Domains}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, req, key)
+	if err != nil {
+		return err
+	}
+	ders, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+	if len(ders) == 0 {
+		return errors.New("ACME CA returned no certificate")
+	}
+	leaf, chain := pemCerts(ders[:1]), pemCerts(ders[1:])
+	if cc.Chain == "" {
+		leaf = append(leaf, chain...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = writeLocal(cc.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if cc.Chain != "" {
+		if err = writeLocal(cc.Chain, chain, 0644); err != nil {
+			return err
+		}
+	}
+	return writeLocal(cc.Cert, leaf, 0644)
+}
+
+// acmeClient client of acme.directory with the account key, registered if new
+func acmeClient(ctx context.Context) (*acme.Client, error) {
+	key, err := acmeAccountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: C.ACME.Directory, UserAgent: "optool/" + Version}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	acct := &acme.Account{}
+	if C.ACME.Email != "" {
+		acct.Contact = []string{"mailto:" + C.ACME.Email}
+	}
+	if _, err = client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+	return client, nil
+}
+
+// acmeAccountKey load account key, a new one is created on first use
+func acmeAccountKey() (crypto.Signer, error) {
+	f := C.ACME.AccountKey
+	if f == "" {
+		f = filepath.Join(StateDir, "acme-account.key")
+	}
+	f = expandHome(f)
+	data, err := ioutil.ReadFile(f)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("Invalid account key: %s", f)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+		return nil, err
+	}
+	return key, writeLocal(f, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// authorizeDNS answer the DNS-01 challenge of authorization u unless it is valid already, the TXT record is
+// removed afterwards
+func authorizeDNS(ctx context.Context, client *acme.Client, u string) error {
+	z, err := client.GetAuthorization(ctx, u)
+	if err != nil {
+		return err
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("No dns-01 challenge for %s", z.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	vars := map[string]string{
+		"domain": z.Identifier.Value,
+		"fqdn":   "_acme-challenge." + z.Identifier.Value,
+		"value":  value,
+	}
+	if err = runLocal(ExpandVars(C.ACME.Present, vars)); err != nil {
+		return fmt.Errorf("acme.present of %s: %s", z.Identifier.Value, err)
+	}
+	if C.ACME.Cleanup != "" {
+		defer func() {
+			if err := runLocal(ExpandVars(C.ACME.Cleanup, vars)); err != nil {
+				fmt.Fprintf(Stderr, "Warning: acme.cleanup of %s: %s\n", z.Identifier.Value, err)
+			}
+		}()
+	}
+	if err = waitTXT(ctx, vars["fqdn"], value); err != nil {
+		return err
+	}
+	if _, err = client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// waitTXT wait until TXT record fqdn resolves to value, up to acme.propagation seconds
+func waitTXT(ctx context.Context, fqdn, value string) error {
+	wait := C.ACME.Propagation
+	if wait <= 0 {
+		wait = 120
+	}
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+	for {
+		records, _ := net.DefaultResolver.LookupTXT(ctx, fqdn)
+		for _, r := range records {
+			if r == value {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("TXT record %s not found after %ds", fqdn, wait)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// pemCerts encode certificates as PEM
+func pemCerts(ders [][]byte) []byte {
+	var b []byte
+	for _, der := range ders {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return b
+}
+
+// writeLocal write local file f through a temp file renamed into place
+func writeLocal(f string, data []byte, mode os.FileMode) error {
+	f = expandHome(f)
+	tmp := runTemp(f, "new")
+	if err := ioutil.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, f)
+}
+
+// RenewCerts renew certs names with domains expiring within acme.renew_days, or all of them if force is set, and
+// deploy every one of them to hosts. hosts with unchanged files are not reloaded, so certs not renewed only catch up
+// hosts which missed an earlier deploy
+func RenewCerts(ctx context.Context, hosts, names []string, force bool) error {
+	var failed []string
+	for _, name := range names {
+		renew, expiry, err := NeedsRenewal(name)
+		if err != nil {
+			return err
+		}
+		if renew || force {
+			fmt.Fprintf(Stdout, "Renewing %s (%s)\n", name, strings.Join(C.Certs[name].Domains, ", "))
+			if err = ObtainCert(ctx, name); err != nil {
+				fmt.Fprintf(Stderr, "Warning: renewing %s: %s\n", name, err)
+				failed = append(failed, name)
+				if expiry.IsZero() {
+					// nothing to deploy yet
+					continue
+				}
+			}
+		}
+		output, errs, err := DeployCert(hosts, name)
+		if err != nil {
+			return err
+		}
+		PrintConfigResult(hosts, output, errs)
+		if len(errs) > 0 {
+			failed = append(failed, fmt.Sprintf("%s on %d host(s)", name, len(errs)))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Cert renewal failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// ACMENames names of certs with domains if names is empty
+func ACMENames(names []string) ([]string, error) {
+	if len(names) > 0 {
+		return names, nil
+	}
+	all, err := CertNames(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range all {
+		if len(C.Certs[name].Domains) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("No cert has domains")
+	}
+	return names, nil
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Alert providers
+const (
+	AlertPagerDuty = "pagerduty"
+	AlertOpsgenie  = "opsgenie"
+)
+
+// AlertConfig open an incident when a deploy to a critical group fails or is rolled back
+type AlertConfig struct {
+	Provider string   `yaml:"provider"` // pagerduty or opsgenie, nothing is alerted if empty
+	Key      string   `yaml:"key"`      // routing key of PagerDuty events v2 integration or Opsgenie api key
+	API      string   `yaml:"api"`      // default https://events.pagerduty.com or https://api.opsgenie.com, eg. https://api.eu.opsgenie.com
+	Critical []string `yaml:"critical"` // groups alerted
+}
+
+// isCritical check if deploys of group are alerted
+func (ac AlertConfig) isCritical(group string) bool {
+	for _, g := range ac.Critical {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// FailedHosts get errors of hosts failed in this run
+func FailedHosts() map[string]string {
+	ciHosts.Lock()
+	defer ciHosts.Unlock()
+	failed := make(map[string]string)
+	for h, e := range ciHosts.failed {
+		failed[h] = e
+	}
+	return failed
+}
+
+// AlertDeploy open an incident if deploy of a critical group failed, err is the result of the deploy
+func AlertDeploy(group string, err error) error {
+	ac := C.Alert
+	if ac.Provider == "" || err == nil || !ac.isCritical(group) {
+		return nil
+	}
+	if ac.Key == "" {
+		return errors.New("alert.key is required")
+	}
+	RegisterSecret(ac.Key)
+	failed := FailedHosts()
+	var hosts []string
+	for h := range failed {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	what := "failed"
+	if strings.Contains(err.Error(), "rolled back") {
+		what = "failed and was rolled back"
+	}
+	summary := Redact(fmt.Sprintf("optool deploy of %s %s: %s", group, what, err))
+	details := map[string]interface{}{
+		"run_id":       RunID,
+		"group":        group,
+		"deployer":     localDeployer(),
+		"failed_hosts": hosts,
+		"error":        Redact(err.Error()),
+	}
+	if u := ciRunURL(); u != "" {
+		details["ci_run"] = u
+	}
+	switch ac.Provider {
+	case AlertPagerDuty:
+		return alertRequest(ac, "https://events.pagerduty.com", "/v2/enqueue", "", map[string]interface{}{
+			"routing_key":  ac.Key,
+			"event_action": "trigger",
+			"dedup_key":    "optool-" + group + "-" + RunID,
+			"payload": map[string]interface{}{
+				"summary":        truncate(summary, 1024),
+				"source":         localDeployer(),
+				"severity":       "critical",
+				"component":      group,
+				"custom_details": details,
+			},
+		})
+	case AlertOpsgenie:
+		return alertRequest(ac, "https://api.opsgenie.com", "/v2/alerts", "GenieKey "+ac.Key, map[string]interface{}{
+			"message":     truncate(summary, 130),
+			"alias":       "optool-" + group + "-" + RunID,
+			"description": summary,
+			"details":     map[string]string{"run_id": RunID, "group": group, "failed_hosts": strings.Join(hosts, ",")},
+			"priority":    "P1",
+			"tags":        []string{"optool", group},
+			"source":      localDeployer(),
+		})
+	}
+	return fmt.Errorf("Unknown alert.provider: %s", ac.Provider)
+}
+
+// truncate cut s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// alertRequest post body to path of alert api
+func alertRequest(ac AlertConfig, api, p, auth string, body interface{}) error {
+	if ac.API != "" {
+		api = ac.API
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(api, "/")+p, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returns %s", ac.Provider, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Approval states
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+	ApprovalExpired  = "expired"
+)
+
+// ApprovalDefaultTimeout minutes a deploy waits for approval
+const ApprovalDefaultTimeout = 60
+
+// ApprovalPollInterval interval of checking a pending approval
+var ApprovalPollInterval = 2 * time.Second
+
+// ApprovalConfig deploys of groups waiting for another user to approve them
+type ApprovalConfig struct {
+	Groups  []string `yaml:"groups"`  // groups whose deploys need approval
+	Dir     string   `yaml:"dir"`     // dir shared by deployers and approvers, required
+	Timeout int      `yaml:"timeout"` // minutes to wait, default 60
+}
+
+// Approval approval of deploy of a group in a run, saved as <run id>-<group>.json in approval dir
+type Approval struct {
+	RunID       string    `json:"run_id"`
+	Group       string    `json:"group"`
+	Command     string    `json:"command"`
+	RequestedBy string    `json:"requested_by"`
+	Requested   time.Time `json:"requested"`
+	State       string    `json:"state"`
+	DecidedBy   string    `json:"decided_by,omitempty"`
+	Decided     time.Time `json:"decided,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Owner       string    `json:"-"` // user owning the file, who wrote it last
+}
+
+// approvalDir get dir of approvals, created if not exists. a dir private to the requester could never be decided
+// by another user, so it must be configured
+func approvalDir() (string, error) {
+	if C.Approval.Dir == "" {
+		return "", errors.New("approval.dir is not configured")
+	}
+	// shared by users of a group
+	return C.Approval.Dir, os.MkdirAll(C.Approval.Dir, 0770)
+}
+
+// needsApproval check if deploys of group need approval
+func needsApproval(group string) bool {
+	for _, g := range C.Approval.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// saveApproval write approval, replacing the file so that readers never see it half written. the file is owned by
+// the writer and not group writable, so only a rename, which makes the renaming user its owner, can change it
+func saveApproval(a Approval) error {
+	dir, err := approvalDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	f := filepath.Join(dir, a.RunID+"-"+a.Group+".json")
+	tmp := runTemp(f, "new")
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, f)
+}
+
+// LoadApprovals get approvals of run, all approvals if run id is empty, oldest first
+func LoadApprovals(runID string) ([]Approval, error) {
+	dir, err := approvalDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, runID+"*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var list []Approval
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var a Approval
+		if err = json.Unmarshal(data, &a); err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+		if a.Owner, err = fileOwner(f); err != nil {
+			return nil, err
+		}
+		if runID == "" || a.RunID == runID {
+			list = append(list, a)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Requested.Before(list[j].Requested) })
+	return list, nil
+}
+
+// approvalUser get user name of user@host, approvers are told apart by name
+func approvalUser(by string) string {
+	return strings.SplitN(by, "@", 2)[0]
+}
+
+// WaitApproval request approval of deploy of group and wait until another user approved it.
+// nothing is done for groups not in approval.groups, an error is returned if it is rejected or expired. a decision
+// is only trusted if the file is owned by the user named as approver, and that user is not the one running this
+func WaitApproval(group string) error {
+	if !needsApproval(group) {
+		return nil
+	}
+	self := approvalUser(localDeployer())
+	a := Approval{
+		RunID:       RunID,
+		Group:       group,
+		Command:     Redact("optool " + strings.Join(os.Args[1:], " ")),
+		RequestedBy: localDeployer(),
+		Requested:   time.Now(),
+		State:       ApprovalPending,
+	}
+	if err := saveApproval(a); err != nil {
+		return err
+	}
+	timeout := C.Approval.Timeout
+	if timeout <= 0 {
+		timeout = ApprovalDefaultTimeout
+	}
+	deadline := a.Requested.Add(time.Duration(timeout) * time.Minute)
+	fmt.Fprintf(Stderr, "Deploy of %s waits for approval, another user runs: optool approve %s\n", group, RunID)
+	for {
+		time.Sleep(ApprovalPollInterval)
+		list, err := LoadApprovals(RunID)
+		if err != nil {
+			return err
+		}
+		for _, cur := range list {
+			if cur.Group != group {
+				continue
+			}
+			if cur.State != ApprovalPending && cur.State != ApprovalExpired &&
+				(cur.Owner == self || cur.Owner != approvalUser(cur.DecidedBy)) {
+				return fmt.Errorf("Decision of %s is owned by %s, not by its approver %s", group, cur.Owner, cur.DecidedBy)
+			}
+			switch cur.State {
+			case ApprovalApproved:
+				fmt.Fprintf(Stderr, "Deploy of %s approved by %s\n", group, cur.DecidedBy)
+				return nil
+			case ApprovalRejected:
+				return fmt.Errorf("Deploy of %s rejected by %s: %s", group, cur.DecidedBy, cur.Reason)
+			}
+		}
+		if time.Now().After(deadline) {
+			a.State = ApprovalExpired
+			a.Decided = time.Now()
+			saveApproval(a)
+			return fmt.Errorf("Deploy of %s not approved within %d minutes", group, timeout)
+		}
+	}
+}
+
+// DecideApproval approve or reject pending deploys of run, by a deployer of the group other than the user requested them
+func DecideApproval(runID string, approve bool, reason string) ([]Approval, error) {
+	list, err := LoadApprovals(runID)
+	if err != nil {
+		return nil, err
+	}
+	by := localDeployer()
+	var decided []Approval
+	for _, a := range list {
+		if a.State != ApprovalPending {
+			continue
+		}
+		if err = Authorize(a.Group, RoleDeployer); err != nil {
+			return decided, err
+		}
+		if approvalUser(a.RequestedBy) == approvalUser(by) || a.Owner == approvalUser(by) {
+			return decided, fmt.Errorf("Deploy of %s was requested by %s, another user must decide", a.Group, a.RequestedBy)
+		}
+		a.State = ApprovalRejected
+		if approve {
+			a.State = ApprovalApproved
+		}
+		a.DecidedBy, a.Decided, a.Reason = by, time.Now(), reason
+		if err = saveApproval(a); err != nil {
+			return decided, err
+		}
+		decided = append(decided, a)
+	}
+	if len(decided) == 0 {
+		return nil, fmt.Errorf("No pending approval of run %s", runID)
+	}
+	return decided, nil
+}
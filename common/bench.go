@@ -0,0 +1,214 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// BenchDefaultSize bytes written and read by every setting of a bench
+	BenchDefaultSize = 32 * 1024 * 1024
+	// BenchHandshakes handshakes timed by a bench, the fastest one is reported
+	BenchHandshakes = 3
+)
+
+// BenchSetting sftp settings tried by a bench
+type BenchSetting struct {
+	Buffer      int // transfer_buffer
+	Concurrent  bool
+	MaxRequests int // sftp.max_requests
+}
+
+// String describe setting in output
+func (bs BenchSetting) String() string {
+	if !bs.Concurrent {
+		return fmt.Sprintf("buffer=%s sequential", HumanSize(int64(bs.Buffer)))
+	}
+	return fmt.Sprintf("buffer=%s concurrent max_requests=%d", HumanSize(int64(bs.Buffer)), bs.MaxRequests)
+}
+
+// benchSettings settings tried from sequential requests to deep pipelines, a buffer covers max_requests packets
+var benchSettings = []BenchSetting{
+	{Buffer: SFTPPacketSize},
+	{Buffer: 8 * SFTPPacketSize, Concurrent: true, MaxRequests: 8},
+	{Buffer: 32 * SFTPPacketSize, Concurrent: true, MaxRequests: 32},
+	{Buffer: 64 * SFTPPacketSize, Concurrent: true, MaxRequests: 64},
+	{Buffer: 128 * SFTPPacketSize, Concurrent: true, MaxRequests: 128},
+}
+
+// BenchRun throughput of a setting
+type BenchRun struct {
+	Setting BenchSetting
+	Put     float64 // bytes per second
+	Get     float64
+	Err     error
+}
+
+// BenchResult network measures of a host
+type BenchResult struct {
+	Host      string
+	Handshake time.Duration // fastest dial and authentication
+	RTT       time.Duration // round trip of a request on an open connection
+	Size      int64
+	Runs      []BenchRun
+}
+
+// Best get run of the highest put and get throughput, nil if all runs failed
+func (br *BenchResult) Best() *BenchRun {
+	var best *BenchRun
+	for i := range br.Runs {
+		r := &br.Runs[i]
+		if r.Err != nil {
+			continue
+		}
+		if best == nil || r.Put+r.Get > best.Put+best.Get {
+			best = r
+		}
+	}
+	return best
+}
+
+// Recommend get configure values of the best setting, the smallest setting within 10% of it is preferred to save memory
+func (br *BenchResult) Recommend() string {
+	best := br.Best()
+	if best == nil {
+		return ""
+	}
+	runs := append([]BenchRun{}, br.Runs...)
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Setting.Buffer < runs[j].Setting.Buffer })
+	for _, r := range runs {
+		if r.Err == nil && r.Put+r.Get >= 0.9*(best.Put+best.Get) {
+			best = &r
+			break
+		}
+	}
+	s := best.Setting
+	if !s.Concurrent {
+		return fmt.Sprintf("transfer_buffer: %d\nsftp:\n  concurrent_writes: false\n", s.Buffer)
+	}
+	return fmt.Sprintf("transfer_buffer: %d\nsftp:\n  concurrent_writes: true\n  max_requests: %d\n", s.Buffer, s.MaxRequests)
+}
+
+// PrettyPrint print bench result and recommended configure
+func (br *BenchResult) PrettyPrint() {
+	fmt.Fprintf(Stdout, "%21s: handshake %dms rtt %dms\n", br.Host,
+		br.Handshake.Nanoseconds()/int64(time.Millisecond), br.RTT.Nanoseconds()/int64(time.Millisecond))
+	for _, r := range br.Runs {
+		if r.Err != nil {
+			fmt.Fprintf(Stdout, "%21s: %s ERROR %s\n", br.Host, r.Setting, r.Err)
+			continue
+		}
+		fmt.Fprintf(Stdout, "%21s: %s put %s/s get %s/s\n", br.Host, r.Setting, HumanSize(int64(r.Put)), HumanSize(int64(r.Get)))
+	}
+	if rec := br.Recommend(); rec != "" {
+		fmt.Fprintf(Stdout, "Recommended configure for %s:\n%s", br.Host, rec)
+	}
+}
+
+// Bench measure ssh handshake time of an ssh host and sftp throughput of size bytes with every setting.
+// the remote file is written into the home of the auth user and removed afterwards
+func Bench(h string, size int64) (*BenchResult, error) {
+	host := ParseHost(h)
+	if host.Type != HostSSH {
+		return nil, fmt.Errorf("Bench is not supported by %s hosts", host.Type)
+	}
+	if size <= 0 {
+		size = BenchDefaultSize
+	}
+	auth, err := GetAuth()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ssh.ClientConfig{
+		User:            C.Auth.User,
+		Auth:            auth,
+		Timeout:         30 * time.Second,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		ClientVersion:   sshClientVersion(),
+	}
+	br := &BenchResult{Host: h, Size: size}
+	var client *ssh.Client
+	for i := 0; i < BenchHandshakes; i++ {
+		ts := time.Now()
+		c, err := DefaultDialer.Dial("tcp", host.Addr(), cfg)
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil, err
+		}
+		if d := time.Now().Sub(ts); br.Handshake == 0 || d < br.Handshake {
+			br.Handshake = d
+		}
+		if client != nil {
+			client.Close()
+		}
+		client = c
+	}
+	defer client.Close()
+	ts := time.Now()
+	if _, _, err = client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		return nil, err
+	}
+	br.RTT = time.Now().Sub(ts)
+	name := "optool-bench-" + RunID
+	for _, s := range benchSettings {
+		r := BenchRun{Setting: s}
+		r.Put, r.Get, r.Err = benchSFTP(client, s, name, size)
+		br.Runs = append(br.Runs, r)
+	}
+	return br, nil
+}
+
+// benchSFTP put and get size bytes of name by sftp with setting s, throughput is in bytes per second
+func benchSFTP(client *ssh.Client, s BenchSetting, name string, size int64) (put, get float64, err error) {
+	// same packet option as NewTransport, see there
+	opts := []sftp.ClientOption{sftp.MaxPacketUnchecked(SFTPPacketSize), sftp.UseConcurrentWrites(s.Concurrent),
+		sftp.UseConcurrentReads(s.Concurrent)}
+	if s.Concurrent {
+		opts = append(opts, sftp.MaxConcurrentRequestsPerFile(s.MaxRequests))
+	}
+	sc, err := sftp.NewClient(client, opts...)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer sc.Close()
+	defer sc.Remove(name)
+	buf := make([]byte, s.Buffer)
+	f, err := sc.Create(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	ts := time.Now()
+	// random data, so that compression of the link does not inflate throughput
+	_, err = io.CopyBuffer(struct{ io.Writer }{f}, io.LimitReader(rand.New(rand.NewSource(1)), size), buf)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	put = float64(size) / time.Now().Sub(ts).Seconds()
+	rf, err := sc.Open(name)
+	if err != nil {
+		return put, 0, err
+	}
+	defer rf.Close()
+	ts = time.Now()
+	n, err := io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{rf}, buf)
+	if err != nil {
+		return put, 0, err
+	}
+	if n != size {
+		return put, 0, fmt.Errorf("Read %d of %d bytes", n, size)
+	}
+	get = float64(size) / time.Now().Sub(ts).Seconds()
+	return put, get, nil
+}
@@ -0,0 +1,305 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ColorBlue blue color directory name
+	ColorBlue = "blue"
+	// ColorGreen green color directory name
+	ColorGreen = "green"
+	// CurrentLink symlink under deploy root pointing to the live color
+	CurrentLink = "current"
+)
+
+const (
+	// SwitchSymlink flip traffic by switching current symlink only
+	SwitchSymlink = "symlink"
+	// SwitchNginx rewrite nginx upstream file and reload
+	SwitchNginx = "nginx"
+	// SwitchURL call a load balancer api
+	SwitchURL = "url"
+)
+
+// BlueGreenConfig configures for blue-green deployment
+type BlueGreenConfig struct {
+	Switch        string         `yaml:"switch"` // symlink,nginx,url
+	Ports         map[string]int `yaml:"ports"`  // color => port
+	NginxUpstream string         `yaml:"nginx_upstream"`
+	NginxName     string         `yaml:"nginx_name"`   // upstream name, default app
+	NginxReload   string         `yaml:"nginx_reload"` // default /usr/sbin/nginx -s reload
+	SwitchURL     string         `yaml:"switch_url"`   // {host},{color},{port} will be replaced
+}
+
+// BlueGreen deploy to the inactive color and flip traffic to it
+type BlueGreen struct {
+	Hosts  []string
+	Active map[string]string // host => live color
+	Result map[string]string // host => result message
+	Failed map[string]string // host => error
+}
+
+// NewBlueGreen get blue-green deployment instance
+func NewBlueGreen(hosts []string) *BlueGreen {
+	return &BlueGreen{
+		Hosts:  hosts,
+		Active: make(map[string]string),
+		Result: make(map[string]string),
+		Failed: make(map[string]string),
+	}
+}
+
+// OtherColor get the opposite color
+func OtherColor(color string) string {
+	if color == ColorBlue {
+		return ColorGreen
+	}
+	return ColorBlue
+}
+
+// Detect read live color of every host
+func (bg *BlueGreen) Detect() error {
+	if C.Deploy.Root == "" {
+		return errors.New("deploy.root is not configured")
+	}
+	link := path.Join(C.Deploy.Root, CurrentLink)
+	out, errs, err := RunRemote(bg.Hosts, "basename \"$(readlink "+link+")\" 2>/dev/null || true")
+	if err != nil {
+		return err
+	}
+	for _, h := range bg.Hosts {
+		if e, ok := errs[h]; ok {
+			bg.Failed[h] = e
+			continue
+		}
+		bg.Active[h] = strings.TrimSpace(out[h])
+	}
+	return nil
+}
+
+// Deploy upload artifact into inactive color, health check it, then flip traffic
+func (bg *BlueGreen) Deploy() error {
+	if err := checkSwitch(); err != nil {
+		return err
+	}
+	if err := PrepareArtifact(); err != nil {
+		return err
+	}
+	if err := CheckReboots(bg.Hosts); err != nil {
+		return err
+	}
+	if err := CheckClocks(bg.Hosts, "deploy"); err != nil {
+		return err
+	}
+	if err := bg.Detect(); err != nil {
+		return err
+	}
+	targets := bg.byTarget(false)
+	for color, hosts := range targets {
+		vars := bg.vars(color)
+		dir := path.Join(C.Deploy.Root, color)
+		_, errs, err := RunRemote(hosts, "mkdir -p "+dir)
+		if err != nil {
+			return err
+		}
+		hosts = bg.fail(hosts, errs)
+		if len(hosts) == 0 {
+			continue
+		}
+		errs, err = PutArtifact(hosts, C.Deploy.Artifact, dir+"/")
+		if err != nil {
+			return err
+		}
+		if hosts = bg.fail(hosts, errs); len(hosts) == 0 {
+			continue
+		}
+		if errs, err = LinkShared(hosts, dir); err != nil {
+			return err
+		}
+		if hosts = bg.fail(hosts, errs); len(hosts) == 0 {
+			continue
+		}
+		if C.Deploy.Activate != "" {
+			_, errs, err = RunRemote(hosts, ExpandVars(C.Deploy.Activate, vars))
+			if err != nil {
+				return err
+			}
+			hosts = bg.fail(hosts, errs)
+		}
+		hosts = bg.fail(hosts, WaitHealthy(hosts, C.Deploy.HealthCheck, vars))
+		if errs, err = WriteMeta(hosts, dir, C.Deploy.Artifact); err != nil {
+			return err
+		}
+		bg.fail(hosts, errs)
+	}
+	if len(bg.Failed) > 0 {
+		return fmt.Errorf("%d host(s) failed, traffic not switched", len(bg.Failed))
+	}
+	if err := bg.flip(targets); err != nil {
+		return err
+	}
+	if err := RecordBoots(bg.Hosts); err != nil {
+		fmt.Fprintf(Stderr, "Warning: record boot ids: %s\n", err)
+	}
+	return nil
+}
+
+// Rollback flip traffic back to the previous color which is kept untouched
+func (bg *BlueGreen) Rollback() error {
+	if err := bg.Detect(); err != nil {
+		return err
+	}
+	return bg.flip(bg.byTarget(true))
+}
+
+// byTarget group hosts by color to deploy/flip to
+func (bg *BlueGreen) byTarget(rollback bool) map[string][]string {
+	targets := make(map[string][]string)
+	for _, h := range bg.Hosts {
+		active, ok := bg.Active[h]
+		if !ok {
+			continue
+		}
+		if rollback && active == "" {
+			bg.Failed[h] = "no live color to roll back from"
+			continue
+		}
+		color := OtherColor(active)
+		targets[color] = append(targets[color], h)
+	}
+	return targets
+}
+
+// checkSwitch check switch of deploy.blue_green, nginx needs the upstream file and a valid port of both colors
+func checkSwitch() error {
+	bgc := C.Deploy.BlueGreen
+	switch bgc.Switch {
+	case "", SwitchSymlink, SwitchURL:
+		return nil
+	case SwitchNginx:
+	default:
+		return fmt.Errorf("Unknown switch type: %s", bgc.Switch)
+	}
+	if bgc.NginxUpstream == "" {
+		return errors.New("deploy.blue_green.nginx_upstream is not configured")
+	}
+	for _, color := range []string{ColorBlue, ColorGreen} {
+		if p := bgc.Ports[color]; p < 1 || p > 65535 {
+			return fmt.Errorf("Invalid port of %s: %d, deploy.blue_green.ports needs 1-65535 for both colors", color, p)
+		}
+	}
+	return nil
+}
+
+// flip switch traffic of hosts to the given colors
+func (bg *BlueGreen) flip(targets map[string][]string) error {
+	if err := checkSwitch(); err != nil {
+		return err
+	}
+	bgc := C.Deploy.BlueGreen
+	for color, hosts := range targets {
+		vars := bg.vars(color)
+		link := path.Join(C.Deploy.Root, CurrentLink)
+		cmd := linkCmd(path.Join(C.Deploy.Root, color), link)
+		if bgc.Switch == SwitchNginx {
+			name := bgc.NginxName
+			if name == "" {
+				name = "app"
+			}
+			reload := bgc.NginxReload
+			if reload == "" {
+				reload = "/usr/sbin/nginx -s reload"
+			}
+			cmd += fmt.Sprintf(" && printf 'upstream %%s {\\n    server 127.0.0.1:%%s;\\n}\\n' %s %s > %s && %s",
+				shellQuote(name), vars["port"], shellQuote(bgc.NginxUpstream), reload)
+		}
+		_, errs, err := RunRemote(hosts, cmd)
+		if err != nil {
+			return err
+		}
+		hosts = bg.fail(hosts, errs)
+		if bgc.Switch == SwitchURL {
+			errs := RunHosts(hosts, func(ctx context.Context, h string) error {
+				return callURL(ExpandVars(bgc.SwitchURL, map[string]string{
+					"host":  h,
+					"color": color,
+					"port":  vars["port"],
+				}))
+			})
+			for h, e := range errs {
+				bg.Failed[h] = e.Error()
+			}
+		}
+		for _, h := range hosts {
+			if _, ok := bg.Failed[h]; !ok {
+				bg.Result[h] = OtherColor(color) + " => " + color
+			}
+		}
+	}
+	if len(bg.Failed) > 0 {
+		return fmt.Errorf("%d host(s) failed", len(bg.Failed))
+	}
+	return nil
+}
+
+// fail record errors and return hosts still succeeding
+func (bg *BlueGreen) fail(hosts []string, errs map[string]string) []string {
+	var ok []string
+	for _, h := range hosts {
+		if e, failed := errs[h]; failed {
+			bg.Failed[h] = e
+			continue
+		}
+		ok = append(ok, h)
+	}
+	return ok
+}
+
+func (bg *BlueGreen) vars(color string) map[string]string {
+	return map[string]string{
+		"color": color,
+		"port":  strconv.Itoa(C.Deploy.BlueGreen.Ports[color]),
+		"dir":   path.Join(C.Deploy.Root, color),
+	}
+}
+
+// callURL call switch url and check response status
+func callURL(u string) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Switch url %s returns %s", u, resp.Status)
+	}
+	return nil
+}
+
+// PrettyPrint print live colors, results and errors
+func (bg *BlueGreen) PrettyPrint() {
+	for _, h := range bg.Hosts {
+		if e, ok := bg.Failed[h]; ok {
+			fmt.Fprintf(Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+			continue
+		}
+		if r, ok := bg.Result[h]; ok {
+			fmt.Fprintf(Stdout, "%21s: %s\n", h, r)
+			continue
+		}
+		active := bg.Active[h]
+		if active == "" {
+			active = "-"
+		}
+		fmt.Fprintf(Stdout, "%21s: live %s\n", h, active)
+	}
+}
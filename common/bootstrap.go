@@ -0,0 +1,74 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// BootstrapConfig preparation of fresh hosts before the first deploy
+type BootstrapConfig struct {
+	User      string   `yaml:"user"`       // deploy user created if not exists
+	Group     string   `yaml:"group"`      // owner group of deploy.root, primary group of user if empty
+	Shell     string   `yaml:"shell"`      // login shell of created user, default /bin/bash
+	PublicKey string   `yaml:"public_key"` // local public key installed for user, default ~/.ssh/id_ed25519.pub
+	Sudo      []string `yaml:"sudo"`       // commands user must be allowed to run by sudo without password
+}
+
+// BootstrapScript shell script run as root(or by sudo -n) preparing host for deploys:
+// deploy user and its authorized key, deploy.root with releases and shared dirs owned by user,
+// sudo rules of user are checked and exit 1 if any is missing
+func BootstrapScript(key string) (string, error) {
+	bc := C.Bootstrap
+	if bc.User == "" {
+		return "", errors.New("bootstrap.user is not configured")
+	}
+	if C.Deploy.Root == "" {
+		return "", errors.New("deploy.root is not configured")
+	}
+	shell := bc.Shell
+	if shell == "" {
+		shell = "/bin/bash"
+	}
+	owner := shellQuote(bc.User + ":" + bc.Group)
+	keyScript, err := authorizeKeyScript(key, `"$H/.ssh"`)
+	if err != nil {
+		return "", err
+	}
+	root := strings.TrimRight(C.Deploy.Root, "/")
+	dirs := shellQuote(root) + " " + shellQuote(root+"/releases") + " " + shellQuote(root+"/shared")
+	var b strings.Builder
+	fmt.Fprintf(&b, "U=%s\n", shellQuote(bc.User))
+	fmt.Fprintf(&b, `if id "$U" >/dev/null 2>&1; then echo "user $U exists"; else
+  if command -v useradd >/dev/null 2>&1; then useradd -m -s %[1]s "$U"; else adduser -D -s %[1]s "$U"; fi || exit 1
+  echo "user $U created"
+fi
+H=$(eval echo ~"$U")
+K=$(%[2]s) || exit 1
+chown -R %[3]s "$H/.ssh" || exit 1
+echo "key $K"
+mkdir -p %[4]s && chown %[3]s %[4]s || exit 1
+echo "layout %[5]s ok"
+missing=0
+`, shellQuote(shell), keyScript, owner, dirs, root)
+	for _, cmd := range bc.Sudo {
+		fmt.Fprintf(&b, "sudo -n -l -U \"$U\" %s >/dev/null 2>&1 && echo %s || { echo %s; missing=1; }\n",
+			cmd, shellQuote("sudo ok: "+cmd), shellQuote("sudo rule missing: "+cmd))
+	}
+	b.WriteString("exit $missing\n")
+	script := shellQuote(b.String())
+	return `if [ "$(id -u)" = 0 ]; then sh -c ` + script + `; else sudo -n sh -c ` + script + `; fi`, nil
+}
+
+// Bootstrap prepare hosts for deploys with BootstrapScript, output and errors are keyed by host
+func Bootstrap(hosts []string) (output map[string]string, errs map[string]string, err error) {
+	key, err := ReadPublicKey(C.Bootstrap.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	script, err := BootstrapScript(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return RunRemote(hosts, script)
+}
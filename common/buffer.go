@@ -0,0 +1,104 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// TransferDefaultBufferSize copy buffer of a transfer
+const TransferDefaultBufferSize = 32 * 1024
+
+// BufferStats copy buffers used by transfers of this run, memory of transfers is at most Peak*Size
+type BufferStats struct {
+	Size      int   // buffer size in bytes
+	Allocated int64 // buffers allocated by the pool
+	InUse     int64 // buffers held by running copies
+	Peak      int64 // max buffers held at the same time
+	Copies    int64
+	Bytes     int64 // bytes copied
+}
+
+// String describe stats in output
+func (bs BufferStats) String() string {
+	return fmt.Sprintf("buffer=%s allocated=%d peak=%d(%s) copies=%d copied=%s",
+		HumanSize(int64(bs.Size)), bs.Allocated, bs.Peak, HumanSize(bs.Peak*int64(bs.Size)), bs.Copies, HumanSize(bs.Bytes))
+}
+
+var bufStats struct {
+	allocated, inUse, peak, copies, bytes int64
+}
+
+// bufPools pools of buffers by size, the size may change between transfers
+var bufPools = struct {
+	sync.Mutex
+	pools map[int]*sync.Pool
+}{pools: make(map[int]*sync.Pool)}
+
+// bufferSize get configured transfer buffer size, large enough to fill the pipeline of sftp concurrent reads or writes
+// by default. a buffer of a packet would never be split into requests in flight
+func bufferSize() int {
+	if C.TransferBuffer > 0 {
+		return C.TransferBuffer
+	}
+	if C.SFTP.ConcurrentWrites || !C.SFTP.NoConcurrentReads {
+		return C.SFTP.maxRequests() * SFTPPacketSize
+	}
+	return TransferDefaultBufferSize
+}
+
+// getBuffer get a buffer of configured size from pool, putBuffer must be called once done
+func getBuffer() *[]byte {
+	size := bufferSize()
+	bufPools.Lock()
+	p, ok := bufPools.pools[size]
+	if !ok {
+		p = &sync.Pool{New: func() interface{} {
+			atomic.AddInt64(&bufStats.allocated, 1)
+			b := make([]byte, size)
+			return &b
+		}}
+		bufPools.pools[size] = p
+	}
+	bufPools.Unlock()
+	n := atomic.AddInt64(&bufStats.inUse, 1)
+	for {
+		peak := atomic.LoadInt64(&bufStats.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&bufStats.peak, peak, n) {
+			break
+		}
+	}
+	return p.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	atomic.AddInt64(&bufStats.inUse, -1)
+	bufPools.Lock()
+	p := bufPools.pools[len(*b)]
+	bufPools.Unlock()
+	p.Put(b)
+}
+
+// copyBuffer copy src to dst through a pooled buffer, memory of a copy never exceeds the buffer.
+// ReaderFrom and WriterTo are hidden since some of them read the whole source into memory
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	b := getBuffer()
+	defer putBuffer(b)
+	n, err := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *b)
+	atomic.AddInt64(&bufStats.copies, 1)
+	atomic.AddInt64(&bufStats.bytes, n)
+	return n, err
+}
+
+// GetBufferStats get stats of transfer buffers
+func GetBufferStats() BufferStats {
+	return BufferStats{
+		Size:      bufferSize(),
+		Allocated: atomic.LoadInt64(&bufStats.allocated),
+		InUse:     atomic.LoadInt64(&bufStats.inUse),
+		Peak:      atomic.LoadInt64(&bufStats.peak),
+		Copies:    atomic.LoadInt64(&bufStats.copies),
+		Bytes:     atomic.LoadInt64(&bufStats.bytes),
+	}
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+// BuildConfig configures local build before deploy
+type BuildConfig struct {
+	Command string   `yaml:"command"` // eg. go build -o build/app .
+	Sources []string `yaml:"sources"` // files,dirs or globs affect the build, unchanged sources skip rebuilding. always rebuilt if empty
+	Output  string   `yaml:"output"`  // build output, used as deploy artifact if artifact is empty
+}
+
+// Build run local build command unless sources are unchanged since last build, without sources it always runs
+// returns true if build is skipped
+func Build() (skipped bool, err error) {
+	bc := C.Deploy.Build
+	if bc.Command == "" {
+		return true, nil
+	}
+	if bc.Output == "" {
+		return false, errors.New("deploy.build.output is not configured")
+	}
+	if C.Deploy.Artifact == "" {
+		C.Deploy.Artifact = bc.Output
+	}
+	if len(bc.Sources) == 0 {
+		// the command alone never tells that output is up to date
+		return false, runBuild(bc)
+	}
+	key, err := buildKey(bc)
+	if err != nil {
+		return false, err
+	}
+	keyFile, err := statePath("build", hashString(bc.Output)+".key")
+	if err != nil {
+		return false, err
+	}
+	if _, err = os.Stat(bc.Output); err == nil {
+		if last, e := ioutil.ReadFile(keyFile); e == nil && string(last) == key {
+			return true, nil
+		}
+	}
+	if err = runBuild(bc); err != nil {
+		return false, err
+	}
+	return false, ioutil.WriteFile(keyFile, []byte(key), 0600)
+}
+
+// runBuild run build command and check its output exists
+func runBuild(bc BuildConfig) error {
+	if err := runLocal(bc.Command); err != nil {
+		return fmt.Errorf("Build: %s", err)
+	}
+	if _, err := os.Stat(bc.Output); err != nil {
+		return fmt.Errorf("Build output: %s", err)
+	}
+	return nil
+}
+
+// localCommand command run by local shell
+func localCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+// runLocal run command by local shell with stdout/stderr attached
+func runLocal(command string) error {
+	cmd := localCommand(command)
+	cmd.Stdout = Stdout
+	cmd.Stderr = Stderr
+	return cmd.Run()
+}
+
+// buildKey hash build command and content of all source files
+func buildKey(bc BuildConfig) (string, error) {
+	var files []string
+	for _, src := range bc.Sources {
+		matches, err := filepath.Glob(src)
+		if err != nil {
+			return "", err
+		}
+		for _, m := range matches {
+			err = filepath.Walk(m, func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !fi.IsDir() {
+					files = append(files, p)
+				}
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	io.WriteString(h, bc.Command+"\n")
+	for _, f := range files {
+		fd, err := os.Open(f)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, f+"\n")
+		_, err = io.Copy(h, fd)
+		fd.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
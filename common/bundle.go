@@ -0,0 +1,333 @@
+package common
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of bundle entries, manifest and its signature come first so that files are checked while read
+const (
+	bundleManifest  = "manifest.json"
+	bundleSignature = "manifest.sig"
+	bundleFiles     = "files/"
+)
+
+// BundleConfig keys of signed bundles
+type BundleConfig struct {
+	PrivateKey string `yaml:"private_key"` // file of hex ed25519 private key signing created bundles
+	PublicKey  string `yaml:"public_key"`  // hex ed25519 public key verifying applied bundles
+}
+
+// BundleManifest content of a bundle: what to run and sha256 of every file, keyed by <n>/<base name> under files/
+type BundleManifest struct {
+	Created  time.Time          `json:"created"`
+	By       string             `json:"by"`
+	Version  string             `json:"optool"`
+	Pipeline string             `json:"pipeline,omitempty"` // pipeline run by apply, deploy if empty
+	Stages   *Pipeline          `json:"stages,omitempty"`
+	Profiles map[string]Profile `json:"profiles,omitempty"` // profiles of pipeline steps, local is a file name
+	Artifact string             `json:"artifact,omitempty"` // file name of deploy artifact
+	Files    map[string]string  `json:"files"`
+}
+
+// BundleKeygen generate a key pair, the private key is written to f and the hex public key is returned
+func BundleKeygen(f string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	if err = ioutil.WriteFile(f, []byte(hex.EncodeToString(priv)+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(pub), nil
+}
+
+// bundleSteps get profiles put by steps of pipeline and if any step deploys, overrides included
+func bundleSteps(p Pipeline) (map[string]Profile, bool, error) {
+	profiles := make(map[string]Profile)
+	deploys := false
+	var steps []Step
+	steps = append(steps, p.Steps...)
+	for _, st := range p.Stages {
+		steps = append(steps, st.Steps...)
+	}
+	for _, s := range steps {
+		names := []string{s.Profile}
+		deploys = deploys || s.Deploy
+		for _, o := range s.Overrides {
+			names = append(names, o.Profile)
+			deploys = deploys || o.Deploy
+		}
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			pf, ok := C.Profiles[name]
+			if !ok {
+				return nil, false, fmt.Errorf("Profile not found: %s", name)
+			}
+			if strings.ToUpper(pf.Method) == TransferGet || pf.From != "" {
+				continue
+			}
+			profiles[name] = pf
+		}
+	}
+	return profiles, deploys, nil
+}
+
+// CreateBundle write a signed archive of deploy artifact, or of pipeline with the artifact and files its profiles put
+func CreateBundle(out, pipeline string) (*BundleManifest, error) {
+	if C.Bundle.PrivateKey == "" {
+		return nil, errors.New("bundle.private_key is not configured")
+	}
+	data, err := ioutil.ReadFile(expandHome(C.Bundle.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("Invalid bundle.private_key")
+	}
+	m := &BundleManifest{
+		Created:  time.Now(),
+		By:       localDeployer(),
+		Version:  Version,
+		Pipeline: pipeline,
+		Files:    make(map[string]string),
+	}
+	local := make(map[string]string) // file name => local path
+	add := func(p string) (string, error) {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		if !fi.Mode().IsRegular() {
+			return "", fmt.Errorf("%s is not a file, only files are bundled", p)
+		}
+		// numbered dirs keep base names, which name the artifact on hosts
+		name := fmt.Sprintf("%d/%s", len(local)+1, filepath.Base(p))
+		if m.Files[name], err = FileChecksum(p); err != nil {
+			return "", err
+		}
+		local[name] = p
+		return name, nil
+	}
+	deploys := pipeline == ""
+	if pipeline != "" {
+		p, ok := C.Pipelines[pipeline]
+		if !ok {
+			return nil, fmt.Errorf("Pipeline not found: %s", pipeline)
+		}
+		m.Stages = &p
+		if m.Profiles, deploys, err = bundleSteps(p); err != nil {
+			return nil, err
+		}
+		for name, pf := range m.Profiles {
+			if pf.Local, err = add(pf.Local); err != nil {
+				return nil, fmt.Errorf("Profile %s: %s", name, err)
+			}
+			m.Profiles[name] = pf
+		}
+	}
+	if deploys {
+		if err = PrepareArtifact(); err != nil {
+			return nil, err
+		}
+		if m.Artifact, err = add(C.Deploy.Artifact); err != nil {
+			return nil, err
+		}
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.PrivateKey(key), manifest))
+	tmp := runTemp(out, "new")
+	defer os.Remove(tmp)
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	gw := gzip.NewWriter(fd)
+	tw := tar.NewWriter(gw)
+	writeEntry := func(name string, size int64, r io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: m.Created}); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+	if err = writeEntry(bundleManifest, int64(len(manifest)), strings.NewReader(string(manifest))); err != nil {
+		return nil, err
+	}
+	if err = writeEntry(bundleSignature, int64(len(sig)), strings.NewReader(sig)); err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range local {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, err := os.Open(local[name])
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err == nil {
+			err = writeEntry(bundleFiles+name, fi.Size(), f)
+		}
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gw.Close(); err != nil {
+		return nil, err
+	}
+	if err = fd.Close(); err != nil {
+		return nil, err
+	}
+	return m, os.Rename(tmp, out)
+}
+
+// ApplyBundle verify signature and checksums of bundle and load it: files are cached, deploy artifact, pipeline and
+// profiles of configure are replaced by those of the bundle. hosts and auth still come from configure
+func ApplyBundle(f string) (*BundleManifest, error) {
+	if C.Bundle.PublicKey == "" {
+		return nil, errors.New("bundle.public_key is not configured")
+	}
+	pub, err := hex.DecodeString(C.Bundle.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid bundle.public_key")
+	}
+	fd, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	gr, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	var manifest, sig []byte
+	for _, want := range []string{bundleManifest, bundleSignature} {
+		hdr, err := tr.Next()
+		if err != nil || hdr.Name != want {
+			return nil, fmt.Errorf("Invalid bundle, %s not found", want)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(tr, 1<<20))
+		if err != nil {
+			return nil, err
+		}
+		if want == bundleManifest {
+			manifest = data
+		} else {
+			sig = data
+		}
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), manifest, rawSig) {
+		return nil, errors.New("Invalid bundle signature")
+	}
+	m := &BundleManifest{}
+	if err = json.Unmarshal(manifest, m); err != nil {
+		return nil, err
+	}
+	tmpDir, err := statePath("artifacts", "tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+		return nil, err
+	}
+	cached := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(hdr.Name, bundleFiles)
+		sum, ok := m.Files[name]
+		if !ok || !strings.HasPrefix(hdr.Name, bundleFiles) {
+			return nil, fmt.Errorf("Invalid bundle, unknown entry %s", hdr.Name)
+		}
+		base := path.Base(name)
+		if base == "." || base == ".." || strings.Contains(base, `\`) {
+			return nil, fmt.Errorf("Invalid bundle, unknown entry %s", hdr.Name)
+		}
+		if cached[name], err = cacheBundleFile(tr, filepath.Join(tmpDir, base), sum); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	for name := range m.Files {
+		if _, ok := cached[name]; !ok {
+			return nil, fmt.Errorf("Invalid bundle, %s not found", name)
+		}
+	}
+	if m.Artifact != "" {
+		C.Deploy.Artifact = cached[m.Artifact]
+		C.Deploy.Checksum = m.Files[m.Artifact]
+		C.Deploy.Build.Command = ""
+	}
+	if m.Pipeline != "" && m.Stages != nil {
+		if C.Pipelines == nil {
+			C.Pipelines = make(map[string]Pipeline)
+		}
+		C.Pipelines[m.Pipeline] = *m.Stages
+	}
+	for name, pf := range m.Profiles {
+		pf.Local = cached[pf.Local]
+		if C.Profiles == nil {
+			C.Profiles = make(map[string]Profile)
+		}
+		C.Profiles[name] = pf
+	}
+	return m, nil
+}
+
+// cacheBundleFile copy r to tmp checking its sha256, then store it in cache and get cached path
+func cacheBundleFile(r io.Reader, tmp, sum string) (string, error) {
+	defer os.Remove(tmp)
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fd, h), r)
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != sum {
+		return "", errors.New("Checksum mismatch")
+	}
+	_, cached, err := CacheStore(tmp)
+	return cached, err
+}
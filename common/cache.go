@@ -0,0 +1,228 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CacheDefaultMaxSize default max size of artifact cache
+const CacheDefaultMaxSize = 10 << 30 // 10GB
+
+// CacheConfig configures local artifact cache
+type CacheConfig struct {
+	MaxSize int64 `yaml:"max_size"` // bytes, least recently used artifacts are removed by gc
+}
+
+// CachedArtifact artifact saved in cache
+type CachedArtifact struct {
+	Checksum string
+	Path     string
+	Size     int64
+	Used     time.Time
+}
+
+// isChecksum check if s is a sha256 hex checksum as artifacts are keyed by
+func isChecksum(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// cachePath get path of artifact in cache, which is keyed by sha256 of content
+func cachePath(checksum, name string) (string, error) {
+	return statePath("artifacts", checksum, name)
+}
+
+// cachedFile artifact in cache dir of a checksum, partial copies left by an interrupted store are skipped
+func cachedFile(dir string) (os.FileInfo, bool) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, false
+	}
+	for _, fi := range files {
+		if !fi.IsDir() && !strings.HasSuffix(fi.Name(), ".tmp") {
+			return fi, true
+		}
+	}
+	return nil, false
+}
+
+// CacheLookup get cached artifact by checksum, empty if not cached
+func CacheLookup(checksum string) string {
+	dir, err := statePath("artifacts", checksum)
+	if err != nil {
+		return ""
+	}
+	fi, ok := cachedFile(dir)
+	if !ok {
+		return ""
+	}
+	p := filepath.Join(dir, fi.Name())
+	// mtime records last use for gc
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return p
+}
+
+// CacheStore copy local file into cache, returns its checksum and cached path
+func CacheStore(f string) (checksum string, cached string, err error) {
+	if checksum, err = FileChecksum(f); err != nil {
+		return
+	}
+	if cached = CacheLookup(checksum); cached != "" {
+		return
+	}
+	if cached, err = cachePath(checksum, filepath.Base(f)); err != nil {
+		return
+	}
+	err = copyFile(f, cached)
+	return
+}
+
+// FetchArtifact get local file of artifact, urls are downloaded into cache
+// cached artifact is used without downloading if checksum is given
+func FetchArtifact(artifact, checksum string) (string, error) {
+	remote := strings.HasPrefix(artifact, "http://") || strings.HasPrefix(artifact, "https://") ||
+		strings.HasPrefix(artifact, "s3://")
+	if !remote {
+		return artifact, nil
+	}
+	if checksum != "" {
+		if cached := CacheLookup(checksum); cached != "" {
+			return cached, nil
+		}
+	}
+	tmpDir, err := statePath("artifacts", "tmp")
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(tmpDir, path.Base(artifact))
+	defer os.Remove(tmp)
+	if strings.HasPrefix(artifact, "s3://") {
+		out, err := exec.Command("aws", "s3", "cp", "--only-show-errors", artifact, tmp).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("Download %s: %s %s", artifact, err, strings.TrimSpace(string(out)))
+		}
+	} else if err = download(artifact, tmp); err != nil {
+		return "", err
+	}
+	sum, cached, err := CacheStore(tmp)
+	if err != nil {
+		return "", err
+	}
+	if checksum != "" && sum != checksum {
+		os.RemoveAll(filepath.Dir(cached))
+		return "", fmt.Errorf("Artifact %s checksum mismatch: %s != %s", artifact, sum, checksum)
+	}
+	return cached, nil
+}
+
+func download(u, dst string) error {
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Download %s: %s", u, resp.Status)
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// CacheList list all cached artifacts, most recently used first
+func CacheList() ([]CachedArtifact, error) {
+	root, err := statePath("artifacts")
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []CachedArtifact
+	for _, d := range dirs {
+		if !d.IsDir() || !isChecksum(d.Name()) {
+			continue
+		}
+		fi, ok := cachedFile(filepath.Join(root, d.Name()))
+		if !ok {
+			continue
+		}
+		list = append(list, CachedArtifact{
+			Checksum: d.Name(),
+			Path:     filepath.Join(root, d.Name(), fi.Name()),
+			Size:     fi.Size(),
+			Used:     fi.ModTime(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Used.After(list[j].Used)
+	})
+	return list, nil
+}
+
+// CacheGC remove least recently used artifacts until cache fits max size
+// artifacts of recorded releases are always kept
+func CacheGC() (removed []CachedArtifact, err error) {
+	maxSize := C.Cache.MaxSize
+	if maxSize < 1 {
+		maxSize = CacheDefaultMaxSize
+	}
+	list, err := CacheList()
+	if err != nil {
+		return nil, err
+	}
+	releases, err := LoadReleases()
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool)
+	for _, rel := range releases {
+		keep[rel.Checksum] = true
+	}
+	var total int64
+	for _, a := range list {
+		total += a.Size
+	}
+	for i := len(list) - 1; i >= 0 && total > maxSize; i-- {
+		a := list[i]
+		if keep[a.Checksum] {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Dir(a.Path)); err != nil {
+			return
+		}
+		total -= a.Size
+		removed = append(removed, a)
+	}
+	return
+}
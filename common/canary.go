@@ -0,0 +1,95 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CanaryGroups stratify canaries by groups of configure
+const CanaryGroups = "group"
+
+// CanaryConfig hosts picked at random every rolling deploy and deployed first as a batch of their own.
+// hosts picked as canary less often weigh more, so that canary coverage rotates across the fleet
+type CanaryConfig struct {
+	Percent  float64 `yaml:"percent"`  // share of hosts, eg. 5 for 5%, at least one host. no canaries if 0
+	Stratify string  `yaml:"stratify"` // pick percent of each group, "group" or a tag key like region for groups named region=<value>
+	Wait     int     `yaml:"wait"`     // seconds to watch canaries before the other batches
+}
+
+// canaryStrata get hosts by stratum, hosts outside strata share the "" stratum
+func canaryStrata(hosts []string, stratify string) map[string][]string {
+	strata := make(map[string][]string)
+	if stratify == "" {
+		strata[""] = hosts
+		return strata
+	}
+	var groups []string
+	for g := range C.Server.Hosts {
+		if stratify == CanaryGroups && !strings.Contains(g, "=") || strings.HasPrefix(g, stratify+"=") {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	member := make(map[string]string) // host => first stratum of it
+	for _, g := range groups {
+		for _, entry := range C.Server.Hosts[g] {
+			expanded, err := ExpandRange(entry)
+			if err != nil {
+				continue
+			}
+			for _, h := range expanded {
+				if _, ok := member[h]; !ok {
+					member[h] = g
+				}
+			}
+		}
+	}
+	for _, h := range hosts {
+		strata[member[h]] = append(strata[member[h]], h)
+	}
+	return strata
+}
+
+// SelectCanaries pick percent of hosts, of every stratum if stratify is set, at random weighted by how often each
+// host was picked before. picks are counted in state dir
+func SelectCanaries(hosts []string, cc CanaryConfig) []string {
+	if cc.Percent <= 0 || len(hosts) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	// missing or broken counts only weigh hosts equally
+	loadState("canaries.json", &counts)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	picked := make(map[string]bool)
+	for _, stratum := range canaryStrata(hosts, cc.Stratify) {
+		n := int(math.Ceil(float64(len(stratum)) * cc.Percent / 100))
+		if n > len(stratum) {
+			n = len(stratum)
+		}
+		// weighted sampling without replacement: the n hosts of largest u^(1/w)
+		keys := make(map[string]float64)
+		for _, h := range stratum {
+			keys[h] = math.Pow(rnd.Float64(), float64(1+counts[h]))
+		}
+		sorted := append([]string(nil), stratum...)
+		sort.Slice(sorted, func(i, j int) bool { return keys[sorted[i]] > keys[sorted[j]] })
+		for _, h := range sorted[:n] {
+			picked[h] = true
+			counts[h]++
+		}
+	}
+	var canaries []string
+	for _, h := range hosts {
+		if picked[h] {
+			canaries = append(canaries, h)
+		}
+	}
+	if err := saveState("canaries.json", counts); err != nil {
+		fmt.Fprintf(Stderr, "Warning: save canary picks: %s\n", err)
+	}
+	return canaries
+}
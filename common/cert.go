@@ -0,0 +1,298 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// certExpiryLayout notAfter of openssl x509 -enddate
+const certExpiryLayout = "Jan _2 15:04:05 2006 MST"
+
+// CertConfig TLS certificate pushed with its key and chain, verified on hosts before it is live and reloaded
+type CertConfig struct {
+	Cert     string   `yaml:"cert"`      // local PEM certificate
+	Key      string   `yaml:"key"`       // local PEM key
+	Chain    string   `yaml:"chain"`     // local PEM intermediates, optional
+	Domains  []string `yaml:"domains"`   // obtained from acme into the local files by cert renew if set
+	Dir      string   `yaml:"dir"`       // remote dir of <name>.crt, <name>.key and <name>.chain.crt
+	Owner    string   `yaml:"owner"`     // chown user[:group] of files, the key is readable by its owner only
+	CAFile   string   `yaml:"ca_file"`   // remote CA bundle verifying the chain, system store if empty
+	Reload   string   `yaml:"reload"`    // run after the new files are in place, eg. systemctl reload nginx
+	WarnDays int      `yaml:"warn_days"` // expiry reports flag certificates expiring within days, default 30
+}
+
+// certFile local file of a cert and its remote path
+type certFile struct {
+	local, remote string
+	mode          os.FileMode
+}
+
+// certPaths remote paths of cert, key and chain of cert name
+func certPaths(name string, cc CertConfig) (string, string, string) {
+	p := strings.TrimRight(cc.Dir, "/") + "/" + name
+	return p + ".crt", p + ".key", p + ".chain.crt"
+}
+
+// warnDays days before expiry certificate of cc is flagged
+func (cc CertConfig) warnDays() int {
+	if cc.WarnDays <= 0 {
+		return 30
+	}
+	return cc.WarnDays
+}
+
+// loadCert check local files of cert name: the key matches the certificate and it has not expired
+func loadCert(name string) (CertConfig, error) {
+	cc, ok := C.Certs[name]
+	if !ok {
+		return cc, fmt.Errorf("No such cert: %s", name)
+	}
+	if cc.Cert == "" || cc.Key == "" || cc.Dir == "" {
+		return cc, fmt.Errorf("Cert %s requires cert, key and dir", name)
+	}
+	certPEM, err := ioutil.ReadFile(expandHome(cc.Cert))
+	if err != nil {
+		return cc, err
+	}
+	keyPEM, err := ioutil.ReadFile(expandHome(cc.Key))
+	if err != nil {
+		return cc, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return cc, fmt.Errorf("Cert %s: %s", name, err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return cc, fmt.Errorf("Cert %s: %s", name, err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return cc, fmt.Errorf("Cert %s expired at %s", name, leaf.NotAfter.Format("2006-01-02 15:04"))
+	}
+	if cc.Chain != "" {
+		if _, err = os.Stat(expandHome(cc.Chain)); err != nil {
+			return cc, err
+		}
+	}
+	return cc, nil
+}
+
+// certScript verify new files of cc uploaded next to their remote paths and move them into place. it prints
+// unchanged or the expiry of the certificate, output of verification and reload goes to stdout
+func certScript(name string, cc CertConfig) string {
+	crt, key, chain := certPaths(name, cc)
+	finals := []string{crt, key}
+	if cc.Chain != "" {
+		finals = append(finals, chain)
+	}
+	var news []string
+	for _, f := range finals {
+		news = append(news, shellQuote(runTemp(f, "new")))
+	}
+	var b strings.Builder
+	b.WriteString("exec 2>&1\n")
+	fmt.Fprintf(&b, "fail() { rm -f %s; echo \"$1\"; exit 1; }\n", strings.Join(news, " "))
+	b.WriteString("command -v openssl >/dev/null || fail 'openssl not found'\n")
+	fmt.Fprintf(&b, "openssl x509 -noout -checkend 0 -in %s >/dev/null || fail 'certificate expired'\n", news[0])
+	fmt.Fprintf(&b, "[ \"$(openssl x509 -noout -pubkey -in %s)\" = \"$(openssl pkey -pubout -in %s)\" ] || fail 'key does not match certificate'\n",
+		news[0], news[1])
+	verify := "openssl verify"
+	if cc.CAFile != "" {
+		verify += " -CAfile " + shellQuote(cc.CAFile)
+	}
+	if cc.Chain != "" {
+		verify += " -untrusted " + news[2]
+	}
+	fmt.Fprintf(&b, "%s %s || fail 'chain verification failed'\n", verify, news[0])
+	var same []string
+	for i, f := range finals {
+		same = append(same, fmt.Sprintf("cmp -s %s %s", news[i], shellQuote(f)))
+	}
+	fmt.Fprintf(&b, "if %s; then rm -f %s; echo unchanged; exit 0; fi\n", strings.Join(same, " && "), strings.Join(news, " "))
+	if cc.Owner != "" {
+		fmt.Fprintf(&b, "chown %s %s || fail 'chown failed'\n", shellQuote(cc.Owner), strings.Join(news, " "))
+	}
+	for i := range finals {
+		fmt.Fprintf(&b, "mv -f %s %s || exit 1\n", news[i], shellQuote(finals[i]))
+	}
+	if cc.Reload != "" {
+		fmt.Fprintf(&b, "{ %s\n} || { echo 'reload failed'; exit 1; }\n", cc.Reload)
+	}
+	fmt.Fprintf(&b, "openssl x509 -noout -enddate -in %s\n", shellQuote(crt))
+	return b.String()
+}
+
+// DeployCert push certificate, key and chain of cert name to hosts with strict permissions, verify them there and
+// swap them into place, and reload. hosts whose files are unchanged are not reloaded. output and errors are keyed by
+// host
+func DeployCert(hosts []string, name string) (map[string]string, map[string]string, error) {
+	cc, err := loadCert(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = CheckClocks(hosts, "cert "+name); err != nil {
+		return nil, nil, err
+	}
+	crt, key, chain := certPaths(name, cc)
+	// the key is created private before it is written
+	_, errs, err := RunRemote(hosts, fmt.Sprintf("mkdir -p %s && (umask 077 && : > %s)",
+		shellQuote(cc.Dir), shellQuote(runTemp(key, "new"))))
+	if err != nil {
+		return nil, nil, err
+	}
+	files := []certFile{{cc.Key, key, 0600}, {cc.Cert, crt, 0644}}
+	if cc.Chain != "" {
+		files = append(files, certFile{cc.Chain, chain, 0644})
+	}
+	for _, f := range files {
+		pending := certPending(hosts, errs)
+		if len(pending) == 0 {
+			return nil, errs, nil
+		}
+		t := NewTransfer(TransferPut, expandHome(f.local), runTemp(f.remote, "new"), pending)
+		t.Override = true
+		t.Mode = f.mode
+		err = t.Start()
+		for h, e := range t.Errors {
+			errs[h] = e.Error()
+		}
+		if err != nil && len(t.Errors) == 0 {
+			return nil, nil, err
+		}
+	}
+	pending := certPending(hosts, errs)
+	if len(pending) == 0 {
+		return nil, errs, nil
+	}
+	output, rerrs, err := RunRemote(pending, certScript(name, cc))
+	if err != nil {
+		return nil, nil, err
+	}
+	for h, e := range rerrs {
+		errs[h] = e
+	}
+	return output, errs, nil
+}
+
+// certPending hosts without error
+func certPending(hosts []string, errs map[string]string) []string {
+	var pending []string
+	for _, h := range hosts {
+		if _, ok := errs[h]; !ok {
+			pending = append(pending, h)
+		}
+	}
+	return pending
+}
+
+// CertExpiries read expiry of certs names installed on hosts, host => name => expiry. certs missing on a host are
+// left out, errors are keyed by host
+func CertExpiries(hosts, names []string) (map[string]map[string]time.Time, map[string]string, error) {
+	var b strings.Builder
+	for _, name := range names {
+		cc, ok := C.Certs[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("No such cert: %s", name)
+		}
+		if cc.Dir == "" {
+			return nil, nil, fmt.Errorf("Cert %s requires cert, key and dir", name)
+		}
+		crt, _, _ := certPaths(name, cc)
+		fmt.Fprintf(&b, "printf '%%s ' %s; openssl x509 -noout -enddate -in %s 2>/dev/null || echo missing\n",
+			shellQuote(name), shellQuote(crt))
+	}
+	output, errs, err := RunRemote(hosts, b.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	expiries := make(map[string]map[string]time.Time)
+	for _, h := range hosts {
+		if _, failed := errs[h]; failed {
+			continue
+		}
+		expiries[h] = make(map[string]time.Time)
+		for _, line := range strings.Split(output[h], "\n") {
+			fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+			if len(fields) != 2 || !strings.HasPrefix(fields[1], "notAfter=") {
+				continue
+			}
+			t, err := time.Parse(certExpiryLayout, strings.TrimPrefix(fields[1], "notAfter="))
+			if err != nil {
+				errs[h] = fmt.Sprintf("Invalid expiry of %s: %s", fields[0], fields[1])
+				continue
+			}
+			expiries[h][fields[0]] = t
+		}
+	}
+	return expiries, errs, nil
+}
+
+// PrintCertExpiry print days until expiry of certs names of every host, the earliest last. returns number of
+// certificates expired or within warn_days, certs missing on a host are listed but not counted
+func PrintCertExpiry(hosts, names []string, expiries map[string]map[string]time.Time, errs map[string]string) int {
+	now := time.Now()
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	flagged := 0
+	var earliest time.Time
+	var earliestAt string
+	for _, h := range hosts {
+		if e, ok := errs[h]; ok {
+			fmt.Fprintf(Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+			if _, read := expiries[h]; !read {
+				continue
+			}
+		}
+		for _, name := range names {
+			t, ok := expiries[h][name]
+			if !ok {
+				fmt.Fprintf(Stdout, "%21s: %-*s  missing\n", h, width, name)
+				continue
+			}
+			days := int(t.Sub(now).Hours() / 24)
+			note := ""
+			switch {
+			case !now.Before(t):
+				note, days = "  EXPIRED", 0
+				flagged++
+			case days < C.Certs[name].warnDays():
+				note = "  EXPIRING"
+				flagged++
+			}
+			fmt.Fprintf(Stdout, "%21s: %-*s  %s  %4d days%s\n", h, width, name, t.Local().Format("2006-01-02"), days, note)
+			if earliest.IsZero() || t.Before(earliest) {
+				earliest, earliestAt = t, name+" on "+h
+			}
+		}
+	}
+	if !earliest.IsZero() {
+		fmt.Fprintf(Stdout, "Earliest: %s expires %s\n", earliestAt, earliest.Local().Format("2006-01-02 15:04"))
+	}
+	return flagged
+}
+
+// CertNames names of certs, all of certs if names is empty
+func CertNames(names []string) ([]string, error) {
+	if len(names) > 0 {
+		return names, nil
+	}
+	for name := range C.Certs {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("certs is not configured")
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,281 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Change ticket systems
+const (
+	ChangeJira       = "jira"
+	ChangeServiceNow = "servicenow"
+)
+
+// ChangeConfig change tickets of deploys, tickets are required for protected groups and may be created for others
+type ChangeConfig struct {
+	System    string   `yaml:"system"`     // jira or servicenow, no ticket is used if empty
+	URL       string   `yaml:"url"`        // eg. https://example.atlassian.net or https://example.service-now.com
+	User      string   `yaml:"user"`       // basic auth user
+	Token     string   `yaml:"token"`      // api token or password
+	Project   string   `yaml:"project"`    // jira project key of created tickets
+	IssueType string   `yaml:"issue_type"` // jira issue type of created tickets, default Change
+	Create    bool     `yaml:"create"`     // create a ticket for deploys without -change, except protected groups
+	Protected []string `yaml:"protected"`  // groups deployed only with an approved ticket given by -change
+	Approved  []string `yaml:"approved"`   // jira statuses counted as approved, default Approved. servicenow checks approval
+	Close     string   `yaml:"close"`      // jira transition or servicenow state closing tickets, default Done or 3
+}
+
+// ChangeTicket change ticket of a deploy
+type ChangeTicket struct {
+	ID    string // issue key or change number
+	sysID string // servicenow record
+}
+
+// isProtected check if deploys of group need an approved ticket
+func (cc ChangeConfig) isProtected(group string) bool {
+	for _, g := range cc.Protected {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// StartChange get change ticket of deploy of group. ticket id is checked to be approved, a ticket is created if
+// none is given and change.create is set. an error is returned if a protected group has no approved ticket
+func StartChange(group, id string) (*ChangeTicket, error) {
+	cc := C.Change
+	if cc.System == "" || group == "" {
+		return nil, nil
+	}
+	RegisterSecret(cc.Token)
+	protected := cc.isProtected(group)
+	if id == "" {
+		if protected {
+			return nil, fmt.Errorf("Deploy of %s requires an approved change ticket, set -change", group)
+		}
+		if !cc.Create {
+			return nil, nil
+		}
+		return createChange(group)
+	}
+	ct := &ChangeTicket{ID: id}
+	approved, err := ct.approved()
+	if err != nil {
+		return nil, err
+	}
+	if !approved && protected {
+		return nil, fmt.Errorf("Change %s is not approved", id)
+	}
+	return ct, ct.comment(fmt.Sprintf("optool run %s started deploying %s by %s", RunID, group, localDeployer()))
+}
+
+// createChange create ticket of deploy of group
+func createChange(group string) (*ChangeTicket, error) {
+	cc := C.Change
+	summary := fmt.Sprintf("Deploy %s", group)
+	desc := fmt.Sprintf("optool run %s deploying %s by %s", RunID, group, localDeployer())
+	if u := ciRunURL(); u != "" {
+		desc += "\n" + u
+	}
+	switch cc.System {
+	case ChangeJira:
+		issueType := cc.IssueType
+		if issueType == "" {
+			issueType = "Change"
+		}
+		var created struct {
+			Key string `json:"key"`
+		}
+		err := changeRequest("POST", "/rest/api/2/issue", map[string]interface{}{
+			"fields": map[string]interface{}{
+				"project":     map[string]string{"key": cc.Project},
+				"summary":     summary,
+				"description": desc,
+				"issuetype":   map[string]string{"name": issueType},
+			},
+		}, &created)
+		if err != nil {
+			return nil, err
+		}
+		return &ChangeTicket{ID: created.Key}, nil
+	case ChangeServiceNow:
+		var created struct {
+			Result struct {
+				SysID  string `json:"sys_id"`
+				Number string `json:"number"`
+			} `json:"result"`
+		}
+		err := changeRequest("POST", "/api/now/table/change_request", map[string]string{
+			"short_description": summary,
+			"description":       desc,
+		}, &created)
+		if err != nil {
+			return nil, err
+		}
+		return &ChangeTicket{ID: created.Result.Number, sysID: created.Result.SysID}, nil
+	}
+	return nil, fmt.Errorf("Unknown change.system: %s", cc.System)
+}
+
+// approved check if ticket is approved, sys id of servicenow change is looked up too
+func (ct *ChangeTicket) approved() (bool, error) {
+	cc := C.Change
+	switch cc.System {
+	case ChangeJira:
+		var issue struct {
+			Fields struct {
+				Status struct {
+					Name string `json:"name"`
+				} `json:"status"`
+			} `json:"fields"`
+		}
+		if err := changeRequest("GET", "/rest/api/2/issue/"+url.PathEscape(ct.ID)+"?fields=status", nil, &issue); err != nil {
+			return false, err
+		}
+		approved := cc.Approved
+		if len(approved) == 0 {
+			approved = []string{"Approved"}
+		}
+		for _, s := range approved {
+			if strings.EqualFold(s, issue.Fields.Status.Name) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case ChangeServiceNow:
+		var found struct {
+			Result []struct {
+				SysID    string `json:"sys_id"`
+				Approval string `json:"approval"`
+			} `json:"result"`
+		}
+		q := url.Values{"sysparm_query": {"number=" + ct.ID}, "sysparm_fields": {"sys_id,approval"}}
+		if err := changeRequest("GET", "/api/now/table/change_request?"+q.Encode(), nil, &found); err != nil {
+			return false, err
+		}
+		if len(found.Result) == 0 {
+			return false, fmt.Errorf("Change %s not found", ct.ID)
+		}
+		ct.sysID = found.Result[0].SysID
+		return found.Result[0].Approval == "approved", nil
+	}
+	return false, fmt.Errorf("Unknown change.system: %s", cc.System)
+}
+
+// comment add note to ticket
+func (ct *ChangeTicket) comment(note string) error {
+	note = Redact(note)
+	if C.Change.System == ChangeServiceNow {
+		return changeRequest("PATCH", "/api/now/table/change_request/"+ct.sysID, map[string]string{"work_notes": note}, nil)
+	}
+	return changeRequest("POST", "/rest/api/2/issue/"+url.PathEscape(ct.ID)+"/comment", map[string]string{"body": note}, nil)
+}
+
+// Finish add result of deploy to ticket and close it, nothing is done on nil
+func (ct *ChangeTicket) Finish(err error) error {
+	if ct == nil {
+		return nil
+	}
+	result := fmt.Sprintf("optool run %s succeeded", RunID)
+	if err != nil {
+		result = fmt.Sprintf("optool run %s failed: %s", RunID, err)
+	}
+	if failed := FailedHosts(); len(failed) > 0 {
+		var hosts []string
+		for h := range failed {
+			hosts = append(hosts, h)
+		}
+		sort.Strings(hosts)
+		result += fmt.Sprintf("\nFailed hosts: %d", len(failed))
+		for _, h := range hosts {
+			result += "\n" + h + ": " + strings.TrimSpace(failed[h])
+		}
+	}
+	result = Redact(result)
+	cc := C.Change
+	if cc.System == ChangeServiceNow {
+		state := cc.Close
+		if state == "" {
+			state = "3"
+		}
+		code := "successful"
+		if err != nil {
+			code = "unsuccessful"
+		}
+		return changeRequest("PATCH", "/api/now/table/change_request/"+ct.sysID, map[string]string{
+			"state":       state,
+			"close_code":  code,
+			"close_notes": result,
+		}, nil)
+	}
+	if e := ct.comment(result); e != nil {
+		return e
+	}
+	transition := cc.Close
+	if transition == "" {
+		transition = "Done"
+	}
+	var list struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"transitions"`
+	}
+	p := "/rest/api/2/issue/" + url.PathEscape(ct.ID) + "/transitions"
+	if e := changeRequest("GET", p, nil, &list); e != nil {
+		return e
+	}
+	for _, t := range list.Transitions {
+		if strings.EqualFold(t.Name, transition) {
+			return changeRequest("POST", p, map[string]interface{}{"transition": map[string]string{"id": t.ID}}, nil)
+		}
+	}
+	return fmt.Errorf("Transition %s of %s not found", transition, ct.ID)
+}
+
+// changeRequest send request to ticket system, json response is decoded into v if not nil
+func changeRequest(method, p string, body interface{}, v interface{}) error {
+	cc := C.Change
+	if cc.URL == "" {
+		return errors.New("change.url is not configured")
+	}
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(cc.URL, "/")+p, rd)
+	if err != nil {
+		return err
+	}
+	if cc.User != "" {
+		req.SetBasicAuth(cc.User, cc.Token)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returns %s", cc.System, resp.Status)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
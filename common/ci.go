@@ -0,0 +1,137 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CI providers, set by -ci from environment of the job
+const (
+	CIGitHub  = "github"
+	CIGitLab  = "gitlab"
+	CIGeneric = "generic"
+)
+
+// Exit codes of a failed run in ci mode
+const (
+	ExitFailure = 1 // every host failed, or the run failed before reaching hosts
+	ExitPartial = 2 // some hosts failed while others succeeded
+)
+
+// CI provider of ci mode, empty if ci mode is off
+var CI string
+
+// ciHosts result of every host run in this invocation, a host failed once is failed
+var ciHosts = struct {
+	sync.Mutex
+	ok     map[string]bool
+	failed map[string]string
+}{ok: make(map[string]bool), failed: make(map[string]string)}
+
+// EnableCI turn on ci mode, provider is detected from environment.
+// registered secrets are masked in the job log on GitHub too, GitLab masks its masked variables itself
+func EnableCI() {
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		CI = CIGitHub
+	case os.Getenv("GITLAB_CI") != "":
+		CI = CIGitLab
+	default:
+		CI = CIGeneric
+	}
+	if CI == CIGitHub {
+		for _, s := range secretList() {
+			// written unredacted, GitHub needs the value itself
+			fmt.Println("::add-mask::" + s)
+		}
+	}
+}
+
+// CIGroup start a collapsible section of the job log, the returned func ends it. nothing is written out of ci mode
+func CIGroup(w io.Writer, title string) func() {
+	switch CI {
+	case CIGitHub:
+		fmt.Fprintln(w, "::group::"+title)
+		return func() { fmt.Fprintln(w, "::endgroup::") }
+	case CIGitLab:
+		// section names allow letters, digits and _.- only
+		name := strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+				return r
+			}
+			return '_'
+		}, title)
+		name = fmt.Sprintf("%s_%d", name, time.Now().UnixNano())
+		fmt.Fprintf(w, "\x1b[0Ksection_start:%d:%s[collapsed=true]\r\x1b[0K%s\n", time.Now().Unix(), name, title)
+		return func() { fmt.Fprintf(w, "\x1b[0Ksection_end:%d:%s\r\x1b[0K\n", time.Now().Unix(), name) }
+	case CIGeneric:
+		fmt.Fprintln(w, "==> "+title)
+	}
+	return func() {}
+}
+
+// CIError annotate a failure, shown on the job summary of GitHub. title is optional
+func CIError(title, msg string) {
+	msg = strings.TrimSpace(msg)
+	switch CI {
+	case CIGitHub:
+		// data of workflow commands is escaped, newlines included
+		esc := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+		if title != "" {
+			fmt.Fprintf(Stdout, "::error title=%s::%s\n", strings.NewReplacer("%", "%25", ",", "%2C", ":", "%3A", "\n", " ").Replace(title), esc.Replace(msg))
+		} else {
+			fmt.Fprintf(Stdout, "::error::%s\n", esc.Replace(msg))
+		}
+	case CIGitLab, CIGeneric:
+		if title != "" {
+			msg = title + ": " + msg
+		}
+		fmt.Fprintln(Stderr, "ERROR: "+msg)
+	}
+}
+
+// recordHostResult record result of a host for the exit code of ci mode
+func recordHostResult(host string, err error) {
+	ciHosts.Lock()
+	defer ciHosts.Unlock()
+	if err != nil {
+		if _, ok := ciHosts.failed[host]; !ok {
+			ciHosts.failed[host] = err.Error()
+		}
+		delete(ciHosts.ok, host)
+		return
+	}
+	if _, ok := ciHosts.failed[host]; !ok {
+		ciHosts.ok[host] = true
+	}
+}
+
+// CIExitCode annotate failed hosts and err, get exit code of the run.
+// 0 if nothing failed, ExitPartial if some hosts succeeded, ExitFailure otherwise
+func CIExitCode(err error) int {
+	ciHosts.Lock()
+	defer ciHosts.Unlock()
+	var failed []string
+	for h := range ciHosts.failed {
+		failed = append(failed, h)
+	}
+	sort.Strings(failed)
+	for _, h := range failed {
+		CIError(h, ciHosts.failed[h])
+	}
+	if err != nil {
+		CIError("", err.Error())
+	}
+	switch {
+	case err == nil && len(failed) == 0:
+		return 0
+	case len(ciHosts.ok) > 0 && len(failed) > 0:
+		return ExitPartial
+	}
+	return ExitFailure
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCIExitCode(t *testing.T) {
+	ciHosts.Lock()
+	oldCI, oldOK, oldFailed := CI, ciHosts.ok, ciHosts.failed
+	ciHosts.Unlock()
+	t.Cleanup(func() {
+		ciHosts.Lock()
+		CI, ciHosts.ok, ciHosts.failed = oldCI, oldOK, oldFailed
+		ciHosts.Unlock()
+	})
+	// no annotations are written out of ci mode
+	CI = ""
+	fail := errors.New("Connection refused")
+	type result struct {
+		host string
+		err  error
+	}
+	tests := []struct {
+		name    string
+		results []result
+		err     error
+		want    int
+	}{
+		{"nothing run", nil, nil, 0},
+		{"all ok", []result{{"h1", nil}, {"h2", nil}}, nil, 0},
+		{"partial", []result{{"h1", nil}, {"h2", fail}}, nil, ExitPartial},
+		{"partial with error", []result{{"h1", nil}, {"h2", fail}}, fail, ExitPartial},
+		{"all failed", []result{{"h1", fail}, {"h2", fail}}, nil, ExitFailure},
+		{"failed before hosts", nil, fail, ExitFailure},
+		{"hosts ok but run failed", []result{{"h1", nil}}, fail, ExitFailure},
+		{"failed once is failed", []result{{"h1", fail}, {"h1", nil}}, nil, ExitFailure},
+		{"retry failed", []result{{"h1", nil}, {"h1", fail}, {"h2", nil}}, nil, ExitPartial},
+	}
+	for _, tt := range tests {
+		ciHosts.Lock()
+		ciHosts.ok, ciHosts.failed = make(map[string]bool), make(map[string]string)
+		ciHosts.Unlock()
+		for _, r := range tt.results {
+			recordHostResult(r.host, r.err)
+		}
+		if got := CIExitCode(tt.err); got != tt.want {
+			t.Errorf("%s: CIExitCode = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
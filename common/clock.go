@@ -0,0 +1,156 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClockConfig pre-flight check of clock skew of hosts against this machine, before deploys, sync puts and config
+// pushes whose mtimes and certificates break silently on skewed clocks
+type ClockConfig struct {
+	MaxSkew int    `yaml:"max_skew"` // seconds, hosts are not checked if 0
+	Action  string `yaml:"action"`   // warn (default) or fail
+}
+
+// ClockSkew clock of a host against this machine
+type ClockSkew struct {
+	Skew  time.Duration // positive if host is ahead
+	Error time.Duration // half round trip, plus a second if host has no sub-second date
+}
+
+// clockScript print unix time of host, with nanoseconds where date supports %N
+const clockScript = "date +%s.%N"
+
+var (
+	clockLock   sync.Mutex
+	clockSkews  = make(map[string]ClockSkew) // measured once per run
+	clockFailed = make(map[string]string)
+)
+
+// parseClock parse output of clockScript, second resolution if %N is not supported
+func parseClock(out string) (time.Time, bool, error) {
+	out = strings.TrimSpace(out)
+	if i := strings.LastIndex(out, "\n"); i >= 0 {
+		out = out[i+1:]
+	}
+	sec, frac := out, ""
+	if i := strings.Index(out, "."); i >= 0 {
+		sec, frac = out[:i], out[i+1:]
+	}
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("Invalid date output: %s", out)
+	}
+	ns, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil || len(frac) != 9 {
+		return time.Unix(s, 0), false, nil
+	}
+	return time.Unix(s, ns), true, nil
+}
+
+// MeasureClocks measure clock skew of hosts, errors are keyed by host. connections are warmed up first, so every host
+// is timed by a command on an open connection
+func MeasureClocks(hosts []string) (map[string]ClockSkew, map[string]string) {
+	var pending []string
+	clockLock.Lock()
+	for _, h := range hosts {
+		_, ok := clockSkews[h]
+		if _, failed := clockFailed[h]; !ok && !failed {
+			pending = append(pending, h)
+		}
+	}
+	clockLock.Unlock()
+	if len(pending) > 0 {
+		RunRemote(pending, "true")
+		RunHosts(pending, func(ctx context.Context, h string) error {
+			start := time.Now()
+			output, errs, err := RunRemote([]string{h}, clockScript)
+			took := time.Since(start)
+			clockLock.Lock()
+			defer clockLock.Unlock()
+			if err == nil && errs[h] != "" {
+				err = fmt.Errorf("%s", strings.TrimSpace(errs[h]))
+			}
+			var remote time.Time
+			var precise bool
+			if err == nil {
+				remote, precise, err = parseClock(output[h])
+			}
+			if err != nil {
+				clockFailed[h] = err.Error()
+				return nil
+			}
+			cs := ClockSkew{Skew: remote.Sub(start.Add(took / 2)), Error: took / 2}
+			if !precise {
+				cs.Error += time.Second
+			}
+			clockSkews[h] = cs
+			return nil
+		})
+	}
+	skews := make(map[string]ClockSkew)
+	errs := make(map[string]string)
+	clockLock.Lock()
+	for _, h := range hosts {
+		if cs, ok := clockSkews[h]; ok {
+			skews[h] = cs
+		} else if e, ok := clockFailed[h]; ok {
+			errs[h] = e
+		}
+	}
+	clockLock.Unlock()
+	return skews, errs
+}
+
+// Exceeds check if skew is beyond max even at the edge of its error
+func (cs ClockSkew) Exceeds(max time.Duration) bool {
+	return time.Duration(math.Abs(float64(cs.Skew)))-cs.Error > max
+}
+
+// String describe skew, eg. +3.2s ±12ms
+func (cs ClockSkew) String() string {
+	sign := "+"
+	if cs.Skew < 0 {
+		sign = "-"
+	}
+	abs := time.Duration(math.Abs(float64(cs.Skew)))
+	return fmt.Sprintf("%s%s ±%s", sign, abs.Round(time.Millisecond), cs.Error.Round(time.Millisecond))
+}
+
+// CheckClocks check clock skew of hosts before step by clock configure, hosts skewed beyond clock.max_skew are
+// warned about or fail the step. hosts not measured are left to the step itself
+func CheckClocks(hosts []string, step string) error {
+	cc := C.Clock
+	if cc.MaxSkew <= 0 {
+		return nil
+	}
+	if cc.Action != "" && cc.Action != "warn" && cc.Action != "fail" {
+		return fmt.Errorf("Unknown clock.action: %s", cc.Action)
+	}
+	max := time.Duration(cc.MaxSkew) * time.Second
+	skews, _ := MeasureClocks(hosts)
+	var skewed []string
+	for h, cs := range skews {
+		if cs.Exceeds(max) {
+			skewed = append(skewed, h)
+		}
+	}
+	if len(skewed) == 0 {
+		return nil
+	}
+	sort.Strings(skewed)
+	for _, h := range skewed {
+		fmt.Fprintf(Stdout, "%21s: clock skew %s\n", h, skews[h])
+	}
+	if cc.Action == "fail" {
+		return fmt.Errorf("%d host(s) clock skewed beyond %ds, %s stopped", len(skewed), cc.MaxSkew, step)
+	}
+	fmt.Fprintf(Stderr, "Warning: %d host(s) clock skewed beyond %ds before %s\n", len(skewed), cc.MaxSkew, step)
+	return nil
+}
@@ -0,0 +1,227 @@
+package common
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// logSliceMax max bytes kept of a log file, the newest lines are kept
+const logSliceMax = 64 << 20
+
+// LogCollect time bounded log slices of hosts packed into one support bundle
+type LogCollect struct {
+	Created time.Time         `json:"created"`
+	By      string            `json:"by"`
+	RunID   string            `json:"run_id"`
+	Since   time.Time         `json:"since"`
+	Paths   []string          `json:"paths,omitempty"` // globs of log files on hosts
+	Units   []string          `json:"units,omitempty"` // journald units
+	Hosts   []string          `json:"hosts"`
+	Files   map[string]int    `json:"files"`            // files collected, keyed by host
+	Failed  map[string]string `json:"failed,omitempty"` // errors keyed by host
+}
+
+// collectScript shell script slicing log files and journal of units since epoch into a tar.gz on host, its path is
+// printed. lines of files are kept from the first timestamp (YYYY-MM-DD HH:MM:SS) at or after since, lines without
+// timestamp go with the line before; files without timestamps are kept whole, both up to logSliceMax bytes
+func collectScript(since time.Time, paths, units []string) string {
+	epoch := since.Unix()
+	minutes := int(time.Since(since).Minutes()) + 1
+	var b strings.Builder
+	fmt.Fprintf(&b, "set -e\nd=$(mktemp -d \"${TMPDIR:-/tmp}/optool-logs-%s.XXXXXX\")\nmkdir -p \"$d/files\" \"$d/journal\"\n", RunID)
+	fmt.Fprintf(&b, "since=$(date -d @%d '+%%Y-%%m-%%dT%%H:%%M:%%S' 2>/dev/null || date -r %d '+%%Y-%%m-%%dT%%H:%%M:%%S')\n", epoch, epoch)
+	b.WriteString(`slice() {
+	awk -v since="$since" '{
+		if (match($0, /[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9][ T][0-9][0-9]:[0-9][0-9]:[0-9][0-9]/)) {
+			ts = substr($0, RSTART, RLENGTH); sub(/ /, "T", ts); keep = (ts >= since); stamped = 1
+		}
+		if (keep || !stamped) print
+	}' | tail -c ` + fmt.Sprint(logSliceMax) + `
+}
+`)
+	for _, p := range paths {
+		// unquoted expansion of the pattern globs on host
+		fmt.Fprintf(&b, "p=%s\nfor f in $p; do\n", shellQuote(p))
+		fmt.Fprintf(&b, "\t[ -f \"$f\" ] && [ -n \"$(find \"$f\" -mmin -%d 2>/dev/null)\" ] || continue\n", minutes)
+		b.WriteString("\tmkdir -p \"$d/files$(dirname \"$f\")\"\n")
+		b.WriteString("\tcase $f in\n\t*.gz) gzip -dc \"$f\" | slice > \"$d/files${f%.gz}\" ;;\n\t*) slice < \"$f\" > \"$d/files$f\" ;;\n\tesac\n")
+		b.WriteString("done\n")
+	}
+	if len(units) > 0 {
+		b.WriteString("command -v journalctl >/dev/null 2>&1 || { echo journalctl not found >&2; exit 1; }\n")
+	}
+	for _, u := range units {
+		fmt.Fprintf(&b, "journalctl --no-pager -o short-iso -u %s --since @%d > \"$d/journal/%s.log\"\n", shellQuote(u), epoch,
+			strings.NewReplacer("/", "-", "'", "").Replace(u))
+	}
+	b.WriteString("tar -C \"$d\" -czf \"$d.tar.gz\" .\nrm -rf \"$d\"\necho \"$d.tar.gz\"\n")
+	return b.String()
+}
+
+// CollectLogs gather log slices of hosts since d ago into a gzipped tar at out, a dir per host. hosts failed are
+// recorded in the bundle and returned in Failed
+func CollectLogs(hosts []string, d time.Duration, paths, units []string, out string) (*LogCollect, error) {
+	if len(paths) == 0 && len(units) == 0 {
+		return nil, errors.New("Paths or units of logs are required")
+	}
+	lc := &LogCollect{
+		Created: time.Now(),
+		By:      localDeployer(),
+		RunID:   RunID,
+		Since:   time.Now().Add(-d),
+		Paths:   paths,
+		Units:   units,
+		Hosts:   hosts,
+		Files:   make(map[string]int),
+		Failed:  make(map[string]string),
+	}
+	output, errs, err := RunRemote(hosts, collectScript(lc.Since, paths, units))
+	if err != nil {
+		return nil, err
+	}
+	remote := make(map[string]string)
+	var ready []string
+	for _, h := range hosts {
+		if e, ok := errs[h]; ok {
+			lc.Failed[h] = e
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(output[h]), "\n")
+		if p := lines[len(lines)-1]; strings.HasSuffix(p, ".tar.gz") {
+			remote[h] = p
+			ready = append(ready, h)
+		} else {
+			lc.Failed[h] = "No log archive created"
+		}
+	}
+	// archives are fetched by the file transport and removed from hosts
+	t := NewTransfer(TransferGet, "", "", ready)
+	t.spools = make(map[string]string)
+	defer func() {
+		for _, f := range t.spools {
+			os.Remove(f)
+		}
+	}()
+	if err = t.initClient(); err != nil {
+		return nil, err
+	}
+	t.batch(func(h Host, tr Transport, c *ssh.Client) error {
+		defer tr.Remove(remote[h.Alias])
+		f, err := tr.Open(remote[h.Alias])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		spool, err := ioutil.TempFile("", "optool-logs-")
+		if err != nil {
+			return err
+		}
+		defer spool.Close()
+		t.Lock.Lock()
+		t.spools[h.Alias] = spool.Name()
+		t.Lock.Unlock()
+		_, err = copyBuffer(spool, f)
+		return err
+	})
+	for _, tr := range t.Transports {
+		tr.Close()
+	}
+	for _, c := range t.Clients {
+		releaseClient(c)
+	}
+	for h, e := range t.Errors {
+		lc.Failed[h] = e.Error()
+	}
+	return lc, lc.write(out, t.spools)
+}
+
+// write pack archives of hosts into out under a dir per host, collect.json describing the bundle comes last
+func (lc *LogCollect) write(out string, spools map[string]string) error {
+	tmp := runTemp(out, "new")
+	defer os.Remove(tmp)
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	gw := gzip.NewWriter(fd)
+	tw := tar.NewWriter(gw)
+	for _, h := range lc.Hosts {
+		if _, failed := lc.Failed[h]; failed || spools[h] == "" {
+			continue
+		}
+		n, err := copyHostLogs(tw, spools[h], strings.NewReplacer("/", "-", ":", "-").Replace(h))
+		if err != nil {
+			lc.Failed[h] = err.Error()
+		}
+		lc.Files[h] = n
+	}
+	doc, err := json.MarshalIndent(lc, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: "collect.json", Mode: 0644, Size: int64(len(doc)), ModTime: lc.Created})
+	if err == nil {
+		_, err = tw.Write(doc)
+	}
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, out)
+}
+
+// copyHostLogs copy files of archive of a host into tw under dir, returns number of files
+func copyHostLogs(tw *tar.Writer, archive, dir string) (int, error) {
+	fd, err := os.Open(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	gr, err := gzip.NewReader(fd)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gr)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean("/" + hdr.Name)
+		hdr.Name = dir + name
+		if err = tw.WriteHeader(hdr); err != nil {
+			return n, err
+		}
+		if _, err = copyBuffer(tw, tr); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -3,11 +3,11 @@ package common
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,7 +18,6 @@ import (
 // RemoteCommand remote command structure
 type RemoteCommand struct {
 	lock     sync.Mutex
-	wg       *sync.WaitGroup
 	Hosts    []string
 	Cmd      string
 	PipeMode bool
@@ -31,6 +30,7 @@ type RemoteCommand struct {
 	Output  map[string]string
 	Error   map[string]string
 	Running map[string]*ssh.Session
+	Dialer  Dialer
 }
 
 // NewRemoteCommand prepare a remote execution
@@ -40,7 +40,6 @@ func NewRemoteCommand(hosts []string, cmd string) *RemoteCommand {
 	}
 	return &RemoteCommand{
 		lock:      sync.Mutex{},
-		wg:        &sync.WaitGroup{},
 		Hosts:     hosts,
 		Cmd:       cmd,
 		Output:    make(map[string]string),
@@ -50,14 +49,19 @@ func NewRemoteCommand(hosts []string, cmd string) *RemoteCommand {
 		PipeOut:   make(map[string]io.Reader),
 		PipeError: make(map[string]io.Reader),
 		PipeChan:  make(chan bool),
+		Dialer:    DefaultDialer,
 	}
 }
 
 // Start run remote command
 func (rc *RemoteCommand) Start() (err error) {
+	if err = CheckCommand(rc.Hosts, rc.Cmd); err != nil {
+		return err
+	}
 	cfg := &ssh.ClientConfig{
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         time.Second * 10,
+		ClientVersion:   sshClientVersion(),
+		Timeout:         CommandTimeout,
 	}
 	if C.Auth.User != "" {
 		cfg.User = C.Auth.User
@@ -66,63 +70,178 @@ func (rc *RemoteCommand) Start() (err error) {
 			return err
 		}
 	}
-	for _, host := range rc.Hosts {
-		rc.wg.Add(1)
-		//L.Info("host=", host)
-		go rc.execute(host, cfg)
+	hosts, skipped := SkipUnreachable(rc.Hosts)
+	for h, e := range skipped {
+		rc.Error[h] = e.Error()
+		hostLogf(h, "$ %s\nskipped: %s", rc.Cmd, e)
 	}
+	done := make(chan map[string]error)
+	go func() {
+		errs := RunHosts(hosts, func(ctx context.Context, host string) error {
+			hostLogf(host, "$ %s", rc.Cmd)
+			err := rc.execute(host, cfg)
+			rc.logResult(host, err)
+			return err
+		})
+		// saved before Start returns, callers may exit right after
+		SaveReachability()
+		done <- errs
+	}()
 	if rc.PipeMode {
 		rc.PipeChan <- true
 	}
-	rc.wg.Wait()
+	for h, e := range <-done {
+		rc.lock.Lock()
+		if _, ok := rc.Error[h]; !ok {
+			rc.Error[h] = e.Error()
+		}
+		rc.lock.Unlock()
+	}
 	return nil
 }
 
 // execute execute command at host
-func (rc *RemoteCommand) execute(host string, cfg *ssh.ClientConfig) {
-	ohost := host
-	if strings.Index(host, ":") < 0 {
-		host = host + ":" + strconv.Itoa(C.Server.DefaultPort)
-	}
-	client, err := ssh.Dial("tcp", host, cfg)
-	if err != nil {
+func (rc *RemoteCommand) execute(ohost string, cfg *ssh.ClientConfig) error {
+	h := ParseHost(ohost)
+	switch h.Type {
+	case HostLocal:
+		return rc.executeLocal(ohost)
+	case HostSSH, HostDocker:
+	case HostWinRM, HostWinRMS:
+		return rc.executeWinRM(h)
+	case HostNetDev, HostTelnet:
+		o, e := runNetDev(h, cfg, rc.Dialer, rc.Cmd)
 		rc.lock.Lock()
-		rc.Error[ohost] = err.Error()
+		rc.Output[ohost] = o
 		rc.lock.Unlock()
-		rc.wg.Done()
-		return
+		return e
+	case HostFTP, HostFTPS:
+		return fmt.Errorf("Commands are not supported by %s hosts", h.Type)
+	default:
+		return fmt.Errorf("Unknown host type: %s", h.Type)
+	}
+	ts := time.Now()
+	client, fresh, err := sharedClient(rc.Dialer, h.Addr(), cfg)
+	if fresh {
+		RecordReach(ohost, time.Now().Sub(ts), err)
 	}
-	defer client.Close()
+	if err != nil {
+		return err
+	}
+	defer releaseClient(client)
 	sess, err := client.NewSession()
 	if err != nil {
-		rc.lock.Lock()
-		rc.Error[ohost] = err.Error()
-		rc.lock.Unlock()
-		return
+		return err
 	}
 	defer sess.Close()
-	var o []byte
-	var e error
+	rec := startRecording(ohost, rc.Cmd)
 	// @todo std pipes
 	if rc.PipeMode {
+		rc.lock.Lock()
 		rc.Running[ohost] = sess
 		//rc.PipeIn[ohost], e = sess.StdinPipe()
-		rc.PipeOut[ohost], e = sess.StdoutPipe()
-		rc.PipeError[ohost], e = sess.StderrPipe()
-		e = sess.Start(rc.Cmd)
-		e = sess.Wait()
-		rc.wg.Done()
+		rc.PipeOut[ohost], _ = sess.StdoutPipe()
+		rc.PipeError[ohost], _ = sess.StderrPipe()
+		if rec != nil {
+			rc.PipeOut[ohost] = io.TeeReader(rc.PipeOut[ohost], rec.output())
+			rc.PipeError[ohost] = io.TeeReader(rc.PipeError[ohost], rec.output())
+		}
+		rc.lock.Unlock()
+		if err = sess.Start(becomeCommand(sess, h.remoteCommand(rc.Cmd))); err != nil {
+			return err
+		}
+		err = sess.Wait()
+		if rec != nil {
+			rec.end(err)
+		}
+		return err
+	}
+	var o bytes.Buffer
+	sess.Stdout = &o
+	if rec != nil && !C.Gzip {
+		sess.Stdout = io.MultiWriter(&o, rec.output())
+	}
+	if rec != nil {
+		sess.Stderr = rec.output()
+	}
+	e := sess.Run(becomeCommand(sess, h.remoteCommand(rc.Cmd)))
+	//L.Debugf("RemoteCommand: [%s] cmd=%s, output=%s, error=%s\n", ohost, rc.Cmd, o.String(), e)
+	if rec != nil {
+		if C.Gzip {
+			rec.line(fmt.Sprintf("(%d bytes of gzipped output)\n", o.Len()))
+		}
+		rec.end(e)
+	}
+	rc.lock.Lock()
+	rc.Output[ohost] = o.String()
+	rc.lock.Unlock()
+	return e
+}
+
+// becomeCommand wrap cmd in sudo if become is set. the password is written to stdin of sess, never into the command,
+// and -k makes sudo always read it so that it is not left to the command
+func becomeCommand(sess *ssh.Session, cmd string) string {
+	if !C.Become {
+		return cmd
+	}
+	if C.BecomePassword == "" {
+		return "sudo -n -- sh -c " + shellQuote(cmd)
+	}
+	sess.Stdin = strings.NewReader(C.BecomePassword + "\n")
+	return "sudo -S -k -p '' -- sh -c " + shellQuote(cmd)
+}
+
+// logResult log output and exit status of command into log file of host
+func (rc *RemoteCommand) logResult(host string, err error) {
+	rc.lock.Lock()
+	o := rc.Output[host]
+	rc.lock.Unlock()
+	switch {
+	case rc.PipeMode:
+	case C.Gzip && o != "":
+		hostLogf(host, "(%d bytes of gzipped output)", len(o))
+	case o != "":
+		hostLogf(host, "%s", o)
+	}
+	if err != nil {
+		hostLogf(host, "failed: %s", err)
 		return
 	}
-	o, e = sess.Output(rc.Cmd)
-	//L.Debugf("RemoteCommand: [%s] cmd=%s, output=%s, error=%s\n", ohost, rc.Cmd, string(o), e)
+	hostLogf(host, "ok")
+}
+
+// executeLocal execute command at local host
+func (rc *RemoteCommand) executeLocal(ohost string) error {
+	cmd := localCommand(rc.Cmd)
+	if rc.PipeMode {
+		rc.lock.Lock()
+		rc.PipeOut[ohost], _ = cmd.StdoutPipe()
+		rc.PipeError[ohost], _ = cmd.StderrPipe()
+		rc.lock.Unlock()
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		return cmd.Wait()
+	}
+	o, e := cmd.Output()
 	rc.lock.Lock()
 	rc.Output[ohost] = string(o)
-	if e != nil {
-		rc.Error[ohost] = e.Error()
+	rc.lock.Unlock()
+	return e
+}
+
+// executeWinRM execute command at windows host by powershell
+func (rc *RemoteCommand) executeWinRM(h Host) error {
+	ws, err := dialWinRM(h)
+	if err != nil {
+		return err
 	}
+	defer ws.Close()
+	o, e := ws.Output(rc.Cmd)
+	rc.lock.Lock()
+	rc.Output[h.Alias] = string(o)
 	rc.lock.Unlock()
-	rc.wg.Done()
+	return e
 }
 
 // ClosePipe close ssh sessions
@@ -149,7 +268,10 @@ func (rc *RemoteCommand) PrettyPrint(wo io.Writer, we io.Writer, noHeader bool,
 		}
 	}
 	if len(rc.Output) > 0 {
-		if !noHeader {
+		if CI != "" {
+			// output of many hosts is folded, errors above stay visible
+			defer CIGroup(wo, fmt.Sprintf("Output of %d host(s)", len(rc.Output)))()
+		} else if !noHeader {
 			fmt.Fprintln(wo, "================================= OUTPUT =================================")
 		}
 		for h, o := range rc.Output {
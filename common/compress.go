@@ -0,0 +1,222 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Compression codecs of extract puts
+const (
+	CodecZstd = "zstd"
+	CodecLZ4  = "lz4"
+	CodecGzip = "gzip"
+	CodecNone = "none"
+)
+
+// DefaultCodecs codecs of extract puts in order of preference
+var DefaultCodecs = []string{CodecZstd, CodecLZ4, CodecGzip}
+
+// codecMagic leading bytes of streams of codecs
+var codecMagic = map[string][]byte{
+	CodecZstd: {0x28, 0xb5, 0x2f, 0xfd},
+	CodecLZ4:  {0x04, 0x22, 0x4d, 0x18},
+	CodecGzip: {0x1f, 0x8b},
+}
+
+// detectCodec get codec of a stream by its leading bytes, none if not compressed by a known codec
+func detectCodec(head []byte) string {
+	for codec, magic := range codecMagic {
+		if bytes.HasPrefix(head, magic) {
+			return codec
+		}
+	}
+	return CodecNone
+}
+
+// decompressCommand shell command decompressing stdin of codec to stdout, empty if it needs none
+func decompressCommand(codec string) string {
+	switch codec {
+	case CodecZstd:
+		return "zstd -dcq"
+	case CodecLZ4:
+		return "lz4 -dcq"
+	case CodecGzip:
+		return "gzip -dc"
+	}
+	return ""
+}
+
+// codecs get configured codecs of extract puts in order of preference
+func codecs() []string {
+	if len(C.Compression) > 0 {
+		return C.Compression
+	}
+	return DefaultCodecs
+}
+
+// localCodec check if codec can compress here, gzip is built in
+func localCodec(codec string) bool {
+	switch codec {
+	case CodecGzip, CodecNone:
+		return true
+	case CodecZstd, CodecLZ4:
+		_, err := exec.LookPath(codec)
+		return err == nil
+	}
+	return false
+}
+
+// negotiateCodec pick the first configured codec available both here and on host, found by command -v there.
+// gzip is used if the probe fails, as extract puts always required it
+func negotiateCodec(h Host, c *ssh.Client) string {
+	var probe []string
+	for _, codec := range codecs() {
+		if codec != CodecNone && localCodec(codec) {
+			probe = append(probe, codec)
+		}
+	}
+	if len(probe) == 0 {
+		return CodecNone
+	}
+	cmd := "for c in " + strings.Join(probe, " ") + "; do command -v $c >/dev/null 2>&1 && echo $c; done; true"
+	var out []byte
+	var err error
+	switch {
+	case h.Type == HostLocal:
+		out, err = localCommand(cmd).Output()
+	case c != nil:
+		var sess *ssh.Session
+		if sess, err = c.NewSession(); err == nil {
+			out, err = sess.Output(cmd)
+			sess.Close()
+		}
+	default:
+		return CodecGzip
+	}
+	if err != nil {
+		return CodecGzip
+	}
+	remote := make(map[string]bool)
+	for _, codec := range strings.Fields(string(out)) {
+		remote[codec] = true
+	}
+	for _, codec := range codecs() {
+		if codec == CodecNone || remote[codec] {
+			return codec
+		}
+	}
+	return CodecGzip
+}
+
+// execCompressor compress by a local command, closed once the command exits
+type execCompressor struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func (ec *execCompressor) Write(p []byte) (int, error) {
+	return ec.stdin.Write(p)
+}
+
+func (ec *execCompressor) Close() error {
+	if err := ec.stdin.Close(); err != nil {
+		return err
+	}
+	return ec.cmd.Wait()
+}
+
+// compressWriter get writer compressing into w by codec
+func compressWriter(w io.Writer, codec string) (io.WriteCloser, error) {
+	switch codec {
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecZstd, CodecLZ4:
+		args := []string{"-cq"}
+		if codec == CodecZstd {
+			args = append(args, "-T0")
+		}
+		cmd := exec.Command(codec, args...)
+		cmd.Stdout = w
+		cmd.Stderr = Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &execCompressor{cmd: cmd, stdin: stdin}, nil
+	case CodecNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("Unknown compression: %s", codec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// writeArchive write local dir as a tar stream compressed by codec into w, names are relative to dir
+func writeArchive(w io.Writer, dir, codec string) error {
+	cw, err := compressWriter(w, codec)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		fd, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		_, err = copyBuffer(tw, fd)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -17,6 +17,10 @@ type AuthConfig struct {
 	PrivateKeyContent string `yaml:"private_key_content"`
 	PrivateKeyPhrase  string `yaml:"private_key_phrase"`
 	PlainPassword     bool   `yaml:"plain_password"` // 是否是明文的密码(通用password和phrase)
+	AskedPassword     string `yaml:"-"`              // entered by -ask-pass, replaces password
+	// names of credentials in the OS keychain, stored by optool credential set, used instead of the values above
+	PasswordCredential         string `yaml:"password_credential"`
+	PrivateKeyPhraseCredential string `yaml:"private_key_phrase_credential"`
 }
 
 // Configure global configure
@@ -27,7 +31,51 @@ type Configure struct {
 	Tags map[string]string `yaml:"tags"` // shortcut for frequently used commands
 	Gzip bool              `yaml:"-"`    // enable gzip transfer
 	//DefaultGroup string              `yaml:"default_group"` // set default host group
-	TransferMaxSize int64 `yaml:"transfer_max_size"`
+	TransferMaxSize int64                 `yaml:"transfer_max_size"`
+	TransferDirMode uint32                `yaml:"transfer_dir_mode"` // mode of remote dirs created by recursive put, default 0755
+	TransferUmask   uint32                `yaml:"transfer_umask"`    // mask of remote dir and file modes, eg. 0022
+	TransferBuffer  int                   `yaml:"transfer_buffer"`   // copy buffer size of a transfer in bytes, default 32KB
+	Compression     []string              `yaml:"compression"`       // codecs of extract puts of dirs by preference, default zstd, lz4, gzip
+	Deploy          DeployConfig          `yaml:"deploy"`
+	Cache           CacheConfig           `yaml:"cache"`
+	Concurrency     int                   `yaml:"concurrency"` // max hosts run at the same time, 0 for unlimited
+	Retries         int                   `yaml:"retries"`     // dial retries of transfers
+	Profiles        map[string]Profile    `yaml:"profiles"`    // named transfers run by `run <profile>`
+	Pipelines       map[string]Pipeline   `yaml:"pipelines"`   // stages of groups run by `pipeline <name>`
+	Update          UpdateConfig          `yaml:"update"`
+	FTP             FTPConfig             `yaml:"ftp"`
+	WinRM           WinRMConfig           `yaml:"winrm"`
+	NetDev          NetDevConfig          `yaml:"netdev"`
+	Reachability    ReachConfig           `yaml:"reachability"`
+	Consul          ConsulConfig          `yaml:"consul"`
+	Bootstrap       BootstrapConfig       `yaml:"bootstrap"`
+	GitHub          GitHubConfig          `yaml:"github"`
+	EnvFile         EnvFileConfig         `yaml:"env_file"`
+	Email           EmailConfig           `yaml:"email"`
+	Alert           AlertConfig           `yaml:"alert"`
+	Change          ChangeConfig          `yaml:"change"`
+	Approval        ApprovalConfig        `yaml:"approval"`
+	RBAC            RBACConfig            `yaml:"rbac"`
+	Bundle          BundleConfig          `yaml:"bundle"`
+	Mux             MuxConfig             `yaml:"mux"`
+	Ramp            RampConfig            `yaml:"ramp"`
+	SFTP            SFTPConfig            `yaml:"sftp"`
+	SSH             SSHConfig             `yaml:"ssh"`
+	Policy          PolicyConfig          `yaml:"policy"`
+	Silence         SilenceConfig         `yaml:"silence"`
+	Clock           ClockConfig           `yaml:"clock"`
+	Configs         map[string]ConfigFile `yaml:"configs"`
+	Certs           map[string]CertConfig `yaml:"certs"`
+	ACME            ACMEConfig            `yaml:"acme"`
+	HostLogDir      string                `yaml:"host_log_dir"` // log commands, transfers and output of every host into <dir>/<run id>/<host>.log
+	Exclude         []string              `yaml:"exclude"`      // hosts skipped by all runs, ranges like web[3-7] are expanded
+	Record          string                `yaml:"record"`       // record remote commands and output of every host: asciicast or typescript
+	DedupeHosts     bool                  `yaml:"dedupe_hosts"` // skip hosts with the same ssh host key as an earlier host
+	Force           bool                  `yaml:"-"`            // dial hosts skipped as recently unreachable
+	Become          bool                  `yaml:"become"`       // run commands on ssh hosts as root by sudo
+	BecomePassword  string                `yaml:"-"`            // sudo password entered by -ask-become-pass
+	Transport       string                `yaml:"transport"`    // file transport: sftp(default) or scp
+	MinVersion      string                `yaml:"min_version"`  // warn if running optool is older
 }
 
 // Server server groups and default port/group config
@@ -44,7 +92,7 @@ func init() {
 	C = &Configure{}
 }
 
-// ParseConfig parse configure file
+// ParseConfig parse configure file, rbac comes from RBACFile if it exists
 func ParseConfig(f string) error {
 	s, err := ioutil.ReadFile(f)
 	if err != nil {
@@ -54,7 +102,53 @@ func ParseConfig(f string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return loadRBACFile()
+}
+
+// credentials get user and decrypted password of a service, auth user and password are used if user is empty
+func credentials(user, password string) (string, string) {
+	if user == "" {
+		user, password = C.Auth.User, C.Auth.Password
+	}
+	if !C.Auth.PlainPassword {
+		password = string(Decrypt(password))
+	}
+	return user, password
+}
+
+// privateKeyPhrase passphrase of auth private key, nil if it has none
+func privateKeyPhrase() ([]byte, error) {
+	if C.Auth.PrivateKeyPhraseCredential != "" {
+		passphrase, err := Credential(C.Auth.PrivateKeyPhraseCredential)
+		return []byte(passphrase), err
+	}
+	if C.Auth.PrivateKeyPhrase == "" {
+		return nil, nil
+	}
+	if !C.Auth.PlainPassword {
+		return Decrypt(C.Auth.PrivateKeyPhrase), nil
+	}
+	return []byte(C.Auth.PrivateKeyPhrase), nil
+}
+
+// parsePrivateKey read private key file f, encrypted by the auth passphrase if one is set
+func parsePrivateKey(f string) (ssh.Signer, error) {
+	keyFile := expandHome(f)
+	if _, err := os.Stat(keyFile); err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := privateKeyPhrase()
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == nil {
+		return ssh.ParsePrivateKey(key)
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
 }
 
 // GetAuth get auth method list from configs
@@ -63,29 +157,26 @@ func GetAuth() (auth []ssh.AuthMethod, err error) {
 	if !C.Auth.PlainPassword {
 		password = string(Decrypt(C.Auth.Password))
 	}
-	if C.Auth.PrivateKey != "" {
-		if _, err := os.Stat(C.Auth.PrivateKey); err != nil {
+	if C.Auth.PasswordCredential != "" {
+		if password, err = Credential(C.Auth.PasswordCredential); err != nil {
 			return nil, err
 		}
-		key, err := ioutil.ReadFile(C.Auth.PrivateKey)
+	}
+	if C.Auth.AskedPassword != "" {
+		password = C.Auth.AskedPassword
+	}
+	if C.Auth.PrivateKey != "" {
+		signer, err := parsePrivateKey(C.Auth.PrivateKey)
 		if err != nil {
 			return nil, err
 		}
-		var signer ssh.Signer
-		if C.Auth.PrivateKeyPhrase == "" {
-			signer, err = ssh.ParsePrivateKey(key)
-		} else {
-			passphrase := []byte(C.Auth.PrivateKeyPhrase)
-			if !C.Auth.PlainPassword {
-				passphrase = Decrypt(C.Auth.PrivateKeyPhrase)
-			}
-			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
-		}
-		if err != nil {
-			return nil, err
+		signers := []ssh.Signer{signer}
+		if other := rotationSigner(); other != nil {
+			// hosts of an unfinished key rotation accept only one of its keys
+			signers = append(signers, other)
 		}
 		auth = []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
+			ssh.PublicKeys(signers...),
 		}
 		if password != "" {
 			auth = append(auth, ssh.Password(password))
@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"runtime"
 	"strings"
 )
@@ -51,3 +52,11 @@ func homeDir() string {
 	}
 	return strings.TrimSpace(string(output))
 }
+
+// expandHome replace leading ~/ of local path with home dir, ~\ too on windows
+func expandHome(p string) string {
+	if strings.HasPrefix(p, "~/") || (runtime.GOOS == "windows" && strings.HasPrefix(p, `~\`)) {
+		return filepath.Join(homeDir(), p[2:])
+	}
+	return p
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ConfigFile config file rendered from a local template, validated on hosts before it is live and reloaded
+type ConfigFile struct {
+	Local    string            `yaml:"local"`    // template, {group}, {run_id} and vars are replaced
+	Remote   string            `yaml:"remote"`   // eg. /etc/nginx/conf.d/app.conf
+	Mode     uint32            `yaml:"mode"`     // default 0644
+	Vars     map[string]string `yaml:"vars"`     // {group} and {run_id} are replaced
+	Validate string            `yaml:"validate"` // eg. haproxy -c -f {file} checks the new file before the swap, nginx -t without {file} checks after it
+	Reload   string            `yaml:"reload"`   // run after the new file is validated, eg. systemctl reload nginx
+}
+
+// RenderConfig render config file name of configure for group
+func RenderConfig(name, group string) (string, error) {
+	cf, ok := C.Configs[name]
+	if !ok {
+		return "", fmt.Errorf("No such config: %s", name)
+	}
+	if cf.Local == "" || cf.Remote == "" {
+		return "", fmt.Errorf("Config %s requires local and remote", name)
+	}
+	data, err := ioutil.ReadFile(expandHome(cf.Local))
+	if err != nil {
+		return "", err
+	}
+	tv := map[string]string{"group": group, "run_id": RunID}
+	vars := make(map[string]string)
+	for k, v := range cf.Vars {
+		vars[k] = ExpandVars(v, tv)
+	}
+	for k, v := range tv {
+		vars[k] = v
+	}
+	return ExpandVars(string(data), vars), nil
+}
+
+// configScript swap new file of cf into place on a host, rolling it back if validation fails. it prints unchanged
+// or reloaded, output of validation and reload goes to stdout
+func configScript(cf ConfigFile, tmp string) string {
+	f, n, old := shellQuote(cf.Remote), shellQuote(tmp), shellQuote(runTemp(cf.Remote, "old"))
+	var b strings.Builder
+	b.WriteString("exec 2>&1\n")
+	fmt.Fprintf(&b, "if cmp -s %s %s; then rm -f %s; echo unchanged; exit 0; fi\n", n, f, n)
+	if strings.Contains(cf.Validate, "{file}") {
+		fmt.Fprintf(&b, "{ %s\n} || { rm -f %s; echo 'validation failed, file kept'; exit 1; }\n",
+			ExpandVars(cf.Validate, map[string]string{"file": n}), n)
+	}
+	fmt.Fprintf(&b, "rm -f %s\n", old)
+	fmt.Fprintf(&b, "if [ -e %s ]; then cp -p %s %s || exit 1; fi\n", f, f, old)
+	fmt.Fprintf(&b, "mv -f %s %s || exit 1\n", n, f)
+	if cf.Validate != "" && !strings.Contains(cf.Validate, "{file}") {
+		// validators of the whole service config only see the file in place
+		fmt.Fprintf(&b, "{ %s\n} || { if [ -e %s ]; then mv -f %s %s; else rm -f %s; fi; echo 'validation failed, file rolled back'; exit 1; }\n",
+			cf.Validate, old, old, f, f)
+	}
+	fmt.Fprintf(&b, "rm -f %s\n", old)
+	if cf.Reload != "" {
+		fmt.Fprintf(&b, "{ %s\n} || { echo 'reload failed'; exit 1; }\n", cf.Reload)
+	}
+	b.WriteString("echo reloaded\n")
+	return b.String()
+}
+
+// PushConfig render config file name for group, upload it next to its remote path of hosts, validate it and swap it
+// into place, and reload. hosts whose file is unchanged are not reloaded. output and errors are keyed by host
+func PushConfig(hosts []string, name, group string) (map[string]string, map[string]string, error) {
+	content, err := RenderConfig(name, group)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = CheckClocks(hosts, "config "+name); err != nil {
+		return nil, nil, err
+	}
+	cf := C.Configs[name]
+	f, err := ioutil.TempFile("", "optool-config-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	mode := cf.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	tmp := runTemp(cf.Remote, "new")
+	t := NewTransfer(TransferPut, f.Name(), tmp, hosts)
+	t.Override = true
+	t.Mode = os.FileMode(mode)
+	err = t.Start()
+	errs := make(map[string]string)
+	for h, e := range t.Errors {
+		errs[h] = e.Error()
+	}
+	if err != nil && len(errs) == 0 {
+		return nil, nil, err
+	}
+	var uploaded []string
+	for _, h := range hosts {
+		if _, ok := errs[h]; !ok {
+			uploaded = append(uploaded, h)
+		}
+	}
+	if len(uploaded) == 0 {
+		return nil, errs, nil
+	}
+	output, rerrs, err := RunRemote(uploaded, configScript(cf, tmp))
+	if err != nil {
+		return nil, nil, err
+	}
+	for h, e := range rerrs {
+		errs[h] = e
+	}
+	return output, errs, nil
+}
+
+// PrintConfigResult print output of config push of every host
+func PrintConfigResult(hosts []string, output, errs map[string]string) {
+	for _, h := range hosts {
+		for _, line := range strings.Split(strings.TrimSpace(output[h]), "\n") {
+			if line != "" {
+				fmt.Fprintf(Stdout, "%21s: %s\n", h, line)
+			}
+		}
+		if e, ok := errs[h]; ok {
+			fmt.Fprintf(Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Controls of a running rollout, given by optool pause|resume|abort <run id> from another terminal
+const (
+	ControlPause  = "pause"  // stop after the current batch or step until resumed
+	ControlResume = "resume" // go on after a pause
+	ControlAbort  = "abort"  // stop after the current batch or step, rolling deploys roll back
+)
+
+// ControlPollInterval interval of checking controls of a paused run
+var ControlPollInterval = time.Second
+
+// ErrAborted run stopped by optool abort
+var ErrAborted = errors.New("Aborted by optool abort")
+
+// SetControl pause, resume or abort run from another terminal
+func SetControl(runID, control string) error {
+	if control != ControlPause && control != ControlResume && control != ControlAbort {
+		return fmt.Errorf("Unknown control: %s", control)
+	}
+	rec, err := LoadRunRecord(runID)
+	if err != nil {
+		return err
+	}
+	if !rec.Finished.IsZero() {
+		return fmt.Errorf("Run %s is finished", runID)
+	}
+	return saveState(filepath.Join("control", runID), control)
+}
+
+// readControl get control of this run, empty if none
+func readControl() string {
+	var control string
+	loadState(filepath.Join("control", RunID), &control)
+	return control
+}
+
+// CheckControl wait while this run is paused, called between batches and steps. ErrAborted is returned if it
+// is aborted
+func CheckControl(where string) error {
+	paused := false
+	for {
+		switch readControl() {
+		case ControlAbort:
+			return ErrAborted
+		case ControlPause:
+			if !paused {
+				paused = true
+				fmt.Fprintf(Stdout, "Paused before %s, optool resume %s or optool abort %s\n", where, RunID, RunID)
+			}
+			time.Sleep(ControlPollInterval)
+			continue
+		}
+		if paused {
+			fmt.Fprintf(Stdout, "Resumed before %s\n", where)
+		}
+		return nil
+	}
+}
+
+// RemoveControl remove control of this run once it finished
+func RemoveControl() {
+	if readControl() != "" {
+		deleteState(filepath.Join("control", RunID))
+	}
+}
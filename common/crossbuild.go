@@ -0,0 +1,130 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// GoBuildConfig configures cross compilation of local go project
+type GoBuildConfig struct {
+	Package string `yaml:"package"` // package to build, default .
+	Output  string `yaml:"output"`  // binary name and remote file name under deploy.root
+	Flags   string `yaml:"flags"`   // extra go build flags, eg. -ldflags="-w -s"
+}
+
+var unameOS = map[string]string{
+	"Linux":   "linux",
+	"Darwin":  "darwin",
+	"FreeBSD": "freebsd",
+	"OpenBSD": "openbsd",
+	"NetBSD":  "netbsd",
+}
+
+var unameArch = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv7l":  "arm",
+	"armv6l":  "arm",
+	"i386":    "386",
+	"i686":    "386",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// DetectPlatforms detect GOOS/GOARCH of hosts by uname
+// returns platform => hosts and errors keyed by host
+func DetectPlatforms(hosts []string) (map[string][]string, map[string]string, error) {
+	out, errs, err := RunRemote(hosts, "uname -s -m")
+	if err != nil {
+		return nil, nil, err
+	}
+	platforms := make(map[string][]string)
+	for _, h := range hosts {
+		if _, ok := errs[h]; ok {
+			continue
+		}
+		f := strings.Fields(out[h])
+		if len(f) != 2 || unameOS[f[0]] == "" || unameArch[f[1]] == "" {
+			errs[h] = "Unsupported platform: " + strings.TrimSpace(out[h])
+			continue
+		}
+		p := unameOS[f[0]] + "/" + unameArch[f[1]]
+		platforms[p] = append(platforms[p], h)
+	}
+	return platforms, errs, nil
+}
+
+// CrossBuild build go binary for platform(GOOS/GOARCH), returns the binary path
+func CrossBuild(platform string) (string, error) {
+	gc := C.Deploy.GoBuild
+	if gc.Output == "" {
+		return "", errors.New("deploy.go_build.output is not configured")
+	}
+	pkg := gc.Package
+	if pkg == "" {
+		pkg = "."
+	}
+	p := strings.Split(platform, "/")
+	binary := gc.Output + "_" + p[0] + "_" + p[1]
+	cmd := localCommand("go build " + gc.Flags + " -o " + binary + " " + pkg)
+	cmd.Env = append(os.Environ(), "GOOS="+p[0], "GOARCH="+p[1], "CGO_ENABLED=0")
+	cmd.Stdout = Stdout
+	cmd.Stderr = Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Build %s: %s", platform, err)
+	}
+	return binary, nil
+}
+
+// CrossDeploy build binary for every detected platform and deploy the matching one to each host
+// returns platform of every deployed host and errors keyed by host
+func CrossDeploy(hosts []string) (map[string]string, map[string]string, error) {
+	if C.Deploy.Root == "" {
+		return nil, nil, errors.New("deploy.root is not configured")
+	}
+	platforms, errs, err := DetectPlatforms(hosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	deployed := make(map[string]string)
+	remote := path.Join(C.Deploy.Root, filepath.Base(C.Deploy.GoBuild.Output))
+	for p, phosts := range platforms {
+		binary, err := CrossBuild(p)
+		if err != nil {
+			return deployed, errs, err
+		}
+		perrs, err := PutArtifact(phosts, binary, remote)
+		if err != nil {
+			return deployed, errs, err
+		}
+		var uploaded []string
+		for _, h := range phosts {
+			if e, ok := perrs[h]; ok {
+				errs[h] = e
+			} else {
+				uploaded = append(uploaded, h)
+			}
+		}
+		if C.Deploy.Activate != "" && len(uploaded) > 0 {
+			_, aerrs, err := RunRemote(uploaded, ExpandVars(C.Deploy.Activate, map[string]string{"dir": C.Deploy.Root}))
+			if err != nil {
+				return deployed, errs, err
+			}
+			for h, e := range aerrs {
+				errs[h] = e
+			}
+		}
+		for _, h := range phosts {
+			if _, ok := errs[h]; !ok {
+				deployed[h] = p
+			}
+		}
+	}
+	return deployed, errs, nil
+}
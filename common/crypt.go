@@ -29,7 +29,7 @@ func Encrypt(s string) string {
 func Decrypt(s string) []byte {
 	dec, err := base64.URLEncoding.DecodeString(s)
 	if err != nil {
-		fmt.Println("Decode string ", s, "err:", err)
+		fmt.Fprintln(Stdout, "Decode string ", s, "err:", err)
 		os.Exit(1)
 	}
 	return xxtea.Decrypt(dec, getUUID())
@@ -42,7 +42,7 @@ func getUUID() []byte {
 	}
 	UUID, err := ioutil.ReadFile(UUIDPath)
 	if err != nil || len(UUID) < 10 {
-		fmt.Println("ERROR read UUID", err)
+		fmt.Fprintln(Stdout, "ERROR read UUID", err)
 	}
 	return append(UUID, appended...)
 }
@@ -50,13 +50,13 @@ func getUUID() []byte {
 func genUUID() {
 	b := make([]byte, 48)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
-		fmt.Println("Get Random UUID failed.", err)
+		fmt.Fprintln(Stdout, "Get Random UUID failed.", err)
 		os.Exit(1)
 	}
 	h := md5.New()
 	h.Write([]byte(base64.URLEncoding.EncodeToString(b)))
 	if err := ioutil.WriteFile(UUIDPath, []byte(hex.EncodeToString(h.Sum(nil))), 0700); err != nil {
-		fmt.Println("Write UUID failed. ", err)
+		fmt.Fprintln(Stdout, "Write UUID failed. ", err)
 		os.Exit(2)
 	}
 }
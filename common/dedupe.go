@@ -0,0 +1,77 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errHostKeyScanned abort handshake once host key is received, no auth is needed to scan it
+var errHostKeyScanned = errors.New("Host key scanned")
+
+// HostKeys get sha256 fingerprints of host keys of ssh hosts, other hosts are left out
+func HostKeys(hosts []string) (map[string]string, map[string]error) {
+	keys := make(map[string]string)
+	lock := sync.Mutex{}
+	var scan []string
+	for _, h := range hosts {
+		if ParseHost(h).Type == HostSSH {
+			scan = append(scan, h)
+		}
+	}
+	errs := RunHosts(scan, func(ctx context.Context, h string) error {
+		cfg := &ssh.ClientConfig{
+			User:          C.Auth.User,
+			Timeout:       10 * time.Second,
+			ClientVersion: sshClientVersion(),
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				lock.Lock()
+				keys[h] = ssh.FingerprintSHA256(key)
+				lock.Unlock()
+				return errHostKeyScanned
+			},
+		}
+		client, err := DefaultDialer.Dial("tcp", ParseHost(h).Addr(), cfg)
+		if err == nil {
+			// dialers not verifying host keys
+			client.Close()
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if _, ok := keys[h]; !ok {
+			if err == nil {
+				err = errors.New("Host key not received")
+			}
+			return err
+		}
+		return nil
+	})
+	return keys, errs
+}
+
+// DedupeHosts remove ssh hosts with the same host key as an earlier host, they are the same machine under another
+// name or address. removed hosts are keyed by the host kept, hosts whose key cannot be scanned are kept
+func DedupeHosts(hosts []string) ([]string, map[string][]string) {
+	keys, _ := HostKeys(hosts)
+	first := make(map[string]string)
+	dups := make(map[string][]string)
+	var unique []string
+	for _, h := range hosts {
+		fp, ok := keys[h]
+		if !ok {
+			unique = append(unique, h)
+			continue
+		}
+		if kept, ok := first[fp]; ok {
+			dups[kept] = append(dups[kept], h)
+			continue
+		}
+		first[fp] = h
+		unique = append(unique, h)
+	}
+	return unique, dups
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StrategyRolling deploy batch by batch
+	StrategyRolling = "rolling"
+	// StrategyBlueGreen deploy to inactive color and flip traffic
+	StrategyBlueGreen = "bluegreen"
+)
+
+// DeployConfig configures for deploy strategies
+type DeployConfig struct {
+	Strategy       string            `yaml:"strategy"`         // rolling,bluegreen used by promote, default rolling
+	Artifact       string            `yaml:"artifact"`         // local file, http(s):// or s3:// url to deploy
+	Mode           uint32            `yaml:"mode"`             // chmod artifact after upload, eg. 0755
+	Verify         string            `yaml:"verify"`           // read back uploaded artifact before activation, all or sample
+	Atomic         bool              `yaml:"atomic"`           // roll back all hosts if any host failed
+	Staged         bool              `yaml:"staged"`           // move artifact into place only after all hosts have it
+	Checksum       string            `yaml:"checksum"`         // expected sha256 of artifact, cached artifact is used without downloading
+	Root           string            `yaml:"root"`             // remote application root
+	Releases       bool              `yaml:"releases"`         // rolling deploy into root/releases/<id> and link root/current to it
+	HardLinks      bool              `yaml:"hard_links"`       // hard link an unchanged artifact from the previous release instead of uploading it
+	SharedPaths    []string          `yaml:"shared_paths"`     // paths under root/shared linked into every release, dirs end with /
+	KeepReleases   int               `yaml:"keep_releases"`    // prune releases beyond the newest ones after deploy, 0 keeps all
+	KeepDays       int               `yaml:"keep_days"`        // prune releases older than days after deploy, 0 keeps all
+	Activate       string            `yaml:"activate"`         // command run after upload, eg. restart service
+	Services       []ServiceConfig   `yaml:"services"`         // restarted in dependency order after activate
+	HealthCheck    string            `yaml:"health_check"`     // command exit with 0 means healthy
+	HealthRetries  int               `yaml:"health_retries"`   // retry times of health check
+	HealthWait     int               `yaml:"health_wait"`      // seconds between health checks
+	BatchSize      int               `yaml:"batch_size"`       // hosts per batch of rolling deploy
+	Adaptive       bool              `yaml:"adaptive"`         // double batch_size after every batch succeeded, halve it after failures
+	MaxBatchSize   int               `yaml:"max_batch_size"`   // cap of adaptive batches, 0 for none
+	MaxFailureRate float64           `yaml:"max_failure_rate"` // share of hosts, eg. 0.05, adaptive deploys may fail and go on, 0 stops at the first failure
+	Canary         CanaryConfig      `yaml:"canary"`           // random hosts deployed first
+	BlueGreen      BlueGreenConfig   `yaml:"blue_green"`
+	LoadBalancer   LBConfig          `yaml:"load_balancer"` // drain hosts during rolling deploy
+	Maintenance    MaintenanceConfig `yaml:"maintenance"`
+	Build          BuildConfig       `yaml:"build"`    // local build before deploy
+	GoBuild        GoBuildConfig     `yaml:"go_build"` // cross compile per host platform
+	Signature      SignatureConfig   `yaml:"signature"`
+	Reboot         RebootConfig      `yaml:"reboot"` // check hosts rebooted since their last deploy
+}
+
+// prepareLock serialize artifact preparation of stages deploying at the same time
+var prepareLock sync.Mutex
+
+// PrepareArtifact build or download artifact, deploy.artifact is set to the local file
+func PrepareArtifact() error {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+	if _, err := Build(); err != nil {
+		return err
+	}
+	if C.Deploy.Artifact == "" {
+		return errors.New("deploy.artifact is not configured")
+	}
+	local, err := FetchArtifact(C.Deploy.Artifact, C.Deploy.Checksum)
+	if err != nil {
+		return err
+	}
+	C.Deploy.Artifact = local
+	return recordArtifact(local)
+}
+
+// PutArtifact upload local file to remote path of hosts, errors are keyed by host
+// err is returned only if the transfer cannot be started at all
+func PutArtifact(hosts []string, local, remote string) (errs map[string]string, err error) {
+	t := NewTransfer(TransferPut, local, remote, hosts)
+	t.Override = true
+	t.Mode = os.FileMode(C.Deploy.Mode)
+	t.Staged = C.Deploy.Staged
+	t.Verify = C.Deploy.Verify
+	err = t.Start()
+	errs = make(map[string]string)
+	for h, e := range t.Errors {
+		errs[h] = e.Error()
+	}
+	if len(errs) > 0 {
+		err = nil
+	}
+	return
+}
+
+// RunRemote run command on hosts and wait for result, output and errors are keyed by host
+func RunRemote(hosts []string, cmd string) (output map[string]string, errs map[string]string, err error) {
+	rc := NewRemoteCommand(hosts, cmd)
+	// internal commands never gzip output
+	rc.Cmd = cmd
+	if err = rc.Start(); err != nil {
+		return nil, nil, err
+	}
+	return rc.Output, rc.Error, nil
+}
+
+// ExpandVars replace {name} in s with vars
+func ExpandVars(s string, vars map[string]string) string {
+	for k, v := range vars {
+		s = strings.Replace(s, "{"+k+"}", v, -1)
+	}
+	return s
+}
+
+// WaitHealthy run health check on hosts until all passed or retries exhausted
+// returns hosts not healthy and their last error
+func WaitHealthy(hosts []string, check string, vars map[string]string) map[string]string {
+	failed := make(map[string]string)
+	if check == "" {
+		return failed
+	}
+	retries := C.Deploy.HealthRetries
+	if retries < 1 {
+		retries = 1
+	}
+	wait := time.Duration(C.Deploy.HealthWait) * time.Second
+	if wait <= 0 {
+		wait = 2 * time.Second
+	}
+	pending := hosts
+	for i := 0; i < retries && len(pending) > 0; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+		}
+		_, errs, err := RunRemote(pending, ExpandVars(check, vars))
+		if err != nil {
+			for _, h := range pending {
+				failed[h] = err.Error()
+			}
+			return failed
+		}
+		var next []string
+		for _, h := range pending {
+			if e, ok := errs[h]; ok {
+				failed[h] = e
+				next = append(next, h)
+				continue
+			}
+			delete(failed, h)
+		}
+		pending = next
+	}
+	return failed
+}
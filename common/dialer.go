@@ -0,0 +1,162 @@
+package common
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Dialer open ssh connections to hosts, replace it to run against mock servers(see common/sshtest)
+type Dialer interface {
+	Dial(network, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error)
+}
+
+// sshDialer dial with happy eyeballs and start ssh client offering algorithms of ssh config, dials are ramped up by
+// ramp config
+type sshDialer struct{}
+
+func (sshDialer) Dial(network, addr string, cfg *ssh.ClientConfig) (client *ssh.Client, err error) {
+	if cfg, err = withAlgorithms(cfg, addr); err != nil {
+		return nil, err
+	}
+	err = rampDial(func() error {
+		conn, err := dialTCP(network, addr, cfg.Timeout)
+		if err != nil {
+			return err
+		}
+		client, err = handshake(conn, addr, cfg)
+		return err
+	})
+	return client, err
+}
+
+// handshake start ssh client on conn, a host stalling the handshake fails after cfg.Timeout
+func handshake(conn net.Conn, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	if cfg.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(cfg.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// DefaultDialer dialer of new transfers, commands and ping
+var DefaultDialer Dialer = sshDialer{}
+
+// TransferTimeout timeout of connecting and ssh handshake of transfers
+var TransferTimeout = 30 * time.Second
+
+// CommandTimeout timeout of connecting and ssh handshake of commands
+var CommandTimeout = 10 * time.Second
+
+// HappyEyeballsDelay wait before racing the next address of a host, see RFC 8305
+var HappyEyeballsDelay = 250 * time.Millisecond
+
+// dialTCP dial addr, if host resolves to several addresses(eg. both A and AAAA) they are raced:
+// ipv6 and ipv4 addresses are tried alternately, a new attempt starts every HappyEyeballsDelay
+// or as soon as all started attempts failed, the first connection established is used
+func dialTCP(network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{}
+	if net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = interleaveFamilies(ips)
+	if len(ips) == 1 {
+		return d.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	race, stop := context.WithCancel(ctx)
+	defer stop()
+	started, failed := 0, 0
+	var firstErr error
+	next := time.NewTimer(0)
+	defer next.Stop()
+	for {
+		select {
+		case <-next.C:
+			ip := ips[started]
+			go func() {
+				conn, err := d.DialContext(race, network, net.JoinHostPort(ip.String(), port))
+				results <- result{conn, err}
+			}()
+			if started++; started < len(ips) {
+				next.Reset(HappyEyeballsDelay)
+			}
+		case r := <-results:
+			if r.err == nil {
+				stop()
+				// close connections of attempts still running
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.err == nil {
+							r.conn.Close()
+						}
+					}
+				}(started - failed - 1)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if failed++; failed == len(ips) {
+				return nil, firstErr
+			}
+			if failed == started {
+				// nothing running, start next now
+				if !next.Stop() {
+					select {
+					case <-next.C:
+					default:
+					}
+				}
+				next.Reset(0)
+			}
+		}
+	}
+}
+
+// interleaveFamilies order addresses as ipv6, ipv4, ipv6... keeping resolver order within a family
+func interleaveFamilies(ips []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	ordered := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
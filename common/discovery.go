@@ -0,0 +1,138 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DiscoverySRV prefix of hosts expanded from dns srv records, eg. srv:_ssh._tcp.web.internal
+	DiscoverySRV = "srv:"
+	// DiscoveryConsul prefix of hosts expanded from addresses of passing instances of a consul service, eg. consul:web
+	// port of service is not used, instances are dialed at default port
+	DiscoveryConsul = "consul:"
+)
+
+// ConsulConfig consul agent queried by consul: hosts
+type ConsulConfig struct {
+	Address    string `yaml:"address"` // default http://127.0.0.1:8500
+	Token      string `yaml:"token"`
+	Datacenter string `yaml:"datacenter"`
+}
+
+// ExpandHosts expand srv: and consul: entries into instances registered now and ranges of other hosts
+// duplicated, excluded and quarantined hosts are removed, so are hosts of the same host key with dedupe_hosts
+func ExpandHosts(hosts []string) ([]string, error) {
+	var expanded []string
+	for _, h := range hosts {
+		var found []string
+		var err error
+		switch {
+		case strings.HasPrefix(h, DiscoverySRV):
+			found, err = lookupSRVHosts(h[len(DiscoverySRV):])
+		case strings.HasPrefix(h, DiscoveryConsul):
+			found, err = lookupConsulHosts(h[len(DiscoveryConsul):])
+		default:
+			found, err = ExpandRange(h)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Expand %s: %s", h, err)
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("Expand %s: no instance found", h)
+		}
+		expanded = append(expanded, found...)
+	}
+	expanded = UniqueHosts(expanded)
+	kept, reasons, err := ExcludeHosts(expanded)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range expanded {
+		if reason, ok := reasons[h]; ok {
+			fmt.Fprintf(Stderr, "Warning: %s skipped, %s\n", h, reason)
+		}
+	}
+	expanded = kept
+	if !C.DedupeHosts || len(expanded) < 2 {
+		return expanded, nil
+	}
+	expanded, dups := DedupeHosts(expanded)
+	for _, h := range expanded {
+		for _, d := range dups[h] {
+			fmt.Fprintf(Stderr, "Warning: %s has the same host key as %s, skipped\n", d, h)
+		}
+	}
+	return expanded, nil
+}
+
+// lookupSRVHosts get target:port of srv records of name, eg. _ssh._tcp.web.internal
+func lookupSRVHosts(name string) ([]string, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, a := range addrs {
+		hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port))))
+	}
+	return hosts, nil
+}
+
+// lookupConsulHosts get addresses of passing instances of consul service, service may be tag.name
+func lookupConsulHosts(service string) ([]string, error) {
+	addr := C.Consul.Address
+	if addr == "" {
+		addr = "http://127.0.0.1:8500"
+	}
+	q := url.Values{"passing": {"1"}}
+	if i := strings.LastIndex(service, "."); i > 0 {
+		q.Set("tag", service[:i])
+		service = service[i+1:]
+	}
+	if C.Consul.Datacenter != "" {
+		q.Set("dc", C.Consul.Datacenter)
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/health/service/"+url.PathEscape(service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if C.Consul.Token != "" {
+		req.Header.Set("X-Consul-Token", C.Consul.Token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Consul returns %s", resp.Status)
+	}
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
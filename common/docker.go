@@ -0,0 +1,156 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostDocker running container on a docker host reached by ssh, configured as docker://address:port/container
+const HostDocker = "docker"
+
+// dockerExec wrap cmd to run in container by docker exec
+func dockerExec(container, cmd string) string {
+	return "docker exec -i " + shellQuote(container) + " sh -c " + shellQuote(cmd)
+}
+
+// remoteCommand command run on ssh host to run cmd on h
+func (h Host) remoteCommand(cmd string) string {
+	if h.Type == HostDocker {
+		return dockerExec(h.Target, cmd)
+	}
+	return cmd
+}
+
+// extractCommand command run on ssh host to extract tar compressed by codec from stdin into dir of h
+func (h Host) extractCommand(dir, codec string) string {
+	decompress := decompressCommand(codec)
+	if h.Type == HostDocker {
+		// docker cp reads tar from stdin
+		if decompress != "" {
+			decompress += " | "
+		}
+		return dockerExec(h.Target, "mkdir -p "+shellQuote(dir)) + " && " + decompress + "docker cp - " + shellQuote(h.Target+":"+dir)
+	}
+	if codec == CodecGzip {
+		return "mkdir -p " + shellQuote(dir) + " && tar xzf - -C " + shellQuote(dir)
+	}
+	if decompress != "" {
+		decompress += " | "
+	}
+	return "mkdir -p " + shellQuote(dir) + " && " + decompress + "tar xf - -C " + shellQuote(dir)
+}
+
+// dockerTransport transport of files in a container, content is streamed by docker exec
+type dockerTransport struct {
+	shellTransport
+	container string
+}
+
+// newDockerTransport get transport of container on docker host of c
+func newDockerTransport(c *ssh.Client, container string) (Transport, error) {
+	if container == "" {
+		return nil, errors.New("Container is not set, eg. docker://10.0.0.1/app")
+	}
+	return &dockerTransport{
+		shellTransport: shellTransport{c: c, wrap: func(cmd string) string {
+			return dockerExec(container, cmd)
+		}},
+		container: container,
+	}, nil
+}
+
+func (dt *dockerTransport) Open(name string) (File, error) {
+	fi, err := dt.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	f, err := dt.stream(name, "cat "+shellQuote(name), false)
+	if err != nil {
+		return nil, err
+	}
+	f.info = fi
+	return f, nil
+}
+
+func (dt *dockerTransport) Create(name string) (File, error) {
+	return dt.stream(name, "cat > "+shellQuote(name), true)
+}
+
+// stream start cmd in container, content is written to its stdin or read from its stdout
+func (dt *dockerTransport) stream(name, cmd string, write bool) (*dockerFile, error) {
+	sess, err := dt.c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	f := &dockerFile{name: name, sess: sess, dt: dt}
+	if write {
+		f.w, err = sess.StdinPipe()
+	} else {
+		f.r, err = sess.StdoutPipe()
+	}
+	if err == nil {
+		err = sess.Start(dockerExec(dt.container, cmd))
+	}
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// dockerFile file streamed from or to a container
+type dockerFile struct {
+	name string
+	info os.FileInfo
+	sess *ssh.Session
+	dt   *dockerTransport
+	r    io.Reader
+	w    io.WriteCloser
+}
+
+func (f *dockerFile) Name() string {
+	return f.name
+}
+
+func (f *dockerFile) Stat() (os.FileInfo, error) {
+	if f.info != nil {
+		return f.info, nil
+	}
+	return f.dt.Stat(f.name)
+}
+
+func (f *dockerFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, errors.New("File is opened for writing")
+	}
+	return f.r.Read(p)
+}
+
+func (f *dockerFile) Write(p []byte) (int, error) {
+	if f.w == nil {
+		return 0, errors.New("File is opened for reading")
+	}
+	return f.w.Write(p)
+}
+
+func (f *dockerFile) Close() error {
+	defer f.sess.Close()
+	if f.w != nil {
+		f.w.Close()
+	} else {
+		io.Copy(ioutil.Discard, f.r)
+	}
+	if err := f.sess.Wait(); err != nil {
+		return fmt.Errorf("%s: %s", f.name, strings.TrimSpace(err.Error()))
+	}
+	return nil
+}
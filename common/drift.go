@@ -0,0 +1,83 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DriftResult state of a host compared with the last recorded release
+type DriftResult struct {
+	Meta    *DeployMeta // metadata found on host, nil if missing
+	Actual  string      // sha256 of artifact on host, empty if missing
+	Drifted bool
+	Reason  string
+}
+
+// deployedDir remote dir holding deployed artifact and metadata
+func deployedDir() string {
+	if C.Deploy.Releases || C.Deploy.Strategy == StrategyBlueGreen {
+		return path.Join(C.Deploy.Root, CurrentLink)
+	}
+	return C.Deploy.Root
+}
+
+// Drift compare deploy metadata and artifact checksum of every host with the last release recorded for group
+// hosts running another release missed it, hosts whose artifact differs from their metadata are modified out-of-band
+func Drift(hosts []string, group string) (map[string]DriftResult, map[string]string, error) {
+	releases, err := LoadReleases()
+	if err != nil {
+		return nil, nil, err
+	}
+	rel, ok := releases[group]
+	if !ok {
+		return nil, nil, fmt.Errorf("No release recorded for group %s", group)
+	}
+	dir := deployedDir()
+	cmd := "cat " + shellQuote(path.Join(dir, MetaFile)) + " 2>/dev/null; echo; echo ---; " +
+		"sha256sum " + shellQuote(path.Join(dir, rel.Artifact)) + " 2>/dev/null | cut -d' ' -f1"
+	output, errs, err := RunRemote(hosts, cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := make(map[string]DriftResult)
+	for _, h := range hosts {
+		if _, ok := errs[h]; ok {
+			continue
+		}
+		parts := strings.SplitN(output[h], "\n---\n", 2)
+		dr := DriftResult{}
+		if len(parts) == 2 {
+			dr.Actual = strings.TrimSpace(parts[1])
+		}
+		if m := strings.TrimSpace(parts[0]); m != "" {
+			meta := &DeployMeta{}
+			if err := json.Unmarshal([]byte(m), meta); err == nil {
+				dr.Meta = meta
+			}
+		}
+		switch {
+		case dr.Meta == nil:
+			dr.Drifted, dr.Reason = true, "no deploy metadata in "+dir
+		case dr.Meta.Checksum != rel.Checksum:
+			dr.Drifted, dr.Reason = true, fmt.Sprintf("missed release, running %s(run %s) instead of %s", ShortSum(dr.Meta.Checksum), dr.Meta.RunID, ShortSum(rel.Checksum))
+		case dr.Actual == "":
+			dr.Drifted, dr.Reason = true, "artifact "+rel.Artifact+" missing"
+		case dr.Actual != dr.Meta.Checksum:
+			dr.Drifted, dr.Reason = true, fmt.Sprintf("modified out-of-band, artifact is %s", ShortSum(dr.Actual))
+		default:
+			dr.Reason = fmt.Sprintf("in sync, %s(run %s)", ShortSum(rel.Checksum), dr.Meta.RunID)
+		}
+		result[h] = dr
+	}
+	return result, errs, nil
+}
+
+// ShortSum abbreviate checksum for output, short or empty ones are kept as they are
+func ShortSum(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DurationSamples durations kept per step and host, older ones are dropped
+const DurationSamples = 20
+
+// DeployStep step name of durations of rolling deploy batches
+const DeployStep = "deploy"
+
+var (
+	durLock  sync.Mutex
+	durCache map[string]map[string][]float64 // step => host => seconds, oldest first
+	durDirty bool
+)
+
+// loadDurations load durations once, caller must hold durLock
+func loadDurations() map[string]map[string][]float64 {
+	if durCache != nil {
+		return durCache
+	}
+	durCache = make(map[string]map[string][]float64)
+	// missing or broken history only loses estimates
+	if _, err := loadState("durations.json", &durCache); err != nil || durCache == nil {
+		durCache = make(map[string]map[string][]float64)
+	}
+	return durCache
+}
+
+// RecordDuration record that step took d on each of hosts, saved by SaveDurations
+func RecordDuration(step string, hosts []string, d time.Duration) {
+	durLock.Lock()
+	defer durLock.Unlock()
+	steps := loadDurations()
+	if steps[step] == nil {
+		steps[step] = make(map[string][]float64)
+	}
+	for _, h := range hosts {
+		samples := append(steps[step][h], d.Seconds())
+		if len(samples) > DurationSamples {
+			samples = samples[len(samples)-DurationSamples:]
+		}
+		steps[step][h] = samples
+	}
+	durDirty = len(hosts) > 0 || durDirty
+}
+
+// SaveDurations save recorded durations
+func SaveDurations() error {
+	durLock.Lock()
+	defer durLock.Unlock()
+	if !durDirty {
+		return nil
+	}
+	durDirty = false
+	return saveState("durations.json", durCache)
+}
+
+// median get median of samples, 0 if empty
+func median(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	s := append([]float64(nil), samples...)
+	sort.Float64s(s)
+	if len(s)%2 == 0 {
+		return (s[len(s)/2-1] + s[len(s)/2]) / 2
+	}
+	return s[len(s)/2]
+}
+
+// EstimateDuration estimate duration of step on hosts running at the same time: the slowest median of hosts, hosts
+// without history take the median of all hosts. false if step has no history
+func EstimateDuration(step string, hosts []string) (time.Duration, bool) {
+	durLock.Lock()
+	defer durLock.Unlock()
+	byHost := loadDurations()[step]
+	if len(byHost) == 0 {
+		return 0, false
+	}
+	var all []float64
+	for _, samples := range byHost {
+		all = append(all, samples...)
+	}
+	est := 0.0
+	for _, h := range hosts {
+		m := median(byHost[h])
+		if len(byHost[h]) == 0 {
+			m = median(all)
+		}
+		if m > est {
+			est = m
+		}
+	}
+	return time.Duration(est * float64(time.Second)), true
+}
+
+// FormatETA format estimated remaining time, eg. ~6m or ~1h5m
+func FormatETA(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("~%ds", int(d.Seconds()+0.5))
+	case d < time.Hour:
+		return fmt.Sprintf("~%dm", int(d.Minutes()+0.5))
+	}
+	return fmt.Sprintf("~%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// DurationStat duration history of a step
+type DurationStat struct {
+	Step    string
+	Hosts   int
+	Samples int
+	Median  time.Duration
+	Max     time.Duration
+	Slowest string // host with the slowest median
+}
+
+// DurationStats get duration history of every step, by name
+func DurationStats() []DurationStat {
+	durLock.Lock()
+	defer durLock.Unlock()
+	var stats []DurationStat
+	for step, byHost := range loadDurations() {
+		st := DurationStat{Step: step, Hosts: len(byHost)}
+		var all []float64
+		slowest := -1.0
+		for h, samples := range byHost {
+			all = append(all, samples...)
+			if m := median(samples); m > slowest {
+				slowest, st.Slowest = m, h
+			}
+		}
+		st.Samples = len(all)
+		st.Median = time.Duration(median(all) * float64(time.Second))
+		for _, s := range all {
+			if d := time.Duration(s * float64(time.Second)); d > st.Max {
+				st.Max = d
+			}
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Step < stats[j].Step })
+	return stats
+}
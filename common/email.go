@@ -0,0 +1,179 @@
+package common
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Email sending conditions
+const (
+	EmailAlways  = "always"
+	EmailFailure = "failure"
+)
+
+// EmailDefaultSubject subject of run summary mails
+const EmailDefaultSubject = "[optool] {status}: {command} ({run_id})"
+
+// EmailDefaultBody body of run summary mails
+const EmailDefaultBody = `Run {run_id} {status}.
+
+Command:  {command}
+By:       {by}
+Started:  {started}
+Duration: {duration}
+Hosts:    {hosts}
+Failed:   {failed_count}
+{failed}
+{error}
+`
+
+// EmailConfig mail summary of every run touching hosts, for change records kept by email
+type EmailConfig struct {
+	SMTP     string   `yaml:"smtp"`     // host:port of smtp server, nothing is sent if empty
+	TLS      bool     `yaml:"tls"`      // implicit tls, eg. port 465. STARTTLS is used if the server offers it otherwise
+	Username string   `yaml:"username"` // auth is skipped if empty
+	Password string   `yaml:"password"` // encrypted unless auth.plain_password
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	On       string   `yaml:"on"`      // always(default) or failure
+	Subject  string   `yaml:"subject"` // {run_id}, {status}, {command}, {by}, {started}, {duration}, {hosts}, {failed_count}, {failed} and {error} are replaced
+	Body     string   `yaml:"body"`
+}
+
+// runSummaryVars get template vars of run summary, values are redacted
+func runSummaryVars(rec *RunRecord) map[string]string {
+	status := "succeeded"
+	if rec.Error != "" || len(rec.Failed) > 0 {
+		status = "failed"
+	}
+	var failed []string
+	for h, e := range rec.Failed {
+		failed = append(failed, fmt.Sprintf("  %s: %s", h, strings.TrimSpace(e)))
+	}
+	sort.Strings(failed)
+	errMsg := ""
+	if rec.Error != "" {
+		errMsg = "Error: " + rec.Error
+	}
+	vars := map[string]string{
+		"run_id":       rec.RunID,
+		"status":       status,
+		"command":      "optool " + strings.Join(rec.Args, " "),
+		"by":           rec.By,
+		"started":      rec.Started.Format(time.RFC3339),
+		"duration":     rec.Finished.Sub(rec.Started).Round(time.Second).String(),
+		"hosts":        strings.Join(rec.Hosts, ", "),
+		"failed_count": fmt.Sprintf("%d of %d", len(rec.Failed), len(rec.Hosts)),
+		"failed":       strings.Join(failed, "\n"),
+		"error":        errMsg,
+	}
+	for k, v := range vars {
+		vars[k] = Redact(v)
+	}
+	return vars
+}
+
+// SendRunEmail mail summary of this run by email config, nothing is sent if it is off or the run is not recorded
+func SendRunEmail() error {
+	ec := C.Email
+	runRecordLock.Lock()
+	var rec RunRecord
+	if runRecord != nil {
+		rec = *runRecord
+	}
+	runRecordLock.Unlock()
+	if ec.SMTP == "" || rec.RunID == "" {
+		return nil
+	}
+	vars := runSummaryVars(&rec)
+	switch ec.On {
+	case "", EmailAlways:
+	case EmailFailure:
+		if vars["status"] != "failed" {
+			return nil
+		}
+	default:
+		return fmt.Errorf("Unknown email.on: %s", ec.On)
+	}
+	if ec.From == "" || len(ec.To) == 0 {
+		return errors.New("email.from and email.to are required")
+	}
+	subject, body := ec.Subject, ec.Body
+	if subject == "" {
+		subject = EmailDefaultSubject
+	}
+	if body == "" {
+		body = EmailDefaultBody
+	}
+	msg := "From: " + ec.From + "\r\n" +
+		"To: " + strings.Join(ec.To, ", ") + "\r\n" +
+		"Subject: " + strings.Replace(ExpandVars(subject, vars), "\n", " ", -1) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + rec.RunID + "@optool>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(ExpandVars(body, vars), "\n", "\r\n", -1)
+	return sendMail(ec, []byte(msg))
+}
+
+// sendMail send msg by smtp server of ec
+func sendMail(ec EmailConfig, msg []byte) error {
+	host, _, err := net.SplitHostPort(ec.SMTP)
+	if err != nil {
+		return err
+	}
+	var conn net.Conn
+	if ec.TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", ec.SMTP, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.DialTimeout("tcp", ec.SMTP, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && !ec.TLS {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if ec.Username != "" {
+		password := ec.Password
+		if !C.Auth.PlainPassword {
+			password = string(Decrypt(password))
+		}
+		if err = c.Auth(smtp.PlainAuth("", ec.Username, password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(ec.From); err != nil {
+		return err
+	}
+	for _, to := range ec.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
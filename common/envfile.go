@@ -0,0 +1,227 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Env file formats
+const (
+	EnvFormatEnv     = "env"     // KEY=value lines, for EnvironmentFile= or sourcing
+	EnvFormatSystemd = "systemd" // drop-in with Environment="KEY=value" lines under [Service]
+)
+
+// EnvFileConfig remote env file of services rendered from vars and secrets
+type EnvFileConfig struct {
+	Path    string            `yaml:"path"`    // eg. /etc/app/env or /etc/systemd/system/app.service.d/env.conf
+	Format  string            `yaml:"format"`  // env or systemd, systemd if path ends with .conf
+	Mode    uint32            `yaml:"mode"`    // default 0600
+	Vars    map[string]string `yaml:"vars"`    // {group} and {run_id} are replaced
+	Secrets map[string]string `yaml:"secrets"` // encrypted unless auth.plain_password, env:NAME reads local environment
+	Changed string            `yaml:"changed"` // run on hosts whose file changed, eg. systemctl daemon-reload && systemctl restart app
+}
+
+// format get format of env file
+func (ec EnvFileConfig) format() string {
+	if ec.Format != "" {
+		return ec.Format
+	}
+	if strings.HasSuffix(ec.Path, ".conf") {
+		return EnvFormatSystemd
+	}
+	return EnvFormatEnv
+}
+
+// secretValue get plain value of a configured secret, it is masked in output
+func secretValue(v string) string {
+	if strings.HasPrefix(v, "env:") {
+		v = os.Getenv(strings.TrimPrefix(v, "env:"))
+	} else if !C.Auth.PlainPassword {
+		v = string(Decrypt(v))
+	}
+	RegisterSecret(v)
+	return v
+}
+
+// EnvValues get rendered values of env file of group, secrets take precedence over vars with the same key
+func EnvValues(group string) map[string]string {
+	tv := map[string]string{"group": group, "run_id": RunID}
+	values := make(map[string]string)
+	for k, v := range C.EnvFile.Vars {
+		values[k] = ExpandVars(v, tv)
+	}
+	for k, v := range C.EnvFile.Secrets {
+		values[k] = secretValue(v)
+	}
+	return values
+}
+
+// RenderEnv render values as env file content of format
+func RenderEnv(values map[string]string, format string) string {
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("# managed by optool, changes are overwritten\n")
+	if format == EnvFormatSystemd {
+		b.WriteString("[Service]\n")
+	}
+	for _, k := range keys {
+		v := values[k]
+		if format == EnvFormatSystemd {
+			v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "\n", `\n`).Replace(v)
+			fmt.Fprintf(&b, "Environment=\"%s=%s\"\n", k, v)
+			continue
+		}
+		if strings.ContainsAny(v, " \t\"'\\$`#\n") {
+			v = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`).Replace(v) + `"`
+		}
+		fmt.Fprintf(&b, "%s=%s\n", k, v)
+	}
+	return b.String()
+}
+
+// ParseEnv parse values of env file content of either format
+func ParseEnv(content string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		systemd := strings.HasPrefix(line, "Environment=")
+		if systemd {
+			line = strings.TrimPrefix(line, "Environment=")
+			if uq, err := strconv.Unquote(line); err == nil {
+				line = uq
+			}
+		}
+		line = strings.TrimPrefix(line, "export ")
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := kv[1]
+		if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\$`, "$", "\\`", "`", `\n`, "\n").Replace(v[1 : len(v)-1])
+		} else if len(v) > 1 && v[0] == '\'' && v[len(v)-1] == '\'' {
+			v = v[1 : len(v)-1]
+		}
+		if systemd {
+			v = strings.Replace(v, "%%", "%", -1)
+		}
+		values[kv[0]] = v
+	}
+	return values
+}
+
+// DiffEnv describe changes from current to desired values, values of secret keys are redacted
+func DiffEnv(current, desired map[string]string) []string {
+	keys := make(map[string]bool)
+	for k := range current {
+		keys[k] = true
+	}
+	for k := range desired {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	show := func(k, v string) string {
+		if _, ok := C.EnvFile.Secrets[k]; ok {
+			return RedactedValue
+		}
+		return v
+	}
+	var changes []string
+	for _, k := range sorted {
+		cv, inCurrent := current[k]
+		dv, inDesired := desired[k]
+		switch {
+		case !inCurrent:
+			changes = append(changes, "+ "+k+"="+show(k, dv))
+		case !inDesired:
+			changes = append(changes, "- "+k)
+		case cv != dv:
+			changes = append(changes, "~ "+k+"="+show(k, cv)+" => "+show(k, dv))
+		}
+	}
+	return changes
+}
+
+// EnvFile compare remote env file of hosts with values rendered for group, and write it on changed hosts if apply.
+// changes of every host are returned, env_file.changed is run on hosts written
+func EnvFile(hosts []string, group string, apply bool) (map[string][]string, map[string]string, error) {
+	ec := C.EnvFile
+	if ec.Path == "" {
+		return nil, nil, errors.New("env_file.path is not configured")
+	}
+	output, errs, err := RunRemote(hosts, "cat "+shellQuote(ec.Path)+" 2>/dev/null; true")
+	if err != nil {
+		return nil, nil, err
+	}
+	values := EnvValues(group)
+	content := RenderEnv(values, ec.format())
+	changes := make(map[string][]string)
+	var changed []string
+	for _, h := range hosts {
+		if _, ok := errs[h]; ok {
+			continue
+		}
+		changes[h] = DiffEnv(ParseEnv(output[h]), values)
+		if len(changes[h]) == 0 && output[h] != content {
+			changes[h] = []string{"~ rewritten, only formatting differs"}
+		}
+		if len(changes[h]) > 0 {
+			changed = append(changed, h)
+		}
+	}
+	if !apply || len(changed) == 0 {
+		return changes, errs, nil
+	}
+	mode := ec.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+	tmp := shellQuote(runTemp(ec.Path, "new"))
+	cmd := "mkdir -p " + shellQuote(path.Dir(ec.Path)) +
+		" && (umask 077 && printf '%s' " + shellQuote(content) + " > " + tmp + ")" +
+		" && chmod " + strconv.FormatUint(uint64(mode), 8) + " " + tmp +
+		" && mv -f " + tmp + " " + shellQuote(ec.Path)
+	if ec.Changed != "" {
+		cmd += " && { " + ec.Changed + "\n}"
+	}
+	_, werrs, err := RunRemote(changed, cmd)
+	if err != nil {
+		return changes, errs, err
+	}
+	for h, e := range werrs {
+		errs[h] = e
+	}
+	return changes, errs, nil
+}
+
+// PrintEnvChanges print changes of env file of every host
+func PrintEnvChanges(hosts []string, changes map[string][]string, errs map[string]string) {
+	for _, h := range hosts {
+		if e, ok := errs[h]; ok {
+			fmt.Fprintf(Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+			continue
+		}
+		if len(changes[h]) == 0 {
+			fmt.Fprintf(Stdout, "%21s: unchanged\n", h)
+		}
+		for _, c := range changes[h] {
+			fmt.Fprintf(Stdout, "%21s: %s\n", h, c)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package common
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HostFTP ftp server, configured as ftp://address:port
+	HostFTP = "ftp"
+	// HostFTPS ftp server with explicit tls (AUTH TLS), configured as ftps://address:port
+	HostFTPS = "ftps"
+)
+
+// FTPConfig auth of ftp hosts, user and password of auth are used if empty
+type FTPConfig struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"` // encrypted unless auth.plain_password
+	Insecure bool   `yaml:"insecure"` // skip verifying certificate of ftps hosts
+}
+
+// ftpTransport transport of a ftp control connection, only one file can be opened at a time
+type ftpTransport struct {
+	conn *textproto.Conn
+	host string
+	tls  *tls.Config // data connections are wrapped if set
+	home string      // working dir after login
+}
+
+// dialFTP connect and login to ftp host
+func dialFTP(h Host) (*ftpTransport, error) {
+	raw, err := dialTCP("tcp", h.Addr(), 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	ft := &ftpTransport{conn: textproto.NewConn(raw), host: h.Address}
+	if _, _, err = ft.conn.ReadResponse(2); err != nil {
+		ft.conn.Close()
+		return nil, err
+	}
+	if err = ft.login(h, raw); err != nil {
+		ft.conn.Close()
+		return nil, err
+	}
+	return ft, nil
+}
+
+func (ft *ftpTransport) login(h Host, raw net.Conn) (err error) {
+	if h.Type == HostFTPS {
+		if _, _, err = ft.cmd(2, "AUTH TLS"); err != nil {
+			return err
+		}
+		ft.tls = &tls.Config{ServerName: h.Address, InsecureSkipVerify: C.FTP.Insecure}
+		tc := tls.Client(raw, ft.tls)
+		if err = tc.Handshake(); err != nil {
+			return err
+		}
+		ft.conn = textproto.NewConn(tc)
+	}
+	user, password := credentials(C.FTP.User, C.FTP.Password)
+	code, _, err := ft.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		if _, _, err = ft.cmd(2, "PASS %s", password); err != nil {
+			return err
+		}
+	} else if code/100 != 2 {
+		return fmt.Errorf("FTP login: %d", code)
+	}
+	if ft.tls != nil {
+		if _, _, err = ft.cmd(2, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, _, err = ft.cmd(2, "PROT P"); err != nil {
+			return err
+		}
+	}
+	if _, _, err = ft.cmd(2, "TYPE I"); err != nil {
+		return err
+	}
+	_, msg, err := ft.cmd(2, "PWD")
+	if err != nil {
+		return err
+	}
+	if i, j := strings.Index(msg, `"`), strings.LastIndex(msg, `"`); i >= 0 && j > i {
+		ft.home = msg[i+1 : j]
+	}
+	return nil
+}
+
+// cmd send command and read response, expect is the leading digits of expected code, 0 for any
+func (ft *ftpTransport) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	id, err := ft.conn.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	ft.conn.StartResponse(id)
+	defer ft.conn.EndResponse(id)
+	return ft.conn.ReadResponse(expect)
+}
+
+// ftpCode code of ftp error response, 0 if err is not a response
+func ftpCode(err error) int {
+	if te, ok := err.(*textproto.Error); ok {
+		return te.Code
+	}
+	return 0
+}
+
+// ftpPathError convert 550 responses to os.ErrNotExist
+func ftpPathError(op, name string, err error) error {
+	if ftpCode(err) == 550 {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// ftpUnsupported is err a response of unknown or unimplemented command
+func ftpUnsupported(err error) bool {
+	code := ftpCode(err)
+	return code == 500 || code == 502 || code == 504
+}
+
+// data open a passive data connection and send command using it
+func (ft *ftpTransport) data(format string, args ...interface{}) (net.Conn, error) {
+	port, err := ft.passive()
+	if err != nil {
+		return nil, err
+	}
+	dc, err := net.DialTimeout("tcp", net.JoinHostPort(ft.host, port), 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err = ft.cmd(1, format, args...); err != nil {
+		dc.Close()
+		return nil, err
+	}
+	if ft.tls != nil {
+		return tls.Client(dc, ft.tls), nil
+	}
+	return dc, nil
+}
+
+// passive get port of passive data connection by EPSV, or PASV if EPSV is not supported
+// address of PASV responses is ignored, data connections always go to the control host
+func (ft *ftpTransport) passive() (string, error) {
+	_, msg, err := ft.cmd(2, "EPSV")
+	if err == nil {
+		// 229 Entering Extended Passive Mode (|||port|)
+		if i, j := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)"); i >= 0 && j > i+4 {
+			return msg[i+4 : j], nil
+		}
+		return "", fmt.Errorf("FTP: unexpected EPSV response %s", msg)
+	}
+	if !ftpUnsupported(err) {
+		return "", err
+	}
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	if _, msg, err = ft.cmd(2, "PASV"); err != nil {
+		return "", err
+	}
+	i, j := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if i < 0 || j < i {
+		return "", fmt.Errorf("FTP: unexpected PASV response %s", msg)
+	}
+	fields := strings.Split(msg[i+1:j], ",")
+	if len(fields) != 6 {
+		return "", fmt.Errorf("FTP: unexpected PASV response %s", msg)
+	}
+	p1, _ := strconv.Atoi(fields[4])
+	p2, _ := strconv.Atoi(fields[5])
+	return strconv.Itoa(p1<<8 | p2), nil
+}
+
+// parseFacts parse a MLST/MLSD line, eg. type=file;size=12;modify=20200101000000;unix.mode=0644; name
+func parseFacts(line string) (os.FileInfo, error) {
+	line = strings.TrimLeft(line, " ")
+	i := strings.Index(line, " ")
+	if i < 0 {
+		return nil, fmt.Errorf("FTP: unexpected facts %s", line)
+	}
+	fi := fileInfo{name: line[i+1:], mode: 0644}
+	for _, fact := range strings.Split(line[:i], ";") {
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(kv[0]) {
+		case "type":
+			switch strings.ToLower(kv[1]) {
+			case "dir", "cdir", "pdir":
+				fi.mode = os.ModeDir | 0755
+			}
+		case "size":
+			fi.size, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "modify":
+			if len(kv[1]) >= 14 {
+				fi.modTime, _ = time.Parse("20060102150405", kv[1][:14])
+			}
+		case "unix.mode":
+			if m, err := strconv.ParseUint(kv[1], 8, 32); err == nil {
+				fi.mode = fi.mode&os.ModeDir | os.FileMode(m).Perm()
+			}
+		}
+	}
+	return fi, nil
+}
+
+func (ft *ftpTransport) Stat(name string) (os.FileInfo, error) {
+	_, msg, err := ft.cmd(2, "MLST %s", name)
+	if err == nil {
+		// 250-Listing name\n facts name\n250 End
+		lines := strings.Split(msg, "\n")
+		if len(lines) < 2 {
+			return nil, fmt.Errorf("FTP: unexpected MLST response %s", msg)
+		}
+		fi, err := parseFacts(lines[1])
+		if err != nil {
+			return nil, err
+		}
+		info := fi.(fileInfo)
+		info.name = name
+		return info, nil
+	}
+	if !ftpUnsupported(err) {
+		return nil, ftpPathError("stat", name, err)
+	}
+	// legacy servers: SIZE for files, CWD for dirs
+	if _, msg, err = ft.cmd(2, "SIZE %s", name); err == nil {
+		size, _ := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+		return fileInfo{name: name, size: size, mode: 0644}, nil
+	}
+	if _, _, err = ft.cmd(2, "CWD %s", name); err != nil {
+		return nil, ftpPathError("stat", name, err)
+	}
+	ft.cmd(2, "CWD %s", ft.home)
+	return fileInfo{name: name, mode: os.ModeDir | 0755}, nil
+}
+
+func (ft *ftpTransport) ReadDir(name string) ([]os.FileInfo, error) {
+	dc, err := ft.data("MLSD %s", name)
+	if ftpUnsupported(err) {
+		return ft.readDirNLST(name)
+	}
+	if err != nil {
+		return nil, ftpPathError("readdir", name, err)
+	}
+	body, err := ft.readAll(dc)
+	if err != nil {
+		return nil, err
+	}
+	var fis []os.FileInfo
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		facts := strings.ToLower(line)
+		if line == "" || strings.Contains(facts, "type=cdir;") || strings.Contains(facts, "type=pdir;") {
+			continue
+		}
+		fi, err := parseFacts(line)
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+// readDirNLST list names of dir and stat them one by one
+func (ft *ftpTransport) readDirNLST(name string) ([]os.FileInfo, error) {
+	dc, err := ft.data("NLST %s", name)
+	if err != nil {
+		return nil, ftpPathError("readdir", name, err)
+	}
+	body, err := ft.readAll(dc)
+	if err != nil {
+		return nil, err
+	}
+	var fis []os.FileInfo
+	for _, line := range strings.Split(body, "\n") {
+		line = path.Base(strings.TrimRight(line, "\r"))
+		if line == "" || line == "." || line == ".." {
+			continue
+		}
+		fi, err := ft.Stat(path.Join(name, line))
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+// readAll read data connection and the transfer complete response
+func (ft *ftpTransport) readAll(dc net.Conn) (string, error) {
+	b, err := ioutil.ReadAll(dc)
+	dc.Close()
+	if _, _, e := ft.conn.ReadResponse(2); err == nil {
+		err = e
+	}
+	return string(b), err
+}
+
+func (ft *ftpTransport) Mkdir(name string) error {
+	if fi, err := ft.Stat(name); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("Mkdir %s: not a directory", name)
+		}
+		return nil
+	}
+	if parent := path.Dir(name); parent != name && parent != "." && parent != "/" {
+		if err := ft.Mkdir(parent); err != nil {
+			return err
+		}
+	}
+	_, _, err := ft.cmd(2, "MKD %s", name)
+	return err
+}
+
+func (ft *ftpTransport) Chmod(name string, mode os.FileMode) error {
+	_, _, err := ft.cmd(2, "SITE CHMOD %o %s", mode.Perm(), name)
+	if ftpUnsupported(err) {
+		// modes are meaningless to many ftp servers
+		return nil
+	}
+	return ftpPathError("chmod", name, err)
+}
+
+func (ft *ftpTransport) Rename(oldname, newname string) error {
+	// RNTO over an existing file is not portable
+	if fi, err := ft.Stat(newname); err == nil && !fi.IsDir() {
+		if _, _, err = ft.cmd(2, "DELE %s", newname); err != nil {
+			return err
+		}
+	}
+	if _, _, err := ft.cmd(3, "RNFR %s", oldname); err != nil {
+		return ftpPathError("rename", oldname, err)
+	}
+	_, _, err := ft.cmd(2, "RNTO %s", newname)
+	return err
+}
+
+func (ft *ftpTransport) Remove(name string) error {
+	fi, err := ft.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		_, _, err = ft.cmd(2, "RMD %s", name)
+	} else {
+		_, _, err = ft.cmd(2, "DELE %s", name)
+	}
+	return err
+}
+
+func (ft *ftpTransport) Open(name string) (File, error) {
+	fi, err := ft.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	dc, err := ft.data("RETR %s", name)
+	if err != nil {
+		return nil, ftpPathError("open", name, err)
+	}
+	return &ftpFile{name: name, info: fi, dc: dc, ft: ft}, nil
+}
+
+func (ft *ftpTransport) Create(name string) (File, error) {
+	dc, err := ft.data("STOR %s", name)
+	if err != nil {
+		return nil, err
+	}
+	return &ftpFile{name: name, dc: dc, ft: ft, write: true}, nil
+}
+
+func (ft *ftpTransport) Close() error {
+	ft.cmd(2, "QUIT")
+	return ft.conn.Close()
+}
+
+// ftpFile file read or written by a data connection
+type ftpFile struct {
+	name  string
+	info  os.FileInfo
+	dc    net.Conn
+	ft    *ftpTransport
+	write bool
+	n     int64
+}
+
+func (f *ftpFile) Name() string {
+	return f.name
+}
+
+func (f *ftpFile) Stat() (os.FileInfo, error) {
+	if f.info != nil {
+		return f.info, nil
+	}
+	return fileInfo{name: f.name, size: f.n, mode: 0644, modTime: time.Now()}, nil
+}
+
+func (f *ftpFile) Read(p []byte) (int, error) {
+	if f.write {
+		return 0, errors.New("File is opened for writing")
+	}
+	return f.dc.Read(p)
+}
+
+func (f *ftpFile) Write(p []byte) (int, error) {
+	if !f.write {
+		return 0, errors.New("File is opened for reading")
+	}
+	n, err := f.dc.Write(p)
+	f.n += int64(n)
+	return n, err
+}
+
+func (f *ftpFile) Close() error {
+	if tc, ok := f.dc.(*tls.Conn); ok && f.write {
+		tc.CloseWrite()
+	}
+	f.dc.Close()
+	// 226 complete, or 426 if a reader closed early
+	code, msg, err := f.ft.conn.ReadResponse(0)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 && (f.write || code != 426) {
+		return fmt.Errorf("FTP %s: %d %s", f.name, code, msg)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Merge modes of gets, files of all hosts are written into one local file
+const (
+	MergeLines    = "lines"    // every line prefixed by its host
+	MergeSections = "sections" // a section per host
+)
+
+// TransferStdout local path of merged gets writing to stdout
+const TransferStdout = "-"
+
+// prepareMerge check local file of a merged get, it is written once all hosts are fetched
+func (t *Transfer) prepareMerge() error {
+	if t.Merge != MergeLines && t.Merge != MergeSections {
+		return fmt.Errorf("Unknown merge mode: %s", t.Merge)
+	}
+	if t.LocalPath == "" {
+		return errors.New("Local path of merged get is required, - for stdout")
+	}
+	if fi, err := os.Stat(t.LocalPath); err == nil && fi.IsDir() {
+		return errors.New("Local path of merged get cannot be a dir")
+	}
+	t.spools = make(map[string]string)
+	return nil
+}
+
+// getSpool fetch remote file of host into a temp file, merged in host order afterwards
+func (t *Transfer) getSpool(h Host, tr Transport, c *ssh.Client) (err error) {
+	fi, err := tr.Stat(t.RemotePath)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errors.New("Remote dir get is not supported")
+	}
+	if fi.Size() > C.TransferMaxSize {
+		return fmt.Errorf("Max transfer size is set to %d", C.TransferMaxSize)
+	}
+	srcFile, err := tr.Open(t.RemotePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	spool, err := ioutil.TempFile("", "optool-get-")
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	t.Lock.Lock()
+	t.spools[h.Alias] = spool.Name()
+	t.Lock.Unlock()
+	ft := t.newFileTransfer(h, t.RemotePath, t.LocalPath)
+	size, err := copyBuffer(spool, srcFile)
+	if err != nil {
+		return err
+	}
+	t.finish(h, ft, size)
+	return nil
+}
+
+// writeMerged write fetched files of hosts into local path in order of hosts, spools are removed
+func (t *Transfer) writeMerged() error {
+	defer func() {
+		for _, f := range t.spools {
+			os.Remove(f)
+		}
+	}()
+	var w io.Writer = Stdout
+	var fd *os.File
+	var tmp string
+	if t.LocalPath != TransferStdout {
+		var err error
+		tmp = runTemp(t.LocalPath, "new")
+		if fd, err = os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+			return err
+		}
+		defer os.Remove(tmp)
+		defer fd.Close()
+		w = fd
+	}
+	bw := bufio.NewWriter(w)
+	first := true
+	for _, h := range t.Hosts {
+		if _, failed := t.Errors[h]; failed {
+			continue
+		}
+		f, ok := t.spools[h]
+		if !ok {
+			continue
+		}
+		if t.Merge == MergeSections {
+			if !first {
+				bw.WriteString("\n")
+			}
+			fmt.Fprintf(bw, "==> %s <==\n", h)
+		}
+		first = false
+		if err := mergeFile(bw, f, h, t.Merge); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if fd == nil {
+		return nil
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.LocalPath)
+}
+
+// mergeFile copy f into w, lines prefixed by host in lines mode. a missing last newline is added
+func mergeFile(w *bufio.Writer, f, host, mode string) error {
+	fd, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	r := bufio.NewReader(fd)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			if mode == MergeLines {
+				w.WriteString(host + ": ")
+			}
+			w.WriteString(line)
+			if line[len(line)-1] != '\n' {
+				w.WriteString("\n")
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
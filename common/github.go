@@ -0,0 +1,175 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Report kinds of GitHub
+const (
+	GitHubDeployments = "deployments"
+	GitHubStatus      = "status"
+)
+
+// GitHubConfig report deploys of groups to GitHub deployments or commit statuses of the deployed revision
+type GitHubConfig struct {
+	Report       string            `yaml:"report"`       // deployments or status, nothing is reported if empty
+	Repository   string            `yaml:"repository"`   // owner/name, $GITHUB_REPOSITORY if empty
+	Token        string            `yaml:"token"`        // $GITHUB_TOKEN if empty
+	API          string            `yaml:"api"`          // default https://api.github.com
+	Environments map[string]string `yaml:"environments"` // group => environment, group itself if not set
+}
+
+// GitHubDeploy deploy of a revision to an environment being reported
+type GitHubDeploy struct {
+	Environment string
+	Revision    string
+	id          int64 // id of GitHub deployment
+}
+
+// StartGitHubDeploy report deploy of revision to group started, revision defaults to HEAD of local working dir.
+// nil is returned if reporting is off, group is empty or revision is unknown
+func StartGitHubDeploy(group, revision string) (*GitHubDeploy, error) {
+	if C.GitHub.Report == "" || group == "" {
+		return nil, nil
+	}
+	if revision == "" {
+		revision = gitRevision()
+	}
+	if revision == "" {
+		return nil, fmt.Errorf("Deploy of %s not reported, revision unknown", group)
+	}
+	env := group
+	if e, ok := C.GitHub.Environments[group]; ok {
+		env = e
+	}
+	gd := &GitHubDeploy{Environment: env, Revision: revision}
+	switch C.GitHub.Report {
+	case GitHubDeployments:
+		var created struct {
+			ID int64 `json:"id"`
+		}
+		err := githubRequest("/deployments", map[string]interface{}{
+			"ref":               revision,
+			"environment":       env,
+			"description":       "optool run " + RunID,
+			"auto_merge":        false,
+			"required_contexts": []string{},
+			"payload":           map[string]string{"run_id": RunID, "deployer": localDeployer()},
+		}, &created)
+		if err != nil {
+			return nil, err
+		}
+		gd.id = created.ID
+	case GitHubStatus:
+	default:
+		return nil, fmt.Errorf("Unknown github.report: %s", C.GitHub.Report)
+	}
+	return gd, gd.report("", nil)
+}
+
+// Finish report result of deploy, nothing is done on nil
+func (gd *GitHubDeploy) Finish(err error) error {
+	if gd == nil {
+		return nil
+	}
+	if err == nil {
+		return gd.report("success", nil)
+	}
+	return gd.report("failure", err)
+}
+
+// report post state of deploy, in progress if state is empty
+func (gd *GitHubDeploy) report(state string, failure error) error {
+	desc := "Deploying by " + localDeployer() + ", run " + RunID
+	switch state {
+	case "success":
+		desc = "Deployed by " + localDeployer() + ", run " + RunID
+	case "failure":
+		desc = "Run " + RunID + " failed: " + failure.Error()
+	}
+	// description is limited to 140 characters
+	if len(desc) > 140 {
+		desc = desc[:137] + "..."
+	}
+	if C.GitHub.Report == GitHubStatus {
+		if state == "" {
+			state = "pending"
+		}
+		return githubRequest("/statuses/"+gd.Revision, map[string]string{
+			"state":       state,
+			"context":     "optool/" + gd.Environment,
+			"description": desc,
+			"target_url":  ciRunURL(),
+		}, nil)
+	}
+	if state == "" {
+		state = "in_progress"
+	}
+	return githubRequest(fmt.Sprintf("/deployments/%d/statuses", gd.id), map[string]string{
+		"state":       state,
+		"environment": gd.Environment,
+		"description": desc,
+		"log_url":     ciRunURL(),
+	}, nil)
+}
+
+// ciRunURL url of the running GitHub Actions run, empty out of GitHub Actions
+func ciRunURL() string {
+	if os.Getenv("GITHUB_RUN_ID") == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/actions/runs/%s", os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID"))
+}
+
+// githubRequest post body to path of configured repository, response is decoded into v if not nil
+func githubRequest(p string, body interface{}, v interface{}) error {
+	repo, token, api := C.GitHub.Repository, C.GitHub.Token, C.GitHub.API
+	if repo == "" {
+		repo = os.Getenv("GITHUB_REPOSITORY")
+	}
+	if token == "" {
+		token = os.Getenv("GITHUB_TOKEN")
+	}
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	if repo == "" || token == "" {
+		return errors.New("GitHub repository and token are required to report deploys")
+	}
+	RegisterSecret(token)
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(api, "/")+"/repos/"+repo+p, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("GitHub returns %s: %s", resp.Status, e.Message)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Graph formats
+const (
+	GraphDOT     = "dot"
+	GraphMermaid = "mermaid"
+)
+
+// graphNode stage of a pipeline run in a graph
+type graphNode struct {
+	id    string
+	lines []string
+}
+
+// graphSet stages and dependencies of a parameter set of matrix
+type graphSet struct {
+	id    string
+	label string // parameter set, empty without matrix
+	nodes []graphNode
+	edges [][2]string
+}
+
+// deployLabel describe deploy strategy of deploy steps
+func deployLabel() string {
+	switch C.Deploy.Strategy {
+	case "", StrategyRolling:
+		batch := C.Deploy.BatchSize
+		if batch < 1 {
+			batch = 1
+		}
+		label := fmt.Sprintf("deploy rolling, batch %d", batch)
+		if C.Deploy.Atomic {
+			label += ", atomic"
+		}
+		return label
+	}
+	return "deploy " + C.Deploy.Strategy
+}
+
+// groupSize count configured hosts of group, discovered entries count as one
+func groupSize(group string) string {
+	list, ok := C.Server.Hosts[group]
+	if !ok {
+		return "group not found"
+	}
+	n := 0
+	for _, entry := range list {
+		if expanded, err := ExpandRange(entry); err == nil {
+			n += len(expanded)
+		} else {
+			n++
+		}
+	}
+	return fmt.Sprintf("%d host(s)", n)
+}
+
+// graphSets get stages of every parameter set of pipeline p
+func graphSets(p Pipeline) ([]graphSet, error) {
+	var sets []graphSet
+	for i, vars := range p.Combinations() {
+		run := p.With(vars)
+		if _, err := run.Levels(); err != nil {
+			return nil, err
+		}
+		set := graphSet{id: fmt.Sprintf("m%d", i), label: matrixLabel(vars)}
+		ids := make(map[string]string)
+		for j, st := range run.Stages {
+			ids[st.StageName()] = fmt.Sprintf("%s_s%d", set.id, j)
+		}
+		for _, st := range run.Stages {
+			lines := []string{st.StageName()}
+			if st.Group != st.StageName() {
+				lines = append(lines, "group "+st.Group)
+			}
+			lines[len(lines)-1] += " (" + groupSize(st.Group) + ")"
+			steps := st.Steps
+			if len(steps) == 0 {
+				steps = run.Steps
+			}
+			for k, step := range steps {
+				step = step.For(st.Group)
+				desc := step.String()
+				if step.Deploy && step.Name == "" {
+					desc = deployLabel()
+				}
+				if step.Skip {
+					desc += " (skipped)"
+				}
+				lines = append(lines, fmt.Sprintf("%d. %s", k+1, Redact(desc)))
+			}
+			set.nodes = append(set.nodes, graphNode{id: ids[st.StageName()], lines: lines})
+			for _, d := range st.Depends {
+				set.edges = append(set.edges, [2]string{ids[d], ids[st.StageName()]})
+			}
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// PipelineGraph render stages of pipeline, their groups, steps and deploy strategy as a DOT or Mermaid diagram
+func PipelineGraph(name, format string) (string, error) {
+	p, ok := C.Pipelines[name]
+	if !ok {
+		return "", fmt.Errorf("No such pipeline: %s", name)
+	}
+	sets, err := graphSets(p)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	switch format {
+	case GraphDOT:
+		dotQuote := func(s string) string {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+		fmt.Fprintf(&b, "digraph %s {\n  rankdir=LR;\n  node [shape=box];\n", dotQuote(name))
+		for _, set := range sets {
+			indent := "  "
+			if set.label != "" {
+				fmt.Fprintf(&b, "  subgraph cluster_%s {\n    label=%s;\n", set.id, dotQuote(set.label))
+				indent = "    "
+			}
+			for _, n := range set.nodes {
+				// \l left aligns lines
+				label := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(strings.Join(n.lines, "\n"))
+				fmt.Fprintf(&b, "%s%s [label=\"%s\\l\"];\n", indent, n.id, strings.Replace(label, "\n", `\l`, -1))
+			}
+			for _, e := range set.edges {
+				fmt.Fprintf(&b, "%s%s -> %s;\n", indent, e[0], e[1])
+			}
+			if set.label != "" {
+				b.WriteString("  }\n")
+			}
+		}
+		b.WriteString("}\n")
+	case GraphMermaid:
+		mermaidEscape := strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace
+		b.WriteString("flowchart LR\n")
+		for _, set := range sets {
+			indent := "  "
+			if set.label != "" {
+				fmt.Fprintf(&b, "  subgraph %s [\"%s\"]\n", set.id, mermaidEscape(set.label))
+				indent = "    "
+			}
+			for _, n := range set.nodes {
+				var lines []string
+				for _, l := range n.lines {
+					lines = append(lines, mermaidEscape(l))
+				}
+				fmt.Fprintf(&b, "%s%s[\"%s\"]\n", indent, n.id, strings.Join(lines, "<br/>"))
+			}
+			for _, e := range set.edges {
+				fmt.Fprintf(&b, "%s%s --> %s\n", indent, e[0], e[1])
+			}
+			if set.label != "" {
+				b.WriteString("  end\n")
+			}
+		}
+	default:
+		return "", fmt.Errorf("Unknown graph format: %s, dot or mermaid", format)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// linkScript shell script hard linking a file of sum from the release current points to into dir as name, copying
+// it if the filesystem has no hard links. it prints linked or copied, nothing if no file of the previous release
+// matches and the artifact has to be uploaded
+func linkScript(dir, name, sum string) string {
+	cur, dst := shellQuote(path.Join(C.Deploy.Root, CurrentLink)), shellQuote(path.Join(dir, name))
+	var b strings.Builder
+	b.WriteString("command -v sha256sum >/dev/null || exit 0\n")
+	fmt.Fprintf(&b, "prev=$(readlink -f %s 2>/dev/null) && [ -d \"$prev\" ] && [ \"$prev\" != \"$(readlink -f %s)\" ] || exit 0\n",
+		cur, shellQuote(dir))
+	b.WriteString("for p in \"$prev\"/*; do\n")
+	b.WriteString("  [ -f \"$p\" ] && [ ! -L \"$p\" ] || continue\n")
+	fmt.Fprintf(&b, "  [ \"$(sha256sum < \"$p\" | cut -d' ' -f1)\" = %s ] || continue\n", shellQuote(sum))
+	if C.Deploy.Mode != 0 {
+		// the link shares permission with the previous release, where the same mode was set
+		fmt.Fprintf(&b, "  chmod %s \"$p\" || exit 1\n", strconv.FormatUint(uint64(C.Deploy.Mode), 8))
+	}
+	fmt.Fprintf(&b, "  ln -f \"$p\" %s 2>/dev/null && { echo linked; exit 0; }\n", dst)
+	fmt.Fprintf(&b, "  cp -p \"$p\" %s && { echo copied; exit 0; }\n", dst)
+	b.WriteString("  exit 1\n")
+	b.WriteString("done\n")
+	return b.String()
+}
+
+// linkUnchanged hard link artifact into release dir of hosts whose previous release has the same artifact, by
+// sha256 of its files. hosts still needing the upload and errors of hosts are returned
+func (r *Rolling) linkUnchanged(hosts []string, dir string) ([]string, map[string]string) {
+	sum, err := CachedChecksum(C.Deploy.Artifact)
+	if err != nil {
+		// nothing to compare with, upload to every host
+		return hosts, nil
+	}
+	output, errs, err := RunRemote(hosts, linkScript(dir, filepath.Base(C.Deploy.Artifact), sum))
+	if err != nil {
+		return hosts, nil
+	}
+	var upload []string
+	for _, h := range hosts {
+		if _, ok := errs[h]; ok {
+			continue
+		}
+		how := strings.TrimSpace(output[h])
+		if how != "linked" && how != "copied" {
+			upload = append(upload, h)
+			continue
+		}
+		if r.reused == nil {
+			r.reused = make(map[string]string)
+		}
+		r.reused[h] = how
+	}
+	return upload, errs
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// hashEntry sha256 of a local file as of its size and mtime
+type hashEntry struct {
+	Size  int64  `json:"size"`
+	MTime int64  `json:"mtime"` // unix nanoseconds
+	Sum   string `json:"sha256"`
+}
+
+var (
+	hashLock  sync.Mutex
+	hashCache map[string]hashEntry // absolute path => entry
+	hashDirty bool
+)
+
+// loadHashes load hash cache once, caller must hold hashLock
+func loadHashes() map[string]hashEntry {
+	if hashCache != nil {
+		return hashCache
+	}
+	hashCache = make(map[string]hashEntry)
+	// a missing or broken cache only costs hashing again
+	if _, err := loadState("hashes.json", &hashCache); err != nil || hashCache == nil {
+		hashCache = make(map[string]hashEntry)
+	}
+	return hashCache
+}
+
+// CachedChecksum get sha256 of local file, reused while its size and mtime are unchanged
+func CachedChecksum(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	hashLock.Lock()
+	e, ok := loadHashes()[abs]
+	hashLock.Unlock()
+	if ok && e.Size == fi.Size() && e.MTime == fi.ModTime().UnixNano() {
+		return e.Sum, nil
+	}
+	sum, err := FileChecksum(abs)
+	if err != nil {
+		return "", err
+	}
+	hashLock.Lock()
+	hashCache[abs] = hashEntry{Size: fi.Size(), MTime: fi.ModTime().UnixNano(), Sum: sum}
+	hashDirty = true
+	hashLock.Unlock()
+	return sum, nil
+}
+
+// HashFiles get sha256 of local files by a worker per core, keyed by path. the first error stops the workers
+func HashFiles(paths []string) (map[string]string, error) {
+	sums := make(map[string]string)
+	var lock sync.Mutex
+	var first error
+	ch := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range ch {
+				sum, err := CachedChecksum(p)
+				lock.Lock()
+				if err != nil && first == nil {
+					first = err
+				}
+				sums[p] = sum
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, p := range paths {
+		lock.Lock()
+		failed := first != nil
+		lock.Unlock()
+		if failed {
+			break
+		}
+		ch <- p
+	}
+	close(ch)
+	wg.Wait()
+	return sums, first
+}
+
+// SaveHashes save hash cache, entries of removed files are dropped
+func SaveHashes() error {
+	hashLock.Lock()
+	defer hashLock.Unlock()
+	if !hashDirty {
+		return nil
+	}
+	hashDirty = false
+	for p := range hashCache {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			delete(hashCache, p)
+		}
+	}
+	return saveState("hashes.json", hashCache)
+}
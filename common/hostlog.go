@@ -0,0 +1,73 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostLogs log file of every host of this run, opened on first write
+var hostLogs = struct {
+	sync.Mutex
+	files map[string]*os.File
+	err   error // first open error, reported once
+}{files: make(map[string]*os.File)}
+
+// HostLogPath get log file of host in this run, empty if host_log_dir is not configured
+func HostLogPath(host string) string {
+	if C.HostLogDir == "" {
+		return ""
+	}
+	return filepath.Join(C.HostLogDir, RunID, hostFileName(host)+".log")
+}
+
+// hostFileName get host as a file name
+func hostFileName(host string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|= `, r) {
+			return '_'
+		}
+		return r
+	}, host)
+}
+
+// hostLogf append a line to log file of host, secrets are redacted.
+// multi-line messages are indented so that every entry starts with its time
+func hostLogf(host, format string, args ...interface{}) {
+	p := HostLogPath(host)
+	if p == "" {
+		return
+	}
+	hostLogs.Lock()
+	defer hostLogs.Unlock()
+	f, ok := hostLogs.files[host]
+	if !ok {
+		err := os.MkdirAll(filepath.Dir(p), 0700)
+		if err == nil {
+			f, err = os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		}
+		if err != nil {
+			if hostLogs.err == nil {
+				hostLogs.err = err
+				fmt.Fprintf(Stderr, "Warning: host log: %s\n", err)
+			}
+			return
+		}
+		hostLogs.files[host] = f
+	}
+	msg := strings.TrimRight(Redact(fmt.Sprintf(format, args...)), "\n")
+	fmt.Fprintf(f, "%s %s\n", time.Now().Format("15:04:05.000"), strings.Replace(msg, "\n", "\n\t", -1))
+}
+
+// CloseHostLogs close log files of hosts
+func CloseHostLogs() {
+	hostLogs.Lock()
+	defer hostLogs.Unlock()
+	for h, f := range hostLogs.files {
+		f.Close()
+		delete(hostLogs.files, h)
+	}
+}
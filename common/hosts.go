@@ -0,0 +1,184 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HostSSH host reached by ssh, default
+	HostSSH = "ssh"
+	// HostLocal the machine running optool, configured as local or local://
+	HostLocal = "local"
+)
+
+// typePorts default ports of host types not reached by ssh
+var typePorts = map[string]int{
+	HostFTP:    21,
+	HostFTPS:   21,
+	HostWinRM:  5985,
+	HostWinRMS: 5986,
+	HostTelnet: 23,
+}
+
+// Host remote host, alias is the canonical key of host in results
+type Host struct {
+	Alias   string // host as configured
+	Type    string // set by type:// prefix of address, eg. local://
+	Address string
+	Port    int
+	Target  string // path after address of typed hosts, eg. container of docker://
+}
+
+// ParseHost parse host configured as address, address:port or alias=address:port
+// port defaults to server default port, address may be prefixed by host type, eg. local://
+func ParseHost(s string) Host {
+	h := Host{Alias: s, Type: HostSSH, Address: s, Port: C.Server.DefaultPort}
+	if i := strings.Index(s, "="); i > 0 {
+		h.Address = s[i+1:]
+	}
+	if i := strings.Index(h.Address, "://"); i > 0 {
+		h.Type, h.Address = h.Address[:i], h.Address[i+3:]
+		if i = strings.Index(h.Address, "/"); i >= 0 {
+			h.Address, h.Target = h.Address[:i], h.Address[i+1:]
+		}
+		if p, ok := typePorts[h.Type]; ok {
+			h.Port = p
+		}
+	} else if h.Address == HostLocal {
+		h.Type = HostLocal
+	}
+	if host, port, err := net.SplitHostPort(h.Address); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			h.Address, h.Port = host, p
+		}
+	}
+	h.Address = strings.Trim(h.Address, "[]")
+	return h
+}
+
+// Addr get address:port to dial
+func (h Host) Addr() string {
+	return net.JoinHostPort(h.Address, strconv.Itoa(h.Port))
+}
+
+// ReadHostList read hosts separated by newline, space or comma, lines starting with # are ignored
+func ReadHostList(r io.Reader) ([]string, error) {
+	var hosts []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, SplitHosts(line)...)
+	}
+	return hosts, sc.Err()
+}
+
+// ReadHostFile read host list from file, - for stdin
+func ReadHostFile(f string) ([]string, error) {
+	if f == "-" {
+		return ReadHostList(os.Stdin)
+	}
+	fd, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ReadHostList(fd)
+}
+
+// SplitHosts split hosts joined by comma or space
+func SplitHosts(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// AddHostTag add hosts to an ad-hoc group named by tag, spec is formatted as key=value:host1,host2
+// returns group name and hosts tagged
+func AddHostTag(spec string) (string, []string, error) {
+	i := strings.Index(spec, ":")
+	if i < 1 || !strings.Contains(spec[:i], "=") {
+		return "", nil, errors.New("Host tag must be formatted as key=value:host1,host2")
+	}
+	group := spec[:i]
+	hosts := SplitHosts(spec[i+1:])
+	if len(hosts) == 0 {
+		return "", nil, errors.New("No host tagged with " + group)
+	}
+	if C.Server.Hosts == nil {
+		C.Server.Hosts = make(map[string][]string)
+	}
+	C.Server.Hosts[group] = UniqueHosts(append(C.Server.Hosts[group], hosts...))
+	return group, hosts, nil
+}
+
+// MaxRangeHosts most hosts a host expression expands to, a typo like web[1-99999999] fails before any allocation
+const MaxRangeHosts = 10000
+
+// hostRange numeric range of host expression, [01:20] or [1-50]
+var hostRange = regexp.MustCompile(`\[(\d+)[:-](\d+)\]`)
+
+// ExpandRange expand ranges of host expression, eg. web[01:20].example.com or 10.0.0.[1-50]
+// leading zeros of range start are kept, several ranges are expanded in all combinations
+func ExpandRange(s string) ([]string, error) {
+	m := hostRange.FindStringSubmatchIndex(s)
+	if m == nil {
+		return []string{s}, nil
+	}
+	from, to := s[m[2]:m[3]], s[m[4]:m[5]]
+	start, err := strconv.Atoi(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := strconv.Atoi(to)
+	if err != nil {
+		return nil, err
+	}
+	if start > end {
+		return nil, fmt.Errorf("Invalid host range %s", s[m[0]:m[1]])
+	}
+	width := 0
+	if len(from) > 1 && from[0] == '0' {
+		width = len(from)
+	}
+	if end-start >= MaxRangeHosts {
+		return nil, fmt.Errorf("Host range %s exceeds %d hosts", s[m[0]:m[1]], MaxRangeHosts)
+	}
+	rest, err := ExpandRange(s[m[1]:])
+	if err != nil {
+		return nil, err
+	}
+	if (end-start+1)*len(rest) > MaxRangeHosts {
+		return nil, fmt.Errorf("Host expression %s exceeds %d hosts", s, MaxRangeHosts)
+	}
+	var hosts []string
+	for i := start; i <= end; i++ {
+		for _, r := range rest {
+			hosts = append(hosts, fmt.Sprintf("%s%0*d%s", s[:m[0]], width, i, r))
+		}
+	}
+	return hosts, nil
+}
+
+// UniqueHosts remove duplicated hosts, order is kept
+func UniqueHosts(hosts []string) []string {
+	seen := make(map[string]bool)
+	var uniq []string
+	for _, h := range hosts {
+		if !seen[h] {
+			seen[h] = true
+			uniq = append(uniq, h)
+		}
+	}
+	return uniq
+}
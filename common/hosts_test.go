@@ -0,0 +1,49 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandRange(t *testing.T) {
+	tests := []struct {
+		expr  string
+		hosts []string
+		err   string
+	}{
+		{"web1", []string{"web1"}, ""},
+		{"web[1-3]", []string{"web1", "web2", "web3"}, ""},
+		{"web[08:11].example.com", []string{"web08.example.com", "web09.example.com", "web10.example.com", "web11.example.com"}, ""},
+		{"10.0.0.[9-10]", []string{"10.0.0.9", "10.0.0.10"}, ""},
+		{"r[1-2]n[1-2]", []string{"r1n1", "r1n2", "r2n1", "r2n2"}, ""},
+		{"web[5-5]", []string{"web5"}, ""},
+		{"web[3-1]", nil, "Invalid host range [3-1]"},
+		{"web[1-99999999]", nil, "Host range [1-99999999] exceeds 10000 hosts"},
+		{"web[0-9999]", make([]string, MaxRangeHosts), ""},
+		{"r[1-200]n[1-200]", nil, "Host expression r[1-200]n[1-200] exceeds 10000 hosts"},
+	}
+	for _, tt := range tests {
+		hosts, err := ExpandRange(tt.expr)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ExpandRange(%q) error = %v, want %q", tt.expr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ExpandRange(%q) error = %v", tt.expr, err)
+			continue
+		}
+		if len(tt.hosts) == MaxRangeHosts {
+			// only the size matters for the cap
+			if len(hosts) != MaxRangeHosts {
+				t.Errorf("ExpandRange(%q) got %d hosts, want %d", tt.expr, len(hosts), MaxRangeHosts)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(hosts, tt.hosts) {
+			t.Errorf("ExpandRange(%q) = %v, want %v", tt.expr, hosts, tt.hosts)
+		}
+	}
+}
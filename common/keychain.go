@@ -0,0 +1,137 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// KeychainService service name of credentials stored in the OS keychain
+const KeychainService = "optool"
+
+// CredentialProvider store of named credentials
+type CredentialProvider interface {
+	Get(name string) (string, error)
+	Set(name, secret string) error
+	Delete(name string) error
+}
+
+// windowsCredentials Windows Credential Manager, set on windows only
+var windowsCredentials CredentialProvider
+
+// keychainCache credentials looked up in this run, hosts dial at the same time and the keychain may prompt for unlock
+var keychainCache = struct {
+	sync.Mutex
+	values map[string]string
+}{values: make(map[string]string)}
+
+// Keychain get credential provider of the OS: macOS Keychain, Windows Credential Manager or libsecret (secret-tool)
+func Keychain() (CredentialProvider, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return macKeychain{}, nil
+	case "windows":
+		if windowsCredentials != nil {
+			return windowsCredentials, nil
+		}
+	case "linux", "freebsd", "openbsd", "netbsd":
+		return secretTool{}, nil
+	}
+	return nil, fmt.Errorf("No keychain on %s", runtime.GOOS)
+}
+
+// Credential get credential of name from the OS keychain, it is registered as secret so that it is never logged
+func Credential(name string) (string, error) {
+	keychainCache.Lock()
+	defer keychainCache.Unlock()
+	if s, ok := keychainCache.values[name]; ok {
+		return s, nil
+	}
+	kc, err := Keychain()
+	if err != nil {
+		return "", err
+	}
+	s, err := kc.Get(name)
+	if err != nil {
+		return "", fmt.Errorf("Credential %s: %s", name, err)
+	}
+	RegisterSecret(s)
+	keychainCache.values[name] = s
+	return s, nil
+}
+
+// keychainError error of a keychain tool with its output
+func keychainError(err error, out []byte) error {
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return errors.New(msg)
+	}
+	return err
+}
+
+// macKeychain macOS Keychain by the security tool
+type macKeychain struct{}
+
+func (macKeychain) Get(name string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", KeychainService, "-a", name, "-w").Output()
+	if err != nil {
+		return "", errors.New("not found in keychain")
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func (macKeychain) Set(name, secret string) error {
+	// given on stdin of interactive mode, so that the secret is not in the process list
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+		securityQuote(KeychainService), securityQuote(name), securityQuote(secret)))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return keychainError(err, out)
+	}
+	return nil
+}
+
+func (macKeychain) Delete(name string) error {
+	out, err := exec.Command("security", "delete-generic-password", "-s", KeychainService, "-a", name).CombinedOutput()
+	if err != nil {
+		return keychainError(err, out)
+	}
+	return nil
+}
+
+// securityQuote quote s for a command line of security -i
+func securityQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// secretTool libsecret (GNOME Keyring, KWallet) by secret-tool
+type secretTool struct{}
+
+func (secretTool) Get(name string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", KeychainService, "account", name).Output()
+	if err != nil {
+		return "", errors.New("not found by secret-tool")
+	}
+	return string(out), nil
+}
+
+func (secretTool) Set(name, secret string) error {
+	cmd := exec.Command("secret-tool", "store", "--label", KeychainService+" "+name, "service", KeychainService, "account", name)
+	cmd.Stdin = strings.NewReader(secret)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return keychainError(err, out)
+	}
+	return nil
+}
+
+func (secretTool) Delete(name string) error {
+	out, err := exec.Command("secret-tool", "clear", "service", KeychainService, "account", name).CombinedOutput()
+	if err != nil {
+		return keychainError(err, out)
+	}
+	return nil
+}
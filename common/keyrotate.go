@@ -0,0 +1,324 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Phases of a host in a key rotation
+const (
+	RotatePending  = "pending"  // new key not pushed yet
+	RotatePushed   = "pushed"   // new key authorized next to the old one
+	RotateVerified = "verified" // login with the new key works
+	RotateDone     = "done"     // old key removed, only the new key is authorized
+)
+
+// KeyRotation rotation of auth.private_key, kept in state until it is finished so that it can be resumed
+type KeyRotation struct {
+	Started   time.Time         `json:"started"`
+	By        string            `json:"by"`
+	Key       string            `json:"key"`     // auth.private_key being rotated
+	NewKey    string            `json:"new_key"` // new private key, moved to key once every host is done
+	OldPublic string            `json:"old_public"`
+	NewPublic string            `json:"new_public"`
+	Hosts     map[string]string `json:"hosts"` // host => phase
+	// set once the new key replaced key, <key>.old is offered to hosts not rotated until the rotation is finished
+	Replaced time.Time `json:"replaced,omitempty"`
+}
+
+var (
+	rotationLock   sync.Mutex
+	rotationLoaded bool
+	rotationOther  ssh.Signer // key offered besides auth.private_key while a rotation is unfinished
+)
+
+// rotationSigner key of an unfinished rotation of auth.private_key other than it, nil if there is none: the new key
+// until it replaced auth.private_key, the old one then
+func rotationSigner() ssh.Signer {
+	rotationLock.Lock()
+	defer rotationLock.Unlock()
+	if !rotationLoaded {
+		rotationLoaded = true
+		var kr KeyRotation
+		if ok, err := loadState("keyrotation.json", &kr); err == nil && ok && kr.Key == C.Auth.PrivateKey {
+			rotationOther, _ = parsePrivateKey(kr.otherKey())
+		}
+	}
+	return rotationOther
+}
+
+// newKey file of the new key of kr
+func (kr *KeyRotation) newKey() string {
+	if kr.Replaced.IsZero() {
+		return kr.NewKey
+	}
+	return kr.Key
+}
+
+// otherKey file of the key of kr which is not auth.private_key
+func (kr *KeyRotation) otherKey() string {
+	if kr.Replaced.IsZero() {
+		return kr.NewKey
+	}
+	return kr.Key + ".old"
+}
+
+// rotationConfig client config logging in by signer alone
+func rotationConfig(signer ssh.Signer) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            C.Auth.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		Timeout:         CommandTimeout,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		ClientVersion:   sshClientVersion(),
+	}
+}
+
+// authorizedLine public key of signer as an authorized_keys line without comment
+func authorizedLine(pub ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+// newRotation generate a new ed25519 key next to auth.private_key, encrypted by the same passphrase, and start a
+// rotation of hosts
+func newRotation(hosts []string) (*KeyRotation, error) {
+	old, err := parsePrivateKey(C.Auth.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := privateKeyPhrase()
+	if err != nil {
+		return nil, err
+	}
+	comment := localDeployer() + " optool " + time.Now().Format("2006-01-02")
+	var block *pem.Block
+	if passphrase == nil {
+		block, err = ssh.MarshalPrivateKey(priv, comment)
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, comment, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	kr := &KeyRotation{
+		Started:   time.Now(),
+		By:        localDeployer(),
+		Key:       C.Auth.PrivateKey,
+		NewKey:    C.Auth.PrivateKey + ".new",
+		OldPublic: authorizedLine(old.PublicKey()),
+		NewPublic: authorizedLine(sshPub) + " " + comment,
+		Hosts:     make(map[string]string),
+	}
+	for _, h := range hosts {
+		kr.Hosts[h] = RotatePending
+	}
+	if err = writeLocal(kr.NewKey, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(expandHome(kr.NewKey)+".pub", []byte(kr.NewPublic+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return kr, saveState("keyrotation.json", kr)
+}
+
+// removeKeyScript shell script removing key from authorized_keys, prints removed or absent
+func removeKeyScript(key string) string {
+	return `F=~/.ssh/authorized_keys
+if [ -f "$F" ] && grep -qF ` + shellQuote(key) + ` "$F"; then
+  { grep -vF ` + shellQuote(key) + ` "$F" || true; } > "$F.optool-new-` + RunID + `" && cat "$F.optool-new-` + RunID + `" > "$F" || exit 1
+  rm -f "$F.optool-new-` + RunID + `"
+  echo removed
+else
+  echo absent
+fi`
+}
+
+// RotateKey rotate auth.private_key on hosts: a new key is generated and authorized next to the old one, login with
+// it is verified, then the old key is removed from authorized_keys. a rotation left unfinished by failed hosts is
+// resumed, hosts not in it are added. once every host is done the new key replaces auth.private_key locally and the
+// old one is kept as <key>.old, which is still offered so that hosts not rotated can be reached and rotated until
+// FinishRotation. phases reached and errors of this run are keyed by host
+func RotateKey(hosts []string) (*KeyRotation, map[string]string, map[string]string, error) {
+	if C.Auth.PrivateKey == "" {
+		return nil, nil, nil, errors.New("auth.private_key is not configured")
+	}
+	kr := &KeyRotation{}
+	ok, err := loadState("keyrotation.json", kr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ok && kr.Key != C.Auth.PrivateKey {
+		return nil, nil, nil, fmt.Errorf("Rotation of %s is unfinished", kr.Key)
+	}
+	if ok {
+		fmt.Fprintf(Stderr, "Resuming key rotation started at %s by %s\n", kr.Started.Format("2006-01-02 15:04"), kr.By)
+		for _, h := range hosts {
+			if _, known := kr.Hosts[h]; !known {
+				kr.Hosts[h] = RotatePending
+			}
+		}
+	} else if kr, err = newRotation(hosts); err != nil {
+		return nil, nil, nil, err
+	}
+	next, err := parsePrivateKey(kr.newKey())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	other, err := parsePrivateKey(kr.otherKey())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rotationLock.Lock()
+	rotationLoaded, rotationOther = true, other
+	rotationLock.Unlock()
+
+	output := make(map[string]string)
+	errs := make(map[string]string)
+	inPhase := func(phase string) []string {
+		var list []string
+		for h, p := range kr.Hosts {
+			if _, failed := errs[h]; !failed && p == phase {
+				list = append(list, h)
+			}
+		}
+		sort.Strings(list)
+		return list
+	}
+	advance := func(list []string, failed map[string]error, phase string) error {
+		for _, h := range list {
+			if e, ok := failed[h]; ok {
+				errs[h] = e.Error()
+				continue
+			}
+			kr.Hosts[h] = phase
+			output[h] = phase
+		}
+		return saveState("keyrotation.json", kr)
+	}
+
+	// the new key is pushed with the old one, logins by it are checked without the old key
+	script, err := authorizeKeyScript(kr.NewPublic, "~/.ssh")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if list := inPhase(RotatePending); len(list) > 0 {
+		_, failed, err := RunRemote(list, script)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ferrs := make(map[string]error)
+		for h, e := range failed {
+			ferrs[h] = errors.New(strings.TrimSpace(e))
+		}
+		if err = advance(list, ferrs, RotatePushed); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	cfg := rotationConfig(next)
+	if list := inPhase(RotatePushed); len(list) > 0 {
+		_, failed := runScript(list, cfg, "true")
+		if err = advance(list, failed, RotateVerified); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if list := inPhase(RotateVerified); len(list) > 0 {
+		_, failed := runScript(list, cfg, removeKeyScript(kr.OldPublic))
+		if err = advance(list, failed, RotateDone); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if !kr.Replaced.IsZero() || kr.pending() > 0 {
+		return kr, output, errs, nil
+	}
+	return kr, output, errs, replaceKey(kr)
+}
+
+// pending number of hosts of kr not done
+func (kr *KeyRotation) pending() int {
+	n := 0
+	for _, p := range kr.Hosts {
+		if p != RotateDone {
+			n++
+		}
+	}
+	return n
+}
+
+// replaceKey move the new key of kr into place of the rotated one, which is kept as <key>.old and offered until the
+// rotation is finished
+func replaceKey(kr *KeyRotation) error {
+	key, next := expandHome(kr.Key), expandHome(kr.NewKey)
+	for _, f := range []string{"", ".pub"} {
+		if _, err := os.Stat(key + f); err == nil {
+			if err = os.Rename(key+f, key+".old"+f); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(next+f, key+f); err != nil {
+			return err
+		}
+	}
+	kr.Replaced = time.Now()
+	if err := saveState("keyrotation.json", kr); err != nil {
+		return err
+	}
+	old, err := parsePrivateKey(kr.otherKey())
+	if err != nil {
+		return err
+	}
+	rotationLock.Lock()
+	rotationOther = old
+	rotationLock.Unlock()
+	return nil
+}
+
+// FinishRotation end a rotation whose new key replaced auth.private_key once login by it alone is verified on hosts,
+// <key>.old is no longer offered then. hosts failing it are keyed by host
+func FinishRotation(hosts []string) (map[string]string, error) {
+	kr := &KeyRotation{}
+	ok, err := loadState("keyrotation.json", kr)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || kr.Key != C.Auth.PrivateKey {
+		return nil, errors.New("No key rotation to finish")
+	}
+	if kr.Replaced.IsZero() || kr.pending() > 0 {
+		return nil, fmt.Errorf("Key rotation unfinished on %d host(s), run keys rotate again to resume", kr.pending())
+	}
+	key, err := parsePrivateKey(kr.Key)
+	if err != nil {
+		return nil, err
+	}
+	_, failed := runScript(hosts, rotationConfig(key), "true")
+	if len(failed) > 0 {
+		errs := make(map[string]string)
+		for h, e := range failed {
+			errs[h] = e.Error()
+		}
+		return errs, fmt.Errorf("Login by the new key failed on %d host(s), rotate them by keys rotate first", len(failed))
+	}
+	rotationLock.Lock()
+	rotationLoaded, rotationOther = true, nil
+	rotationLock.Unlock()
+	return nil, deleteState("keyrotation.json")
+}
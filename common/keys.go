@@ -0,0 +1,122 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// passwordClientConfig ssh config authenticating by password only, used before keys are installed on hosts
+func passwordClientConfig() *ssh.ClientConfig {
+	_, password := credentials("", "")
+	return &ssh.ClientConfig{
+		User: C.Auth.User,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}),
+		},
+		Timeout:         10 * time.Second,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		ClientVersion:   sshClientVersion(),
+	}
+}
+
+// runScript run script on ssh hosts, combined output is keyed by host
+func runScript(hosts []string, cfg *ssh.ClientConfig, script string) (map[string]string, map[string]error) {
+	output := make(map[string]string)
+	lock := sync.Mutex{}
+	errs := RunHosts(hosts, func(ctx context.Context, h string) error {
+		host := ParseHost(h)
+		if host.Type != HostSSH {
+			return fmt.Errorf("Not supported by %s hosts", host.Type)
+		}
+		client, err := DefaultDialer.Dial("tcp", host.Addr(), cfg)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		sess, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		defer sess.Close()
+		out, err := sess.CombinedOutput(script)
+		if err != nil {
+			return fmt.Errorf("%s %s", err, strings.TrimSpace(string(out)))
+		}
+		lock.Lock()
+		output[h] = strings.TrimSpace(string(out))
+		lock.Unlock()
+		return nil
+	})
+	return output, errs
+}
+
+// authorizeKeyScript shell script appending key to authorized_keys under dir unless key is there
+// dir is a shell word, eg. ~/.ssh, it is created with authorized_keys and chmod 700/600, prints added or present
+func authorizeKeyScript(key, dir string) (string, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", fmt.Errorf("Invalid public key: %s", err)
+	}
+	// keys are compared without comment
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	entry := line
+	if comment != "" {
+		entry += " " + comment
+	}
+	return `D=` + dir + `
+(umask 077; mkdir -p "$D" && chmod 700 "$D" && touch "$D/authorized_keys" && chmod 600 "$D/authorized_keys") || exit 1
+if grep -qF ` + shellQuote(line) + ` "$D/authorized_keys"; then echo present; else
+  [ -s "$D/authorized_keys" ] && [ "$(tail -c 1 "$D/authorized_keys")" != "" ] && echo >> "$D/authorized_keys"
+  echo ` + shellQuote(entry) + ` >> "$D/authorized_keys" && echo added || exit 1
+fi
+command -v restorecon >/dev/null 2>&1 && restorecon -R "$D" >/dev/null 2>&1
+true`, nil
+}
+
+// PushKey append public key to authorized_keys of auth user on hosts by password auth
+// result of every host is added or present
+func PushKey(hosts []string, key string) (map[string]string, map[string]error) {
+	script, err := authorizeKeyScript(key, "~/.ssh")
+	if err != nil {
+		errs := make(map[string]error)
+		for _, h := range hosts {
+			errs[h] = err
+		}
+		return nil, errs
+	}
+	return runScript(hosts, passwordClientConfig(), script)
+}
+
+// ReadPublicKey read public key file, ~/.ssh/id_ed25519.pub, id_ecdsa.pub or id_rsa.pub is used if f is empty
+func ReadPublicKey(f string) (string, error) {
+	if f == "" {
+		for _, name := range []string{"id_ed25519.pub", "id_ecdsa.pub", "id_rsa.pub"} {
+			p := filepath.Join(homeDir(), ".ssh", name)
+			if _, err := os.Stat(p); err == nil {
+				f = p
+				break
+			}
+		}
+		if f == "" {
+			return "", errors.New("No public key found in ~/.ssh")
+		}
+	}
+	key, err := ioutil.ReadFile(expandHome(f))
+	return string(key), err
+}
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// LBHAProxy drain by haproxy runtime api socket
+	LBHAProxy = "haproxy"
+	// LBNginx drain by commenting out server in nginx upstream file
+	LBNginx = "nginx"
+	// LBAWS drain by aws elbv2 target group deregistration
+	LBAWS = "aws"
+)
+
+// LBConfig configures load balancer integration
+type LBConfig struct {
+	Type           string            `yaml:"type"`             // haproxy,nginx,aws
+	Host           string            `yaml:"host"`             // load balancer host to run commands on (haproxy,nginx)
+	Socket         string            `yaml:"socket"`           // haproxy admin socket, default /var/run/haproxy.sock
+	Backend        string            `yaml:"backend"`          // haproxy backend name
+	ServerNames    map[string]string `yaml:"server_names"`     // host => server name in lb, default host itself
+	UpstreamFile   string            `yaml:"upstream_file"`    // nginx upstream file
+	Reload         string            `yaml:"reload"`           // nginx reload command
+	Port           int               `yaml:"port"`             // backend port (nginx,aws)
+	TargetGroupARN string            `yaml:"target_group_arn"` // aws target group
+}
+
+// LoadBalancer drain a host before deploying and enable it afterwards
+type LoadBalancer interface {
+	Drain(host string) error
+	Enable(host string) error
+}
+
+// NewLoadBalancer get load balancer from configure, nil if not configured
+func NewLoadBalancer(c LBConfig) (LoadBalancer, error) {
+	switch c.Type {
+	case "":
+		return nil, nil
+	case LBHAProxy:
+		if c.Host == "" || c.Backend == "" {
+			return nil, errors.New("haproxy load balancer requires host and backend")
+		}
+		if c.Socket == "" {
+			c.Socket = "/var/run/haproxy.sock"
+		}
+		return &haproxyLB{c}, nil
+	case LBNginx:
+		if c.Host == "" || c.UpstreamFile == "" {
+			return nil, errors.New("nginx load balancer requires host and upstream_file")
+		}
+		if c.Reload == "" {
+			c.Reload = "/usr/sbin/nginx -s reload"
+		}
+		return &nginxLB{c}, nil
+	case LBAWS:
+		if c.TargetGroupARN == "" {
+			return nil, errors.New("aws load balancer requires target_group_arn")
+		}
+		return &awsLB{c}, nil
+	}
+	return nil, fmt.Errorf("Unknown load balancer type: %s", c.Type)
+}
+
+func (c LBConfig) serverName(host string) string {
+	if name, ok := c.ServerNames[host]; ok {
+		return name
+	}
+	return host
+}
+
+// runOnLB run command on the load balancer host
+func runOnLB(lbHost, cmd string) error {
+	_, errs, err := RunRemote([]string{lbHost}, cmd)
+	if err != nil {
+		return err
+	}
+	if e, ok := errs[lbHost]; ok {
+		return errors.New(strings.TrimSpace(e))
+	}
+	return nil
+}
+
+type haproxyLB struct {
+	c LBConfig
+}
+
+func (lb *haproxyLB) state(host, state string) error {
+	return runOnLB(lb.c.Host, fmt.Sprintf("echo 'set server %s/%s state %s' | socat stdio %s",
+		lb.c.Backend, lb.c.serverName(host), state, lb.c.Socket))
+}
+
+// Drain set server state to drain
+func (lb *haproxyLB) Drain(host string) error {
+	return lb.state(host, "drain")
+}
+
+// Enable set server state to ready
+func (lb *haproxyLB) Enable(host string) error {
+	return lb.state(host, "ready")
+}
+
+type nginxLB struct {
+	c LBConfig
+}
+
+func (lb *nginxLB) server(host string) string {
+	s := lb.c.serverName(host)
+	if lb.c.Port > 0 {
+		s += ":" + strconv.Itoa(lb.c.Port)
+	}
+	return strings.Replace(s, ".", "\\.", -1)
+}
+
+// Drain mark server down in upstream file and reload
+func (lb *nginxLB) Drain(host string) error {
+	return runOnLB(lb.c.Host, fmt.Sprintf("sed -i -E 's/^([[:space:]]*server[[:space:]]+%s)[[:space:]]*;/\\1 down;/' %s && %s",
+		lb.server(host), lb.c.UpstreamFile, lb.c.Reload))
+}
+
+// Enable remove down mark in upstream file and reload
+func (lb *nginxLB) Enable(host string) error {
+	return runOnLB(lb.c.Host, fmt.Sprintf("sed -i -E 's/^([[:space:]]*server[[:space:]]+%s)[[:space:]]+down;/\\1;/' %s && %s",
+		lb.server(host), lb.c.UpstreamFile, lb.c.Reload))
+}
+
+type awsLB struct {
+	c LBConfig
+}
+
+func (lb *awsLB) target(host string) string {
+	t := "Id=" + lb.c.serverName(host)
+	if lb.c.Port > 0 {
+		t += ",Port=" + strconv.Itoa(lb.c.Port)
+	}
+	return t
+}
+
+func (lb *awsLB) run(args ...string) error {
+	out, err := exec.Command("aws", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Drain deregister target and wait until it is drained
+func (lb *awsLB) Drain(host string) error {
+	if err := lb.run("elbv2", "deregister-targets", "--target-group-arn", lb.c.TargetGroupARN, "--targets", lb.target(host)); err != nil {
+		return err
+	}
+	return lb.run("elbv2", "wait", "target-deregistered", "--target-group-arn", lb.c.TargetGroupARN, "--targets", lb.target(host))
+}
+
+// Enable register target again
+func (lb *awsLB) Enable(host string) error {
+	return lb.run("elbv2", "register-targets", "--target-group-arn", lb.c.TargetGroupARN, "--targets", lb.target(host))
+}
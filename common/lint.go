@@ -0,0 +1,314 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LintIssue problem found in configure without connecting to any host
+type LintIssue struct {
+	Where   string // eg. pipeline release stage web step 2
+	Message string
+}
+
+func (li LintIssue) String() string {
+	return li.Where + ": " + li.Message
+}
+
+// lintVar {name} replaced by matrix vars, ${name} of shells is not one
+var lintVar = regexp.MustCompile(`(^|[^$]){([A-Za-z_][A-Za-z0-9_]*)}`)
+
+// Lint statically check pipelines and inventory of configure
+func Lint() []LintIssue {
+	var issues []LintIssue
+	add := func(where, format string, args ...interface{}) {
+		issues = append(issues, LintIssue{where, fmt.Sprintf(format, args...)})
+	}
+	var names []string
+	for name := range C.Pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lintPipeline("pipeline "+name, C.Pipelines[name], add)
+	}
+	lintInventory(add)
+	return issues
+}
+
+// lintPipeline check pipeline p, and each parameter set of its matrix
+func lintPipeline(where string, p Pipeline, add func(where, format string, args ...interface{})) {
+	undefined := func(w, s string) {
+		for _, m := range lintVar.FindAllStringSubmatch(s, -1) {
+			if _, ok := p.Matrix[m[2]]; !ok {
+				add(w, "undefined variable {%s}", m[2])
+			}
+		}
+	}
+	checkSteps := func(w string, steps []Step) {
+		for i, s := range steps {
+			sw := fmt.Sprintf("%s step %d", w, i+1)
+			undefined(sw, s.Name)
+			undefined(sw, s.Exec)
+			undefined(sw, s.Profile)
+			for g, o := range s.Overrides {
+				undefined(sw+" override "+g, g)
+				undefined(sw+" override "+g, o.Exec)
+				undefined(sw+" override "+g, o.Profile)
+			}
+		}
+	}
+	if len(p.Stages) == 0 {
+		add(where, "no stages")
+	}
+	checkSteps(where, p.Steps)
+	ownSteps := 0
+	for _, st := range p.Stages {
+		sw := where + " stage " + st.StageName()
+		undefined(sw, st.Name)
+		undefined(sw, st.Group)
+		for _, d := range st.Depends {
+			undefined(sw, d)
+		}
+		checkSteps(sw, st.Steps)
+		if len(st.Steps) > 0 {
+			ownSteps++
+		}
+	}
+	if len(p.Steps) > 0 && len(p.Stages) > 0 && ownSteps == len(p.Stages) {
+		add(where, "steps are never run, every stage has its own steps")
+	}
+	for _, vars := range p.Combinations() {
+		w := where
+		if len(vars) > 0 {
+			w += " " + matrixLabel(vars)
+		}
+		lintRun(w, p.With(vars), add)
+	}
+}
+
+// lintRun check a pipeline whose vars are replaced
+func lintRun(where string, p Pipeline, add func(where, format string, args ...interface{})) {
+	if _, err := p.Levels(); err != nil {
+		add(where, "%s", err)
+	}
+	stageGroups := make(map[string]bool)
+	for _, st := range p.Stages {
+		stageGroups[st.Group] = true
+	}
+	// overrides of groups without a stage never apply
+	checkOverrides := func(w string, steps []Step) {
+		for i, s := range steps {
+			for g := range s.Overrides {
+				if !stageGroups[g] {
+					add(fmt.Sprintf("%s step %d", w, i+1), "override of %s never applies, no stage runs it", g)
+				}
+			}
+		}
+	}
+	checkOverrides(where, p.Steps)
+	for _, st := range p.Stages {
+		sw := where + " stage " + st.StageName()
+		if _, ok := C.Server.Hosts[st.Group]; !ok {
+			add(sw, "host group not found: %s", st.Group)
+		}
+		checkOverrides(sw, st.Steps)
+		steps := st.Steps
+		if len(steps) == 0 {
+			steps = p.Steps
+		}
+		if len(steps) == 0 {
+			add(sw, "no steps")
+		}
+		run := 0
+		for i, step := range steps {
+			step = step.For(st.Group)
+			if step.Skip {
+				continue
+			}
+			run++
+			lintStep(fmt.Sprintf("%s step %d", sw, i+1), step, add)
+		}
+		if len(steps) > 0 && run == 0 {
+			add(sw, "every step is skipped")
+		}
+	}
+}
+
+// lintStep check a step of a stage
+func lintStep(where string, s Step, add func(where, format string, args ...interface{})) {
+	if s.Maintenance && C.Deploy.Maintenance.Type == "" {
+		add(where, "runs in maintenance, but deploy.maintenance.type is not configured")
+	}
+	switch {
+	case s.Exec != "":
+	case s.Profile != "":
+		if _, ok := C.Profiles[s.Profile]; !ok {
+			add(where, "profile not found: %s", s.Profile)
+		}
+	case s.Deploy:
+		if C.Deploy.Artifact == "" && C.Deploy.Build.Output == "" {
+			add(where, "deploys, but deploy.artifact is not configured")
+		}
+	case s.Env:
+		if C.EnvFile.Path == "" {
+			add(where, "writes env file, but env_file.path is not configured")
+		}
+	case s.Config != "":
+		if _, ok := C.Configs[s.Config]; !ok {
+			add(where, "config not found: %s", s.Config)
+		}
+	case s.Cert != "":
+		if _, ok := C.Certs[s.Cert]; !ok {
+			add(where, "cert not found: %s", s.Cert)
+		}
+	default:
+		add(where, "sets none of exec, profile, deploy, env, config and cert")
+	}
+}
+
+// lintInventory check groups, hosts outside groups and groups referenced by other settings
+func lintInventory(add func(where, format string, args ...interface{})) {
+	known := make(map[string]bool) // hosts listed in groups
+	var groups []string
+	for g, list := range C.Server.Hosts {
+		groups = append(groups, g)
+		for _, entry := range list {
+			if expanded, err := ExpandRange(entry); err == nil {
+				for _, h := range expanded {
+					known[h] = true
+					known[ParseHost(h).Address] = true
+				}
+			} else {
+				add("group "+g, "%s", err)
+			}
+		}
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		if len(C.Server.Hosts[g]) == 0 {
+			add("group "+g, "no hosts")
+		}
+	}
+	group := func(where, g string) {
+		if _, ok := C.Server.Hosts[g]; !ok && g != "" {
+			add(where, "host group not found: %s", g)
+		}
+	}
+	// a host entry names a host of a group, or a group for profiles
+	host := func(where, h string, groupsToo bool) {
+		if _, ok := C.Server.Hosts[h]; ok && groupsToo {
+			return
+		}
+		if !known[h] && !known[ParseHost(h).Address] {
+			add(where, "host %s is in no group", h)
+		}
+	}
+	group("server.default_group", C.Server.DefaultGroup)
+	var names []string
+	for name := range C.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pf := C.Profiles[name]
+		for _, h := range SplitHosts(pf.Hosts) {
+			host("profile "+name, h, true)
+		}
+		if pf.From != "" {
+			host("profile "+name, pf.From, false)
+		}
+		if strings.ToUpper(pf.Method) == TransferGet || pf.From != "" || pf.Local == "" || pf.Local == TransferStdin {
+			continue
+		}
+		if _, err := os.Stat(pf.Local); err != nil {
+			add("profile "+name, "local file not found: %s", pf.Local)
+		}
+	}
+	var sshHosts []string
+	for h := range C.SSH.Hosts {
+		sshHosts = append(sshHosts, h)
+	}
+	sort.Strings(sshHosts)
+	for _, h := range sshHosts {
+		host("ssh.hosts", h, false)
+	}
+	for _, g := range C.Approval.Groups {
+		group("approval.groups", g)
+	}
+	if len(C.Approval.Groups) > 0 && C.Approval.Dir == "" {
+		add("approval", "groups are set, but approval.dir is not configured")
+	}
+	for _, g := range C.Change.Protected {
+		group("change.protected", g)
+	}
+	for _, g := range C.Deploy.Signature.Protected {
+		group("deploy.signature.protected", g)
+	}
+	for _, r := range C.Policy.Rules {
+		for _, g := range r.Groups {
+			group("policy rule "+r.Name, g)
+		}
+	}
+	for _, f := range C.Policy.Files {
+		if _, err := os.Stat(expandHome(f)); err != nil {
+			add("policy.files", "file not found: %s", f)
+		}
+	}
+	var configs []string
+	for name := range C.Configs {
+		configs = append(configs, name)
+	}
+	sort.Strings(configs)
+	for _, name := range configs {
+		if _, err := os.Stat(expandHome(C.Configs[name].Local)); err != nil {
+			add("config "+name, "local file not found: %s", C.Configs[name].Local)
+		}
+	}
+	if len(C.Certs) > 0 {
+		certs, _ := CertNames(nil)
+		for _, name := range certs {
+			cc := C.Certs[name]
+			if len(cc.Domains) > 0 {
+				if C.ACME.Present == "" {
+					add("cert "+name, "has domains, but acme.present is not configured")
+				}
+				if _, err := os.Stat(expandHome(cc.Cert)); os.IsNotExist(err) {
+					// obtained by the first renew
+					continue
+				}
+			}
+			if _, err := loadCert(name); err != nil {
+				add("certs", "%s", err)
+			}
+		}
+	}
+	if _, err := ServiceOrder(); err != nil {
+		add("deploy.services", "%s", err)
+	}
+	for _, sc := range C.Deploy.Services {
+		for _, g := range sc.Groups {
+			group("deploy.services "+sc.Name, g)
+		}
+	}
+	switch a := C.Clock.Action; a {
+	case "", "warn", "fail":
+	default:
+		add("clock", "unknown action %s, want warn or fail", a)
+	}
+	switch a := C.Deploy.Reboot.Action; a {
+	case "", RebootWarn, RebootConfirm, RebootFail:
+	default:
+		add("deploy.reboot", "unknown action %s, want warn, confirm or fail", a)
+	}
+	for _, u := range C.RBAC.Users {
+		for g := range u.Roles {
+			if g != "*" {
+				group("rbac user "+u.Name, g)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// MaintenanceFile maintenance page is on while flag file exists
+	MaintenanceFile = "file"
+	// MaintenanceSymlink swap a symlink between normal and maintenance target
+	MaintenanceSymlink = "symlink"
+	// MaintenanceURL call urls to turn maintenance on and off
+	MaintenanceURL = "url"
+)
+
+// MaintenanceConfig configures maintenance page toggle
+type MaintenanceConfig struct {
+	Type       string `yaml:"type"`        // file,symlink,url
+	File       string `yaml:"file"`        // flag file
+	Link       string `yaml:"link"`        // symlink to swap
+	Target     string `yaml:"target"`      // symlink target during maintenance
+	Normal     string `yaml:"normal"`      // symlink target of normal page
+	EnableURL  string `yaml:"enable_url"`  // {host} will be replaced
+	DisableURL string `yaml:"disable_url"` // {host} will be replaced
+}
+
+// Maintenance toggle maintenance page on hosts
+type Maintenance struct {
+	Hosts  []string
+	Failed map[string]string // host => error
+}
+
+// NewMaintenance get maintenance page toggle
+func NewMaintenance(hosts []string) *Maintenance {
+	return &Maintenance{
+		Hosts:  hosts,
+		Failed: make(map[string]string),
+	}
+}
+
+// Enable turn maintenance page on
+func (m *Maintenance) Enable() error {
+	return m.toggle(true)
+}
+
+// Disable turn maintenance page off
+func (m *Maintenance) Disable() error {
+	return m.toggle(false)
+}
+
+// Wrap run fn with maintenance page on, and always turn it off after fn returns
+func (m *Maintenance) Wrap(fn func() error) error {
+	if err := m.Enable(); err != nil {
+		failed := m.Failed
+		m.Disable()
+		// hosts failing to turn it on are reported by that error
+		for h, e := range failed {
+			m.Failed[h] = e
+		}
+		return err
+	}
+	err := fn()
+	if derr := m.Disable(); derr != nil && err == nil {
+		err = derr
+	}
+	return err
+}
+
+// toggle turn maintenance page on or off, Failed holds hosts failing this toggle only
+func (m *Maintenance) toggle(on bool) error {
+	m.Failed = make(map[string]string)
+	mc := C.Deploy.Maintenance
+	var cmd string
+	switch mc.Type {
+	case MaintenanceFile:
+		if mc.File == "" {
+			return errors.New("deploy.maintenance.file is not configured")
+		}
+		cmd = "rm -f " + shellQuote(mc.File)
+		if on {
+			cmd = "touch " + shellQuote(mc.File)
+		}
+	case MaintenanceSymlink:
+		if mc.Link == "" || mc.Target == "" || mc.Normal == "" {
+			return errors.New("deploy.maintenance requires link, target and normal")
+		}
+		target := mc.Normal
+		if on {
+			target = mc.Target
+		}
+		tmp := runTemp(mc.Link, "link")
+		cmd = "ln -sfn " + shellQuote(target) + " " + shellQuote(tmp) + " && mv -T " + shellQuote(tmp) + " " + shellQuote(mc.Link)
+	case MaintenanceURL:
+		u := mc.DisableURL
+		if on {
+			u = mc.EnableURL
+		}
+		for _, h := range m.Hosts {
+			if err := callURL(ExpandVars(u, map[string]string{"host": h})); err != nil {
+				m.Failed[h] = err.Error()
+			}
+		}
+		return m.err()
+	default:
+		return fmt.Errorf("Unknown maintenance type: %s", mc.Type)
+	}
+	_, errs, err := RunRemote(m.Hosts, cmd)
+	if err != nil {
+		return err
+	}
+	for h, e := range errs {
+		m.Failed[h] = strings.TrimSpace(e)
+	}
+	return m.err()
+}
+
+func (m *Maintenance) err() error {
+	if len(m.Failed) > 0 {
+		return fmt.Errorf("Maintenance toggle failed on %d host(s)", len(m.Failed))
+	}
+	return nil
+}
+
+// PrettyPrint print hosts failed to toggle
+func (m *Maintenance) PrettyPrint() {
+	for h, e := range m.Failed {
+		fmt.Fprintf(Stdout, "%21s: ERROR %s\n", h, e)
+	}
+}
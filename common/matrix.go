@@ -0,0 +1,140 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Combinations get parameter sets of matrix, every value of a key combined with every value of other keys
+// keys are ordered by name, a pipeline without matrix has a single empty set
+func (p Pipeline) Combinations() []map[string]string {
+	var keys []string
+	for k := range p.Matrix {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sets := []map[string]string{{}}
+	for _, k := range keys {
+		var next []map[string]string
+		for _, set := range sets {
+			for _, v := range p.Matrix[k] {
+				vars := map[string]string{k: v}
+				for sk, sv := range set {
+					vars[sk] = sv
+				}
+				next = append(next, vars)
+			}
+		}
+		sets = next
+	}
+	return sets
+}
+
+// With get pipeline with {name} of matrix vars replaced in stage names, groups, dependencies and steps
+func (p Pipeline) With(vars map[string]string) Pipeline {
+	if len(vars) == 0 {
+		return p
+	}
+	expand := func(steps []Step) []Step {
+		var expanded []Step
+		for _, s := range steps {
+			overrides := make(map[string]Step)
+			for g, o := range s.Overrides {
+				overrides[ExpandVars(g, vars)] = expandStep(o, vars)
+			}
+			s = expandStep(s, vars)
+			s.Overrides = overrides
+			expanded = append(expanded, s)
+		}
+		return expanded
+	}
+	with := Pipeline{Steps: expand(p.Steps)}
+	for _, st := range p.Stages {
+		var depends []string
+		for _, d := range st.Depends {
+			depends = append(depends, ExpandVars(d, vars))
+		}
+		with.Stages = append(with.Stages, Stage{
+			Name:    ExpandVars(st.Name, vars),
+			Group:   ExpandVars(st.Group, vars),
+			Depends: depends,
+			Steps:   expand(st.Steps),
+		})
+	}
+	return with
+}
+
+func expandStep(s Step, vars map[string]string) Step {
+	s.Name = ExpandVars(s.Name, vars)
+	s.Exec = ExpandVars(s.Exec, vars)
+	s.Profile = ExpandVars(s.Profile, vars)
+	return s
+}
+
+// matrixLabel describe parameter set, eg. region=eu,service=api
+func matrixLabel(vars map[string]string) string {
+	var pairs []string
+	for k, v := range vars {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// RunPipeline run named pipeline once per parameter set of its matrix, sequentially or at the same time
+// with matrix_parallel. runs are returned in matrix order for reporting
+func RunPipeline(name string, deploy func(group string, hosts []string) error) ([]*PipelineRun, error) {
+	p, ok := C.Pipelines[name]
+	if !ok {
+		return nil, fmt.Errorf("No such pipeline: %s", name)
+	}
+	var runs []*PipelineRun
+	for _, vars := range p.Combinations() {
+		runs = append(runs, &PipelineRun{
+			Pipeline: p.With(vars),
+			Label:    matrixLabel(vars),
+			Deploy:   deploy,
+			Result:   make(map[string]error),
+		})
+	}
+	// a broken DAG of any set fails the whole run before anything starts
+	for _, pr := range runs {
+		if _, err := pr.Pipeline.Levels(); err != nil {
+			if pr.Label != "" {
+				err = fmt.Errorf("%s: %s", pr.Label, err)
+			}
+			return nil, err
+		}
+	}
+	errs := make([]error, len(runs))
+	if p.MatrixParallel {
+		wg := sync.WaitGroup{}
+		for i, pr := range runs {
+			wg.Add(1)
+			go func(i int, pr *PipelineRun) {
+				defer wg.Done()
+				errs[i] = pr.Start()
+			}(i, pr)
+		}
+		wg.Wait()
+	} else {
+		for i, pr := range runs {
+			errs[i] = pr.Start()
+		}
+	}
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		if len(runs) > 1 {
+			return runs, fmt.Errorf("%d of %d matrix run(s) failed", failed, len(runs))
+		}
+		return runs, errs[0]
+	}
+	return runs, nil
+}
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// MetaFile deploy metadata written into every deployed release dir
+	MetaFile = "deploy.json"
+	// RevisionFile git revision written into every deployed release dir
+	RevisionFile = "REVISION"
+)
+
+// RunIDEnv environment variable holding run id, set for local commands. a run id set by the caller is used as is
+const RunIDEnv = "OPTOOL_RUN_ID"
+
+// RunID unique id of this invocation, found in logs, remote temp paths, releases, deploy metadata and reports
+var RunID = newRunID()
+
+func init() {
+	os.Setenv(RunIDEnv, RunID)
+}
+
+// newRunID time ordered random id, eg. 20261016T093925-3f9a1c
+func newRunID() string {
+	if id := os.Getenv(RunIDEnv); id != "" {
+		return id
+	}
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// runTemp remote temp path of kind next to p, named by run id so that leftovers of a run are traceable
+func runTemp(p, kind string) string {
+	return p + ".optool-" + kind + "-" + RunID
+}
+
+// DeployMeta what is running in a release dir, written after activation
+type DeployMeta struct {
+	Revision string    `json:"revision,omitempty"` // git revision of local working dir
+	Artifact string    `json:"artifact"`           // artifact file name
+	Checksum string    `json:"checksum"`           // sha256 of artifact
+	Deployer string    `json:"deployer"`           // user@host running optool
+	Version  string    `json:"optool"`
+	RunID    string    `json:"run_id"`
+	Deployed time.Time `json:"deployed"`
+}
+
+// gitRevision get HEAD revision of local working dir, empty if it is not a git repository
+func gitRevision() string {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// localDeployer get user@host running optool
+func localDeployer() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+// NewDeployMeta get metadata of deploying local artifact
+func NewDeployMeta(artifact string) (DeployMeta, error) {
+	sum, err := FileChecksum(artifact)
+	if err != nil {
+		return DeployMeta{}, err
+	}
+	return DeployMeta{
+		Revision: gitRevision(),
+		Artifact: filepath.Base(artifact),
+		Checksum: sum,
+		Deployer: localDeployer(),
+		Version:  Version,
+		RunID:    RunID,
+		Deployed: time.Now(),
+	}, nil
+}
+
+// WriteMeta write deploy.json and REVISION of artifact into dir on hosts, errors are keyed by host
+func WriteMeta(hosts []string, dir, artifact string) (map[string]string, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	meta, err := NewDeployMeta(artifact)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	cmd := "printf '%s\\n' " + shellQuote(string(data)) + " > " + shellQuote(path.Join(dir, MetaFile)) +
+		" && printf '%s\\n' " + shellQuote(meta.Revision) + " > " + shellQuote(path.Join(dir, RevisionFile))
+	_, errs, err := RunRemote(hosts, cmd)
+	return errs, err
+}
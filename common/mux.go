@@ -0,0 +1,123 @@
+package common
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MuxDefaultMaxChannels channels open at the same time on a shared connection, MaxSessions of sshd defaults to 10
+const MuxDefaultMaxChannels = 10
+
+// MuxConfig share one ssh connection per host among commands and transfers of a run
+type MuxConfig struct {
+	Disabled    bool `yaml:"disabled"`     // dial a connection for every command and transfer
+	MaxChannels int  `yaml:"max_channels"` // commands and transfers using a connection at the same time
+}
+
+type muxKey struct {
+	dialer Dialer
+	addr   string
+	user   string
+}
+
+// muxConn shared connection, slots limit its open channels
+type muxConn struct {
+	key    muxKey
+	client *ssh.Client
+	err    error
+	ready  chan struct{} // closed once dialed
+	slots  chan struct{}
+}
+
+var muxPool = struct {
+	sync.Mutex
+	conns   map[muxKey]*muxConn
+	clients map[*ssh.Client]*muxConn
+}{conns: make(map[muxKey]*muxConn), clients: make(map[*ssh.Client]*muxConn)}
+
+// sharedClient get ssh connection of addr holding a channel slot, releaseClient must be called once done with it.
+// an open connection of the same dialer and user is reused after a keepalive, fresh is set if it was dialed
+func sharedClient(d Dialer, addr string, cfg *ssh.ClientConfig) (client *ssh.Client, fresh bool, err error) {
+	if C.Mux.Disabled {
+		client, err = d.Dial("tcp", addr, cfg)
+		return client, true, err
+	}
+	key := muxKey{dialer: d, addr: addr, user: cfg.User}
+	for {
+		muxPool.Lock()
+		mc, ok := muxPool.conns[key]
+		if !ok {
+			max := C.Mux.MaxChannels
+			if max < 1 {
+				max = MuxDefaultMaxChannels
+			}
+			mc = &muxConn{key: key, ready: make(chan struct{}), slots: make(chan struct{}, max)}
+			muxPool.conns[key] = mc
+			muxPool.Unlock()
+			mc.client, mc.err = d.Dial("tcp", addr, cfg)
+			muxPool.Lock()
+			if mc.err != nil {
+				delete(muxPool.conns, key)
+			} else {
+				muxPool.clients[mc.client] = mc
+			}
+			muxPool.Unlock()
+			close(mc.ready)
+			if mc.err != nil {
+				return nil, true, mc.err
+			}
+			mc.slots <- struct{}{}
+			return mc.client, true, nil
+		}
+		muxPool.Unlock()
+		<-mc.ready
+		if mc.err != nil {
+			// dialed by another caller at the same time
+			return nil, false, mc.err
+		}
+		mc.slots <- struct{}{}
+		if _, _, err = mc.client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return mc.client, false, nil
+		}
+		// broken while idle, eg. host rebooted
+		<-mc.slots
+		dropClient(mc)
+	}
+}
+
+// dropClient close shared connection and remove it from pool, callers holding it see their channels fail
+func dropClient(mc *muxConn) {
+	muxPool.Lock()
+	if muxPool.conns[mc.key] == mc {
+		delete(muxPool.conns, mc.key)
+	}
+	delete(muxPool.clients, mc.client)
+	muxPool.Unlock()
+	mc.client.Close()
+}
+
+// releaseClient release channel slot of a shared connection, connections not shared are closed
+func releaseClient(c *ssh.Client) {
+	muxPool.Lock()
+	mc, ok := muxPool.clients[c]
+	muxPool.Unlock()
+	if !ok {
+		c.Close()
+		return
+	}
+	<-mc.slots
+}
+
+// CloseShared close all shared connections
+func CloseShared() {
+	muxPool.Lock()
+	var conns []*muxConn
+	for _, mc := range muxPool.clients {
+		conns = append(conns, mc)
+	}
+	muxPool.Unlock()
+	for _, mc := range conns {
+		dropClient(mc)
+	}
+}
@@ -0,0 +1,354 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// HostNetDev network device reached by an interactive ssh shell, configured as netdev://address:port
+	HostNetDev = "netdev"
+	// HostTelnet network device reached by telnet, configured as telnet://address:port
+	HostTelnet = "telnet"
+)
+
+// NetDevConfig prompts and auth of netdev and telnet hosts, lines of commands are sent one by one
+// and each is finished when prompt is seen again
+type NetDevConfig struct {
+	User           string   `yaml:"user"`            // telnet login, auth.user if empty
+	Password       string   `yaml:"password"`        // encrypted unless auth.plain_password
+	EnablePassword string   `yaml:"enable_password"` // send enable after login if set
+	Prompt         string   `yaml:"prompt"`          // regexp of command prompt
+	LoginPrompt    string   `yaml:"login_prompt"`
+	PasswordPrompt string   `yaml:"password_prompt"`
+	Setup          []string `yaml:"setup"`   // run after login, eg. terminal length 0
+	Timeout        int      `yaml:"timeout"` // seconds waiting for a prompt, default 30
+}
+
+// default prompts of netdev hosts
+const (
+	NetDevPrompt         = `[\w\-.@()/:~\[\]]+ ?[>#$%] ?$`
+	NetDevLoginPrompt    = `(?i)(login|user ?name):\s*$`
+	NetDevPasswordPrompt = `(?i)password:\s*$`
+)
+
+// netdevSession interactive session waiting for prompts
+type netdevSession struct {
+	w       io.Writer
+	out     chan []byte
+	done    chan struct{}
+	err     error
+	buf     bytes.Buffer
+	prompt  *regexp.Regexp
+	timeout time.Duration
+}
+
+// newNetDevSession start reading r
+func newNetDevSession(r io.Reader, w io.Writer) (*netdevSession, error) {
+	s := &netdevSession{w: w, out: make(chan []byte, 16), done: make(chan struct{}), timeout: 30 * time.Second}
+	if C.NetDev.Timeout > 0 {
+		s.timeout = time.Duration(C.NetDev.Timeout) * time.Second
+	}
+	prompt := C.NetDev.Prompt
+	if prompt == "" {
+		prompt = NetDevPrompt
+	}
+	var err error
+	if s.prompt, err = regexp.Compile(prompt); err != nil {
+		return nil, fmt.Errorf("Invalid netdev prompt: %s", err)
+	}
+	go func() {
+		for {
+			b := make([]byte, 4096)
+			n, err := r.Read(b)
+			if n > 0 {
+				select {
+				case s.out <- b[:n]:
+				case <-s.done:
+					return
+				}
+			}
+			if err != nil {
+				s.err = err
+				close(s.out)
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// close stop reading
+func (s *netdevSession) close() {
+	close(s.done)
+}
+
+// expect read until re matches, output read is returned
+func (s *netdevSession) expect(re *regexp.Regexp) (string, error) {
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	for !re.Match(s.buf.Bytes()) {
+		select {
+		case b, ok := <-s.out:
+			if !ok {
+				return s.buf.String(), fmt.Errorf("Connection closed waiting for %s: %v", re, s.err)
+			}
+			s.buf.Write(b)
+		case <-timer.C:
+			return s.buf.String(), fmt.Errorf("Timeout waiting for %s, got: %q", re, lastLine(s.buf.String()))
+		}
+	}
+	out := s.buf.String()
+	s.buf.Reset()
+	return out, nil
+}
+
+// send write a line
+func (s *netdevSession) send(line string) error {
+	_, err := io.WriteString(s.w, line+"\r\n")
+	return err
+}
+
+// run send line and wait for prompt, output without echoed line and prompt is returned
+func (s *netdevSession) run(line string) (string, error) {
+	if err := s.send(line); err != nil {
+		return "", err
+	}
+	out, err := s.expect(s.prompt)
+	out = strings.Replace(out, "\r", "", -1)
+	if i := strings.Index(out, "\n"); i >= 0 && strings.TrimSpace(out[:i]) == strings.TrimSpace(line) {
+		out = out[i+1:]
+	}
+	if i := strings.LastIndex(out, "\n"); i >= 0 {
+		out = out[:i+1]
+	} else if err == nil {
+		out = ""
+	}
+	return out, err
+}
+
+// login answer login prompts, then wait for command prompt and run enable and setup
+func (s *netdevSession) login(telnet bool) error {
+	user, password := credentials(C.NetDev.User, C.NetDev.Password)
+	if telnet {
+		loginPrompt, passwordPrompt := C.NetDev.LoginPrompt, C.NetDev.PasswordPrompt
+		if loginPrompt == "" {
+			loginPrompt = NetDevLoginPrompt
+		}
+		if passwordPrompt == "" {
+			passwordPrompt = NetDevPasswordPrompt
+		}
+		lre, err := regexp.Compile(loginPrompt)
+		if err != nil {
+			return err
+		}
+		pre, err := regexp.Compile(passwordPrompt)
+		if err != nil {
+			return err
+		}
+		if _, err = s.expect(lre); err != nil {
+			return err
+		}
+		s.send(user)
+		if _, err = s.expect(pre); err != nil {
+			return err
+		}
+		s.send(password)
+	}
+	if _, err := s.expect(s.prompt); err != nil {
+		return err
+	}
+	if C.NetDev.EnablePassword != "" {
+		enable := C.NetDev.EnablePassword
+		if !C.Auth.PlainPassword {
+			enable = string(Decrypt(enable))
+		}
+		s.send("enable")
+		if _, err := s.expect(regexp.MustCompile(NetDevPasswordPrompt)); err != nil {
+			return err
+		}
+		if _, err := s.run(enable); err != nil {
+			return err
+		}
+	}
+	for _, line := range C.NetDev.Setup {
+		if _, err := s.run(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runNetDev login to netdev or telnet host and run lines of cmd one by one
+func runNetDev(h Host, cfg *ssh.ClientConfig, dialer Dialer, cmd string) (string, error) {
+	var r io.Reader
+	var w io.Writer
+	if h.Type == HostTelnet {
+		conn, err := dialTCP("tcp", h.Addr(), 30*time.Second)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		tc := &telnetConn{conn: conn}
+		r, w = tc, tc
+	} else {
+		client, err := dialer.Dial("tcp", h.Addr(), cfg)
+		if err != nil {
+			return "", err
+		}
+		defer client.Close()
+		sess, err := client.NewSession()
+		if err != nil {
+			return "", err
+		}
+		defer sess.Close()
+		if err = sess.RequestPty("vt100", 0, 511, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+			return "", err
+		}
+		if w, err = sess.StdinPipe(); err != nil {
+			return "", err
+		}
+		if r, err = sess.StdoutPipe(); err != nil {
+			return "", err
+		}
+		if err = sess.Shell(); err != nil {
+			return "", err
+		}
+	}
+	s, err := newNetDevSession(r, w)
+	if err != nil {
+		return "", err
+	}
+	defer s.close()
+	if err = s.login(h.Type == HostTelnet); err != nil {
+		return "", err
+	}
+	var output strings.Builder
+	for _, line := range strings.Split(cmd, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		out, err := s.run(line)
+		output.WriteString(out)
+		if err != nil {
+			return output.String(), err
+		}
+	}
+	s.send("exit")
+	return output.String(), nil
+}
+
+// lastLine get last non empty line of s
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimRight(strings.Replace(s, "\r", "", -1), "\n"), "\n")
+	return lines[len(lines)-1]
+}
+
+// telnet commands and options
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+	telnetEcho = 1
+	telnetSGA  = 3
+)
+
+// telnetConn telnet connection, negotiations are answered and removed from data read
+// only echo and suppress go ahead are accepted
+type telnetConn struct {
+	conn  net.Conn
+	state int // 0 data, 1 after IAC, 2 after IAC verb, 3 in subnegotiation, 4 IAC in subnegotiation
+	verb  byte
+}
+
+func (tc *telnetConn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for {
+		n, err := tc.conn.Read(buf)
+		m := 0
+		for _, b := range buf[:n] {
+			switch tc.state {
+			case 0:
+				if b == telnetIAC {
+					tc.state = 1
+				} else {
+					p[m] = b
+					m++
+				}
+			case 1:
+				switch b {
+				case telnetIAC:
+					p[m] = b
+					m++
+					tc.state = 0
+				case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+					tc.verb, tc.state = b, 2
+				case telnetSB:
+					tc.state = 3
+				default:
+					tc.state = 0
+				}
+			case 2:
+				tc.answer(tc.verb, b)
+				tc.state = 0
+			case 3:
+				if b == telnetIAC {
+					tc.state = 4
+				}
+			case 4:
+				if b == telnetSE {
+					tc.state = 0
+				} else {
+					tc.state = 3
+				}
+			}
+		}
+		if m > 0 || err != nil {
+			return m, err
+		}
+	}
+}
+
+// answer reply to a negotiation
+func (tc *telnetConn) answer(verb, option byte) {
+	accept := option == telnetEcho || option == telnetSGA
+	var reply byte
+	switch verb {
+	case telnetWILL:
+		reply = telnetDONT
+		if accept {
+			reply = telnetDO
+		}
+	case telnetDO:
+		reply = telnetWONT
+		if option == telnetSGA {
+			reply = telnetWILL
+		}
+	default:
+		// DONT and WONT need no answer
+		return
+	}
+	tc.conn.Write([]byte{telnetIAC, reply, option})
+}
+
+func (tc *telnetConn) Write(p []byte) (int, error) {
+	// escape IAC in data
+	if bytes.IndexByte(p, telnetIAC) < 0 {
+		return tc.conn.Write(p)
+	}
+	if _, err := tc.conn.Write(bytes.Replace(p, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}, -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
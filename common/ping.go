@@ -0,0 +1,105 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PingResult ssh reachability of a host
+type PingResult struct {
+	Latency time.Duration // time to dial and authenticate
+	Err     error
+}
+
+// Ping connect to hosts and run a no-op session, results are keyed by host
+func Ping(hosts []string) map[string]PingResult {
+	result := make(map[string]PingResult)
+	lock := sync.Mutex{}
+	auth, err := GetAuth()
+	if err != nil {
+		for _, h := range hosts {
+			result[h] = PingResult{Err: err}
+		}
+		return result
+	}
+	cfg := &ssh.ClientConfig{
+		User:            C.Auth.User,
+		Auth:            auth,
+		Timeout:         10 * time.Second,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		ClientVersion:   sshClientVersion(),
+	}
+	errs := RunHosts(hosts, func(ctx context.Context, h string) error {
+		host := ParseHost(h)
+		switch host.Type {
+		case HostLocal:
+			lock.Lock()
+			result[h] = PingResult{}
+			lock.Unlock()
+			return nil
+		case HostFTP, HostFTPS:
+			ts := time.Now()
+			ft, err := dialFTP(host)
+			if err != nil {
+				return err
+			}
+			defer ft.Close()
+			latency := time.Now().Sub(ts)
+			if _, _, err = ft.cmd(2, "NOOP"); err != nil {
+				return err
+			}
+			lock.Lock()
+			result[h] = PingResult{Latency: latency}
+			lock.Unlock()
+			return nil
+		case HostWinRM, HostWinRMS:
+			ts := time.Now()
+			ws, err := dialWinRM(host)
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			result[h] = PingResult{Latency: time.Now().Sub(ts)}
+			lock.Unlock()
+			return ws.Close()
+		case HostNetDev, HostTelnet:
+			ts := time.Now()
+			if _, err := runNetDev(host, cfg, DefaultDialer, ""); err != nil {
+				return err
+			}
+			lock.Lock()
+			result[h] = PingResult{Latency: time.Now().Sub(ts)}
+			lock.Unlock()
+			return nil
+		case HostSSH, HostDocker:
+		default:
+			return fmt.Errorf("Unknown host type: %s", host.Type)
+		}
+		ts := time.Now()
+		client, err := DefaultDialer.Dial("tcp", host.Addr(), cfg)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		latency := time.Now().Sub(ts)
+		if err = runSession(client, host.remoteCommand("true")); err != nil {
+			return err
+		}
+		lock.Lock()
+		result[h] = PingResult{Latency: latency}
+		lock.Unlock()
+		return nil
+	})
+	for h, e := range errs {
+		result[h] = PingResult{Err: e}
+	}
+	for h, r := range result {
+		RecordReach(h, r.Latency, r.Err)
+	}
+	SaveReachability()
+	return result
+}
@@ -0,0 +1,347 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSkipped stage not run since a stage it depends on failed
+var ErrSkipped = errors.New("Skipped, dependency failed")
+
+// Step unit of a pipeline run against hosts of a stage, one of exec, profile, deploy, env, config or cert is set
+type Step struct {
+	Name        string          `yaml:"name"`
+	Exec        string          `yaml:"exec"`        // command run on hosts
+	Profile     string          `yaml:"profile"`     // named transfer, hosts of profile take precedence
+	Deploy      bool            `yaml:"deploy"`      // deploy with deploy.strategy and record release of group
+	Env         bool            `yaml:"env"`         // write env_file rendered for group
+	Config      string          `yaml:"config"`      // push config file of configs, validated before it is live
+	Cert        string          `yaml:"cert"`        // deploy certificate of certs, verified before it is live
+	Skip        bool            `yaml:"skip"`        // step is not run, set by overrides
+	Maintenance bool            `yaml:"maintenance"` // maintenance page is on while the step runs, eg. db migrations
+	Overrides   map[string]Step `yaml:"overrides"`   // group => fields replacing the step for stages of the group
+}
+
+// For get step of group with its override applied, fields set in override replace those of step
+func (s Step) For(group string) Step {
+	o, ok := s.Overrides[group]
+	if !ok {
+		return s
+	}
+	if o.Name != "" {
+		s.Name = o.Name
+	}
+	if o.Exec != "" || o.Profile != "" || o.Deploy || o.Env || o.Config != "" || o.Cert != "" {
+		// an override of the action replaces it
+		s.Exec, s.Profile, s.Deploy, s.Env, s.Config, s.Cert = o.Exec, o.Profile, o.Deploy, o.Env, o.Config, o.Cert
+	}
+	s.Skip = o.Skip
+	if o.Maintenance {
+		s.Maintenance = true
+	}
+	s.Overrides = nil
+	return s
+}
+
+// String describe step in output
+func (s Step) String() string {
+	switch {
+	case s.Name != "":
+		return s.Name
+	case s.Exec != "":
+		return "exec " + s.Exec
+	case s.Profile != "":
+		return "run " + s.Profile
+	case s.Deploy:
+		return "deploy"
+	case s.Env:
+		return "env"
+	case s.Config != "":
+		return "config " + s.Config
+	case s.Cert != "":
+		return "cert " + s.Cert
+	}
+	return "empty step"
+}
+
+// Stage steps run against hosts of a group after the stages it depends on succeeded
+type Stage struct {
+	Name    string   `yaml:"name"` // group if empty
+	Group   string   `yaml:"group"`
+	Depends []string `yaml:"depends"` // names of stages run before
+	Steps   []Step   `yaml:"steps"`   // steps of pipeline if empty
+}
+
+// Pipeline stages forming a DAG, stages whose dependencies are done run at the same time
+type Pipeline struct {
+	Stages         []Stage             `yaml:"stages"`
+	Steps          []Step              `yaml:"steps"`           // default steps of stages
+	Matrix         map[string][]string `yaml:"matrix"`          // run pipeline once per parameter set, {name} is replaced
+	MatrixParallel bool                `yaml:"matrix_parallel"` // run parameter sets at the same time
+}
+
+// StageName name of stage, group if not set
+func (st Stage) StageName() string {
+	if st.Name != "" {
+		return st.Name
+	}
+	return st.Group
+}
+
+// Levels check the DAG and get stage names level by level, stages of a level only depend on earlier levels
+func (p Pipeline) Levels() ([][]string, error) {
+	stages := make(map[string]Stage)
+	for _, st := range p.Stages {
+		name := st.StageName()
+		if name == "" {
+			return nil, errors.New("Stage without name and group")
+		}
+		if _, ok := stages[name]; ok {
+			return nil, fmt.Errorf("Duplicated stage %s", name)
+		}
+		stages[name] = st
+	}
+	for name, st := range stages {
+		for _, d := range st.Depends {
+			if _, ok := stages[d]; !ok {
+				return nil, fmt.Errorf("Stage %s depends on unknown stage %s", name, d)
+			}
+		}
+	}
+	var levels [][]string
+	done := make(map[string]bool)
+	for len(done) < len(stages) {
+		var level []string
+		for _, st := range p.Stages {
+			name := st.StageName()
+			if done[name] {
+				continue
+			}
+			ready := true
+			for _, d := range st.Depends {
+				ready = ready && done[d]
+			}
+			if ready {
+				level = append(level, name)
+			}
+		}
+		if len(level) == 0 {
+			var cycle []string
+			for _, st := range p.Stages {
+				if !done[st.StageName()] {
+					cycle = append(cycle, st.StageName())
+				}
+			}
+			return nil, fmt.Errorf("Dependency cycle among stages %s", strings.Join(cycle, ","))
+		}
+		for _, name := range level {
+			done[name] = true
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// PipelineRun run of a pipeline, errors of stages are kept in Result
+type PipelineRun struct {
+	Pipeline Pipeline
+	Label    string                                   // parameter set of matrix, empty without matrix
+	Deploy   func(group string, hosts []string) error // runs deploy steps
+	Result   map[string]error                         // stage => nil, error or ErrSkipped
+	lock     sync.Mutex
+}
+
+// Start run every stage once its dependencies succeeded, independent stages run at the same time
+func (pr *PipelineRun) Start() error {
+	if _, err := pr.Pipeline.Levels(); err != nil {
+		return err
+	}
+	if err := CheckPipeline(pr.Pipeline); err != nil {
+		return err
+	}
+	if C.TransferMaxSize < 1 {
+		C.TransferMaxSize = TransferDefaultMaxSize
+	}
+	done := make(map[string]chan struct{})
+	for _, st := range pr.Pipeline.Stages {
+		done[st.StageName()] = make(chan struct{})
+	}
+	wg := sync.WaitGroup{}
+	for _, st := range pr.Pipeline.Stages {
+		wg.Add(1)
+		go func(st Stage) {
+			defer wg.Done()
+			defer close(done[st.StageName()])
+			var err error
+			for _, d := range st.Depends {
+				<-done[d]
+				pr.lock.Lock()
+				if pr.Result[d] != nil {
+					err = ErrSkipped
+				}
+				pr.lock.Unlock()
+			}
+			if err == nil {
+				err = pr.runStage(st)
+			}
+			pr.lock.Lock()
+			pr.Result[st.StageName()] = err
+			pr.lock.Unlock()
+		}(st)
+	}
+	wg.Wait()
+	failed := 0
+	for _, err := range pr.Result {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d stage(s) failed or skipped", failed)
+	}
+	return nil
+}
+
+// runStage run steps of stage one by one against hosts of its group, stops at the first failed step
+func (pr *PipelineRun) runStage(st Stage) error {
+	name := st.StageName()
+	if pr.Label != "" {
+		name = pr.Label + " " + name
+	}
+	hosts, ok := C.Server.Hosts[st.Group]
+	if !ok {
+		return fmt.Errorf("Host group not found. Group: %s", st.Group)
+	}
+	hosts, err := ExpandHosts(hosts)
+	if err != nil {
+		return err
+	}
+	NotePolicyGroup(st.Group, hosts)
+	steps := st.Steps
+	if len(steps) == 0 {
+		steps = pr.Pipeline.Steps
+	}
+	for i, step := range steps {
+		if step = step.For(st.Group); step.Skip {
+			fmt.Fprintf(Stdout, "[%s] step %d/%d: %s skipped\n", name, i+1, len(steps), step)
+			continue
+		}
+		if err = CheckControl(fmt.Sprintf("[%s] step %d", name, i+1)); err != nil {
+			return err
+		}
+		progress := fmt.Sprintf("[%s] step %d/%d: %s", name, i+1, len(steps), step)
+		if eta, ok := stepsRemaining(st.Group, steps[i:], hosts); ok {
+			progress += ", " + FormatETA(eta) + " remaining"
+		}
+		fmt.Fprintln(Stdout, progress)
+		start := time.Now()
+		run := func() error { return pr.runStep(st, step, hosts) }
+		if step.Maintenance {
+			m := NewMaintenance(hosts)
+			err = m.Wrap(run)
+			m.PrettyPrint()
+		} else {
+			err = run()
+		}
+		if err != nil {
+			return fmt.Errorf("Step %d %s: %s", i+1, step, err)
+		}
+		RecordDuration(stepKey(st.Group, step), hosts, time.Since(start))
+	}
+	return nil
+}
+
+// stepKey name of durations of step of a stage of group
+func stepKey(group string, step Step) string {
+	return group + ": " + step.String()
+}
+
+// stepsRemaining estimate time of steps of a stage of group, false unless every step has history
+func stepsRemaining(group string, steps []Step, hosts []string) (time.Duration, bool) {
+	var total time.Duration
+	for _, step := range steps {
+		if step = step.For(group); step.Skip {
+			continue
+		}
+		est, ok := EstimateDuration(stepKey(group, step), hosts)
+		if !ok {
+			return 0, false
+		}
+		total += est
+	}
+	return total, true
+}
+
+func (pr *PipelineRun) runStep(st Stage, step Step, hosts []string) error {
+	switch {
+	case step.Exec != "":
+		output, errs, err := RunRemote(hosts, step.Exec)
+		if err != nil {
+			return err
+		}
+		for _, h := range hosts {
+			for _, line := range strings.Split(strings.TrimSpace(output[h]), "\n") {
+				if line != "" {
+					fmt.Fprintf(Stdout, "%21s: %s\n", h, line)
+				}
+			}
+			if e, ok := errs[h]; ok {
+				fmt.Fprintf(Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("Command failed on %d host(s)", len(errs))
+		}
+		return nil
+	case step.Profile != "":
+		t, err := NewProfileTransfer(step.Profile, hosts)
+		if err != nil {
+			return err
+		}
+		err = t.Start()
+		t.PrettyPrint()
+		if err == nil && len(t.Errors) > 0 {
+			err = fmt.Errorf("Transfer failed on %d host(s)", len(t.Errors))
+		}
+		return err
+	case step.Deploy:
+		if pr.Deploy == nil {
+			return errors.New("Deploy is not supported")
+		}
+		return pr.Deploy(st.Group, hosts)
+	case step.Env:
+		changes, errs, err := EnvFile(hosts, st.Group, true)
+		if err != nil {
+			return err
+		}
+		PrintEnvChanges(hosts, changes, errs)
+		if len(errs) > 0 {
+			return fmt.Errorf("Env file failed on %d host(s)", len(errs))
+		}
+		return nil
+	case step.Config != "":
+		output, errs, err := PushConfig(hosts, step.Config, st.Group)
+		if err != nil {
+			return err
+		}
+		PrintConfigResult(hosts, output, errs)
+		if len(errs) > 0 {
+			return fmt.Errorf("Config failed on %d host(s)", len(errs))
+		}
+		return nil
+	case step.Cert != "":
+		output, errs, err := DeployCert(hosts, step.Cert)
+		if err != nil {
+			return err
+		}
+		PrintConfigResult(hosts, output, errs)
+		if len(errs) > 0 {
+			return fmt.Errorf("Cert failed on %d host(s)", len(errs))
+		}
+		return nil
+	}
+	return errors.New("Step sets none of exec, profile, deploy, env, config and cert")
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPipelineLevels(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []Stage
+		levels [][]string
+		err    string
+	}{
+		{
+			name:   "independent",
+			stages: []Stage{{Group: "db"}, {Group: "web"}},
+			levels: [][]string{{"db", "web"}},
+		},
+		{
+			name: "diamond",
+			stages: []Stage{
+				{Name: "web", Depends: []string{"db", "cache"}},
+				{Name: "db"},
+				{Name: "cache"},
+				{Name: "lb", Depends: []string{"web"}},
+			},
+			levels: [][]string{{"db", "cache"}, {"web"}, {"lb"}},
+		},
+		{
+			name:   "name over group",
+			stages: []Stage{{Name: "first", Group: "web"}, {Group: "web", Depends: []string{"first"}}},
+			levels: [][]string{{"first"}, {"web"}},
+		},
+		{
+			name:   "unknown dependency",
+			stages: []Stage{{Name: "web", Depends: []string{"dbs"}}, {Name: "db"}},
+			err:    "Stage web depends on unknown stage dbs",
+		},
+		{
+			name: "cycle",
+			stages: []Stage{
+				{Name: "db"},
+				{Name: "a", Depends: []string{"db", "b"}},
+				{Name: "b", Depends: []string{"a"}},
+				{Name: "c", Depends: []string{"b"}},
+			},
+			err: "Dependency cycle among stages a,b,c",
+		},
+		{
+			name:   "self dependency",
+			stages: []Stage{{Name: "web", Depends: []string{"web"}}},
+			err:    "Dependency cycle among stages web",
+		},
+		{
+			name:   "duplicated",
+			stages: []Stage{{Group: "web"}, {Name: "web"}},
+			err:    "Duplicated stage web",
+		},
+		{
+			name:   "no name",
+			stages: []Stage{{Depends: []string{"db"}}},
+			err:    "Stage without name and group",
+		},
+	}
+	for _, tt := range tests {
+		levels, err := Pipeline{Stages: tt.stages}.Levels()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(levels, tt.levels) {
+			t.Errorf("%s: levels = %v, want %v", tt.name, levels, tt.levels)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-yaml/yaml"
+)
+
+// PolicyRule rule denying dangerous operations on hosts of its groups
+type PolicyRule struct {
+	Name          string   `yaml:"name"`
+	Groups        []string `yaml:"groups"`         // groups the rule applies to, every host if empty
+	Deny          []string `yaml:"deny"`           // regexps of denied commands, eg. rm\s+-rf\s+/(\s|$)
+	AllowPaths    []string `yaml:"allow_paths"`    // remote dirs files may be put into, anywhere if empty
+	RequireChange bool     `yaml:"require_change"` // deny deploys without a change ticket
+	Message       string   `yaml:"message"`        // shown when the rule denies, optional
+
+	deny []*regexp.Regexp
+}
+
+// PolicyConfig rules checked before every command, put and deploy. rules of files are added to those of configure
+type PolicyConfig struct {
+	Files []string     `yaml:"files"` // yaml files with rules:, shipped beside configure
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// policy rules loaded on first check, and hosts of groups expanded in this run
+var policy = struct {
+	sync.Mutex
+	once   sync.Once
+	rules  []PolicyRule
+	err    error
+	groups map[string]map[string]bool // host => groups
+}{groups: make(map[string]map[string]bool)}
+
+// NotePolicyGroup remember hosts expanded from group, so that rules of group apply to discovered hosts too
+func NotePolicyGroup(group string, hosts []string) {
+	if group == "" {
+		return
+	}
+	policy.Lock()
+	defer policy.Unlock()
+	for _, h := range hosts {
+		if policy.groups[h] == nil {
+			policy.groups[h] = make(map[string]bool)
+		}
+		policy.groups[h][group] = true
+	}
+}
+
+// policyRules get rules of configure and policy files, regexps compiled
+func policyRules() ([]PolicyRule, error) {
+	policy.once.Do(func() {
+		rules := append([]PolicyRule(nil), C.Policy.Rules...)
+		for _, f := range C.Policy.Files {
+			data, err := ioutil.ReadFile(expandHome(f))
+			if err != nil {
+				policy.err = err
+				return
+			}
+			var pc PolicyConfig
+			if err = yaml.Unmarshal(data, &pc); err != nil {
+				policy.err = fmt.Errorf("%s: %s", f, err)
+				return
+			}
+			rules = append(rules, pc.Rules...)
+		}
+		for i := range rules {
+			if rules[i].Name == "" {
+				rules[i].Name = fmt.Sprintf("#%d", i+1)
+			}
+			for _, d := range rules[i].Deny {
+				re, err := regexp.Compile(d)
+				if err != nil {
+					policy.err = fmt.Errorf("Policy %s: %s", rules[i].Name, err)
+					return
+				}
+				rules[i].deny = append(rules[i].deny, re)
+			}
+		}
+		policy.rules = rules
+	})
+	return policy.rules, policy.err
+}
+
+// hostGroups get groups host belongs to, by group lists of configure and groups expanded in this run
+func hostGroups(host string) map[string]bool {
+	groups := make(map[string]bool)
+	policy.Lock()
+	for g := range policy.groups[host] {
+		groups[g] = true
+	}
+	policy.Unlock()
+	for g, list := range C.Server.Hosts {
+		for _, entry := range list {
+			expanded, err := ExpandRange(entry)
+			if err != nil {
+				continue
+			}
+			for _, h := range expanded {
+				if h == host {
+					groups[g] = true
+				}
+			}
+		}
+	}
+	return groups
+}
+
+// appliesTo check if rule applies to a host of groups
+func (r PolicyRule) appliesTo(groups map[string]bool) bool {
+	if len(r.Groups) == 0 {
+		return true
+	}
+	for _, g := range r.Groups {
+		if groups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// denied get error of rule denying what
+func (r PolicyRule) denied(what string) error {
+	if r.Message != "" {
+		return fmt.Errorf("Denied by policy %s: %s (%s)", r.Name, r.Message, what)
+	}
+	return fmt.Errorf("Denied by policy %s: %s", r.Name, what)
+}
+
+// checkCommand check rules of groups allow cmd
+func (r PolicyRule) checkCommand(cmd string) error {
+	for _, re := range r.deny {
+		if re.MatchString(cmd) {
+			return r.denied(Redact(cmd))
+		}
+	}
+	return nil
+}
+
+// checkWrite check rules of groups allow putting files into remote path p
+func (r PolicyRule) checkWrite(p string) error {
+	if len(r.AllowPaths) == 0 {
+		return nil
+	}
+	clean := path.Clean(p)
+	for _, a := range r.AllowPaths {
+		a = path.Clean(a)
+		if clean == a || strings.HasPrefix(clean, strings.TrimSuffix(a, "/")+"/") {
+			return nil
+		}
+	}
+	return r.denied("write to " + p)
+}
+
+// checkHosts check check of every rule applying to each of hosts
+func checkHosts(hosts []string, check func(PolicyRule) error) error {
+	rules, err := policyRules()
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	for _, h := range hosts {
+		groups := hostGroups(h)
+		for _, r := range rules {
+			if !r.appliesTo(groups) {
+				continue
+			}
+			if err = check(r); err != nil {
+				return fmt.Errorf("%s: %s", h, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkGroup check check of every rule applying to group, "" for hosts outside groups
+func checkGroup(group string, check func(PolicyRule) error) error {
+	rules, err := policyRules()
+	if err != nil {
+		return err
+	}
+	groups := map[string]bool{group: group != ""}
+	for _, r := range rules {
+		if !r.appliesTo(groups) {
+			continue
+		}
+		if err = check(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckCommand check policy allows cmd on hosts
+func CheckCommand(hosts []string, cmd string) error {
+	return checkHosts(hosts, func(r PolicyRule) error { return r.checkCommand(cmd) })
+}
+
+// CheckWrite check policy allows putting files into remote path p of hosts
+func CheckWrite(hosts []string, p string) error {
+	return checkHosts(hosts, func(r PolicyRule) error { return r.checkWrite(p) })
+}
+
+// CheckDeploy check policy allows deploy to group with change ticket, empty if none, into deploy.root
+func CheckDeploy(group, ticket string) error {
+	return checkGroup(group, func(r PolicyRule) error {
+		if r.RequireChange && ticket == "" {
+			return r.denied("deploy without a change ticket")
+		}
+		if C.Deploy.Root != "" {
+			return r.checkWrite(C.Deploy.Root)
+		}
+		return nil
+	})
+}
+
+// CheckPipeline check policy allows every step of pipeline before any is run
+func CheckPipeline(p Pipeline) error {
+	for _, st := range p.Stages {
+		steps := st.Steps
+		if len(steps) == 0 {
+			steps = p.Steps
+		}
+		for i, step := range steps {
+			if step = step.For(st.Group); step.Skip {
+				continue
+			}
+			err := checkGroup(st.Group, func(r PolicyRule) error {
+				switch {
+				case step.Exec != "":
+					return r.checkCommand(step.Exec)
+				case step.Profile != "":
+					if pf, ok := C.Profiles[step.Profile]; ok && strings.ToUpper(pf.Method) != TransferGet {
+						return r.checkWrite(pf.Remote)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("[%s] step %d %s: %s", st.StageName(), i+1, step, err)
+			}
+		}
+	}
+	return nil
+}
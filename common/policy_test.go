@@ -0,0 +1,30 @@
+package common
+
+import "testing"
+
+func TestPolicyRuleCheckWrite(t *testing.T) {
+	tests := []struct {
+		allow []string
+		path  string
+		ok    bool
+	}{
+		{nil, "/etc/passwd", true},
+		{[]string{"/srv/app"}, "/srv/app", true},
+		{[]string{"/srv/app"}, "/srv/app/", true},
+		{[]string{"/srv/app"}, "/srv/app/current/bin", true},
+		{[]string{"/srv/app/"}, "/srv/app/x", true},
+		{[]string{"/srv/app"}, "/srv/application", false},
+		{[]string{"/srv/app"}, "/srv/app-old/x", false},
+		{[]string{"/srv/app"}, "/srv/app/../etc/passwd", false},
+		{[]string{"/srv/app"}, "/srv", false},
+		{[]string{"/srv/app", "/var/log/app"}, "/var/log/app/app.log", true},
+		{[]string{"/"}, "/etc/passwd", true},
+	}
+	for _, tt := range tests {
+		r := PolicyRule{Name: "paths", AllowPaths: tt.allow}
+		err := r.checkWrite(tt.path)
+		if (err == nil) != tt.ok {
+			t.Errorf("allow %v, checkWrite(%q) = %v, want allowed %v", tt.allow, tt.path, err, tt.ok)
+		}
+	}
+}
@@ -7,9 +7,9 @@ import (
 
 // TagList list all configured tags
 func TagList() {
-	fmt.Println("Shortcut command configured are below:")
+	fmt.Fprintln(Stdout, "Shortcut command configured are below:")
 	for tg, cmd := range C.Tags {
-		fmt.Println(" ", tg, ":", cmd)
+		fmt.Fprintln(Stdout, " ", tg, ":", cmd)
 	}
 	os.Exit(0)
 }
@@ -19,13 +19,13 @@ func TagPrint(t string) {
 	found := false
 	for tg, cmd := range C.Tags {
 		if tg == t {
-			fmt.Println(cmd)
+			fmt.Fprintln(Stdout, cmd)
 			found = true
 			break
 		}
 	}
 	if !found {
-		fmt.Println("No such tag: ", t)
+		fmt.Fprintln(Stdout, "No such tag: ", t)
 	}
 	os.Exit(0)
 }
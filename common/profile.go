@@ -0,0 +1,65 @@
+package common
+
+import (
+	"fmt"
+	"os"
+)
+
+// Profile named transfer operation
+type Profile struct {
+	Method    string `yaml:"method"` // GET or PUT, default PUT
+	Local     string `yaml:"local"`
+	Remote    string `yaml:"remote"`
+	Hosts     string `yaml:"hosts"` // host group, or hosts separated by comma
+	Mode      uint32 `yaml:"mode"`
+	Recursive bool   `yaml:"recursive"`
+	Override  bool   `yaml:"override"`
+	Staged    bool   `yaml:"staged"`
+	Verify    string `yaml:"verify"`
+	Sync      bool   `yaml:"sync"` // put only files changed since the last sync of recursive puts
+	From      string `yaml:"from"` // host local is read from and relayed to hosts
+}
+
+// ProfileHosts resolve hosts of profile, empty if profile does not set hosts
+func ProfileHosts(p Profile) []string {
+	if p.Hosts == "" {
+		return nil
+	}
+	if hosts, ok := C.Server.Hosts[p.Hosts]; ok {
+		return hosts
+	}
+	return SplitHosts(p.Hosts)
+}
+
+// NewProfileTransfer get transfer of named profile, hosts are used if profile does not set hosts
+func NewProfileTransfer(name string, hosts []string) (*Transfer, error) {
+	p, ok := C.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("No such profile: %s", name)
+	}
+	if ph := ProfileHosts(p); len(ph) > 0 {
+		var err error
+		if hosts, err = ExpandHosts(ph); err != nil {
+			return nil, err
+		}
+	}
+	var t *Transfer
+	switch p.Method {
+	case "", TransferPut:
+		t = NewTransfer(TransferPut, p.Local, p.Remote, hosts)
+	case TransferGet:
+		t = NewTransfer(TransferGet, p.Local, p.Remote, hosts)
+	default:
+		return nil, fmt.Errorf("Unknown method of profile %s: %s", name, p.Method)
+	}
+	t.Mode = os.FileMode(p.Mode)
+	t.Recursive = p.Recursive
+	t.Override = p.Override
+	t.Staged = p.Staged
+	t.Verify = p.Verify
+	t.Sync = p.Sync
+	if t.Method == TransferPut {
+		t.From = p.From
+	}
+	return t, nil
+}
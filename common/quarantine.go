@@ -0,0 +1,129 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Quarantine host excluded from all runs until it expires, saved in state dir
+type Quarantine struct {
+	Host    string    `json:"host"`
+	Reason  string    `json:"reason"`
+	By      string    `json:"by,omitempty"` // user@host quarantined the host
+	Added   time.Time `json:"added"`
+	Expires time.Time `json:"expires,omitempty"` // zero never expires
+}
+
+// Expired check if quarantine is over at t
+func (q Quarantine) Expired(t time.Time) bool {
+	return !q.Expires.IsZero() && !t.Before(q.Expires)
+}
+
+// String describe quarantine in output and warnings
+func (q Quarantine) String() string {
+	until := "removed"
+	if !q.Expires.IsZero() {
+		until = q.Expires.Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("quarantined until %s by %s: %s", until, q.By, q.Reason)
+}
+
+// LoadQuarantine load quarantined hosts, expired ones are left out
+func LoadQuarantine() (map[string]Quarantine, error) {
+	list := make(map[string]Quarantine)
+	if _, err := loadState("quarantine.json", &list); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for h, q := range list {
+		if q.Expired(now) {
+			delete(list, h)
+		}
+	}
+	return list, nil
+}
+
+// QuarantineHost exclude host from all runs for d, 0 until removed
+func QuarantineHost(host, reason string, d time.Duration) (Quarantine, error) {
+	if reason == "" {
+		return Quarantine{}, errors.New("Reason of quarantine is required")
+	}
+	q := Quarantine{Host: host, Reason: reason, By: localDeployer(), Added: time.Now()}
+	if d > 0 {
+		q.Expires = q.Added.Add(d)
+	}
+	list, err := LoadQuarantine()
+	if err != nil {
+		return q, err
+	}
+	list[host] = q
+	return q, saveState("quarantine.json", list)
+}
+
+// ReleaseQuarantine remove host from quarantine
+func ReleaseQuarantine(host string) error {
+	list, err := LoadQuarantine()
+	if err != nil {
+		return err
+	}
+	if _, ok := list[host]; !ok {
+		return fmt.Errorf("Host %s is not quarantined", host)
+	}
+	delete(list, host)
+	return saveState("quarantine.json", list)
+}
+
+// QuarantineList get quarantined hosts sorted by host
+func QuarantineList() ([]Quarantine, error) {
+	list, err := LoadQuarantine()
+	if err != nil {
+		return nil, err
+	}
+	var sorted []Quarantine
+	for _, q := range list {
+		sorted = append(sorted, q)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Host < sorted[j].Host })
+	return sorted, nil
+}
+
+// ExcludeHosts remove hosts excluded by C.Exclude or quarantined, matched by host as configured or by its address.
+// reasons of removed hosts are keyed by host
+func ExcludeHosts(hosts []string) ([]string, map[string]string, error) {
+	excluded := make(map[string]string)
+	for _, e := range C.Exclude {
+		expanded, err := ExpandRange(e)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Exclude %s: %s", e, err)
+		}
+		for _, h := range expanded {
+			excluded[h] = "excluded"
+		}
+	}
+	list, err := LoadQuarantine()
+	if err != nil {
+		return nil, nil, err
+	}
+	for h, q := range list {
+		excluded[h] = q.String()
+	}
+	if len(excluded) == 0 {
+		return hosts, nil, nil
+	}
+	var kept []string
+	reasons := make(map[string]string)
+	for _, h := range hosts {
+		reason, ok := excluded[h]
+		if !ok {
+			reason, ok = excluded[ParseHost(h).Address]
+		}
+		if ok {
+			reasons[h] = reason
+			continue
+		}
+		kept = append(kept, h)
+	}
+	return kept, reasons, nil
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RampDefaultRetries retries of a dial refused by rate limits of the server
+const RampDefaultRetries = 3
+
+// RampConfig ramp up ssh dials, for many hosts behind one bastion or sshd MaxStartups limits
+type RampConfig struct {
+	DialsPerSecond float64 `yaml:"dials_per_second"` // dials started per second, 0 for unlimited
+	Retries        int     `yaml:"retries"`          // retries of throttled dials, default 3, -1 for none
+	Backoff        int     `yaml:"backoff"`          // seconds all dials pause after a throttled one, doubled every retry, default 1
+}
+
+// ramp time the next dial may start
+var ramp = struct {
+	sync.Mutex
+	next time.Time
+}{}
+
+// throttleErrors errors of servers dropping connections by rate limits
+var throttleErrors = []string{
+	"connection reset by peer",
+	"too many authentication failures",
+	"handshake failed: eof",
+	"kex_exchange_identification",
+	"maxstartups",
+}
+
+// isThrottled check if dial err looks like the server is rate limiting
+func isThrottled(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range throttleErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitDial wait for the turn of a dial by ramp.dials_per_second and pauses of throttled dials
+func waitDial() {
+	ramp.Lock()
+	now := time.Now()
+	at := ramp.next
+	if at.Before(now) {
+		at = now
+	}
+	if C.Ramp.DialsPerSecond > 0 {
+		ramp.next = at.Add(time.Duration(float64(time.Second) / C.Ramp.DialsPerSecond))
+	}
+	ramp.Unlock()
+	time.Sleep(at.Sub(now))
+}
+
+// pauseDials delay dials not started yet by d with some jitter, so that throttled dials do not retry at once
+func pauseDials(d time.Duration) {
+	d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+	ramp.Lock()
+	if at := time.Now().Add(d); at.After(ramp.next) {
+		ramp.next = at
+	}
+	ramp.Unlock()
+}
+
+// rampDial run dial in turn, retrying with backoff while the server throttles
+func rampDial(dial func() error) error {
+	retries := C.Ramp.Retries
+	if retries == 0 {
+		retries = RampDefaultRetries
+	}
+	backoff := time.Duration(C.Ramp.Backoff) * time.Second
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for i := 0; ; i++ {
+		waitDial()
+		err := dial()
+		if err == nil || !isThrottled(err) || i >= retries {
+			return err
+		}
+		pauseDials(backoff << uint(i))
+	}
+}
@@ -0,0 +1,175 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/go-yaml/yaml"
+)
+
+// Roles, each role may do what the roles before it may
+const (
+	RoleViewer   = "viewer"   // read only commands
+	RoleDeployer = "deployer" // deploys, commands and transfers
+	RoleAdmin    = "admin"    // keys, bootstrap, quarantine and cache
+)
+
+// TokenEnv env var of token identifying the user, eg. in CI
+const TokenEnv = "OPTOOL_TOKEN"
+
+var roleLevels = map[string]int{RoleViewer: 1, RoleDeployer: 2, RoleAdmin: 3}
+
+// RBACToken token of a user, a user has several tokens while they are rotated
+type RBACToken struct {
+	ID      string `yaml:"id"`      // recorded as by of runs using the token
+	SHA256  string `yaml:"sha256"`  // sha256 hex of token, printed by optool token new
+	Expires string `yaml:"expires"` // date (2006-01-02) or time (RFC3339) from which the token is refused, optional
+}
+
+// expired check if token is expired at now
+func (t RBACToken) expired(now time.Time) (bool, error) {
+	if t.Expires == "" {
+		return false, nil
+	}
+	at, err := time.Parse(time.RFC3339, t.Expires)
+	if err != nil {
+		if at, err = time.ParseInLocation("2006-01-02", t.Expires, time.Local); err != nil {
+			return false, fmt.Errorf("Invalid expires of token %s: %s", t.ID, t.Expires)
+		}
+	}
+	return !now.Before(at), nil
+}
+
+// RBACUser user allowed to run optool and its roles by host group
+type RBACUser struct {
+	Name   string            `yaml:"name"`   // local user name
+	Tokens []RBACToken       `yaml:"tokens"` // tokens given by OPTOOL_TOKEN, optional
+	Roles  map[string]string `yaml:"roles"`  // group to role, * for groups not listed and hosts given by -host
+}
+
+// RBACConfig users and their roles, every user may do anything if no user is configured. rbac of RBACFile replaces
+// the one of configure if the file exists
+type RBACConfig struct {
+	Users []RBACUser `yaml:"users"`
+}
+
+// RBACFile system wide rbac, which -config of another configure can not replace
+var RBACFile = "/etc/optool/rbac.yml"
+
+// loadRBACFile replace rbac of configure by rbac of RBACFile if it exists. it must be owned by root and writable by it
+// only, otherwise users could change their own roles
+func loadRBACFile() error {
+	fi, err := os.Stat(RBACFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by group or others", RBACFile)
+	}
+	owner, err := fileOwner(RBACFile)
+	if err != nil {
+		return err
+	}
+	if owner != "root" {
+		return fmt.Errorf("%s is owned by %s, not root", RBACFile, owner)
+	}
+	data, err := ioutil.ReadFile(RBACFile)
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		RBAC RBACConfig `yaml:"rbac"`
+	}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %s", RBACFile, err)
+	}
+	C.RBAC = doc.RBAC
+	return nil
+}
+
+// currentRBACUser get configured user running optool and id of its token, by OPTOOL_TOKEN if set or local user name
+func currentRBACUser() (*RBACUser, string, string, error) {
+	if token := os.Getenv(TokenEnv); token != "" {
+		RegisterSecret(token)
+		sum := sha256.Sum256([]byte(token))
+		for i, u := range C.RBAC.Users {
+			for _, t := range u.Tokens {
+				want, err := hex.DecodeString(t.SHA256)
+				if err != nil || subtle.ConstantTimeCompare(want, sum[:]) != 1 {
+					continue
+				}
+				expired, err := t.expired(time.Now())
+				if err != nil {
+					return nil, "", "", err
+				}
+				if expired {
+					return nil, "", "", fmt.Errorf("Token %s of %s is expired", t.ID, u.Name)
+				}
+				return &C.RBAC.Users[i], u.Name, t.ID, nil
+			}
+		}
+		return nil, "", "", errors.New("Unknown " + TokenEnv)
+	}
+	name := approvalUser(localDeployer())
+	for i, u := range C.RBAC.Users {
+		if u.Name == name {
+			return &C.RBAC.Users[i], name, "", nil
+		}
+	}
+	return nil, name, "", nil
+}
+
+// actingUser get user@host running optool, with token id for runs authenticated by token
+func actingUser() string {
+	by := localDeployer()
+	if _, name, id, err := currentRBACUser(); err == nil && id != "" {
+		by += fmt.Sprintf(" as %s (token %s)", name, id)
+	}
+	return by
+}
+
+// NewToken generate a random token and its sha256 hex
+func NewToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+	return token, hex.EncodeToString(sum[:]), nil
+}
+
+// Authorize check if user running optool has role of at least need in group, "" for hosts given by -host
+func Authorize(group, need string) error {
+	if len(C.RBAC.Users) == 0 {
+		return nil
+	}
+	u, name, _, err := currentRBACUser()
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("User %s is not allowed to run optool", name)
+	}
+	role, ok := u.Roles[group]
+	if !ok {
+		role = u.Roles["*"]
+	}
+	if roleLevels[role] < roleLevels[need] {
+		if group == "" {
+			group = "hosts outside groups"
+		}
+		return fmt.Errorf("User %s needs role %s of %s", name, need, group)
+	}
+	return nil
+}
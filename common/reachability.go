@@ -0,0 +1,115 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReachConfig reachability cache of hosts, saved in state dir
+type ReachConfig struct {
+	SkipMinutes int `yaml:"skip_minutes"` // skip hosts unreachable within last minutes unless -force, 0 never skips
+}
+
+// Reach last dial result of a host
+type Reach struct {
+	Latency time.Duration `json:"latency"` // time to dial and authenticate, or to fail
+	Error   string        `json:"error,omitempty"`
+	Checked time.Time     `json:"checked"`
+}
+
+var (
+	reachLock  sync.Mutex
+	reachCache map[string]Reach
+	reachDirty bool
+)
+
+// loadReach load cache once, caller must hold reachLock
+func loadReach() map[string]Reach {
+	if reachCache != nil {
+		return reachCache
+	}
+	reachCache = make(map[string]Reach)
+	// a missing or broken cache only loses dial order
+	if _, err := loadState("reachability.json", &reachCache); err != nil || reachCache == nil {
+		reachCache = make(map[string]Reach)
+	}
+	return reachCache
+}
+
+// LoadReachability get cached reachability of hosts
+func LoadReachability() map[string]Reach {
+	reachLock.Lock()
+	defer reachLock.Unlock()
+	reach := make(map[string]Reach)
+	for h, r := range loadReach() {
+		reach[h] = r
+	}
+	return reach
+}
+
+// RecordReach record dial result of host, saved by SaveReachability
+func RecordReach(host string, latency time.Duration, err error) {
+	r := Reach{Latency: latency, Checked: time.Now()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	reachLock.Lock()
+	loadReach()[host] = r
+	reachDirty = true
+	reachLock.Unlock()
+}
+
+// SaveReachability save recorded dial results
+func SaveReachability() error {
+	reachLock.Lock()
+	defer reachLock.Unlock()
+	if !reachDirty {
+		return nil
+	}
+	reachDirty = false
+	return saveState("reachability.json", reachCache)
+}
+
+// DialOrder sort hosts by cached latency, slowest first since they dominate wall time
+// hosts never dialed or unreachable last time go first, order is kept for equal latencies
+func DialOrder(hosts []string) []string {
+	reachLock.Lock()
+	reach := loadReach()
+	latency := make(map[string]time.Duration, len(hosts))
+	for _, h := range hosts {
+		if r, ok := reach[h]; ok && r.Error == "" {
+			latency[h] = r.Latency
+		} else {
+			latency[h] = time.Duration(1<<63 - 1)
+		}
+	}
+	reachLock.Unlock()
+	ordered := append([]string{}, hosts...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return latency[ordered[i]] > latency[ordered[j]]
+	})
+	return ordered
+}
+
+// SkipUnreachable split hosts unreachable within reachability.skip_minutes off, errors of them are returned
+// nothing is skipped if C.Force is set
+func SkipUnreachable(hosts []string) ([]string, map[string]error) {
+	skipped := make(map[string]error)
+	if C.Reachability.SkipMinutes <= 0 || C.Force {
+		return hosts, skipped
+	}
+	since := time.Now().Add(-time.Duration(C.Reachability.SkipMinutes) * time.Minute)
+	reach := LoadReachability()
+	var dial []string
+	for _, h := range hosts {
+		if r, ok := reach[h]; ok && r.Error != "" && r.Checked.After(since) {
+			skipped[h] = fmt.Errorf("Skipped, unreachable %s ago: %s", time.Now().Sub(r.Checked).Round(time.Second), r.Error)
+			recordHostResult(h, skipped[h])
+			continue
+		}
+		dial = append(dial, h)
+	}
+	return dial, skipped
+}
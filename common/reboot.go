@@ -0,0 +1,176 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Actions on hosts rebooted since their last deploy
+const (
+	RebootWarn    = "warn"
+	RebootConfirm = "confirm" // ask on terminal, refused without one
+	RebootFail    = "fail"
+)
+
+// RebootConfig guard against hosts rebooted since their last deploy, which may have lost tmpfs state or pending
+// config. boot ids of hosts are recorded after deploys and compared before the next one
+type RebootConfig struct {
+	Action    string   `yaml:"action"`    // warn, confirm or fail, hosts are not checked if empty
+	Bootstrap bool     `yaml:"bootstrap"` // run bootstrap on rebooted hosts before deploying
+	Commands  []string `yaml:"commands"`  // run on rebooted hosts before deploying, eg. restore tmpfs state
+}
+
+// bootRecord boot of a host as of its last deploy
+type bootRecord struct {
+	BootID   string    `json:"boot_id"`
+	Deployed time.Time `json:"deployed"`
+}
+
+// bootScript print boot id and uptime seconds, kern.boottime stands for boot id on BSD and macOS
+const bootScript = `id=$(cat /proc/sys/kernel/random/boot_id 2>/dev/null || sysctl -n kern.boottime 2>/dev/null | tr -d ' ')
+up=$(cut -d. -f1 /proc/uptime 2>/dev/null || echo -1)
+echo "$id $up"`
+
+var (
+	bootLock sync.Mutex
+	bootIDs  = make(map[string]string) // host => boot id found by CheckReboots
+)
+
+// CheckReboots find hosts rebooted since their last deploy and act by deploy.reboot: bootstrap and commands run on
+// them first, then the deploy is refused, asked for or warned about. hosts never deployed or not reached are skipped
+func CheckReboots(hosts []string) error {
+	rc := C.Deploy.Reboot
+	if rc.Action == "" {
+		return nil
+	}
+	if rc.Action != RebootWarn && rc.Action != RebootConfirm && rc.Action != RebootFail {
+		return fmt.Errorf("Unknown deploy.reboot.action: %s", rc.Action)
+	}
+	output, errs, err := RunRemote(hosts, bootScript)
+	if err != nil {
+		return err
+	}
+	boots := make(map[string]bootRecord)
+	if _, err = loadState("boots.json", &boots); err != nil {
+		return err
+	}
+	var rebooted []string
+	bootLock.Lock()
+	for _, h := range hosts {
+		fields := strings.Fields(output[h])
+		if _, failed := errs[h]; failed || len(fields) == 0 {
+			continue
+		}
+		bootIDs[h] = fields[0]
+		rec, ok := boots[h]
+		if !ok || rec.BootID == fields[0] {
+			continue
+		}
+		rebooted = append(rebooted, h)
+		msg := "rebooted since last deploy at " + rec.Deployed.Format("2006-01-02 15:04")
+		if len(fields) > 1 {
+			if up, err := strconv.Atoi(fields[1]); err == nil && up >= 0 {
+				msg += ", up " + (time.Duration(up) * time.Second).String()
+			}
+		}
+		fmt.Fprintf(Stdout, "%21s: %s\n", h, msg)
+	}
+	bootLock.Unlock()
+	if len(rebooted) == 0 {
+		return nil
+	}
+	switch rc.Action {
+	case RebootFail:
+		return fmt.Errorf("%d host(s) rebooted since last deploy", len(rebooted))
+	case RebootConfirm:
+		if !confirm(fmt.Sprintf("%d host(s) rebooted since last deploy, deploy anyway?", len(rebooted))) {
+			return errors.New("Deploy to rebooted hosts not confirmed")
+		}
+	default:
+		fmt.Fprintf(Stderr, "Warning: %d host(s) rebooted since last deploy\n", len(rebooted))
+	}
+	return prepareRebooted(rebooted)
+}
+
+// prepareRebooted run bootstrap and deploy.reboot.commands on rebooted hosts, any failure stops the deploy
+func prepareRebooted(hosts []string) error {
+	rc := C.Deploy.Reboot
+	failed := make(map[string]string)
+	if rc.Bootstrap {
+		_, errs, err := Bootstrap(hosts)
+		if err != nil {
+			return err
+		}
+		for h, e := range errs {
+			failed[h] = "bootstrap: " + strings.TrimSpace(e)
+		}
+	}
+	for _, cmd := range rc.Commands {
+		var pending []string
+		for _, h := range hosts {
+			if _, ok := failed[h]; !ok {
+				pending = append(pending, h)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		_, errs, err := RunRemote(pending, cmd)
+		if err != nil {
+			return err
+		}
+		for h, e := range errs {
+			failed[h] = cmd + ": " + strings.TrimSpace(e)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	var names []string
+	for h := range failed {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	for _, h := range names {
+		fmt.Fprintf(Stdout, "%21s: ERROR %s\n", h, failed[h])
+	}
+	return fmt.Errorf("Preparing rebooted hosts failed on %d host(s)", len(failed))
+}
+
+// RecordBoots record boot ids found by CheckReboots of hosts deployed
+func RecordBoots(hosts []string) error {
+	if C.Deploy.Reboot.Action == "" || len(hosts) == 0 {
+		return nil
+	}
+	boots := make(map[string]bootRecord)
+	return updateState("boots.json", &boots, func() error {
+		bootLock.Lock()
+		defer bootLock.Unlock()
+		for _, h := range hosts {
+			if id, ok := bootIDs[h]; ok {
+				boots[h] = bootRecord{BootID: id, Deployed: time.Now()}
+			}
+		}
+		return nil
+	})
+}
+
+// confirm ask a yes/no question on terminal, no without a terminal
+func confirm(question string) bool {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Fprintf(Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
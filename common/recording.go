@@ -0,0 +1,165 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Session recording formats
+const (
+	RecordAsciicast  = "asciicast"  // asciicast v2, played by asciinema play
+	RecordTypescript = "typescript" // raw output like script(1)
+)
+
+// recordings session recording of every host of this run, opened on first command
+var recordings = struct {
+	sync.Mutex
+	files map[string]*sessionRecording
+	err   error // first open error, reported once
+}{files: make(map[string]*sessionRecording)}
+
+// sessionRecording recording of commands and output of a host in this run
+type sessionRecording struct {
+	sync.Mutex
+	f       *os.File
+	format  string
+	start   time.Time
+	midLine bool // last output did not end a line
+}
+
+// RecordingPath get recording file of host in this run, stored with run record as runs/<run id>/<host>.cast or .typescript
+func RecordingPath(host string) (string, error) {
+	ext := ".cast"
+	if C.Record == RecordTypescript {
+		ext = ".typescript"
+	}
+	return statePath("runs", RunID, hostFileName(host)+ext)
+}
+
+// CheckRecord check configured recording format
+func CheckRecord() error {
+	if C.Record != "" && C.Record != RecordAsciicast && C.Record != RecordTypescript {
+		return fmt.Errorf("Unknown record format: %s, asciicast or typescript", C.Record)
+	}
+	return nil
+}
+
+// startRecording record start of cmd at host, nil if recording is off or its file failed to open
+func startRecording(host, cmd string) *sessionRecording {
+	if C.Record == "" {
+		return nil
+	}
+	recordings.Lock()
+	defer recordings.Unlock()
+	r, ok := recordings.files[host]
+	if !ok {
+		p, err := RecordingPath(host)
+		var f *os.File
+		if err == nil {
+			f, err = os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		}
+		if err != nil {
+			if recordings.err == nil {
+				recordings.err = err
+				fmt.Fprintf(Stderr, "Warning: session recording: %s\n", err)
+			}
+			return nil
+		}
+		r = &sessionRecording{f: f, format: C.Record, start: time.Now()}
+		if r.format == RecordAsciicast {
+			header, _ := json.Marshal(map[string]interface{}{
+				"version":   2,
+				"width":     80,
+				"height":    24,
+				"timestamp": r.start.Unix(),
+				"title":     fmt.Sprintf("optool %s %s", RunID, host),
+				"env":       map[string]string{"TERM": "xterm-256color", "SHELL": "/bin/sh"},
+			})
+			fmt.Fprintf(f, "%s\n", header)
+		} else {
+			fmt.Fprintf(f, "Script started on %s [HOST=%q RUN=%q]\n", r.start.Format("2006-01-02 15:04:05-07:00"), host, RunID)
+		}
+		recordings.files[host] = r
+	}
+	r.line("$ " + Redact(cmd) + "\n")
+	return r
+}
+
+// line append s as a line of its own
+func (r *sessionRecording) line(s string) {
+	r.Lock()
+	midLine := r.midLine
+	r.Unlock()
+	if midLine {
+		s = "\n" + s
+	}
+	r.write(s)
+}
+
+// write append output s, as an output event of asciicast
+func (r *sessionRecording) write(s string) {
+	r.Lock()
+	defer r.Unlock()
+	r.midLine = !strings.HasSuffix(s, "\n")
+	if r.format != RecordAsciicast {
+		io.WriteString(r.f, s)
+		return
+	}
+	event, _ := json.Marshal([]interface{}{time.Since(r.start).Seconds(), "o", strings.Replace(s, "\n", "\r\n", -1)})
+	fmt.Fprintf(r.f, "%s\n", event)
+}
+
+// end record exit of command
+func (r *sessionRecording) end(err error) {
+	if err != nil {
+		r.line(fmt.Sprintf("[%s]\n", Redact(err.Error())))
+	}
+}
+
+// output get writer of a stream of command output into recording, secrets are redacted
+func (r *sessionRecording) output() io.Writer {
+	return &recordingWriter{r: r}
+}
+
+// recordingWriter output stream of a command, keeping a split utf-8 rune until its rest arrives
+type recordingWriter struct {
+	r       *sessionRecording
+	pending []byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	b := append(w.pending, p...)
+	w.pending = nil
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				w.pending = append([]byte(nil), b[i:]...)
+				b = b[:i]
+			}
+			break
+		}
+	}
+	if len(b) > 0 {
+		w.r.write(Redact(string(b)))
+	}
+	return len(p), nil
+}
+
+// CloseRecordings close session recordings of hosts
+func CloseRecordings() {
+	recordings.Lock()
+	defer recordings.Unlock()
+	for h, r := range recordings.files {
+		if r.format == RecordTypescript {
+			r.line(fmt.Sprintf("Script done on %s\n", time.Now().Format("2006-01-02 15:04:05-07:00")))
+		}
+		r.f.Close()
+		delete(recordings.files, h)
+	}
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedactedValue shown instead of secret values
+const RedactedValue = "******"
+
+// MinSecretLength secrets shorter than this are not redacted, they would mask ordinary output
+const MinSecretLength = 4
+
+// secrets values masked in output, replacer is rebuilt when a secret is registered
+var secrets = struct {
+	sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}{values: make(map[string]bool)}
+
+// Stdout standard output with secrets redacted, all output of optool is written here
+var Stdout io.Writer = RedactWriter(os.Stdout)
+
+// Stderr standard error with secrets redacted
+var Stderr io.Writer = RedactWriter(os.Stderr)
+
+// RegisterSecret mask s in all output from now on
+func RegisterSecret(s string) {
+	if len(s) < MinSecretLength {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	if secrets.values[s] {
+		return
+	}
+	secrets.values[s] = true
+	// longer secrets first, so that a secret containing another is masked whole
+	var values []string
+	for v := range secrets.values {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	var pairs []string
+	for _, v := range values {
+		pairs = append(pairs, v, RedactedValue)
+	}
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// configSecrets get decrypted passwords, phrases and tokens of configure
+func configSecrets() []string {
+	var values []string
+	add := func(s string, encrypted bool) {
+		if s == "" {
+			return
+		}
+		if encrypted && !C.Auth.PlainPassword {
+			s = string(Decrypt(s))
+		}
+		if s != "" {
+			values = append(values, s)
+		}
+	}
+	add(C.Auth.Password, true)
+	add(C.Auth.PrivateKeyPhrase, true)
+	add(C.FTP.Password, true)
+	add(C.WinRM.Password, true)
+	add(C.NetDev.Password, true)
+	add(C.NetDev.EnablePassword, true)
+	add(C.Email.Password, true)
+	add(C.Consul.Token, false)
+	add(C.GitHub.Token, false)
+	add(C.Alert.Key, false)
+	add(C.Change.Token, false)
+	for _, v := range C.EnvFile.Secrets {
+		add(secretValue(v), false)
+	}
+	return values
+}
+
+// RegisterConfigSecrets mask passwords, phrases and tokens of configure in all output
+func RegisterConfigSecrets() {
+	for _, s := range configSecrets() {
+		RegisterSecret(s)
+	}
+}
+
+// secretList get registered secrets
+func secretList() []string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	var values []string
+	for v := range secrets.values {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// Redact replace registered secrets in s, for output, reports and error messages
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+type redactWriter struct {
+	w io.Writer
+}
+
+// RedactWriter get writer redacting secrets of every write into w
+func RedactWriter(w io.Writer) io.Writer {
+	return &redactWriter{w: w}
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
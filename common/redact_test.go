@@ -0,0 +1,47 @@
+package common
+
+import "testing"
+
+// withSecrets register values for a test, registered secrets are restored when the test ends
+func withSecrets(t *testing.T, values ...string) {
+	t.Helper()
+	secrets.Lock()
+	oldValues, oldReplacer := secrets.values, secrets.replacer
+	secrets.values, secrets.replacer = make(map[string]bool), nil
+	secrets.Unlock()
+	t.Cleanup(func() {
+		secrets.Lock()
+		secrets.values, secrets.replacer = oldValues, oldReplacer
+		secrets.Unlock()
+	})
+	for _, v := range values {
+		RegisterSecret(v)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		secrets []string
+		in      string
+		want    string
+	}{
+		{nil, "password hunter22", "password hunter22"},
+		{[]string{"abc"}, "abc", "abc"},
+		{[]string{"hunter22"}, "password hunter22 again hunter22", "password ****** again ******"},
+		// registered in either order, a secret containing another is masked whole
+		{[]string{"pass", "password1"}, "token=password1", "token=******"},
+		{[]string{"password1", "pass"}, "token=password1 pass", "token=****** ******"},
+		{[]string{"pass", "mypassword"}, "mypassword", "******"},
+		// partly overlapping secrets, the leftmost match is masked and neither is left whole
+		{[]string{"abcdef", "defghi"}, "abcdefghi", "******ghi"},
+		{[]string{"abcdef", "defghi"}, "xdefghi", "x******"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			withSecrets(t, tt.secrets...)
+			if got := Redact(tt.in); got != tt.want {
+				t.Errorf("secrets %v, Redact(%q) = %q, want %q", tt.secrets, tt.in, got, tt.want)
+			}
+		})
+	}
+}
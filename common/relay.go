@@ -0,0 +1,72 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// prepareRelay check a put relayed from host t.From, its file is streamed through optool and never lands locally
+func (t *Transfer) prepareRelay() error {
+	switch {
+	case t.Recursive || t.Sync:
+		return errors.New("Dirs cannot be relayed from a host, put a tar with -extract instead")
+	case t.Verify != "":
+		return errors.New("Verify is not supported by relayed puts")
+	case t.LocalPath == TransferStdin:
+		return errors.New("Relayed put reads a file of the source host, not stdin")
+	}
+	target := t.RemotePath
+	if strings.HasSuffix(target, "/") {
+		target = path.Join(target, path.Base(t.LocalPath))
+	}
+	for _, h := range t.Hosts {
+		if h == t.From && !t.Extract && path.Clean(target) == path.Clean(t.LocalPath) {
+			return fmt.Errorf("%s: source and target are the same file", h)
+		}
+	}
+	return nil
+}
+
+// putRelay open file of source host and tee it to hosts
+func (t *Transfer) putRelay() error {
+	src := NewTransfer(TransferGet, "", t.LocalPath, []string{t.From})
+	src.Transport, src.Dialer = t.Transport, t.Dialer
+	if err := src.initClient(); err != nil {
+		return err
+	}
+	defer func() {
+		for _, tr := range src.Transports {
+			tr.Close()
+		}
+		for _, c := range src.Clients {
+			releaseClient(c)
+		}
+	}()
+	tr, ok := src.Transports[t.From]
+	if !ok {
+		return fmt.Errorf("Source host %s: %s", t.From, src.Errors[t.From])
+	}
+	fi, err := tr.Stat(t.LocalPath)
+	if err != nil {
+		return fmt.Errorf("Source host %s: %s", t.From, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("Source host %s: %s is a dir", t.From, t.LocalPath)
+	}
+	f, err := tr.Open(t.LocalPath)
+	if err != nil {
+		return fmt.Errorf("Source host %s: %s", t.From, err)
+	}
+	defer f.Close()
+	hostLogf(t.From, "relay %s to %d host(s)", t.LocalPath, len(t.connected()))
+	if !t.Extract && strings.HasSuffix(t.RemotePath, "/") {
+		final := t.RemotePath
+		t.RemotePath = path.Join(final, path.Base(t.LocalPath))
+		defer func() {
+			t.RemotePath = final
+		}()
+	}
+	return t.putStream(f)
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Kinds of release changes
+const (
+	ChangeAdded    = "+"
+	ChangeRemoved  = "-"
+	ChangeModified = "~"
+)
+
+// ReleaseChange file changed between two releases
+type ReleaseChange struct {
+	Kind string // ChangeAdded, ChangeRemoved or ChangeModified
+	Path string // relative to release dir
+}
+
+// manifestScript print sha256 of files and targets of links under dir, paths relative to dir
+func manifestScript(dir string) string {
+	return "cd " + shellQuote(dir) + " 2>/dev/null || { echo no such dir; exit 1; }; { find . -type f -exec sha256sum {} +; " +
+		`find . -type l -exec sh -c 'for f; do printf "link:%s  %s\n" "$(readlink "$f")" "$f"; done' sh {} +; }`
+}
+
+// releasePath get dir of release on hosts: current, previous, a release id under deploy.root/releases or a path
+func releasePath(rel string) (string, error) {
+	if path.IsAbs(rel) {
+		return rel, nil
+	}
+	if C.Deploy.Root == "" {
+		return "", errors.New("deploy.root is not configured")
+	}
+	switch {
+	case rel == CurrentLink:
+		return path.Join(C.Deploy.Root, CurrentLink), nil
+	case rel == "previous":
+		return path.Join(C.Deploy.Root, CurrentLink+PrevSuffix), nil
+	case rel == "" || strings.Contains(rel, "/") || rel == "." || rel == "..":
+		return "", fmt.Errorf("Invalid release: %s", rel)
+	}
+	return path.Join(C.Deploy.Root, ReleasesDir, rel), nil
+}
+
+// releaseManifest get checksums of files of dir on host keyed by relative path, links are listed by target
+func releaseManifest(host, dir string) (map[string]string, error) {
+	output, errs, err := RunRemote([]string{host}, manifestScript(dir))
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := errs[host]; ok {
+		if out := strings.TrimSpace(output[host]); out != "" {
+			e = out
+		}
+		return nil, fmt.Errorf("%s: %s", dir, strings.TrimSpace(e))
+	}
+	manifest := make(map[string]string)
+	for _, line := range strings.Split(output[host], "\n") {
+		kv := strings.SplitN(line, "  ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		manifest[strings.TrimPrefix(kv[1], "./")] = kv[0]
+	}
+	return manifest, nil
+}
+
+// DiffReleases list files added, removed and modified from release from to release to on host, sorted by path
+func DiffReleases(host, from, to string) ([]ReleaseChange, error) {
+	fromDir, err := releasePath(from)
+	if err != nil {
+		return nil, err
+	}
+	toDir, err := releasePath(to)
+	if err != nil {
+		return nil, err
+	}
+	fm, err := releaseManifest(host, fromDir)
+	if err != nil {
+		return nil, err
+	}
+	tm, err := releaseManifest(host, toDir)
+	if err != nil {
+		return nil, err
+	}
+	var changes []ReleaseChange
+	for p, sum := range tm {
+		if fsum, ok := fm[p]; !ok {
+			changes = append(changes, ReleaseChange{Kind: ChangeAdded, Path: p})
+		} else if fsum != sum {
+			changes = append(changes, ReleaseChange{Kind: ChangeModified, Path: p})
+		}
+	}
+	for p := range fm {
+		if _, ok := tm[p]; !ok {
+			changes = append(changes, ReleaseChange{Kind: ChangeRemoved, Path: p})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Release artifact deployed to a host group
+type Release struct {
+	Group    string    `json:"group"`
+	Artifact string    `json:"artifact"` // artifact file name
+	Checksum string    `json:"checksum"` // sha256 of artifact
+	Deployed time.Time `json:"deployed"`
+	Deployer string    `json:"deployer,omitempty"` // optool version recorded the release
+	Revision string    `json:"revision,omitempty"` // git revision of local working dir
+	RunID    string    `json:"run_id,omitempty"`
+}
+
+// FileChecksum get sha256 of local file
+func FileChecksum(f string) (string, error) {
+	fd, err := os.Open(f)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// LoadReleases load last release of every group
+func LoadReleases() (map[string]Release, error) {
+	releases := make(map[string]Release)
+	_, err := loadState("releases.json", &releases)
+	return releases, err
+}
+
+// RecordRelease record artifact deployed to group and keep a copy of its bytes in cache
+func RecordRelease(group, artifact string) (Release, error) {
+	rel := Release{
+		Group:    group,
+		Artifact: filepath.Base(artifact),
+		Deployed: time.Now(),
+		Deployer: Version,
+		Revision: gitRevision(),
+		RunID:    RunID,
+	}
+	sum, _, err := CacheStore(artifact)
+	if err != nil {
+		return rel, err
+	}
+	rel.Checksum = sum
+	releases := make(map[string]Release)
+	err = updateState("releases.json", &releases, func() error {
+		releases[group] = rel
+		return nil
+	})
+	if err != nil {
+		return rel, err
+	}
+	var history []Release
+	return rel, updateState("history.json", &history, func() error {
+		history = append(history, rel)
+		return nil
+	})
+}
+
+// LoadHistory load all recorded releases, oldest first
+func LoadHistory() ([]Release, error) {
+	var history []Release
+	_, err := loadState("history.json", &history)
+	return history, err
+}
+
+// PreviousRelease get the latest release of group whose artifact differs from the current one
+func PreviousRelease(group string) (Release, error) {
+	releases, err := LoadReleases()
+	if err != nil {
+		return Release{}, err
+	}
+	current, ok := releases[group]
+	if !ok {
+		return Release{}, fmt.Errorf("No release recorded for group %s", group)
+	}
+	history, err := LoadHistory()
+	if err != nil {
+		return Release{}, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Group == group && history[i].Checksum != current.Checksum {
+			return history[i], nil
+		}
+	}
+	return Release{}, fmt.Errorf("No previous release recorded for group %s", group)
+}
+
+// PromoteArtifact get cached artifact last deployed to group, its bytes are verified against recorded checksum
+func PromoteArtifact(group string) (string, error) {
+	releases, err := LoadReleases()
+	if err != nil {
+		return "", err
+	}
+	rel, ok := releases[group]
+	if !ok {
+		return "", fmt.Errorf("No release recorded for group %s", group)
+	}
+	cached := CacheLookup(rel.Checksum)
+	if cached == "" {
+		return "", fmt.Errorf("Artifact %s of group %s is not in cache", rel.Checksum, group)
+	}
+	sum, err := FileChecksum(cached)
+	if err != nil {
+		return "", err
+	}
+	if sum != rel.Checksum {
+		return "", fmt.Errorf("Cached artifact %s checksum mismatch: %s != %s", cached, sum, rel.Checksum)
+	}
+	return cached, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
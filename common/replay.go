@@ -0,0 +1,234 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayEnv run id replayed by a child optool started by Replay
+const ReplayEnv = "OPTOOL_REPLAY"
+
+// replayHostsEnv hosts of a replay, comma separated, all recorded hosts if empty
+const replayHostsEnv = "OPTOOL_REPLAY_HOSTS"
+
+// RunRecord parameters and result of a run, saved in state dir so that the run can be replayed
+type RunRecord struct {
+	RunID    string            `json:"run_id"`
+	ReplayOf string            `json:"replay_of,omitempty"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished,omitempty"`
+	By       string            `json:"by"`     // user@host, with rbac user and token id if run by token
+	Dir      string            `json:"dir"`    // working dir
+	Config   string            `json:"config"` // absolute path of configure
+	Args     []string          `json:"args"`
+	Hosts    []string          `json:"hosts"`
+	Files    map[string]string `json:"files,omitempty"`    // sha256 of local files put, keyed by absolute path
+	Artifact string            `json:"artifact,omitempty"` // sha256 of deploy artifact
+	Failed   map[string]string `json:"failed,omitempty"`   // errors of failed hosts
+	Error    string            `json:"error,omitempty"`
+}
+
+var (
+	runRecordLock sync.Mutex
+	runRecord     *RunRecord
+	replaying     *RunRecord
+)
+
+// StartRunRecord record parameters of this run, files put and the deploy artifact are added as they are used
+func StartRunRecord(config string, args, hosts []string) error {
+	dir, _ := os.Getwd()
+	if abs, err := filepath.Abs(config); err == nil {
+		config = abs
+	}
+	runRecordLock.Lock()
+	defer runRecordLock.Unlock()
+	runRecord = &RunRecord{
+		RunID:   RunID,
+		Started: time.Now(),
+		By:      actingUser(),
+		Dir:     dir,
+		Config:  config,
+		Args:    args,
+		Hosts:   hosts,
+		Files:   make(map[string]string),
+	}
+	if replaying != nil {
+		runRecord.ReplayOf = replaying.RunID
+	}
+	return saveState(filepath.Join("runs", RunID+".json"), runRecord)
+}
+
+// FinishRunRecord record result of this run
+func FinishRunRecord(err error) error {
+	runRecordLock.Lock()
+	defer runRecordLock.Unlock()
+	if runRecord == nil {
+		return nil
+	}
+	runRecord.Finished = time.Now()
+	if err != nil {
+		runRecord.Error = Redact(err.Error())
+	}
+	for h, e := range FailedHosts() {
+		if runRecord.Failed == nil {
+			runRecord.Failed = make(map[string]string)
+		}
+		runRecord.Failed[h] = Redact(e)
+	}
+	return saveState(filepath.Join("runs", RunID+".json"), runRecord)
+}
+
+// recordFile keep a copy of local file put in cache, so that a replay puts the same bytes
+func recordFile(f string) error {
+	runRecordLock.Lock()
+	recording := runRecord != nil
+	runRecordLock.Unlock()
+	if !recording {
+		return nil
+	}
+	abs, err := filepath.Abs(f)
+	if err != nil {
+		return err
+	}
+	sum, _, err := CacheStore(abs)
+	if err != nil {
+		return err
+	}
+	runRecordLock.Lock()
+	runRecord.Files[abs] = sum
+	runRecordLock.Unlock()
+	return nil
+}
+
+// recordArtifact record checksum of prepared deploy artifact, it is cached by the deploy
+func recordArtifact(f string) error {
+	runRecordLock.Lock()
+	recording := runRecord != nil
+	runRecordLock.Unlock()
+	if !recording {
+		return nil
+	}
+	sum, _, err := CacheStore(f)
+	if err != nil {
+		return err
+	}
+	runRecordLock.Lock()
+	runRecord.Artifact = sum
+	runRecordLock.Unlock()
+	return nil
+}
+
+// LoadRunRecord load recorded run
+func LoadRunRecord(runID string) (*RunRecord, error) {
+	rec := &RunRecord{}
+	ok, err := loadState(filepath.Join("runs", runID+".json"), rec)
+	if err == nil && !ok {
+		err = fmt.Errorf("Run %s is not recorded", runID)
+	}
+	return rec, err
+}
+
+// LoadReplay load run replayed by this process if started by Replay, deploy artifact is pinned to the recorded one
+func LoadReplay() error {
+	runID := os.Getenv(ReplayEnv)
+	if runID == "" {
+		return nil
+	}
+	rec, err := LoadRunRecord(runID)
+	if err != nil {
+		return err
+	}
+	if rec.Artifact != "" {
+		cached := CacheLookup(rec.Artifact)
+		if cached == "" {
+			return fmt.Errorf("Artifact %s of run %s is not cached", ShortSum(rec.Artifact), runID)
+		}
+		C.Deploy.Artifact = cached
+		C.Deploy.Checksum = rec.Artifact
+		C.Deploy.Build.Command = ""
+	}
+	replaying = rec
+	return nil
+}
+
+// ReplayHosts get hosts of replayed run, nil if not replaying
+func ReplayHosts() []string {
+	if replaying == nil {
+		return nil
+	}
+	if hosts := os.Getenv(replayHostsEnv); hosts != "" {
+		return SplitHosts(hosts)
+	}
+	return replaying.Hosts
+}
+
+// replayFile get cached copy of local file put by replayed run, f itself if not replaying or not recorded
+func replayFile(f string) (string, error) {
+	if replaying == nil {
+		return f, nil
+	}
+	abs, err := filepath.Abs(f)
+	if err != nil {
+		return f, err
+	}
+	sum, ok := replaying.Files[abs]
+	if !ok {
+		return f, nil
+	}
+	cached := CacheLookup(sum)
+	if cached == "" {
+		return f, fmt.Errorf("%s of run %s is not cached", f, replaying.RunID)
+	}
+	return cached, nil
+}
+
+// Replay run optool again with args, configure and working dir of recorded run, against its hosts, its files and
+// its artifact. only failed hosts are run if failed is set
+func Replay(runID string, failed bool) error {
+	rec, err := LoadRunRecord(runID)
+	if err != nil {
+		return err
+	}
+	var hosts []string
+	if failed {
+		for h := range rec.Failed {
+			hosts = append(hosts, h)
+		}
+		if len(hosts) == 0 {
+			return fmt.Errorf("No host failed in run %s", runID)
+		}
+		sort.Strings(hosts)
+	}
+	for f, sum := range rec.Files {
+		if CacheLookup(sum) == "" {
+			return fmt.Errorf("%s of run %s is not cached", f, runID)
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// a -config of recorded args still wins, it is resolved in the same dir
+	args := append([]string{"-config", rec.Config}, rec.Args...)
+	fmt.Fprintf(Stdout, "Replaying run %s of %s: %s\n", runID, rec.Started.Format("2006-01-02 15:04:05"), strings.Join(args, " "))
+	cmd := exec.Command(self, args...)
+	cmd.Dir = rec.Dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), ReplayEnv+"="+runID, replayHostsEnv+"="+strings.Join(hosts, ","))
+	if err = cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return errors.New("Replay failed")
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pruneScript shell script removing old release dirs, the release current points to is always kept.
+// releases beyond the newest keep_releases, or older than keep_days, are removed with dangling backup links.
+// prints pruned releases and freed kilobytes on the last line
+func pruneScript() string {
+	cutoff := "0"
+	if C.Deploy.KeepDays > 0 {
+		cutoff = time.Now().UTC().Add(-time.Duration(C.Deploy.KeepDays) * 24 * time.Hour).Format("20060102150405")
+	}
+	root := shellQuote(C.Deploy.Root)
+	current := shellQuote(path.Join(C.Deploy.Root, CurrentLink))
+	return `cd ` + root + `/` + ReleasesDir + ` 2>/dev/null || { echo 0; exit 0; }
+cur=$(basename "$(readlink ` + current + `)")
+n=0; freed=0
+for r in $(ls -1 | sort -r); do
+  case "$r" in *[!0-9]*) continue;; esac
+  n=$((n+1))
+  [ "$r" = "$cur" ] && continue
+  if [ ` + strconv.Itoa(C.Deploy.KeepReleases) + ` -gt 0 ] && [ $n -gt ` + strconv.Itoa(C.Deploy.KeepReleases) + ` ] || [ "$r" -lt ` + cutoff + ` ]; then
+    kb=$(du -sk "$r" | cut -f1)
+    rm -rf "$r" || exit 1
+    freed=$((freed+kb))
+    echo "$r"
+  fi
+done
+b=` + shellQuote(path.Join(C.Deploy.Root, CurrentLink+PrevSuffix)) + `
+[ -L "$b" ] && [ ! -e "$b" ] && rm -f "$b"
+echo $freed`
+}
+
+// PruneReleases remove old release dirs on hosts by deploy.keep_releases and deploy.keep_days
+// result of hosts with releases pruned reports count and freed space
+func PruneReleases(hosts []string) (result map[string]string, errs map[string]string, err error) {
+	if !C.Deploy.Releases || (C.Deploy.KeepReleases <= 0 && C.Deploy.KeepDays <= 0) || len(hosts) == 0 {
+		return nil, nil, nil
+	}
+	output, errs, err := RunRemote(hosts, pruneScript())
+	if err != nil {
+		return nil, nil, err
+	}
+	result = make(map[string]string)
+	for h, out := range output {
+		if _, ok := errs[h]; ok {
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if len(lines) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseInt(lines[len(lines)-1], 10, 64)
+		result[h] = fmt.Sprintf("pruned %d release(s), freed %s", len(lines)-1, HumanSize(kb*1024))
+	}
+	return result, errs, nil
+}
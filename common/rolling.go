@@ -0,0 +1,468 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PrevSuffix suffix of previous artifact kept for atomic rollback
+const PrevSuffix = ".optool-prev"
+
+// Rolling deploy hosts batch by batch, draining each batch from load balancer
+type Rolling struct {
+	Hosts          []string
+	BatchSize      int
+	LB             LoadBalancer
+	Atomic         bool              // revert all hosts to previous release if any host failed
+	RolledBack     bool              // run is reverted
+	Result         map[string]string // host => result message
+	Release        string            // id of release dir if deploy.releases is set
+	Failed         map[string]string // host => error
+	Adaptive       bool              // start with BatchSize and double it after every batch succeeded
+	MaxBatchSize   int               // cap of adaptive batches, 0 for none
+	MaxFailureRate float64           // share of hosts adaptive batches may fail before the deploy stops
+	Canaries       []string          // hosts deployed first as a batch of their own
+	order          []string          // hosts in order of deploy, canaries first
+	touched        []string          // hosts artifact is uploaded to
+	reused         map[string]string // host => linked or copied, artifact taken from previous release
+}
+
+// NewRolling get rolling deployment instance
+func NewRolling(hosts []string, batchSize int) (*Rolling, error) {
+	lb, err := NewLoadBalancer(C.Deploy.LoadBalancer)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize < 1 {
+		batchSize = C.Deploy.BatchSize
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	r := &Rolling{
+		Hosts:          hosts,
+		BatchSize:      batchSize,
+		LB:             lb,
+		Atomic:         C.Deploy.Atomic,
+		Result:         make(map[string]string),
+		Failed:         make(map[string]string),
+		Adaptive:       C.Deploy.Adaptive,
+		MaxBatchSize:   C.Deploy.MaxBatchSize,
+		MaxFailureRate: C.Deploy.MaxFailureRate,
+	}
+	if C.Deploy.Releases {
+		r.Release = NewReleaseID()
+	}
+	return r, nil
+}
+
+// Start deploy batches one by one, stop at the first batch with failure. adaptive batches double after a batch
+// succeeded and halve after failures, stopping once the failed share of hosts exceeds deploy.max_failure_rate
+func (r *Rolling) Start() error {
+	if C.Deploy.Root == "" {
+		return errors.New("deploy.root is not configured")
+	}
+	if err := PrepareArtifact(); err != nil {
+		return err
+	}
+	if err := CheckReboots(r.Hosts); err != nil {
+		return err
+	}
+	if err := CheckClocks(r.Hosts, "deploy"); err != nil {
+		return err
+	}
+	r.Canaries = SelectCanaries(r.Hosts, C.Deploy.Canary)
+	r.order = append([]string(nil), r.Canaries...)
+	for _, h := range r.Hosts {
+		if !r.isCanary(h) {
+			r.order = append(r.order, h)
+		}
+	}
+	size, failed := r.BatchSize, 0
+	var took []time.Duration // batches of this run, estimate hosts when there is no history
+	for i, n := 0, 1; i < len(r.order); n++ {
+		if err := CheckControl(fmt.Sprintf("batch %d", n)); err != nil {
+			// previous artifacts are kept by atomic deploys only, no batch is drained between batches
+			if !r.Atomic || len(r.touched) == 0 {
+				return err
+			}
+			if rerr := r.rollback(nil); rerr != nil {
+				return fmt.Errorf("%s, rollback: %s", err, rerr)
+			}
+			return fmt.Errorf("%s, all hosts rolled back", err)
+		}
+		plan := r.plan(i, size)
+		canary := i == 0 && len(r.Canaries) > 0
+		if canary {
+			plan = append([][]string{r.Canaries}, r.plan(len(r.Canaries), size)...)
+			fmt.Fprintf(Stdout, "Canary: %s\n", strings.Join(r.Canaries, ","))
+		}
+		batch := plan[0]
+		end := i + len(batch)
+		if total := n - 1 + len(plan); total > 1 {
+			progress := fmt.Sprintf("Batch %d/%d: %d host(s)", n, total, len(batch))
+			if eta, ok := remaining(plan, took); ok {
+				progress += ", " + FormatETA(eta) + " remaining"
+			}
+			fmt.Fprintln(Stdout, progress)
+		}
+		start := time.Now()
+		err := r.deployBatch(batch)
+		took = append(took, time.Since(start))
+		var deployed []string
+		for _, h := range batch {
+			if _, f := r.Failed[h]; !f {
+				deployed = append(deployed, h)
+			}
+		}
+		RecordDuration(DeployStep, deployed, took[len(took)-1])
+		if rerr := RecordBoots(deployed); rerr != nil {
+			fmt.Fprintf(Stderr, "Warning: record boot ids: %s\n", rerr)
+		}
+		failed += len(batch) - len(deployed)
+		i = end
+		if err == nil && canary && C.Deploy.Canary.Wait > 0 && i < len(r.order) {
+			fmt.Fprintf(Stdout, "Canary: watching for %ds\n", C.Deploy.Canary.Wait)
+			time.Sleep(time.Duration(C.Deploy.Canary.Wait) * time.Second)
+			// canaries turned unhealthy while watched stop the deploy
+			if errs := WaitHealthy(r.Canaries, C.Deploy.HealthCheck, map[string]string{"dir": r.deployDir()}); len(errs) > 0 {
+				r.fail(r.Canaries, errs)
+				failed += len(errs)
+				err = fmt.Errorf("%d canary host(s) unhealthy", len(errs))
+			}
+		}
+		if err == nil {
+			if r.Adaptive && !canary {
+				size = r.grow(size)
+			}
+			continue
+		}
+		if canary {
+			err = fmt.Errorf("Canary: %s", err)
+		} else {
+			err = fmt.Errorf("Batch %d: %s", n, err)
+		}
+		if r.Adaptive && !canary && !r.Atomic && float64(failed) <= r.MaxFailureRate*float64(end) {
+			fmt.Fprintf(Stderr, "Warning: %s, %d of %d host(s) failed, batch size halved\n", err, failed, end)
+			if size /= 2; size < 1 {
+				size = 1
+			}
+			continue
+		}
+		if r.Atomic {
+			if rerr := r.rollback(r.order[:end]); rerr != nil {
+				return fmt.Errorf("%s, rollback: %s", err, rerr)
+			}
+			return fmt.Errorf("%s, all hosts rolled back", err)
+		}
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d host(s) failed", failed)
+	}
+	return nil
+}
+
+// isCanary check if host is a canary of this deploy
+func (r *Rolling) isCanary(host string) bool {
+	for _, c := range r.Canaries {
+		if c == host {
+			return true
+		}
+	}
+	return false
+}
+
+// grow get size of the batch after a batch of size succeeded
+func (r *Rolling) grow(size int) int {
+	size *= 2
+	if r.MaxBatchSize > 0 && size > r.MaxBatchSize {
+		size = r.MaxBatchSize
+	}
+	return size
+}
+
+// plan get batches of hosts from index i on if every batch succeeds, the first of size
+func (r *Rolling) plan(i, size int) [][]string {
+	var batches [][]string
+	for i < len(r.order) {
+		end := i + size
+		if end > len(r.order) {
+			end = len(r.order)
+		}
+		batches = append(batches, r.order[i:end])
+		i = end
+		if r.Adaptive {
+			size = r.grow(size)
+		}
+	}
+	return batches
+}
+
+// remaining estimate time of batches, by historical medians of their hosts or the mean of batches of this run
+func remaining(batches [][]string, took []time.Duration) (time.Duration, bool) {
+	var mean time.Duration
+	for _, d := range took {
+		mean += d / time.Duration(len(took))
+	}
+	var total time.Duration
+	for _, batch := range batches {
+		est, ok := EstimateDuration(DeployStep, batch)
+		if !ok {
+			if len(took) == 0 {
+				return 0, false
+			}
+			est = mean
+		}
+		total += est
+	}
+	return total, true
+}
+
+// artifactPath remote path of deployed artifact, current link if deploy.releases is set
+func artifactPath() string {
+	if C.Deploy.Releases {
+		return path.Join(C.Deploy.Root, CurrentLink)
+	}
+	return path.Join(C.Deploy.Root, filepath.Base(C.Deploy.Artifact))
+}
+
+// deployDir remote dir artifact of release is deployed into
+func (r *Rolling) deployDir() string {
+	if r.Release != "" {
+		return releaseDir(r.Release)
+	}
+	return strings.TrimRight(C.Deploy.Root, "/")
+}
+
+// backup keep previous artifact on hosts for atomic rollback
+func (r *Rolling) backup(hosts []string) []string {
+	f, prev := shellQuote(artifactPath()), shellQuote(artifactPath()+PrevSuffix)
+	_, errs, err := RunRemote(hosts, "[ ! -e "+f+" ] || { rm -f "+prev+" && cp -pP "+f+" "+prev+"; }")
+	if err != nil {
+		errs = make(map[string]string)
+		for _, h := range hosts {
+			errs[h] = err.Error()
+		}
+	}
+	return r.fail(hosts, errs)
+}
+
+// rollback restore previous artifact on every touched host, activate it and put it back into rotation. hosts without
+// a previous artifact, eg. on first deploy, keep the failed one and are reported as not reverted
+func (r *Rolling) rollback(batch []string) error {
+	r.RolledBack = true
+	f := artifactPath()
+	failed := make(map[string]string)
+	hosts := r.touched
+	if len(hosts) > 0 {
+		mv := "mv -f "
+		if C.Deploy.Releases {
+			// never move into the dir current points to
+			mv = "mv -fT "
+		}
+		prev := shellQuote(f + PrevSuffix)
+		output, errs, err := RunRemote(hosts, "if [ -e "+prev+" ]; then "+mv+prev+" "+shellQuote(f)+"; else echo none; fi")
+		if err != nil {
+			return err
+		}
+		for _, h := range hosts {
+			if _, ok := errs[h]; !ok && strings.TrimSpace(output[h]) == "none" {
+				errs[h] = "not reverted, no previous artifact"
+			}
+		}
+		hosts = failHosts(hosts, errs, failed)
+	}
+	if C.Deploy.Activate != "" && len(hosts) > 0 {
+		dir := C.Deploy.Root
+		if C.Deploy.Releases {
+			dir = f
+		}
+		_, errs, err := RunRemote(hosts, ExpandVars(C.Deploy.Activate, map[string]string{"dir": dir}))
+		if err != nil {
+			return err
+		}
+		hosts = failHosts(hosts, errs, failed)
+	}
+	if r.LB != nil {
+		// hosts drained by the failed batch, those not reverted stay out of rotation
+		var enable []string
+		for _, h := range batch {
+			if _, ok := failed[h]; !ok {
+				enable = append(enable, h)
+			}
+		}
+		errs := make(map[string]string)
+		for h, e := range RunHosts(enable, func(ctx context.Context, h string) error {
+			return r.LB.Enable(h)
+		}) {
+			errs[h] = "enable: " + e.Error()
+		}
+		failHosts(enable, errs, failed)
+	}
+	for _, h := range r.touched {
+		if e, ok := failed[h]; ok {
+			r.Failed[h] = "rollback: " + e
+			delete(r.Result, h)
+			continue
+		}
+		r.Result[h] = "rolled back"
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d host(s) failed to roll back", len(failed))
+	}
+	return nil
+}
+
+// failHosts record errors of hosts into failed, returns hosts without error
+func failHosts(hosts []string, errs map[string]string, failed map[string]string) []string {
+	var ok []string
+	for _, h := range hosts {
+		if e, f := errs[h]; f {
+			failed[h] = e
+			continue
+		}
+		ok = append(ok, h)
+	}
+	return ok
+}
+
+func (r *Rolling) deployBatch(batch []string) error {
+	hosts := batch
+	// alerts of failed hosts are back on too, they need a look
+	silence, err := SilenceHosts(hosts)
+	if err != nil {
+		fmt.Fprintf(Stderr, "Warning: silence alerts: %s\n", err)
+	}
+	defer func() {
+		if err := silence.Unsilence(); err != nil {
+			fmt.Fprintf(Stderr, "Warning: unsilence alerts: %s\n", err)
+		}
+	}()
+	if r.LB != nil {
+		hosts = r.lbFail(hosts, "drain: ", r.LB.Drain)
+	}
+	if r.Atomic && len(hosts) > 0 {
+		hosts = r.backup(hosts)
+	}
+	r.touched = append(r.touched, hosts...)
+	dir := r.deployDir()
+	if r.Release != "" && len(hosts) > 0 {
+		_, errs, err := RunRemote(hosts, "mkdir -p "+shellQuote(dir))
+		if err != nil {
+			return err
+		}
+		hosts = r.fail(hosts, errs)
+	}
+	upload := hosts
+	if r.Release != "" && C.Deploy.HardLinks && len(hosts) > 0 {
+		var errs map[string]string
+		upload, errs = r.linkUnchanged(hosts, dir)
+		hosts = r.fail(hosts, errs)
+	}
+	if len(upload) > 0 {
+		// failed hosts are kept out of rotation, they may be half deployed
+		errs, err := PutArtifact(upload, C.Deploy.Artifact, dir+"/")
+		if err != nil {
+			for _, h := range upload {
+				r.Failed[h] = err.Error()
+			}
+			return err
+		}
+		hosts = r.fail(hosts, errs)
+	}
+	errs, err := LinkShared(hosts, dir)
+	if err != nil {
+		return err
+	}
+	hosts = r.fail(hosts, errs)
+	if r.Release != "" && len(hosts) > 0 {
+		_, errs, err := RunRemote(hosts, linkCmd(dir, path.Join(C.Deploy.Root, CurrentLink)))
+		if err != nil {
+			return err
+		}
+		hosts = r.fail(hosts, errs)
+	}
+	vars := map[string]string{"dir": dir}
+	if C.Deploy.Activate != "" && len(hosts) > 0 {
+		_, errs, err := RunRemote(hosts, ExpandVars(C.Deploy.Activate, vars))
+		if err != nil {
+			return err
+		}
+		hosts = r.fail(hosts, errs)
+	}
+	if len(C.Deploy.Services) > 0 && len(hosts) > 0 {
+		rs := NewRestart(hosts)
+		if err := rs.Start(vars); err != nil {
+			return err
+		}
+		hosts = r.fail(hosts, rs.Failed)
+	}
+	hosts = r.fail(hosts, WaitHealthy(hosts, C.Deploy.HealthCheck, vars))
+	if errs, err = WriteMeta(hosts, dir, C.Deploy.Artifact); err != nil {
+		return err
+	}
+	hosts = r.fail(hosts, errs)
+	if r.LB != nil {
+		hosts = r.lbFail(hosts, "enable: ", r.LB.Enable)
+	}
+	pruned, perrs, err := PruneReleases(hosts)
+	for _, h := range hosts {
+		r.Result[h] = "deployed"
+		if how, ok := r.reused[h]; ok {
+			r.Result[h] += ", artifact " + how + " from previous release"
+		}
+		if err != nil {
+			r.Result[h] += ", prune: " + err.Error()
+		} else if e, ok := perrs[h]; ok {
+			r.Result[h] += ", prune: " + strings.TrimSpace(e)
+		} else if p, ok := pruned[h]; ok {
+			r.Result[h] += ", " + p
+		}
+	}
+	for _, h := range batch {
+		if _, ok := r.Failed[h]; ok {
+			return fmt.Errorf("%d host(s) failed", len(batch)-len(hosts))
+		}
+	}
+	return nil
+}
+
+// fail record errors and return hosts still succeeding
+func (r *Rolling) fail(hosts []string, errs map[string]string) []string {
+	return failHosts(hosts, errs, r.Failed)
+}
+
+// lbFail run load balancer action for hosts in parallel, returns hosts succeeded
+func (r *Rolling) lbFail(hosts []string, prefix string, action func(host string) error) []string {
+	errs := make(map[string]string)
+	for h, e := range RunHosts(hosts, func(ctx context.Context, h string) error {
+		return action(h)
+	}) {
+		errs[h] = prefix + e.Error()
+	}
+	return r.fail(hosts, errs)
+}
+
+// PrettyPrint print result of every host
+func (r *Rolling) PrettyPrint() {
+	for _, h := range r.Hosts {
+		if res, ok := r.Result[h]; ok && r.RolledBack {
+			fmt.Fprintf(Stdout, "%21s: %s\n", h, res)
+		} else if e, ok := r.Failed[h]; ok {
+			fmt.Fprintf(Stdout, "%21s: ERROR %s\n", h, strings.TrimSpace(e))
+		} else if res, ok := r.Result[h]; ok {
+			if r.isCanary(h) {
+				res = "canary, " + res
+			}
+			fmt.Fprintf(Stdout, "%21s: %s\n", h, res)
+		} else {
+			fmt.Fprintf(Stdout, "%21s: skipped\n", h)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrCanceled job skipped since scheduler is canceled
+var ErrCanceled = errors.New("Canceled")
+
+// Job unit of work run against a host
+type Job interface {
+	Host() string
+	Run(ctx context.Context) error
+}
+
+type funcJob struct {
+	host string
+	fn   func(ctx context.Context) error
+}
+
+func (j *funcJob) Host() string {
+	return j.host
+}
+
+func (j *funcJob) Run(ctx context.Context) error {
+	return j.fn(ctx)
+}
+
+// NewJob get job running fn against host
+func NewJob(host string, fn func(ctx context.Context) error) Job {
+	return &funcJob{host: host, fn: fn}
+}
+
+// Scheduler run jobs with a worker pool
+// jobs of the same host are queued and run in order, the rest of the queue is skipped after a failure
+type Scheduler struct {
+	Concurrency int // max hosts running at the same time, 0 for unlimited
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// NewScheduler get scheduler, concurrency defaults to configured concurrency
+func NewScheduler(concurrency int) *Scheduler {
+	if concurrency < 1 {
+		concurrency = C.Concurrency
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		Concurrency: concurrency,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Cancel stop scheduling jobs not started yet, running jobs see their context done
+func (s *Scheduler) Cancel() {
+	s.cancel()
+}
+
+// Run run jobs and wait for all of them, returns errors keyed by host
+func (s *Scheduler) Run(jobs []Job) map[string]error {
+	var order []string
+	queues := make(map[string][]Job)
+	for _, j := range jobs {
+		if _, ok := queues[j.Host()]; !ok {
+			order = append(order, j.Host())
+		}
+		queues[j.Host()] = append(queues[j.Host()], j)
+	}
+	workers := s.Concurrency
+	if workers < 1 || workers > len(order) {
+		workers = len(order)
+	}
+	errs := make(map[string]error)
+	lock := sync.Mutex{}
+	hosts := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := range hosts {
+				if err := s.runQueue(queues[h]); err != nil {
+					lock.Lock()
+					errs[h] = err
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, h := range order {
+		hosts <- h
+	}
+	close(hosts)
+	wg.Wait()
+	return errs
+}
+
+func (s *Scheduler) runQueue(queue []Job) error {
+	for _, j := range queue {
+		if s.ctx.Err() != nil {
+			return ErrCanceled
+		}
+		if err := s.runJob(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runJob run job and recover its panic, so that one host never breaks the others
+func (s *Scheduler) runJob(j Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.Run(s.ctx)
+}
+
+// RunHosts run fn against every host with configured concurrency, returns errors keyed by host
+// hosts are started slowest first by cached reachability
+func RunHosts(hosts []string, fn func(ctx context.Context, host string) error) map[string]error {
+	var jobs []Job
+	for _, h := range DialOrder(hosts) {
+		h := h
+		jobs = append(jobs, NewJob(h, func(ctx context.Context) error {
+			return fn(ctx, h)
+		}))
+	}
+	errs := NewScheduler(0).Run(jobs)
+	for _, h := range hosts {
+		recordHostResult(h, errs[h])
+	}
+	return errs
+}
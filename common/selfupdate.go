@@ -0,0 +1,123 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// UpdateConfig configures self update
+type UpdateConfig struct {
+	URL       string `yaml:"url"`        // release endpoint returns json of latest release
+	PublicKey string `yaml:"public_key"` // hex ed25519 public key verifying asset signatures
+}
+
+// ReleaseAsset binary of a platform in latest release
+type ReleaseAsset struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"` // base64 ed25519 signature of releaseMessage
+}
+
+// LatestRelease response of release endpoint
+type LatestRelease struct {
+	Version string                  `json:"version"`
+	Assets  map[string]ReleaseAsset `json:"assets"` // GOOS/GOARCH => asset
+}
+
+// ErrUpToDate returned by SelfUpdate if the latest release is not newer than the running version
+var ErrUpToDate = errors.New("Already up to date")
+
+// releaseMessage signed content of asset of a release: version, GOOS/GOARCH and sha256 hex, one per line. a valid
+// signature of another version or platform never verifies
+func releaseMessage(version, platform, sum string) string {
+	return version + "\n" + platform + "\n" + sum
+}
+
+// CheckUpdate get latest release and asset of current platform
+func CheckUpdate() (*LatestRelease, *ReleaseAsset, error) {
+	if C.Update.URL == "" {
+		return nil, nil, errors.New("update.url is not configured")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(C.Update.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("Release endpoint returns %s", resp.Status)
+	}
+	latest := &LatestRelease{}
+	if err = json.NewDecoder(resp.Body).Decode(latest); err != nil {
+		return nil, nil, err
+	}
+	asset, ok := latest.Assets[runtime.GOOS+"/"+runtime.GOARCH]
+	if !ok {
+		return latest, nil, fmt.Errorf("No release asset for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	return latest, &asset, nil
+}
+
+// SelfUpdate verify signature of asset of latest release, download it and check its checksum, then replace running
+// binary atomically. ErrUpToDate is returned unless the signed version is newer than the running one. without
+// update.public_key it is refused unless insecure is set, the checksum only comes from the same endpoint
+func SelfUpdate(latest *LatestRelease, asset *ReleaseAsset, insecure bool) error {
+	if C.Update.PublicKey == "" && !insecure {
+		return errors.New("update.public_key is not configured, pass --insecure to update without verifying the signature")
+	}
+	if C.Update.PublicKey != "" {
+		key, err := hex.DecodeString(C.Update.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("Invalid update.public_key")
+		}
+		msg := releaseMessage(latest.Version, runtime.GOOS+"/"+runtime.GOARCH, asset.SHA256)
+		sig, err := base64.StdEncoding.DecodeString(asset.Signature)
+		if err != nil || !ed25519.Verify(key, []byte(msg), sig) {
+			return errors.New("Release signature verification failed")
+		}
+	}
+	if CompareVersion(latest.Version, Version) <= 0 {
+		return ErrUpToDate
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	// same dir so that rename is atomic
+	tmp := exe + ".new"
+	defer os.Remove(tmp)
+	if err = download(asset.URL, tmp); err != nil {
+		return err
+	}
+	sum, err := FileChecksum(tmp)
+	if err != nil {
+		return err
+	}
+	if sum != asset.SHA256 {
+		return fmt.Errorf("Checksum mismatch: %s != %s", sum, asset.SHA256)
+	}
+	if err = os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// running binary cannot be replaced but can be renamed on windows
+		old := exe + ".old"
+		os.Remove(old)
+		if err = os.Rename(exe, old); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, exe)
+}
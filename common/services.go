@@ -0,0 +1,221 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kinds of services, they set default commands
+const (
+	ServiceSystemd = "systemd"
+	ServiceDocker  = "docker" // container named by name
+)
+
+// ServiceConfig service of hosts restarted in dependency order, {name} is replaced in commands
+type ServiceConfig struct {
+	Name        string   `yaml:"name"`
+	Kind        string   `yaml:"kind"`         // systemd (default) or docker
+	DependsOn   []string `yaml:"depends_on"`   // services started before and stopped after this one
+	Groups      []string `yaml:"groups"`       // hosts of groups run the service, all hosts if empty
+	Stop        string   `yaml:"stop"`         // default by kind, eg. systemctl stop {name}
+	Start       string   `yaml:"start"`        // default by kind, eg. systemctl start {name}
+	Status      string   `yaml:"status"`       // command exit with 0 means up, default by kind
+	HealthCheck string   `yaml:"health_check"` // command exit with 0 means started, retried like deploy.health_check
+}
+
+// serviceCommands default stop, start and status commands by kind
+var serviceCommands = map[string][3]string{
+	ServiceSystemd: {"systemctl stop {name}", "systemctl start {name}", "systemctl is-active --quiet {name}"},
+	ServiceDocker:  {"docker stop {name}", "docker start {name}", "docker ps -q -f name=^{name}$ -f status=running | grep -q ."},
+}
+
+// commands get stop, start and status commands of service, configured ones or defaults of its kind
+func (s ServiceConfig) commands() (stop, start, status string) {
+	kind := s.Kind
+	if kind == "" {
+		kind = ServiceSystemd
+	}
+	def := serviceCommands[kind]
+	stop, start, status = s.Stop, s.Start, s.Status
+	if stop == "" {
+		stop = def[0]
+	}
+	if start == "" {
+		start = def[1]
+	}
+	if status == "" {
+		status = def[2]
+	}
+	return
+}
+
+// ServiceOrder get services of deploy.services so that every service comes after its dependencies
+func ServiceOrder() ([]ServiceConfig, error) {
+	byName := make(map[string]ServiceConfig)
+	for _, s := range C.Deploy.Services {
+		if s.Name == "" {
+			return nil, errors.New("Service without name in deploy.services")
+		}
+		if _, ok := serviceCommands[s.Kind]; s.Kind != "" && !ok {
+			return nil, fmt.Errorf("Unknown kind of service %s: %s", s.Name, s.Kind)
+		}
+		if _, ok := byName[s.Name]; ok {
+			return nil, fmt.Errorf("Service %s is configured twice", s.Name)
+		}
+		byName[s.Name] = s
+	}
+	var order []ServiceConfig
+	state := make(map[string]int) // 1 visiting, 2 done
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("Service dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, d := range byName[name].DependsOn {
+			if _, ok := byName[d]; !ok {
+				return fmt.Errorf("Service %s depends on unknown service %s", name, d)
+			}
+			if err := visit(d, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, byName[name])
+		return nil
+	}
+	// configured order is kept where dependencies allow
+	for _, s := range C.Deploy.Services {
+		if err := visit(s.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Restart restart services of hosts: stopped in reverse dependency order, started in order with health gates
+type Restart struct {
+	Hosts  []string
+	Failed map[string]string // host => error
+}
+
+// NewRestart get service restart of hosts
+func NewRestart(hosts []string) *Restart {
+	return &Restart{
+		Hosts:  hosts,
+		Failed: make(map[string]string),
+	}
+}
+
+// serviceHosts get hosts running service
+func serviceHosts(s ServiceConfig, hosts []string) []string {
+	if len(s.Groups) == 0 {
+		return hosts
+	}
+	var matched []string
+	for _, h := range hosts {
+		groups := hostGroups(h)
+		for _, g := range s.Groups {
+			if groups[g] {
+				matched = append(matched, h)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// Start restart services, hosts failed are in Failed. vars are expanded in commands, err is returned only if the
+// restart cannot be started at all
+func (rs *Restart) Start(vars map[string]string) error {
+	order, err := ServiceOrder()
+	if err != nil {
+		return err
+	}
+	run := func(s ServiceConfig, hosts []string, cmd, what string, skip map[string]bool) []string {
+		var pending []string
+		for _, h := range hosts {
+			if !skip[h] {
+				pending = append(pending, h)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		v := map[string]string{"name": s.Name}
+		for k, val := range vars {
+			v[k] = val
+		}
+		_, errs, err := RunRemote(pending, ExpandVars(cmd, v))
+		if err != nil {
+			errs = make(map[string]string)
+			for _, h := range pending {
+				errs[h] = err.Error()
+			}
+		}
+		var failed, started []string
+		fail := func(h, what, e string) {
+			failed = append(failed, h)
+			if _, ok := rs.Failed[h]; !ok {
+				rs.Failed[h] = fmt.Sprintf("%s %s: %s", what, s.Name, strings.TrimSpace(e))
+			}
+		}
+		for _, h := range pending {
+			if e, ok := errs[h]; ok {
+				fail(h, what, e)
+			} else {
+				started = append(started, h)
+			}
+		}
+		if what == "start" {
+			// dependents start only after the service is healthy
+			unhealthy := WaitHealthy(started, s.HealthCheck, v)
+			for _, h := range started {
+				if e, ok := unhealthy[h]; ok {
+					fail(h, "health check", e)
+				}
+			}
+		}
+		return failed
+	}
+	// hosts failing to stop a service still start the stopped ones, hosts failing to start one skip dependents
+	stopFailed := make(map[string]bool)
+	for i := len(order) - 1; i >= 0; i-- {
+		s := order[i]
+		stop, _, _ := s.commands()
+		for _, h := range run(s, serviceHosts(s, rs.Hosts), stop, "stop", stopFailed) {
+			stopFailed[h] = true
+		}
+	}
+	down := make(map[string]map[string]bool) // service => hosts it is not up on
+	for _, s := range order {
+		_, start, _ := s.commands()
+		hosts := serviceHosts(s, rs.Hosts)
+		skip := make(map[string]bool)
+		for _, d := range s.DependsOn {
+			for h := range down[d] {
+				skip[h] = true
+			}
+		}
+		down[s.Name] = skip
+		for _, h := range run(s, hosts, start, "start", skip) {
+			skip[h] = true
+		}
+	}
+	return nil
+}
+
+// PrettyPrint print hosts failed to restart
+func (rs *Restart) PrettyPrint() {
+	for _, h := range rs.Hosts {
+		if e, ok := rs.Failed[h]; ok {
+			fmt.Fprintf(Stdout, "%21s: ERROR %s\n", h, e)
+		} else {
+			fmt.Fprintf(Stdout, "%21s: restarted\n", h)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// ReleasesDir dir of release directories under deploy root
+	ReleasesDir = "releases"
+	// SharedDir dir of shared paths under deploy root, kept across releases
+	SharedDir = "shared"
+)
+
+// NewReleaseID name of a new release directory, sorted in deploy order
+func NewReleaseID() string {
+	return time.Now().UTC().Format("20060102150405")
+}
+
+// releaseDir remote release directory of id
+func releaseDir(id string) string {
+	return path.Join(C.Deploy.Root, ReleasesDir, id)
+}
+
+// linkCmd shell command pointing link to target atomically
+func linkCmd(target, link string) string {
+	tmp := shellQuote(runTemp(link, "link"))
+	return "ln -sfn " + shellQuote(target) + " " + tmp + " && mv -T " + tmp + " " + shellQuote(link)
+}
+
+// sharedLinkCmd shell command linking deploy.shared_paths into release dir, whatever the release has at those paths
+// is replaced. shared paths are created if not exist: paths ending with / are dirs, others files
+func sharedLinkCmd(dir string) (string, error) {
+	var cmds []string
+	for _, p := range C.Deploy.SharedPaths {
+		isDir := strings.HasSuffix(p, "/")
+		p = path.Clean(p)
+		if path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return "", fmt.Errorf("Shared path must be relative to release: %s", p)
+		}
+		shared, link := path.Join(C.Deploy.Root, SharedDir, p), path.Join(dir, p)
+		create := "[ -e " + shellQuote(shared) + " ] || touch " + shellQuote(shared)
+		if isDir {
+			create = "mkdir -p " + shellQuote(shared)
+		}
+		cmds = append(cmds, "mkdir -p "+shellQuote(path.Dir(shared))+" "+shellQuote(path.Dir(link))+
+			" && "+create+" && rm -rf "+shellQuote(link)+" && ln -s "+shellQuote(shared)+" "+shellQuote(link))
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// LinkShared link deploy.shared_paths into release dir on hosts, errors are keyed by host
+func LinkShared(hosts []string, dir string) (map[string]string, error) {
+	if len(C.Deploy.SharedPaths) == 0 || len(hosts) == 0 {
+		return nil, nil
+	}
+	cmd, err := sharedLinkCmd(dir)
+	if err != nil {
+		return nil, err
+	}
+	_, errs, err := RunRemote(hosts, cmd)
+	return errs, err
+}
@@ -0,0 +1,145 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Artifact signature types
+const (
+	SignatureGPG    = "gpg"
+	SignatureCosign = "cosign"
+)
+
+// SignatureConfig detached signature of deploy artifact checked against trusted keys before deploy
+type SignatureConfig struct {
+	Type      string   `yaml:"type"`      // gpg or cosign, signatures are not checked if empty
+	URL       string   `yaml:"url"`       // local file, http(s):// or s3:// url of signature, default artifact + .sig
+	Keys      []string `yaml:"keys"`      // trusted public key files, gpg keys (armored or binary) or cosign keys
+	Protected []string `yaml:"protected"` // groups refusing unsigned artifacts, others deploy them with a warning
+}
+
+// isProtected check if group refuses unsigned artifacts
+func (sc SignatureConfig) isProtected(group string) bool {
+	for _, g := range sc.Protected {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyArtifact prepare deploy artifact and check its signature before it is deployed to group. signatures are kept
+// in state dir by artifact checksum, so promoted and rolled back artifacts from cache are checked again by current keys
+func VerifyArtifact(group string) error {
+	sc := C.Deploy.Signature
+	if sc.Type == "" {
+		return nil
+	}
+	if sc.Type != SignatureGPG && sc.Type != SignatureCosign {
+		return fmt.Errorf("Unknown deploy.signature.type: %s", sc.Type)
+	}
+	if len(sc.Keys) == 0 {
+		return errors.New("deploy.signature.keys is required")
+	}
+	source := C.Deploy.Artifact
+	if err := PrepareArtifact(); err != nil {
+		return err
+	}
+	sum, err := FileChecksum(C.Deploy.Artifact)
+	if err != nil {
+		return err
+	}
+	sig, err := statePath("signatures", sum+".sig")
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(sig); err != nil {
+		u := sc.URL
+		if u == "" {
+			u = source + ".sig"
+		}
+		if err = fetchSignature(u, sig); err != nil {
+			if sc.isProtected(group) {
+				return fmt.Errorf("Artifact is not signed, %s refuses it: %s", group, err)
+			}
+			fmt.Fprintf(Stderr, "Warning: artifact is not signed: %s\n", err)
+			return nil
+		}
+	}
+	if err = verifySignature(sc, sig, C.Deploy.Artifact); err != nil {
+		os.Remove(sig)
+		return err
+	}
+	fmt.Fprintf(Stdout, "Signature: %s verified by %s\n", sum[:12], sc.Type)
+	return nil
+}
+
+// VerifyCrossBuild check binaries cross built by optool may be deployed to group, they are built locally and never
+// signed so groups refusing unsigned artifacts refuse them
+func VerifyCrossBuild(group string) error {
+	sc := C.Deploy.Signature
+	if sc.Type == "" {
+		return nil
+	}
+	if sc.isProtected(group) {
+		return fmt.Errorf("Cross built binaries are not signed, %s refuses them", group)
+	}
+	fmt.Fprintln(Stderr, "Warning: cross built binaries are not signed")
+	return nil
+}
+
+// fetchSignature copy signature from local file or url to dst
+func fetchSignature(u, dst string) error {
+	var err error
+	switch {
+	case strings.HasPrefix(u, "s3://"):
+		var out []byte
+		if out, err = exec.Command("aws", "s3", "cp", "--only-show-errors", u, dst).CombinedOutput(); err != nil {
+			err = fmt.Errorf("Download %s: %s %s", u, err, strings.TrimSpace(string(out)))
+		}
+	case strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://"):
+		err = download(u, dst)
+	default:
+		err = copyFile(expandHome(u), dst)
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// verifySignature check detached signature sig of artifact against trusted keys by gpg or cosign
+func verifySignature(sc SignatureConfig, sig, artifact string) error {
+	if sc.Type == SignatureCosign {
+		var msgs []string
+		for _, k := range sc.Keys {
+			out, err := exec.Command("cosign", "verify-blob", "--key", expandHome(k), "--signature", sig, artifact).CombinedOutput()
+			if err == nil {
+				return nil
+			}
+			msgs = append(msgs, strings.TrimSpace(string(out)))
+		}
+		return fmt.Errorf("Invalid artifact signature: %s", strings.Join(msgs, "; "))
+	}
+	// a throwaway keyring holds only the trusted keys
+	home, err := ioutil.TempDir("", "optool-gpg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(home)
+	for _, k := range sc.Keys {
+		if out, err := exec.Command("gpg", "--homedir", home, "--batch", "--import", expandHome(k)).CombinedOutput(); err != nil {
+			return fmt.Errorf("Import %s: %s %s", k, err, strings.TrimSpace(string(out)))
+		}
+	}
+	out, err := exec.Command("gpg", "--homedir", home, "--batch", "--verify", sig, artifact).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Invalid artifact signature: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
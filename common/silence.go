@@ -0,0 +1,293 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Silence providers
+const (
+	SilenceAlertmanager = "alertmanager"
+	SilenceNagios       = "nagios"
+	SilenceZabbix       = "zabbix"
+)
+
+// SilenceDefaultMinutes length of a silence, it ends by itself if optool dies before removing it
+const SilenceDefaultMinutes = 30
+
+// SilenceConfig alerts of hosts silenced while a rolling batch deploys them
+type SilenceConfig struct {
+	Provider string `yaml:"provider"` // alertmanager, nagios or zabbix, nothing is silenced if empty
+	URL      string `yaml:"url"`      // eg. http://alertmanager:9093, https://nagios/nagios or https://zabbix/zabbix
+	User     string `yaml:"user"`     // basic auth of nagios
+	Token    string `yaml:"token"`    // password of nagios or api token of zabbix
+	Label    string `yaml:"label"`    // alertmanager label matching hosts, default instance
+	Minutes  int    `yaml:"minutes"`  // length of silences, default 30
+}
+
+// monitorName get name of host in monitoring, alias of alias=address or address
+func monitorName(host string) string {
+	if i := strings.Index(host, "="); i > 0 {
+		return host[:i]
+	}
+	return ParseHost(host).Address
+}
+
+// Silence silences of a deploy window, removed by Unsilence
+type Silence struct {
+	ids []string
+}
+
+// SilenceHosts silence alerts of hosts for the deploy window
+func SilenceHosts(hosts []string) (*Silence, error) {
+	sc := C.Silence
+	if sc.Provider == "" || len(hosts) == 0 {
+		return nil, nil
+	}
+	if sc.URL == "" {
+		return nil, errors.New("silence.url is not configured")
+	}
+	RegisterSecret(sc.Token)
+	minutes := sc.Minutes
+	if minutes <= 0 {
+		minutes = SilenceDefaultMinutes
+	}
+	start := time.Now()
+	end := start.Add(time.Duration(minutes) * time.Minute)
+	comment := fmt.Sprintf("optool deploy, run %s by %s", RunID, localDeployer())
+	var names []string
+	for _, h := range hosts {
+		names = append(names, monitorName(h))
+	}
+	s := &Silence{}
+	switch sc.Provider {
+	case SilenceAlertmanager:
+		label := sc.Label
+		if label == "" {
+			label = "instance"
+		}
+		var quoted []string
+		for _, n := range names {
+			quoted = append(quoted, regexp.QuoteMeta(n))
+		}
+		var resp struct {
+			SilenceID string `json:"silenceID"`
+		}
+		err := silenceRequest("POST", "/api/v2/silences", map[string]interface{}{
+			"matchers": []map[string]interface{}{
+				// instance labels carry the port of the exporter
+				{"name": label, "value": "(" + strings.Join(quoted, "|") + ")(:[0-9]+)?", "isRegex": true, "isEqual": true},
+			},
+			"startsAt":  start.UTC().Format(time.RFC3339),
+			"endsAt":    end.UTC().Format(time.RFC3339),
+			"createdBy": localDeployer(),
+			"comment":   comment,
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		s.ids = append(s.ids, resp.SilenceID)
+	case SilenceNagios:
+		for _, n := range names {
+			// host downtime and downtime of all services of host
+			for _, typ := range []string{"55", "86"} {
+				err := nagiosCommand(url.Values{
+					"cmd_typ":      {typ},
+					"cmd_mod":      {"2"},
+					"host":         {n},
+					"com_author":   {localDeployer()},
+					"com_data":     {comment},
+					"start_time":   {start.Format("01-02-2006 15:04:05")},
+					"end_time":     {end.Format("01-02-2006 15:04:05")},
+					"fixed":        {"1"},
+					"trigger":      {"0"},
+					"childoptions": {"0"},
+				})
+				if err != nil {
+					return s, fmt.Errorf("%s: %s", n, err)
+				}
+			}
+			s.ids = append(s.ids, n)
+		}
+	case SilenceZabbix:
+		var found []struct {
+			HostID string `json:"hostid"`
+		}
+		if err := zabbixCall("host.get", map[string]interface{}{"output": []string{"hostid"}, "filter": map[string]interface{}{"host": names}}, &found); err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return nil, errors.New("No host found in zabbix")
+		}
+		var ids []map[string]string
+		for _, h := range found {
+			ids = append(ids, map[string]string{"hostid": h.HostID})
+		}
+		var created struct {
+			MaintenanceIDs []string `json:"maintenanceids"`
+		}
+		err := zabbixCall("maintenance.create", map[string]interface{}{
+			"name":         "optool " + RunID + " " + strconv.FormatInt(start.UnixNano(), 36),
+			"description":  comment,
+			"active_since": start.Unix(),
+			"active_till":  end.Unix(),
+			"hosts":        ids,
+			"timeperiods":  []map[string]interface{}{{"timeperiod_type": 0, "start_date": start.Unix(), "period": minutes * 60}},
+		}, &created)
+		if err != nil {
+			return nil, err
+		}
+		s.ids = created.MaintenanceIDs
+	default:
+		return nil, fmt.Errorf("Unknown silence.provider: %s", sc.Provider)
+	}
+	return s, nil
+}
+
+// Unsilence remove silences, alerts of hosts are on again
+func (s *Silence) Unsilence() error {
+	if s == nil || len(s.ids) == 0 {
+		return nil
+	}
+	switch C.Silence.Provider {
+	case SilenceAlertmanager:
+		for _, id := range s.ids {
+			if err := silenceRequest("DELETE", "/api/v2/silence/"+url.PathEscape(id), nil, nil); err != nil {
+				return err
+			}
+		}
+	case SilenceNagios:
+		return nagiosDeleteDowntimes(s.ids)
+	case SilenceZabbix:
+		return zabbixCall("maintenance.delete", s.ids, nil)
+	}
+	return nil
+}
+
+// silenceRequest send json body to path of silence api, response is decoded into out if not nil
+func silenceRequest(method, p string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(C.Silence.URL, "/")+p, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if C.Silence.Provider == SilenceZabbix {
+		req.Header.Set("Authorization", "Bearer "+C.Silence.Token)
+	} else if C.Silence.User != "" {
+		req.SetBasicAuth(C.Silence.User, C.Silence.Token)
+	}
+	return silenceDo(req, out)
+}
+
+// silenceDo send request and decode json response into out if not nil
+func silenceDo(req *http.Request, out interface{}) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returns %s %s", C.Silence.Provider, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// nagiosCommand submit a command to cmd.cgi of nagios core
+func nagiosCommand(form url.Values) error {
+	req, err := http.NewRequest("POST", strings.TrimRight(C.Silence.URL, "/")+"/cgi-bin/cmd.cgi", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(C.Silence.User, C.Silence.Token)
+	return silenceDo(req, nil)
+}
+
+// nagiosDeleteDowntimes delete downtimes of hosts scheduled by this run, found by their comment
+func nagiosDeleteDowntimes(hosts []string) error {
+	for _, h := range hosts {
+		req, err := http.NewRequest("GET", strings.TrimRight(C.Silence.URL, "/")+"/cgi-bin/statusjson.cgi?query=downtimelist&details=true&hostname="+url.QueryEscape(h), nil)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(C.Silence.User, C.Silence.Token)
+		var list struct {
+			Data struct {
+				DowntimeList map[string]struct {
+					DowntimeID  int    `json:"downtime_id"`
+					Comment     string `json:"comment"`
+					Description string `json:"service_description"`
+				} `json:"downtimelist"`
+			} `json:"data"`
+		}
+		if err = silenceDo(req, &list); err != nil {
+			return fmt.Errorf("%s: %s", h, err)
+		}
+		for _, d := range list.Data.DowntimeList {
+			if !strings.Contains(d.Comment, "run "+RunID) {
+				continue
+			}
+			// delete host or service downtime
+			typ := "78"
+			if d.Description != "" {
+				typ = "79"
+			}
+			if err = nagiosCommand(url.Values{"cmd_typ": {typ}, "cmd_mod": {"2"}, "down_id": {strconv.Itoa(d.DowntimeID)}}); err != nil {
+				return fmt.Errorf("%s: %s", h, err)
+			}
+		}
+	}
+	return nil
+}
+
+// zabbixCall call method of zabbix json-rpc api, result is decoded into out if not nil
+func zabbixCall(method string, params, out interface{}) error {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+			Data    string `json:"data"`
+		} `json:"error"`
+	}
+	err := silenceRequest("POST", "/api_jsonrpc.php", map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+		"id":      1,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("zabbix %s: %s %s", method, resp.Error.Message, resp.Error.Data)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, out)
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// FIPS 140 approved algorithms offered when ssh.fips is set
+var (
+	fipsCiphers = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr"}
+	fipsKEX     = []string{"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512"}
+	fipsMACs     = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512"}
+	fipsHostKeys = []string{"ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521", "rsa-sha2-256", "rsa-sha2-512"}
+)
+
+// SSHConfig algorithms offered in ssh handshakes, in order of preference. defaults of golang.org/x/crypto/ssh are
+// used for empty lists, fips sets FIPS 140 approved lists which explicit lists replace
+type SSHConfig struct {
+	FIPS              bool                     `yaml:"fips"`
+	Ciphers           []string                 `yaml:"ciphers"`             // eg. aes256-gcm@openssh.com, aes256-ctr
+	KeyExchanges      []string                 `yaml:"kex"`                 // eg. ecdh-sha2-nistp384, diffie-hellman-group14-sha256
+	MACs              []string                 `yaml:"macs"`                // eg. hmac-sha2-256-etm@openssh.com
+	HostKeyAlgorithms []string                 `yaml:"host_key_algorithms"` // eg. rsa-sha2-512, ecdsa-sha2-nistp256
+	Hosts             map[string]SSHHostConfig `yaml:"hosts"`               // keyed by host as configured or its address
+}
+
+// SSHHostConfig ssh options of a host
+type SSHHostConfig struct {
+	Legacy bool `yaml:"legacy"` // also offer insecure algorithms, eg. ssh-rsa and diffie-hellman-group14-sha1
+}
+
+// isLegacy check if host dialed at addr offers legacy algorithms
+func (sc SSHConfig) isLegacy(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	for k, hc := range sc.Hosts {
+		if hc.Legacy && (k == host || ParseHost(k).Address == host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAlgorithms check every name of list is implemented
+func checkAlgorithms(kind string, list, supported []string) error {
+	known := make(map[string]bool)
+	for _, a := range supported {
+		known[a] = true
+	}
+	for _, a := range list {
+		if !known[a] {
+			return fmt.Errorf("Unsupported ssh %s: %s", kind, a)
+		}
+	}
+	return nil
+}
+
+// pick get configured list, fips list if fips is set or nil for defaults
+func pick(list []string, fips bool, fipsList []string) []string {
+	if len(list) > 0 {
+		return list
+	}
+	if fips {
+		return fipsList
+	}
+	return nil
+}
+
+// withLegacy get list followed by the other default and insecure algorithms, so that fips and allow-lists only
+// set preference of legacy hosts
+func withLegacy(list, defaults, insecure []string) []string {
+	var all []string
+	seen := make(map[string]bool)
+	for _, l := range [][]string{list, defaults, insecure} {
+		for _, a := range l {
+			if !seen[a] {
+				seen[a] = true
+				all = append(all, a)
+			}
+		}
+	}
+	return all
+}
+
+// withAlgorithms get copy of cfg offering algorithms of ssh config to host dialed at addr, cfg itself if nothing is
+// configured
+func withAlgorithms(cfg *ssh.ClientConfig, addr string) (*ssh.ClientConfig, error) {
+	sc := C.SSH
+	ciphers := pick(sc.Ciphers, sc.FIPS, fipsCiphers)
+	kex := pick(sc.KeyExchanges, sc.FIPS, fipsKEX)
+	macs := pick(sc.MACs, sc.FIPS, fipsMACs)
+	hostKeys := pick(sc.HostKeyAlgorithms, sc.FIPS, fipsHostKeys)
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	if sc.isLegacy(addr) {
+		ciphers = withLegacy(ciphers, supported.Ciphers, insecure.Ciphers)
+		kex = withLegacy(kex, supported.KeyExchanges, insecure.KeyExchanges)
+		macs = withLegacy(macs, supported.MACs, insecure.MACs)
+		hostKeys = withLegacy(hostKeys, supported.HostKeys, insecure.HostKeys)
+	}
+	if ciphers == nil && kex == nil && macs == nil && hostKeys == nil {
+		return cfg, nil
+	}
+	for _, c := range []struct {
+		kind            string
+		list, supported []string
+	}{
+		{"cipher", ciphers, append(supported.Ciphers, insecure.Ciphers...)},
+		{"kex", kex, append(supported.KeyExchanges, insecure.KeyExchanges...)},
+		{"mac", macs, append(supported.MACs, insecure.MACs...)},
+		{"host key algorithm", hostKeys, append(supported.HostKeys, insecure.HostKeys...)},
+	} {
+		if err := checkAlgorithms(c.kind, c.list, c.supported); err != nil {
+			return nil, err
+		}
+	}
+	copied := *cfg
+	copied.Ciphers, copied.KeyExchanges, copied.MACs = ciphers, kex, macs
+	if hostKeys != nil {
+		copied.HostKeyAlgorithms = hostKeys
+	}
+	return &copied, nil
+}
@@ -0,0 +1,73 @@
+package sshtest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrDialFailed error returned by FailDialer
+var ErrDialFailed = errors.New("Dial failed by FailDialer")
+
+// Dialer dial every address to the mock server, so that hosts of any name reach it
+type Dialer struct {
+	Server *Server
+}
+
+// Dial implements common.Dialer, the handshake is bounded by cfg.Timeout like dials of hosts
+func (d Dialer) Dial(network, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", d.Server.Addr, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(cfg.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// FailDialer fail the first Fail dials of every address, then dial by Dialer
+type FailDialer struct {
+	Dialer interface {
+		Dial(network, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error)
+	}
+	Fail int
+	Err  error // ErrDialFailed if nil
+
+	lock  sync.Mutex
+	dials map[string]int
+}
+
+// Dial implements common.Dialer
+func (d *FailDialer) Dial(network, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	d.lock.Lock()
+	if d.dials == nil {
+		d.dials = make(map[string]int)
+	}
+	d.dials[addr]++
+	n := d.dials[addr]
+	d.lock.Unlock()
+	if n <= d.Fail {
+		if d.Err != nil {
+			return nil, d.Err
+		}
+		return nil, ErrDialFailed
+	}
+	return d.Dialer.Dial(network, addr, cfg)
+}
+
+// Dials dial attempts of addr
+func (d *FailDialer) Dials(addr string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.dials[addr]
+}
@@ -0,0 +1,200 @@
+// Package sshtest in-process ssh/sftp server and dialers to run transfers and commands without real hosts
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ExecHandler handle an exec request, returns exit status
+type ExecHandler func(cmd string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// Server ssh server listening on 127.0.0.1 with password auth, exec and sftp subsystem
+type Server struct {
+	Addr     string
+	User     string
+	Password string
+	Exec     ExecHandler   // run by sh -c if nil
+	Delay    time.Duration // wait before handshake, to test timeouts. use SetDelay once serving
+	Refuse   int           // close the first Refuse connections before handshake, to test retries
+
+	lock     sync.Mutex
+	accepted int
+	commands []string
+	listener net.Listener
+	config   *ssh.ServerConfig
+}
+
+// NewServer start a server accepting user/password
+func NewServer(user, password string) (*Server, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:     l.Addr().String(),
+		User:     user,
+		Password: password,
+		listener: l,
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == s.User && string(pass) == s.Password {
+				return nil, nil
+			}
+			return nil, errors.New("Permission denied")
+		},
+	}
+	s.config.AddHostKey(signer)
+	go s.serve()
+	return s, nil
+}
+
+// Close stop listening
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Commands exec requests received
+func (s *Server) Commands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// SetDelay change Delay of a serving server
+func (s *Server) SetDelay(d time.Duration) {
+	s.lock.Lock()
+	s.Delay = d
+	s.lock.Unlock()
+}
+
+// Accepted connections accepted including refused ones
+func (s *Server) Accepted() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accepted
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.accepted++
+		refuse := s.accepted <= s.Refuse
+		delay := s.Delay
+		s.lock.Unlock()
+		if refuse {
+			conn.Close()
+			continue
+		}
+		go s.handleConn(conn, delay)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn, delay time.Duration) {
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	sc, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(ch, creqs)
+	}
+}
+
+func (s *Server) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			s.lock.Lock()
+			s.commands = append(s.commands, payload.Command)
+			s.lock.Unlock()
+			status := s.exec(payload.Command, ch, ch, ch.Stderr())
+			ch.SendRequest("exit-status", false, exitStatus(status))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+			ch.SendRequest("exit-status", false, exitStatus(0))
+			return
+		default:
+			// env, pty-req, signals are accepted and ignored
+			if req.WantReply {
+				req.Reply(req.Type == "env" || req.Type == "pty-req", nil)
+			}
+		}
+	}
+}
+
+func (s *Server) exec(cmd string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if s.Exec != nil {
+		return s.Exec(cmd, stdin, stdout, stderr)
+	}
+	c := exec.Command("/bin/sh", "-c", cmd)
+	c.Stdin, c.Stdout, c.Stderr = stdin, stdout, stderr
+	if err := c.Run(); err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return ee.ExitCode()
+		}
+		return 127
+	}
+	return 0
+}
+
+func exitStatus(status int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(status))
+	return b
+}
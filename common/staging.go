@@ -0,0 +1,98 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// StagingSuffix suffix of remote staging path of a staged put
+const StagingSuffix = ".optool-staging"
+
+// stagedPut upload to a staging path on all hosts first, and only when every host has the bytes
+// move them into place everywhere. staging paths are removed if any host failed
+func (t *Transfer) stagedPut() error {
+	final := t.RemotePath
+	if strings.HasSuffix(final, "/") {
+		final = path.Join(final, filepath.Base(t.LocalPath))
+	}
+	staging := final + StagingSuffix + "-" + RunID
+	isDir := t.Extract
+	if fi, err := os.Stat(t.LocalPath); err == nil && fi.IsDir() {
+		isDir = true
+	}
+	override := t.Override
+	t.RemotePath, t.Override = staging, true
+	defer func() {
+		t.RemotePath, t.Override = final, override
+	}()
+	hosts := t.connected()
+	if !override && !isDir {
+		// fail before uploading anything
+		t.batch(func(h Host, tr Transport, c *ssh.Client) error {
+			if _, e := tr.Stat(final); e == nil {
+				return fmt.Errorf("Remote file exists")
+			}
+			return nil
+		})
+	}
+	if len(t.Errors) == 0 {
+		if err := t.batchPut(); err != nil {
+			return err
+		}
+	}
+	if len(t.Errors) > 0 {
+		// never leave a half deployed fleet
+		RunHosts(hosts, func(ctx context.Context, h string) error {
+			return removeAll(t.Transports[h], staging)
+		})
+		return nil
+	}
+	t.batch(func(h Host, tr Transport, c *ssh.Client) error {
+		if !isDir {
+			return tr.Rename(staging, final)
+		}
+		// a dir cannot replace an existing dir, move the existing one aside first
+		old := runTemp(final, "old")
+		if err := removeAll(tr, old); err != nil {
+			return err
+		}
+		if _, e := tr.Stat(final); e == nil {
+			if err := tr.Rename(final, old); err != nil {
+				return err
+			}
+		}
+		if err := tr.Rename(staging, final); err != nil {
+			return err
+		}
+		return removeAll(tr, old)
+	})
+	t.Lock.Lock()
+	for h, fts := range t.TransferResult {
+		for i := range fts {
+			fts[i].Target = strings.Replace(fts[i].Target, staging, final, 1)
+		}
+		t.TransferResult[h] = fts
+	}
+	t.Lock.Unlock()
+	return nil
+}
+
+// runSession run command in a new session of client
+func runSession(c *ssh.Client, cmd string) error {
+	sess, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	out, err := sess.CombinedOutput(cmd)
+	if err != nil {
+		return fmt.Errorf("%s %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// StateDir directory for saving local state like build cache keys
+var StateDir = homeDir() + "/.optool"
+
+// statePath get path of name under state dir, state dir is created if not exists
+func statePath(name ...string) (string, error) {
+	p := filepath.Join(append([]string{StateDir}, name...)...)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return "", err
+	}
+	return p, nil
+}
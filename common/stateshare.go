@@ -0,0 +1,295 @@
+package common
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of state export entries, the document comes first and cached artifacts follow it
+const (
+	stateExportDocument  = "state.json"
+	stateExportArtifacts = "artifacts/"
+)
+
+// StateExport state shared between machines: releases and history for rollbacks and drift checks, quarantined
+// hosts and run records for replays. artifacts are sha256 => entry name under artifacts/
+type StateExport struct {
+	Exported   time.Time             `json:"exported"`
+	By         string                `json:"by"`
+	Version    string                `json:"optool"`
+	Releases   map[string]Release    `json:"releases"`
+	History    []Release             `json:"history"`
+	Quarantine map[string]Quarantine `json:"quarantine,omitempty"`
+	Runs       []RunRecord           `json:"runs,omitempty"`
+	Artifacts  map[string]string     `json:"artifacts,omitempty"`
+}
+
+// StateImported what an import added to local state
+type StateImported struct {
+	Releases   int // groups whose last release changed
+	History    int
+	Quarantine int
+	Runs       int
+	Artifacts  int
+}
+
+// releaseKey identify a release across machines
+func releaseKey(rel Release) string {
+	return fmt.Sprintf("%s %s %s %d", rel.Group, rel.Checksum, rel.RunID, rel.Deployed.UnixNano())
+}
+
+// ExportState write local state to a gzipped tar. with artifacts the cached artifacts of last and previous release
+// of every group are included, so rollbacks work on a machine that never deployed them
+func ExportState(out string, artifacts bool) (*StateExport, error) {
+	st := &StateExport{Exported: time.Now(), By: localDeployer(), Version: Version, Artifacts: make(map[string]string)}
+	var err error
+	if st.Releases, err = LoadReleases(); err != nil {
+		return nil, err
+	}
+	if st.History, err = LoadHistory(); err != nil {
+		return nil, err
+	}
+	if st.Quarantine, err = LoadQuarantine(); err != nil {
+		return nil, err
+	}
+	names, err := stateNames("runs")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		var rec RunRecord
+		if _, err = loadState(name, &rec); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		st.Runs = append(st.Runs, rec)
+	}
+	local := make(map[string]string) // entry name => cached path
+	if artifacts {
+		for group, rel := range st.Releases {
+			rels := []Release{rel}
+			if prev, err := PreviousRelease(group); err == nil {
+				rels = append(rels, prev)
+			}
+			for _, rel := range rels {
+				cached := CacheLookup(rel.Checksum)
+				if cached == "" {
+					fmt.Fprintf(Stderr, "Warning: artifact %s of group %s is not in cache\n", rel.Checksum, group)
+					continue
+				}
+				name := stateExportArtifacts + rel.Checksum + "/" + filepath.Base(cached)
+				st.Artifacts[rel.Checksum] = name
+				local[name] = cached
+			}
+		}
+	}
+	doc, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tmp := runTemp(out, "new")
+	defer os.Remove(tmp)
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	gw := gzip.NewWriter(fd)
+	tw := tar.NewWriter(gw)
+	writeEntry := func(name string, size int64, r io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: st.Exported}); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+	if err = writeEntry(stateExportDocument, int64(len(doc)), strings.NewReader(string(doc))); err != nil {
+		return nil, err
+	}
+	var entries []string
+	for name := range local {
+		entries = append(entries, name)
+	}
+	sort.Strings(entries)
+	for _, name := range entries {
+		f, err := os.Open(local[name])
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err == nil {
+			err = writeEntry(name, fi.Size(), f)
+		}
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gw.Close(); err != nil {
+		return nil, err
+	}
+	if err = fd.Close(); err != nil {
+		return nil, err
+	}
+	return st, os.Rename(tmp, out)
+}
+
+// ImportState merge state exported on another machine into local state. releases and history are merged by time,
+// the later release of a group wins; local quarantines and run records are kept, artifacts are checked and cached
+func ImportState(f string) (*StateExport, StateImported, error) {
+	var n StateImported
+	fd, err := os.Open(f)
+	if err != nil {
+		return nil, n, err
+	}
+	defer fd.Close()
+	gr, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil, n, err
+	}
+	tr := tar.NewReader(gr)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != stateExportDocument {
+		return nil, n, fmt.Errorf("Invalid state export, %s not found", stateExportDocument)
+	}
+	doc, err := ioutil.ReadAll(io.LimitReader(tr, 256<<20))
+	if err != nil {
+		return nil, n, err
+	}
+	st := &StateExport{}
+	if err = json.Unmarshal(doc, st); err != nil {
+		return nil, n, err
+	}
+	// checksums name dirs of the artifact cache
+	for _, rec := range st.Runs {
+		if rec.RunID == "" || strings.ContainsAny(rec.RunID, `/\`) {
+			return nil, n, errors.New("Invalid state export, bad run id")
+		}
+		if rec.Artifact != "" && !isChecksum(rec.Artifact) {
+			return nil, n, fmt.Errorf("Invalid state export, bad artifact checksum of run %s", rec.RunID)
+		}
+	}
+	for _, rel := range st.History {
+		if !isChecksum(rel.Checksum) {
+			return nil, n, fmt.Errorf("Invalid state export, bad checksum of release of %s", rel.Group)
+		}
+	}
+	for group, rel := range st.Releases {
+		if !isChecksum(rel.Checksum) {
+			return nil, n, fmt.Errorf("Invalid state export, bad checksum of release of %s", group)
+		}
+	}
+	for sum := range st.Artifacts {
+		if !isChecksum(sum) {
+			return nil, n, errors.New("Invalid state export, bad artifact checksum")
+		}
+	}
+	sums := make(map[string]string) // entry name => sha256
+	for sum, name := range st.Artifacts {
+		sums[name] = sum
+	}
+	tmpDir, err := statePath("artifacts", "tmp")
+	if err != nil {
+		return nil, n, err
+	}
+	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+		return nil, n, err
+	}
+	// artifacts are cached before releases refer to them
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, n, err
+		}
+		sum, ok := sums[hdr.Name]
+		base := path.Base(hdr.Name)
+		if !ok || base == "." || base == ".." || strings.Contains(base, `\`) {
+			return nil, n, fmt.Errorf("Invalid state export, unknown entry %s", hdr.Name)
+		}
+		if CacheLookup(sum) != "" {
+			continue
+		}
+		if _, err = cacheBundleFile(tr, filepath.Join(tmpDir, base), sum); err != nil {
+			return nil, n, fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+		n.Artifacts++
+	}
+	var history []Release
+	err = updateState("history.json", &history, func() error {
+		seen := make(map[string]bool)
+		for _, rel := range history {
+			seen[releaseKey(rel)] = true
+		}
+		for _, rel := range st.History {
+			if !seen[releaseKey(rel)] {
+				seen[releaseKey(rel)] = true
+				history = append(history, rel)
+				n.History++
+			}
+		}
+		sort.SliceStable(history, func(i, j int) bool { return history[i].Deployed.Before(history[j].Deployed) })
+		return nil
+	})
+	if err != nil {
+		return nil, n, err
+	}
+	releases := make(map[string]Release)
+	err = updateState("releases.json", &releases, func() error {
+		for group, rel := range st.Releases {
+			if cur, ok := releases[group]; !ok || rel.Deployed.After(cur.Deployed) {
+				releases[group] = rel
+				n.Releases++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, n, err
+	}
+	quarantine := make(map[string]Quarantine)
+	err = updateState("quarantine.json", &quarantine, func() error {
+		now := time.Now()
+		for host, q := range st.Quarantine {
+			if cur, ok := quarantine[host]; (!ok || cur.Expired(now)) && !q.Expired(now) {
+				quarantine[host] = q
+				n.Quarantine++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, n, err
+	}
+	for _, rec := range st.Runs {
+		name := filepath.Join("runs", rec.RunID+".json")
+		var local RunRecord
+		ok, err := loadState(name, &local)
+		if err != nil {
+			return nil, n, err
+		}
+		if ok {
+			continue
+		}
+		if err = saveState(name, rec); err != nil {
+			return nil, n, err
+		}
+		n.Runs++
+	}
+	return st, n, nil
+}
@@ -0,0 +1,133 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Status of a service on a host
+const (
+	StatusUp    = "up"
+	StatusDown  = "down"
+	StatusError = "error" // host unreachable or status command failed to run
+	StatusNone  = "-"     // service does not run on host
+)
+
+// StatusMatrix status of deploy.services on hosts
+type StatusMatrix struct {
+	Hosts    []string
+	Services []string
+	Cells    map[string]map[string]string // host => service => status
+	Errors   map[string]string            // host => error
+}
+
+// ServiceStatus query status of every service on hosts running it, a service at a time and hosts at the same time.
+// vars are expanded in status commands
+func ServiceStatus(hosts []string, vars map[string]string) (*StatusMatrix, error) {
+	order, err := ServiceOrder()
+	if err != nil {
+		return nil, err
+	}
+	sm := &StatusMatrix{Hosts: hosts, Cells: make(map[string]map[string]string), Errors: make(map[string]string)}
+	for _, h := range hosts {
+		sm.Cells[h] = make(map[string]string)
+		for _, s := range order {
+			sm.Cells[h][s.Name] = StatusNone
+		}
+	}
+	for _, s := range order {
+		sm.Services = append(sm.Services, s.Name)
+		running := serviceHosts(s, hosts)
+		if len(running) == 0 {
+			continue
+		}
+		_, _, status := s.commands()
+		v := map[string]string{"name": s.Name}
+		for k, val := range vars {
+			v[k] = val
+		}
+		// exits 0 unless the host cannot run it, which tells down from unreachable
+		cmd := "if " + ExpandVars(status, v) + "\nthen echo " + StatusUp + "\nelse echo " + StatusDown + "\nfi"
+		output, errs, err := RunRemote(running, cmd)
+		for _, h := range running {
+			e, failed := errs[h]
+			if err != nil {
+				e, failed = err.Error(), true
+			}
+			out := strings.TrimSpace(output[h])
+			switch {
+			case failed:
+				sm.Cells[h][s.Name] = StatusError
+				if _, ok := sm.Errors[h]; !ok {
+					sm.Errors[h] = strings.TrimSpace(e)
+				}
+			case strings.HasSuffix(out, StatusUp):
+				sm.Cells[h][s.Name] = StatusUp
+			default:
+				sm.Cells[h][s.Name] = StatusDown
+			}
+		}
+	}
+	return sm, nil
+}
+
+// Unhealthy count hosts with a service down or not queried
+func (sm *StatusMatrix) Unhealthy() int {
+	n := 0
+	for _, h := range sm.Hosts {
+		for _, st := range sm.Cells[h] {
+			if st == StatusDown || st == StatusError {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// Render print matrix of hosts by services, up is green and down red if color is set. errors of hosts follow it
+func (sm *StatusMatrix) Render(w io.Writer, color bool) {
+	width := len("HOST")
+	for _, h := range sm.Hosts {
+		if len(h) > width {
+			width = len(h)
+		}
+	}
+	cell := func(s string, n int, code string) string {
+		s = fmt.Sprintf("%-*s", n, s)
+		if color && code != "" {
+			return "\x1b[" + code + "m" + s + "\x1b[0m"
+		}
+		return s
+	}
+	cols := make([]int, len(sm.Services))
+	fmt.Fprintf(w, "%-*s", width, "HOST")
+	for i, s := range sm.Services {
+		cols[i] = len(s)
+		if cols[i] < len(StatusError) {
+			cols[i] = len(StatusError)
+		}
+		fmt.Fprintf(w, "  %-*s", cols[i], s)
+	}
+	fmt.Fprintln(w)
+	for _, h := range sm.Hosts {
+		fmt.Fprintf(w, "%-*s", width, h)
+		for i, s := range sm.Services {
+			switch st := sm.Cells[h][s]; st {
+			case StatusUp:
+				fmt.Fprint(w, "  "+cell(st, cols[i], "32"))
+			case StatusDown, StatusError:
+				fmt.Fprint(w, "  "+cell(strings.ToUpper(st), cols[i], "31"))
+			default:
+				fmt.Fprint(w, "  "+cell(st, cols[i], ""))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	for _, h := range sm.Hosts {
+		if e, ok := sm.Errors[h]; ok {
+			fmt.Fprintf(w, "%21s: ERROR %s\n", h, e)
+		}
+	}
+}
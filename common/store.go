@@ -0,0 +1,182 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// StateDB bolt database of local state under state dir: run records, releases, durations, hash cache, controls
+const StateDB = "state.db"
+
+// stateBucket bucket of state documents, keyed by their former file names under state dir, eg. history.json
+var stateBucket = []byte("state")
+
+// storeTimeout wait for the lock of state db held by another optool process
+var storeTimeout = 10 * time.Second
+
+// openStore open state db, it is locked against other processes until closed. a read only db that does not
+// exist yet is nil
+func openStore(readOnly bool) (*bolt.DB, error) {
+	f, err := statePath(StateDB)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(f); readOnly && os.IsNotExist(err) {
+		return nil, nil
+	}
+	return bolt.Open(f, 0600, &bolt.Options{Timeout: storeTimeout, ReadOnly: readOnly})
+}
+
+// loadState load state document name into v, from the file of the same name under state dir if it was saved
+// before state db. false if there is none
+func loadState(name string, v interface{}) (bool, error) {
+	db, err := openStore(true)
+	if err != nil {
+		return false, err
+	}
+	var data []byte
+	if db != nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			if b := tx.Bucket(stateBucket); b != nil {
+				data = append([]byte(nil), b.Get([]byte(filepath.ToSlash(name)))...)
+			}
+			return nil
+		})
+		db.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+	if data == nil {
+		// saved by an older version, it moves into state db on the next save
+		if data, err = ioutil.ReadFile(filepath.Join(StateDir, name)); os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// saveState save v as state document name
+func saveState(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	db, err := openStore(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(filepath.ToSlash(name)), data)
+	})
+	if err == nil {
+		os.Remove(filepath.Join(StateDir, name))
+	}
+	return err
+}
+
+// updateState load state document name into v, change it by fn and save it, other processes wait meanwhile
+func updateState(name string, v interface{}, fn func() error) error {
+	db, err := openStore(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+		key := []byte(filepath.ToSlash(name))
+		data := b.Get(key)
+		if data == nil {
+			data, err = ioutil.ReadFile(filepath.Join(StateDir, name))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if data != nil {
+			if err = json.Unmarshal(data, v); err != nil {
+				return err
+			}
+		}
+		if err = fn(); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+	if err == nil {
+		os.Remove(filepath.Join(StateDir, name))
+	}
+	return err
+}
+
+// deleteState delete state document name, and its file saved before state db
+func deleteState(name string) error {
+	os.Remove(filepath.Join(StateDir, name))
+	db, err := openStore(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(stateBucket); b != nil {
+			return b.Delete([]byte(filepath.ToSlash(name)))
+		}
+		return nil
+	})
+}
+
+// stateNames get names of state documents under dir, eg. runs, including files saved before state db
+func stateNames(dir string) ([]string, error) {
+	seen := make(map[string]bool)
+	files, _ := filepath.Glob(filepath.Join(StateDir, dir, "*.json"))
+	for _, f := range files {
+		seen[filepath.ToSlash(filepath.Join(dir, filepath.Base(f)))] = true
+	}
+	db, err := openStore(true)
+	if err != nil {
+		return nil, err
+	}
+	if db != nil {
+		prefix := []byte(filepath.ToSlash(dir) + "/")
+		err = db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(stateBucket)
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				seen[string(k)] = true
+			}
+			return nil
+		})
+		db.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// SyncIndexFile checksum index of a remote dir written by sync puts, relative path => entry
+const SyncIndexFile = ".optool-index"
+
+// syncEntry file of remote dir as last put by optool
+type syncEntry struct {
+	Sum  string      `json:"sha256"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// readSyncIndex read index of remote dir, empty if missing or broken, so that every file is put
+func readSyncIndex(tr Transport, dir string) map[string]syncEntry {
+	index := make(map[string]syncEntry)
+	f, err := tr.Open(path.Join(dir, SyncIndexFile))
+	if err != nil {
+		return index
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err == nil {
+		json.Unmarshal(data, &index)
+	}
+	return index
+}
+
+// writeSyncIndex write index of remote dir, replacing the old one at once
+func writeSyncIndex(tr Transport, dir string, index map[string]syncEntry) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	p := path.Join(dir, SyncIndexFile)
+	tmp := runTemp(p, "new")
+	f, err := tr.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return tr.Rename(tmp, p)
+}
+
+// hashDir hash local files of sync in parallel before any host compares them
+func (t *Transfer) hashDir() error {
+	var files []string
+	err := filepath.Walk(t.LocalPath, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			files = append(files, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sums, err := HashFiles(files)
+	if err != nil {
+		return err
+	}
+	t.Lock.Lock()
+	t.sums = sums
+	t.Lock.Unlock()
+	return nil
+}
+
+// localSum get sha256 of local file once per transfer, files are hashed once for all hosts
+func (t *Transfer) localSum(p string) (string, error) {
+	t.Lock.Lock()
+	sum, ok := t.sums[p]
+	t.Lock.Unlock()
+	if ok {
+		return sum, nil
+	}
+	sum, err := CachedChecksum(p)
+	if err != nil {
+		return "", err
+	}
+	t.Lock.Lock()
+	if t.sums == nil {
+		t.sums = make(map[string]string)
+	}
+	t.sums[p] = sum
+	t.Lock.Unlock()
+	return sum, nil
+}
@@ -1,17 +1,20 @@
 package common
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
-	"strconv"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -22,6 +25,8 @@ const (
 	TransferPut = "PUT"
 	// TransferDefaultMaxSize default max size to transfer
 	TransferDefaultMaxSize = 1099511627776 // 100MB
+	// TransferStdin local path to read put content from stdin
+	TransferStdin = "-"
 )
 
 // Transfer transfer files via ssh
@@ -32,19 +37,43 @@ type Transfer struct {
 	RemotePath     string
 	Recursive      bool
 	Hosts          []string
-	Clients        map[string]*ssh.Client
-	SftpClient     map[string]*sftp.Client
-	Override       bool                    // override remote existed file?
-	TransferResult map[string]FileTransfer // result of transfering
+	Clients        map[string]*ssh.Client    // keyed by host
+	Transports     map[string]Transport      // keyed by host, hosts with a preset transport are not dialed
+	Transport      string                    // sftp or scp, C.Transport if empty
+	Override       bool                      // override remote existed file?
+	Extract        bool                      // extract tar.gz stream into remote dir instead of writing a file
+	Mode           os.FileMode               // chmod remote files after upload if not 0
+	Staged         bool                      // upload to staging path on all hosts, then move into place
+	Verify         string                    // read back uploaded content, all or sample
+	Sync           bool                      // recursive puts skip files unchanged since the last sync, by the checksum index of remote dir
+	From           string                    // put local path of this host instead, relayed to hosts through optool
+	Merge          string                    // gets write files of all hosts into local path: lines or sections
+	Unchanged      map[string]int            // files skipped by sync, keyed by host
+	TransferResult map[string][]FileTransfer // results of transfering, a host may transfer multiple files
+	Errors         map[string]error          // errors keyed by host
+	connects       map[string]connectStat    // keyed by host
+	sums           map[string]string         // sha256 of local files of sync
+	spools         map[string]string         // temp files of merged gets, keyed by host
+	Dialer         Dialer
 	Lock           sync.Mutex
 }
 
 // FileTransfer transfer file info
 type FileTransfer struct {
-	Source string
-	Target string
-	Size   int64
-	Elapse time.Duration
+	Source                string
+	Target                string
+	Size                  int64
+	Elapse                time.Duration
+	ThroughputBytesPerSec float64
+	Attempts              int           // dial attempts before connected
+	ConnectLatency        time.Duration // time of the successful dial
+	StartedAt             time.Time
+}
+
+// connectStat connection statistics of a host
+type connectStat struct {
+	attempts int
+	latency  time.Duration
 }
 
 // NewTransfer get file transfer instance
@@ -56,91 +85,458 @@ func NewTransfer(method, localPath, remotePath string, hosts []string) *Transfer
 		RemotePath:     remotePath,
 		Recursive:      false,
 		Clients:        make(map[string]*ssh.Client),
-		SftpClient:     make(map[string]*sftp.Client),
+		Transports:     make(map[string]Transport),
 		Hosts:          hosts,
 		Override:       false,
-		TransferResult: make(map[string]FileTransfer),
+		TransferResult: make(map[string][]FileTransfer),
+		Errors:         make(map[string]error),
+		connects:       make(map[string]connectStat),
+		Dialer:         DefaultDialer,
 		Lock:           sync.Mutex{},
 	}
 }
 
 // Start start file transfer
+// errors of every host are saved in Errors, an error is returned if any host failed
 func (t *Transfer) Start() (err error) {
+	defer func() {
+		for h, e := range t.Errors {
+			hostLogf(h, "%s %s failed: %s", strings.ToLower(t.Method), t.RemotePath, e)
+		}
+	}()
+	if t.Method == TransferGet && t.Merge != "" {
+		if err = t.prepareMerge(); err != nil {
+			return
+		}
+	} else if t.Method == TransferGet {
+		if err = t.prepareGet(); err != nil {
+			return
+		}
+	}
+	if t.Method == TransferPut {
+		if err = CheckWrite(t.Hosts, t.RemotePath); err != nil {
+			return
+		}
+	}
+	if t.Method == TransferPut && t.From != "" {
+		if err = t.prepareRelay(); err != nil {
+			return
+		}
+	} else if t.Method == TransferPut && t.LocalPath != TransferStdin {
+		if err = t.preparePut(); err != nil {
+			return
+		}
+	}
 	if err = t.initClient(); err != nil {
 		return
 	}
 	// close connections
 	defer func() {
-		for _, sc := range t.SftpClient {
-			sc.Close()
+		for _, tr := range t.Transports {
+			tr.Close()
 		}
 		for _, c := range t.Clients {
-			c.Close()
+			releaseClient(c)
 		}
 	}()
-	if t.Method == TransferGet {
-		return t.batchGet()
+	if t.Method == TransferGet && t.Merge != "" {
+		t.batch(t.getSpool)
+		if err = t.writeMerged(); err != nil {
+			return
+		}
+	} else if t.Method == TransferGet {
+		t.batch(func(h Host, tr Transport, c *ssh.Client) error {
+			return t.get(h, tr, c, t.RemotePath, t.LocalPath)
+		})
 	}
 	if t.Method == TransferPut {
-		return t.batchPut()
+		if t.Staged {
+			err = t.stagedPut()
+		} else {
+			err = t.batchPut()
+		}
+		if err != nil {
+			return
+		}
+	}
+	if len(t.Errors) > 0 {
+		return fmt.Errorf("Transfer failed on %d host(s)", len(t.Errors))
 	}
 	return nil
 }
 
-func (t *Transfer) batchGet() (err error) {
+// connected get hosts connected successfully
+func (t *Transfer) connected() []string {
+	var hosts []string
+	for _, h := range t.Hosts {
+		if _, ok := t.Transports[h]; ok {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// batch run fn on every connected host with configured concurrency
+func (t *Transfer) batch(fn func(h Host, tr Transport, c *ssh.Client) error) {
+	errs := RunHosts(t.connected(), func(ctx context.Context, h string) error {
+		return fn(ParseHost(h), t.Transports[h], t.Clients[h])
+	})
+	t.Lock.Lock()
+	for h, e := range errs {
+		t.Errors[h] = e
+	}
+	t.Lock.Unlock()
+}
+
+func (t *Transfer) prepareGet() error {
 	fi, err := os.Stat(t.LocalPath)
 	if err != nil {
-		err = os.MkdirAll(t.LocalPath, 0755)
-		if err != nil {
-			return
-		}
-	} else {
-		if !fi.IsDir() {
-			log.Fatalln("Local path cannot be a file")
-		}
-	}
-	wg := sync.WaitGroup{}
-	for h, sc := range t.SftpClient {
-		c := t.Clients[h]
-		wg.Add(1)
-		go func(sc *sftp.Client, c *ssh.Client) {
-			defer wg.Done()
-			err := t.get(sc, c, t.RemotePath, t.LocalPath)
-			if err != nil {
-				fmt.Println(c.Conn.RemoteAddr().String(), err)
-			}
-		}(sc, c)
+		return os.MkdirAll(t.LocalPath, 0755)
 	}
-	wg.Wait()
-	return
+	if !fi.IsDir() {
+		return errors.New("Local path cannot be a file")
+	}
+	return nil
 }
 
-func (t *Transfer) batchPut() (err error) {
+func (t *Transfer) preparePut() (err error) {
+	if t.Verify != "" && t.Verify != VerifyAll && t.Verify != VerifySample {
+		return fmt.Errorf("Unknown verify mode: %s", t.Verify)
+	}
+	if t.LocalPath, err = replayFile(t.LocalPath); err != nil {
+		return err
+	}
 	fi, err := os.Stat(t.LocalPath)
 	if err != nil {
-		return
+		return err
+	}
+	if fi.IsDir() && !t.Extract && !t.Recursive {
+		return errors.New("Local is dir, set recursive to transfer a dir")
+	}
+	if t.Sync {
+		// changed files are replaced
+		t.Override = true
+		if err = CheckClocks(t.Hosts, "sync"); err != nil {
+			return err
+		}
 	}
 	if fi.IsDir() {
-		return errors.New("Local is dir,recursive transfer not supported now")
-	}
-	wg := sync.WaitGroup{}
-	for h, sc := range t.SftpClient {
-		c := t.Clients[h]
-		wg.Add(1)
-		go func(sc *sftp.Client, c *ssh.Client) {
-			defer wg.Done()
-			err := t.put(sc, c, t.LocalPath, t.RemotePath)
-			if err != nil {
-				fmt.Println(err)
+		if t.Sync && !t.Extract {
+			return t.hashDir()
+		}
+		return nil
+	}
+	return recordFile(t.LocalPath)
+}
+
+func (t *Transfer) batchPut() (err error) {
+	if t.From != "" {
+		return t.putRelay()
+	}
+	if t.LocalPath == TransferStdin {
+		return t.putStream(os.Stdin)
+	}
+	if t.Extract {
+		if fi, err := os.Stat(t.LocalPath); err == nil && fi.IsDir() {
+			return t.putArchive()
+		}
+		fd, err := os.Open(t.LocalPath)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		return t.putStream(fd)
+	}
+	if fi, err := os.Stat(t.LocalPath); err == nil && fi.IsDir() {
+		t.batch(t.putDir)
+		return nil
+	}
+	t.batch(func(h Host, tr Transport, c *ssh.Client) error {
+		return t.put(h, tr, c, t.LocalPath, t.RemotePath)
+	})
+	return nil
+}
+
+// DirMode get mode of created remote dirs, masked by umask
+func DirMode() os.FileMode {
+	mode := C.TransferDirMode
+	if mode == 0 {
+		mode = 0755
+	}
+	return os.FileMode(mode &^ C.TransferUmask)
+}
+
+// localMode get permission of local file put to hosts, 0644 on windows as its files have no unix permission
+func localMode(fi os.FileInfo) os.FileMode {
+	if runtime.GOOS == "windows" {
+		return 0644
+	}
+	return fi.Mode().Perm()
+}
+
+// putDir put local dir recursively, remote dirs are created with DirMode
+// and files keep local permission masked by umask
+func (t *Transfer) putDir(h Host, tr Transport, c *ssh.Client) (err error) {
+	remoteRoot := t.RemotePath
+	if strings.HasSuffix(remoteRoot, "/") {
+		remoteRoot = path.Join(remoteRoot, filepath.Base(t.LocalPath))
+	}
+	var index map[string]syncEntry
+	seen := make(map[string]bool) // local files of index
+	if t.Sync {
+		// one read of the index instead of a stat of every remote file
+		index = readSyncIndex(tr, remoteRoot)
+		defer func() {
+			if err == nil {
+				// entries of removed local files are dropped once the whole tree is put
+				for rel := range index {
+					if !seen[rel] {
+						delete(index, rel)
+					}
+				}
+			}
+			// files put so far are indexed even if the walk failed, the next sync goes on from there
+			if werr := writeSyncIndex(tr, remoteRoot, index); werr != nil && err == nil {
+				err = fmt.Errorf("Write %s: %s", SyncIndexFile, werr)
 			}
-		}(sc, c)
+		}()
 	}
-	wg.Wait()
-	return
+	return filepath.Walk(t.LocalPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(t.LocalPath, p)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(remoteRoot, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			if err = tr.Mkdir(remote); err != nil {
+				return fmt.Errorf("Mkdir %s: %s", remote, err)
+			}
+			return tr.Chmod(remote, DirMode())
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		mode := t.Mode
+		if mode == 0 {
+			mode = localMode(fi) &^ os.FileMode(C.TransferUmask)
+		}
+		var sum string
+		if t.Sync {
+			if sum, err = t.localSum(p); err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			seen[key] = true
+			if e, ok := index[key]; ok && e.Sum == sum && e.Mode == mode {
+				t.Lock.Lock()
+				if t.Unchanged == nil {
+					t.Unchanged = make(map[string]int)
+				}
+				t.Unchanged[h.Alias]++
+				t.Lock.Unlock()
+				return nil
+			}
+		}
+		if err = t.put(h, tr, c, p, remote); err != nil {
+			return fmt.Errorf("Put %s: %s", p, err)
+		}
+		if t.Mode == 0 {
+			// already changed by put otherwise
+			if err = tr.Chmod(remote, mode); err != nil {
+				return err
+			}
+		}
+		if t.Sync {
+			index[filepath.ToSlash(rel)] = syncEntry{Sum: sum, Mode: mode}
+		}
+		return nil
+	})
+}
+
+// putStream tee r to all hosts, so the stream never needs to touch local disk
+// the stream is read once, so all hosts are written at the same time regardless of concurrency
+func (t *Transfer) putStream(r io.Reader) error {
+	if !t.Extract && strings.HasSuffix(t.RemotePath, "/") {
+		return errors.New("Remote path must be a file when reading from stdin")
+	}
+	var codec string
+	if t.Extract {
+		// archives of any codec are extracted by its decompressor on hosts
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(4)
+		codec, r = detectCodec(head), br
+	}
+	return t.putStreamTo(t.connected(), r, codec)
 }
 
-func (t *Transfer) get(sc *sftp.Client, c *ssh.Client, remotePath, localPath string) (err error) {
-	fi, err := sc.Stat(remotePath)
+// putArchive pack local dir into a tar stream compressed by the codec negotiated with each host, and extract it on
+// hosts. hosts of the same codec share one stream
+func (t *Transfer) putArchive() error {
+	var lock sync.Mutex
+	hostCodec := make(map[string]string)
+	RunHosts(t.connected(), func(ctx context.Context, h string) error {
+		codec := negotiateCodec(ParseHost(h), t.Clients[h])
+		lock.Lock()
+		hostCodec[h] = codec
+		lock.Unlock()
+		return nil
+	})
+	var order []string
+	byCodec := make(map[string][]string)
+	for _, h := range t.connected() {
+		codec := hostCodec[h]
+		if _, ok := byCodec[codec]; !ok {
+			order = append(order, codec)
+		}
+		byCodec[codec] = append(byCodec[codec], h)
+	}
+	for _, codec := range order {
+		hosts := byCodec[codec]
+		pr, pw := io.Pipe()
+		go func(codec string) {
+			pw.CloseWithError(writeArchive(pw, t.LocalPath, codec))
+		}(codec)
+		if err := t.putStreamTo(hosts, pr, codec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putStreamTo tee r to hosts, extract puts decompress it by codec
+func (t *Transfer) putStreamTo(hosts []string, r io.Reader, codec string) error {
+	var writers []io.Writer
+	var pws []*io.PipeWriter
+	var jobs []Job
+	for _, h := range hosts {
+		pr, pw := io.Pipe()
+		writers = append(writers, pw)
+		pws = append(pws, pw)
+		host, tr, c := ParseHost(h), t.Transports[h], t.Clients[h]
+		jobs = append(jobs, NewJob(h, func(ctx context.Context) error {
+			// keep draining so other hosts are not blocked by a failed one
+			defer io.Copy(ioutil.Discard, pr)
+			return t.putReader(host, tr, c, pr, codec)
+		}))
+	}
+	done := make(chan map[string]error)
+	go func() {
+		done <- NewScheduler(len(jobs)).Run(jobs)
+	}()
+	_, err := copyBuffer(io.MultiWriter(writers...), r)
+	for _, pw := range pws {
+		pw.CloseWithError(err)
+	}
+	errs := <-done
+	t.Lock.Lock()
+	for h, e := range errs {
+		t.Errors[h] = e
+	}
+	t.Lock.Unlock()
+	return err
+}
+
+// putReader write r to remote file, or extract it into remote dir
+func (t *Transfer) putReader(h Host, tr Transport, c *ssh.Client, r io.Reader, codec string) (err error) {
+	source := t.LocalPath
+	if t.From != "" {
+		source = t.From + ":" + source
+	}
+	if t.Extract {
+		source += " (" + codec + ")"
+	}
+	ft := t.newFileTransfer(h, source, t.RemotePath)
+	cr := &countReader{r: r}
+	if t.Extract {
+		extract := h.extractCommand(t.RemotePath, codec)
+		var out []byte
+		if h.Type == HostLocal {
+			cmd := localCommand(extract)
+			cmd.Stdin = cr
+			out, err = cmd.CombinedOutput()
+		} else if c == nil {
+			return errors.New("Extract requires an ssh connection")
+		} else {
+			var sess *ssh.Session
+			if sess, err = c.NewSession(); err != nil {
+				return err
+			}
+			defer sess.Close()
+			sess.Stdin = cr
+			out, err = sess.CombinedOutput(extract)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s", err, strings.TrimSpace(string(out)))
+		}
+	} else {
+		if _, e := tr.Stat(t.RemotePath); e == nil && !t.Override {
+			return errors.New("Remote file exists")
+		}
+		dstFile, err := tr.Create(t.RemotePath)
+		if err != nil {
+			return err
+		}
+		if _, err = copyBuffer(dstFile, cr); err != nil {
+			dstFile.Close()
+			return err
+		}
+		if err = dstFile.Close(); err != nil {
+			return err
+		}
+		if t.Mode != 0 {
+			if err = tr.Chmod(t.RemotePath, t.Mode); err != nil {
+				return err
+			}
+		}
+	}
+	t.finish(h, ft, cr.n)
+	return nil
+}
+
+// newFileTransfer start recording a file transfer on host
+func (t *Transfer) newFileTransfer(h Host, source, target string) FileTransfer {
+	t.Lock.Lock()
+	cs := t.connects[h.Alias]
+	t.Lock.Unlock()
+	return FileTransfer{
+		Source:         source,
+		Target:         target,
+		Attempts:       cs.attempts,
+		ConnectLatency: cs.latency,
+		StartedAt:      time.Now(),
+	}
+}
+
+// finish save result of a finished file transfer
+func (t *Transfer) finish(h Host, ft FileTransfer, size int64) {
+	ft.Size = size
+	ft.Elapse = time.Now().Sub(ft.StartedAt)
+	if ft.Elapse > 0 {
+		ft.ThroughputBytesPerSec = float64(size) / ft.Elapse.Seconds()
+	}
+	t.Lock.Lock()
+	t.TransferResult[h.Alias] = append(t.TransferResult[h.Alias], ft)
+	t.Lock.Unlock()
+	hostLogf(h.Alias, "%s %s => %s %d bytes %.2f seconds", strings.ToLower(t.Method), ft.Source, ft.Target, size, ft.Elapse.Seconds())
+}
+
+// countReader count bytes read
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (t *Transfer) get(h Host, tr Transport, c *ssh.Client, remotePath, localPath string) (err error) {
+	fi, err := tr.Stat(remotePath)
 	if err != nil {
 		return
 	}
@@ -151,13 +547,11 @@ func (t *Transfer) get(sc *sftp.Client, c *ssh.Client, remotePath, localPath str
 		return fmt.Errorf("Max transfer size is set to %d", C.TransferMaxSize)
 	}
 	basename := path.Base(fi.Name())
-	srcFile, err := sc.Open(remotePath)
+	srcFile, err := tr.Open(remotePath)
 	if err != nil {
 		return
 	}
 	defer srcFile.Close()
-	addr := c.Conn.RemoteAddr().String()
-	xaddr := strings.Split(addr, ":")
 	exp := strings.Split(basename, ".")
 	var ext, prefName string
 	lenth := len(exp)
@@ -167,43 +561,28 @@ func (t *Transfer) get(sc *sftp.Client, c *ssh.Client, remotePath, localPath str
 	} else {
 		prefName = basename
 	}
-	dstFile, err := os.OpenFile(path.Join(localPath, prefName+"-"+strings.Replace(xaddr[0], ".", "-", -1)+"."+ext), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	dstFile, err := os.OpenFile(filepath.Join(localPath, prefName+"-"+strings.NewReplacer(".", "-", ":", "-").Replace(h.Address)+"."+ext), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
 	if err != nil {
 		return
 	}
 	defer dstFile.Close()
-	ft := FileTransfer{
-		Source: srcFile.Name(),
-		Target: dstFile.Name(),
-	}
-	ts := time.Now()
-	buf := make([]byte, 1024)
-	var size int64
-	for {
-		n, _ := srcFile.Read(buf)
-		if n < 1 {
-			break
-		}
-		size = size + int64(n)
-		dstFile.Write(buf[0:n])
+	ft := t.newFileTransfer(h, srcFile.Name(), dstFile.Name())
+	size, err := copyBuffer(dstFile, srcFile)
+	if err != nil {
+		return
 	}
-	ft.Size = size
-	ft.Elapse = time.Now().Sub(ts)
-	t.Lock.Lock()
-	t.TransferResult[addr] = ft
-	t.Lock.Unlock()
+	t.finish(h, ft, size)
 	return
 }
-func (t *Transfer) put(sc *sftp.Client, c *ssh.Client, localPath, remotePath string) (err error) {
+func (t *Transfer) put(h Host, tr Transport, c *ssh.Client, localPath, remotePath string) (err error) {
 	// remote path is dir
 	if strings.HasSuffix(remotePath, "/") {
-		basename := path.Base(localPath)
+		basename := filepath.Base(localPath)
 		remotePath = path.Join(remotePath, basename)
 	}
-	_, e := sc.Stat(remotePath)
+	_, e := tr.Stat(remotePath)
 	if e == nil {
 		if !t.Override {
-			fmt.Println("Remote file exists")
 			return errors.New("Remote file exists")
 		}
 	}
@@ -212,66 +591,179 @@ func (t *Transfer) put(sc *sftp.Client, c *ssh.Client, localPath, remotePath str
 		return
 	}
 	defer srcFile.Close()
-	dstFile, err := sc.OpenFile(remotePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	dstFile, err := tr.Create(remotePath)
 	if err != nil {
 		return
 	}
-	defer dstFile.Close()
-	ft := FileTransfer{
-		Source: srcFile.Name(),
-		Target: dstFile.Name(),
+	ft := t.newFileTransfer(h, srcFile.Name(), dstFile.Name())
+	size, err := copyBuffer(dstFile, srcFile)
+	if err != nil {
+		dstFile.Close()
+		return
 	}
-	ts := time.Now()
-	var size int64
-	buf := make([]byte, 1024)
-	for {
-		n, _ := srcFile.Read(buf)
-		if n < 1 {
-			break
+	// content may be sent on close by some transports
+	if err = dstFile.Close(); err != nil {
+		return
+	}
+	if t.Verify != "" {
+		if err = verifyRemote(tr, localPath, remotePath, t.Verify); err != nil {
+			return
 		}
-		size = size + int64(n)
-		dstFile.Write(buf[0:n])
 	}
-	ft.Size = size
-	ft.Elapse = time.Now().Sub(ts)
-	addr := c.Conn.RemoteAddr().String()
-	t.Lock.Lock()
-	t.TransferResult[addr] = ft
-	t.Lock.Unlock()
+	if t.Mode != 0 {
+		if err = tr.Chmod(remotePath, t.Mode); err != nil {
+			return
+		}
+	}
+	t.finish(h, ft, size)
 	return
 }
 
 func (t *Transfer) initClient() error {
 	auth, err := GetAuth()
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 	clientConfig := &ssh.ClientConfig{
 		User:            C.Auth.User,
 		Auth:            auth,
-		Timeout:         30 * time.Second,
+		Timeout:         TransferTimeout,
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		ClientVersion:   sshClientVersion(),
 	}
+	var dial []string
 	for _, h := range t.Hosts {
-		if strings.Index(h, ":") < 0 {
-			h = h + ":" + strconv.Itoa(C.Server.DefaultPort)
+		if _, ok := t.Transports[h]; ok {
+			continue
 		}
-		client, err := ssh.Dial("tcp", h, clientConfig)
-		if err != nil {
-			return err
+		switch host := ParseHost(h); host.Type {
+		case HostLocal:
+			t.Transports[h] = NewLocalTransport()
+		case HostSSH, HostDocker, HostFTP, HostFTPS, HostWinRM, HostWinRMS:
+			dial = append(dial, h)
+		case HostNetDev, HostTelnet:
+			t.Errors[h] = fmt.Errorf("Transfers are not supported by %s hosts", host.Type)
+		default:
+			t.Errors[h] = fmt.Errorf("Unknown host type: %s", host.Type)
+		}
+	}
+	dial, skipped := SkipUnreachable(dial)
+	for h, e := range skipped {
+		t.Errors[h] = e
+	}
+	kind := t.Transport
+	if kind == "" {
+		kind = C.Transport
+	}
+	defer SaveReachability()
+	errs := RunHosts(dial, func(ctx context.Context, h string) error {
+		host := ParseHost(h)
+		var client *ssh.Client
+		var tr Transport
+		var err error
+		cs := connectStat{}
+		for {
+			cs.attempts++
+			ts := time.Now()
+			client, tr, err = t.connect(host, kind, clientConfig)
+			cs.latency = time.Now().Sub(ts)
+			RecordReach(h, cs.latency, err)
+			if err == nil || cs.attempts > C.Retries || ctx.Err() != nil {
+				break
+			}
+			time.Sleep(time.Second)
 		}
-		t.Clients[h] = client
-		t.SftpClient[h], err = sftp.NewClient(client, sftp.MaxPacket(33788))
 		if err != nil {
 			return err
 		}
+		t.Lock.Lock()
+		if client != nil {
+			t.Clients[h] = client
+		}
+		t.Transports[h] = tr
+		t.connects[h] = cs
+		t.Lock.Unlock()
+		return nil
+	})
+	for h, e := range errs {
+		t.Errors[h] = e
 	}
 	return nil
 }
 
+// connect get transport of host, client is nil for hosts not reached by ssh
+func (t *Transfer) connect(h Host, kind string, cfg *ssh.ClientConfig) (*ssh.Client, Transport, error) {
+	switch h.Type {
+	case HostFTP, HostFTPS:
+		tr, err := dialFTP(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, tr, nil
+	case HostWinRM, HostWinRMS:
+		ws, err := dialWinRM(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &winrmTransport{ws}, nil
+	}
+	client, _, err := sharedClient(t.Dialer, h.Addr(), cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tr Transport
+	if h.Type == HostDocker {
+		tr, err = newDockerTransport(client, h.Target)
+	} else {
+		tr, err = NewTransport(kind, client)
+	}
+	if err != nil {
+		releaseClient(client)
+		return nil, nil, err
+	}
+	return client, tr, nil
+}
+
 // PrettyPrint print transfer result
 func (t *Transfer) PrettyPrint() {
-	for h, ft := range t.TransferResult {
-		fmt.Printf("%21s: %s => %s %dByte %.2f seconds\n", h, ft.Source, ft.Target, ft.Size, ft.Elapse.Seconds())
+	out := Stdout
+	if t.Merge != "" && t.LocalPath == TransferStdout {
+		// merged files are on stdout
+		out = Stderr
+	}
+	for h, fts := range t.TransferResult {
+		for _, ft := range fts {
+			fmt.Fprintf(out, "%21s: %s => %s %dByte %.2f seconds %s/s attempts=%d connect=%dms started=%s\n",
+				h, ft.Source, ft.Target, ft.Size, ft.Elapse.Seconds(), HumanSize(int64(ft.ThroughputBytesPerSec)),
+				ft.Attempts, ft.ConnectLatency.Nanoseconds()/int64(time.Millisecond), ft.StartedAt.Format("15:04:05"))
+		}
+		if len(fts) > 1 {
+			var total int64
+			for _, ft := range fts {
+				total += ft.Size
+			}
+			fmt.Fprintf(out, "%21s: %d files %dByte\n", h, len(fts), total)
+		}
+	}
+	for h, n := range t.Unchanged {
+		fmt.Fprintf(out, "%21s: %d files unchanged\n", h, n)
+	}
+	for h, e := range t.Errors {
+		fmt.Fprintf(out, "%21s: ERROR %s\n", h, e)
+	}
+	if bs := GetBufferStats(); bs.Bytes > 0 {
+		fmt.Fprintf(out, "%21s: %s\n", "buffers", bs)
+	}
+}
+
+// HumanSize format bytes as B,KB,MB,GB
+func HumanSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
 	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
 }
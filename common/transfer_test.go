@@ -0,0 +1,231 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nealwon/optool/common/sshtest"
+)
+
+// setupServer start a mock ssh server reached by every host, configure auth for it and keep state in a temp dir.
+// globals are restored when the test ends
+func setupServer(t *testing.T) *sshtest.Server {
+	t.Helper()
+	s, err := sshtest.NewServer("u", "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldC, oldDialer, oldStateDir := *C, DefaultDialer, StateDir
+	oldTransfer, oldCommand := TransferTimeout, CommandTimeout
+	t.Cleanup(func() {
+		s.Close()
+		*C, DefaultDialer, StateDir = oldC, oldDialer, oldStateDir
+		TransferTimeout, CommandTimeout = oldTransfer, oldCommand
+	})
+	C.Auth = AuthConfig{User: "u", Password: "p", PlainPassword: true}
+	C.Mux.Disabled = true
+	C.TransferMaxSize = TransferDefaultMaxSize
+	C.Retries = 0
+	StateDir = t.TempDir()
+	DefaultDialer = sshtest.Dialer{Server: s}
+	return s
+}
+
+func writeTemp(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	f := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestTransferPutGet(t *testing.T) {
+	setupServer(t)
+	dir := t.TempDir()
+	local := writeTemp(t, dir, "data.txt", "hello\n")
+	remote := filepath.Join(dir, "remote.txt")
+
+	put := NewTransfer(TransferPut, local, remote, []string{"h1"})
+	if err := put.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := put.Errors["h1"]; ok {
+		t.Fatalf("put failed: %s", e)
+	}
+	if data, err := ioutil.ReadFile(remote); err != nil || string(data) != "hello\n" {
+		t.Fatalf("remote file = %q, %v", data, err)
+	}
+	if n := len(put.TransferResult["h1"]); n != 1 {
+		t.Fatalf("put results = %d, want 1", n)
+	}
+
+	out := filepath.Join(dir, "out")
+	get := NewTransfer(TransferGet, out, remote, []string{"h1"})
+	if err := get.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := get.Errors["h1"]; ok {
+		t.Fatalf("get failed: %s", e)
+	}
+	files, _ := filepath.Glob(filepath.Join(out, "remote-h1*"))
+	if len(files) != 1 {
+		t.Fatalf("got files %v, want one of h1", files)
+	}
+	if data, _ := ioutil.ReadFile(files[0]); string(data) != "hello\n" {
+		t.Fatalf("got %q", data)
+	}
+}
+
+func TestTransferPutExisting(t *testing.T) {
+	setupServer(t)
+	dir := t.TempDir()
+	local := writeTemp(t, dir, "data.txt", "new\n")
+	remote := writeTemp(t, dir, "remote.txt", "old\n")
+
+	put := NewTransfer(TransferPut, local, remote, []string{"h1"})
+	if err := put.Start(); err == nil {
+		t.Fatal("put over an existing file without override succeeded")
+	}
+	if e := put.Errors["h1"]; e == nil || !strings.Contains(e.Error(), "Remote file exists") {
+		t.Fatalf("error = %v, want Remote file exists", e)
+	}
+	if data, _ := ioutil.ReadFile(remote); string(data) != "old\n" {
+		t.Fatalf("remote file replaced without override: %q", data)
+	}
+
+	put = NewTransfer(TransferPut, local, remote, []string{"h1"})
+	put.Override = true
+	if err := put.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := put.Errors["h1"]; ok {
+		t.Fatalf("put with override failed: %s", e)
+	}
+	if data, _ := ioutil.ReadFile(remote); string(data) != "new\n" {
+		t.Fatalf("remote file = %q, want new", data)
+	}
+}
+
+func TestTransferRetries(t *testing.T) {
+	s := setupServer(t)
+	dir := t.TempDir()
+	local := writeTemp(t, dir, "data.txt", "retry\n")
+
+	C.Retries = 2
+	d := &sshtest.FailDialer{Dialer: sshtest.Dialer{Server: s}, Fail: 2}
+	put := NewTransfer(TransferPut, local, filepath.Join(dir, "ok.txt"), []string{"h1"})
+	put.Dialer = d
+	if err := put.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := put.Errors["h1"]; ok {
+		t.Fatalf("put failed after retries: %s", e)
+	}
+	if n := d.Dials(ParseHost("h1").Addr()); n != 3 {
+		t.Fatalf("dials = %d, want 3", n)
+	}
+	if a := put.TransferResult["h1"][0].Attempts; a != 3 {
+		t.Fatalf("attempts = %d, want 3", a)
+	}
+
+	C.Retries = 1
+	d = &sshtest.FailDialer{Dialer: sshtest.Dialer{Server: s}, Fail: 2}
+	put = NewTransfer(TransferPut, local, filepath.Join(dir, "failed.txt"), []string{"h1"})
+	put.Dialer = d
+	if err := put.Start(); err == nil {
+		t.Fatal("put succeeded with fewer retries than failed dials")
+	}
+	if e := put.Errors["h1"]; e != sshtest.ErrDialFailed {
+		t.Fatalf("error = %v, want %v", e, sshtest.ErrDialFailed)
+	}
+	if n := d.Dials(ParseHost("h1").Addr()); n != 2 {
+		t.Fatalf("dials = %d, want 2", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file put by failed transfer")
+	}
+}
+
+func TestTransferTimeout(t *testing.T) {
+	s := setupServer(t)
+	s.SetDelay(3 * time.Second)
+	TransferTimeout = 200 * time.Millisecond
+	dir := t.TempDir()
+	local := writeTemp(t, dir, "data.txt", "slow\n")
+
+	start := time.Now()
+	put := NewTransfer(TransferPut, local, filepath.Join(dir, "remote.txt"), []string{"h1"})
+	put.Start()
+	if put.Errors["h1"] == nil {
+		t.Fatal("put to a host stalling the handshake succeeded")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("timeout took %s", took)
+	}
+}
+
+func TestTransferMemTransport(t *testing.T) {
+	setupServer(t)
+	dir := t.TempDir()
+	local := writeTemp(t, dir, "data.txt", "mem\n")
+
+	mem := NewMemTransport()
+	put := NewTransfer(TransferPut, local, "/app/data.txt", []string{"h1"})
+	put.Transports["h1"] = mem
+	if err := mem.Mkdir("/app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := put.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := put.Errors["h1"]; ok {
+		t.Fatalf("put failed: %s", e)
+	}
+	f, err := mem.Open("/app/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, _ := ioutil.ReadAll(f); string(data) != "mem\n" {
+		t.Fatalf("mem file = %q", data)
+	}
+}
+
+func TestRemoteCommand(t *testing.T) {
+	s := setupServer(t)
+	rc := NewRemoteCommand([]string{"h1"}, "echo hi; exit 3")
+	if err := rc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rc.Output["h1"], "hi") {
+		t.Fatalf("output = %q", rc.Output["h1"])
+	}
+	if rc.Error["h1"] == "" {
+		t.Fatal("exit status 3 not reported")
+	}
+	if cmds := s.Commands(); len(cmds) != 1 || cmds[0] != "echo hi; exit 3" {
+		t.Fatalf("commands = %q", cmds)
+	}
+}
+
+func TestRemoteCommandTimeout(t *testing.T) {
+	s := setupServer(t)
+	s.SetDelay(3 * time.Second)
+	CommandTimeout = 200 * time.Millisecond
+	start := time.Now()
+	rc := NewRemoteCommand([]string{"h1"}, "true")
+	if err := rc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if rc.Error["h1"] == "" {
+		t.Fatal("command on a host stalling the handshake succeeded")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("timeout took %s", took)
+	}
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TransportSFTP transfer files by sftp subsystem, default
+	TransportSFTP = "sftp"
+	// TransportSCP transfer files by scp and shell commands, for hosts without sftp subsystem
+	TransportSCP = "scp"
+)
+
+const (
+	// SFTPPacketSize max data of a sftp request, 32KB is what every server must support.
+	// a larger packet is cut short by some servers, which ends a pipelined read early
+	SFTPPacketSize = 32768
+	// SFTPDefaultMaxRequests outstanding requests of a file when pipelined
+	SFTPDefaultMaxRequests = 64
+)
+
+// SFTPConfig pipelining of sftp requests, so that throughput over high latency links is not capped by round trips.
+// a read or write is pipelined when it is larger than a packet, see transfer_buffer
+type SFTPConfig struct {
+	ConcurrentWrites  bool `yaml:"concurrent_writes"`   // pipeline writes, a failed put may leave holes in the remote file
+	NoConcurrentReads bool `yaml:"no_concurrent_reads"` // reads are pipelined unless set, for read-once servers
+	MaxRequests       int  `yaml:"max_requests"`        // outstanding requests per file, default 64
+}
+
+// maxRequests get outstanding sftp requests per file
+func (sc SFTPConfig) maxRequests() int {
+	if sc.MaxRequests > 0 {
+		return sc.MaxRequests
+	}
+	return SFTPDefaultMaxRequests
+}
+
+// File file opened by a transport
+type File interface {
+	io.ReadWriteCloser
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+// Transport file operations on a host
+type Transport interface {
+	Open(name string) (File, error)   // open for reading
+	Create(name string) (File, error) // create or truncate for writing
+	Stat(name string) (os.FileInfo, error)
+	Mkdir(name string) error // create dir and parents
+	Chmod(name string, mode os.FileMode) error
+	Rename(oldname, newname string) error // newname is replaced if it is a file
+	Remove(name string) error             // remove a file or an empty dir
+	ReadDir(name string) ([]os.FileInfo, error)
+	Close() error
+}
+
+// NewTransport get transport of kind over ssh client
+func NewTransport(kind string, c *ssh.Client) (Transport, error) {
+	switch kind {
+	case "", TransportSFTP:
+		// sftp.MaxPacket is MaxPacketChecked since sftp v1.13 and fails NewClient for sizes over 32768, which the
+		// 33788 used before was. the unchecked option leaves the size to SFTPPacketSize
+		sc, err := sftp.NewClient(c,
+			sftp.MaxPacketUnchecked(SFTPPacketSize),
+			sftp.UseConcurrentWrites(C.SFTP.ConcurrentWrites),
+			sftp.UseConcurrentReads(!C.SFTP.NoConcurrentReads),
+			sftp.MaxConcurrentRequestsPerFile(C.SFTP.maxRequests()))
+		if err != nil {
+			return nil, err
+		}
+		return sftpTransport{sc}, nil
+	case TransportSCP:
+		return &scpTransport{shellTransport{c: c}}, nil
+	}
+	return nil, fmt.Errorf("Unknown transport: %s", kind)
+}
+
+// sftpTransport transport of sftp client
+type sftpTransport struct {
+	*sftp.Client
+}
+
+func (st sftpTransport) Open(name string) (File, error) {
+	return st.Client.Open(name)
+}
+
+func (st sftpTransport) Create(name string) (File, error) {
+	return st.Client.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+}
+
+func (st sftpTransport) Mkdir(name string) error {
+	return st.Client.MkdirAll(name)
+}
+
+func (st sftpTransport) Rename(oldname, newname string) error {
+	return st.Client.PosixRename(oldname, newname)
+}
+
+// fileInfo os.FileInfo of transports without a native one
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return path.Base(fi.name) }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+// removeAll remove name and everything it contains
+func removeAll(tr Transport, name string) error {
+	fi, err := tr.Stat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		fis, err := tr.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range fis {
+			if err = removeAll(tr, path.Join(name, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return tr.Remove(name)
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// localTransport transport of local filesystem
+type localTransport struct{}
+
+// NewLocalTransport get transport of local filesystem
+func NewLocalTransport() Transport {
+	return localTransport{}
+}
+
+func (localTransport) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (localTransport) Create(name string) (File, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644&^os.FileMode(C.TransferUmask))
+}
+
+func (localTransport) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localTransport) Mkdir(name string) error {
+	return os.MkdirAll(name, DirMode())
+}
+
+func (localTransport) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (localTransport) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (localTransport) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (localTransport) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (localTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,228 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memTransport in-memory transport, for tests and dry runs
+type memTransport struct {
+	lock  sync.Mutex
+	nodes map[string]*memNode // keyed by clean path
+}
+
+// memNode file or dir of memTransport
+type memNode struct {
+	name    string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (n *memNode) IsDir() bool {
+	return n.mode.IsDir()
+}
+
+func (n *memNode) info() os.FileInfo {
+	return fileInfo{name: n.name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// NewMemTransport get an empty in-memory transport with root dir
+func NewMemTransport() Transport {
+	return &memTransport{nodes: map[string]*memNode{
+		"/": {name: "/", mode: os.ModeDir | 0755, modTime: time.Now()},
+	}}
+}
+
+func (m *memTransport) get(name string) (*memNode, error) {
+	n, ok := m.nodes[path.Clean("/"+name)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return n, nil
+}
+
+func (m *memTransport) Open(name string) (File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	cp := *n
+	return &memFile{r: bytes.NewReader(cp.data), node: &cp}, nil
+}
+
+func (m *memTransport) Create(name string) (File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = path.Clean("/" + name)
+	if p, ok := m.nodes[path.Dir(name)]; !ok || !p.IsDir() {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrNotExist}
+	}
+	mode := os.FileMode(0644)
+	if n, ok := m.nodes[name]; ok {
+		if n.IsDir() {
+			return nil, &os.PathError{Op: "create", Path: name, Err: errors.New("is a directory")}
+		}
+		mode = n.mode
+	}
+	n := &memNode{name: name, mode: mode, modTime: time.Now()}
+	m.nodes[name] = n
+	return &memFile{node: n, m: m}, nil
+}
+
+func (m *memTransport) Stat(name string) (os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+func (m *memTransport) Mkdir(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = path.Clean("/" + name)
+	for p := name; ; p = path.Dir(p) {
+		if n, ok := m.nodes[p]; ok {
+			if !n.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+			}
+			break
+		}
+		m.nodes[p] = &memNode{name: p, mode: os.ModeDir | DirMode(), modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *memTransport) Chmod(name string, mode os.FileMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+func (m *memTransport) Rename(oldname, newname string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	oldname, newname = path.Clean("/"+oldname), path.Clean("/"+newname)
+	n, err := m.get(oldname)
+	if err != nil {
+		return err
+	}
+	if dst, ok := m.nodes[newname]; ok && (dst.IsDir() || n.IsDir()) {
+		return &os.PathError{Op: "rename", Path: newname, Err: os.ErrExist}
+	}
+	if p, ok := m.nodes[path.Dir(newname)]; !ok || !p.IsDir() {
+		return &os.PathError{Op: "rename", Path: newname, Err: os.ErrNotExist}
+	}
+	for p, c := range m.nodes {
+		if p == oldname || strings.HasPrefix(p, oldname+"/") {
+			delete(m.nodes, p)
+			c.name = newname + strings.TrimPrefix(p, oldname)
+			m.nodes[c.name] = c
+		}
+	}
+	return nil
+}
+
+func (m *memTransport) Remove(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = path.Clean("/" + name)
+	if _, err := m.get(name); err != nil {
+		return err
+	}
+	for p := range m.nodes {
+		if strings.HasPrefix(p, name+"/") {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *memTransport) ReadDir(name string) ([]os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = path.Clean("/" + name)
+	if _, err := m.get(name); err != nil {
+		return nil, err
+	}
+	var fis []os.FileInfo
+	for p, n := range m.nodes {
+		if p != name && path.Dir(p) == name {
+			fis = append(fis, n.info())
+		}
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (m *memTransport) Close() error {
+	return nil
+}
+
+// memFile file opened by memTransport, readers see content at open, writes are visible at once
+type memFile struct {
+	r    *bytes.Reader
+	node *memNode
+	m    *memTransport
+}
+
+func (f *memFile) Name() string {
+	return f.node.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.m != nil {
+		f.m.lock.Lock()
+		defer f.m.lock.Unlock()
+	}
+	return f.node.info(), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, errors.New("File is opened for writing")
+	}
+	return f.r.Read(p)
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.r == nil {
+		return 0, errors.New("File is opened for writing")
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.m == nil {
+		return 0, errors.New("File is opened for reading")
+	}
+	f.m.lock.Lock()
+	defer f.m.lock.Unlock()
+	f.node.data = append(f.node.data, p...)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
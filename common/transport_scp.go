@@ -0,0 +1,202 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scpTransport transport of scp for file content and shell commands for metadata
+type scpTransport struct {
+	shellTransport
+}
+
+// scpAck read an scp response, 0 is ok, 1 and 2 are followed by an error message
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return fmt.Errorf("scp: %s", strings.TrimSpace(msg))
+}
+
+func (st *scpTransport) Open(name string) (File, error) {
+	sess, err := st.c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	out, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	if err = sess.Start("scp -f " + shellQuote(name)); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(out)
+	f := &scpFile{name: name, sess: sess, w: w, r: r}
+	// C<mode> <size> <name>
+	w.Write([]byte{0})
+	header, err := r.ReadString('\n')
+	if err == nil && !strings.HasPrefix(header, "C") {
+		err = fmt.Errorf("scp: %s", strings.TrimSpace(strings.TrimLeft(header, "\x01\x02")))
+		if strings.Contains(header, "No such file") {
+			err = &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+	}
+	var mode uint64
+	if err == nil {
+		fields := strings.SplitN(strings.TrimSpace(header[1:]), " ", 3)
+		if len(fields) != 3 {
+			err = fmt.Errorf("scp: unexpected header %s", header)
+		} else if mode, err = strconv.ParseUint(fields[0], 8, 32); err == nil {
+			f.size, err = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	f.mode = os.FileMode(mode)
+	f.body = io.LimitReader(r, f.size)
+	w.Write([]byte{0})
+	return f, nil
+}
+
+func (st *scpTransport) Create(name string) (File, error) {
+	// scp sends size before content, so content is buffered in a local temp file until closed
+	tmp, err := ioutil.TempFile("", "optool-"+RunID+"-scp-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	return &scpFile{name: name, st: st, tmp: tmp, mode: 0644}, nil
+}
+
+// scpFile file read by scp -f, or written by scp -t when closed
+type scpFile struct {
+	name string
+	mode os.FileMode
+	size int64
+
+	// reading
+	sess *ssh.Session
+	w    io.WriteCloser
+	r    *bufio.Reader
+	body io.Reader
+
+	// writing
+	st  *scpTransport
+	tmp *os.File
+}
+
+func (f *scpFile) Name() string {
+	return f.name
+}
+
+func (f *scpFile) Stat() (os.FileInfo, error) {
+	size := f.size
+	if f.tmp != nil {
+		fi, err := f.tmp.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = fi.Size()
+	}
+	return fileInfo{name: f.name, size: size, mode: f.mode, modTime: time.Now()}, nil
+}
+
+func (f *scpFile) Read(p []byte) (int, error) {
+	if f.body == nil {
+		return 0, errors.New("File is opened for writing")
+	}
+	return f.body.Read(p)
+}
+
+func (f *scpFile) Write(p []byte) (int, error) {
+	if f.tmp == nil {
+		return 0, errors.New("File is opened for reading")
+	}
+	return f.tmp.Write(p)
+}
+
+func (f *scpFile) Close() error {
+	if f.tmp != nil {
+		defer f.tmp.Close()
+		return f.send()
+	}
+	defer f.sess.Close()
+	if _, err := io.Copy(ioutil.Discard, f.body); err != nil {
+		return err
+	}
+	err := scpAck(f.r)
+	f.w.Write([]byte{0})
+	f.w.Close()
+	if e := f.sess.Wait(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// send upload buffered content by scp -t
+func (f *scpFile) send() error {
+	fi, err := f.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sess, err := f.st.c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	w, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = sess.Start("scp -t " + shellQuote(f.name)); err != nil {
+		return err
+	}
+	r := bufio.NewReader(out)
+	if err = scpAck(r); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "C%04o %d %s\n", f.mode.Perm(), fi.Size(), path.Base(f.name))
+	if err = scpAck(r); err != nil {
+		return err
+	}
+	if _, err = copyBuffer(w, f.tmp); err != nil {
+		return err
+	}
+	w.Write([]byte{0})
+	if err = scpAck(r); err != nil {
+		return err
+	}
+	w.Close()
+	return sess.Wait()
+}
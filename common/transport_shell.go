@@ -0,0 +1,134 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// shellNotExist exit status of shell transport commands when path does not exist
+const shellNotExist = 44
+
+// shellTransport metadata operations by shell commands, embedded by transports for file content
+type shellTransport struct {
+	c    *ssh.Client
+	wrap func(cmd string) string // wrap commands to run them elsewhere, eg. in a container
+}
+
+// shellQuote quote s for remote shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// output run cmd and get its stdout, exit status shellNotExist is returned as os.ErrNotExist
+func (st *shellTransport) output(name, cmd string) ([]byte, error) {
+	if st.wrap != nil {
+		cmd = st.wrap(cmd)
+	}
+	sess, err := st.c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	out, err := sess.Output(cmd)
+	if ee, ok := err.(*ssh.ExitError); ok {
+		if ee.ExitStatus() == shellNotExist {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+		}
+		return nil, fmt.Errorf("%s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// run run cmd on name, os.ErrNotExist is returned if name does not exist
+func (st *shellTransport) run(name, cmd string) error {
+	_, err := st.output(name, fmt.Sprintf("[ -e %s ] || exit %d; %s", shellQuote(name), shellNotExist, cmd))
+	return err
+}
+
+// shellStatFormat stat format parsed by parseStat
+const shellStatFormat = "'%s %f %Y %n'"
+
+// parseStat parse a line of stat -c shellStatFormat
+func parseStat(line string) (os.FileInfo, error) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("Unexpected stat output: %s", line)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	mode := os.FileMode(raw & 0777)
+	switch raw & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0120000:
+		mode |= os.ModeSymlink
+	}
+	return fileInfo{name: fields[3], size: size, mode: mode, modTime: time.Unix(mtime, 0)}, nil
+}
+
+func (st *shellTransport) Stat(name string) (os.FileInfo, error) {
+	out, err := st.output(name, fmt.Sprintf("[ -e %[1]s ] || exit %d; stat -L -c %s %[1]s", shellQuote(name), shellNotExist, shellStatFormat))
+	if err != nil {
+		return nil, err
+	}
+	return parseStat(strings.TrimRight(string(out), "\n"))
+}
+
+func (st *shellTransport) ReadDir(name string) ([]os.FileInfo, error) {
+	out, err := st.output(name, fmt.Sprintf("[ -d %[1]s ] || exit %d; find %[1]s -mindepth 1 -maxdepth 1 -exec stat -L -c %[3]s {} +",
+		shellQuote(name), shellNotExist, shellStatFormat))
+	if err != nil {
+		return nil, err
+	}
+	var fis []os.FileInfo
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fi, err := parseStat(line)
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+func (st *shellTransport) Mkdir(name string) error {
+	_, err := st.output(name, "mkdir -p "+shellQuote(name))
+	return err
+}
+
+func (st *shellTransport) Chmod(name string, mode os.FileMode) error {
+	return st.run(name, fmt.Sprintf("chmod %o %s", mode.Perm(), shellQuote(name)))
+}
+
+func (st *shellTransport) Rename(oldname, newname string) error {
+	return st.run(oldname, fmt.Sprintf("mv -f %s %s", shellQuote(oldname), shellQuote(newname)))
+}
+
+func (st *shellTransport) Remove(name string) error {
+	return st.run(name, fmt.Sprintf("if [ -d %[1]s ]; then rmdir %[1]s; else rm -f %[1]s; fi", shellQuote(name)))
+}
+
+func (st *shellTransport) Close() error {
+	return nil
+}
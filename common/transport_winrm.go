@@ -0,0 +1,213 @@
+package common
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// winrmNotExist exit code of winrm transport scripts when path does not exist
+const winrmNotExist = 44
+
+// winrmChunkSize bytes uploaded by a script, keeps encoded command line under windows limit
+const winrmChunkSize = 4000
+
+// winrmTransport transport of windows host by powershell scripts, file content is sent as base64 chunks
+type winrmTransport struct {
+	ws *winrmShell
+}
+
+// output run script, exit code winrmNotExist is returned as os.ErrNotExist
+func (wt *winrmTransport) output(name, script string) ([]byte, error) {
+	out, err := wt.ws.Output("$ErrorActionPreference = 'Stop'\n" + script)
+	if ee, ok := err.(*winrmExitError); ok && ee.Code == winrmNotExist {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return out, err
+}
+
+// exists script prefix exit with winrmNotExist if name does not exist
+func winrmExists(name string) string {
+	return fmt.Sprintf("if (-not (Test-Path -LiteralPath %s)) { exit %d }\n", psQuote(name), winrmNotExist)
+}
+
+// winrmStatFormat print item as: d|f size unixtime name
+const winrmStatFormat = `ForEach-Object { $t = 'f'; $n = 0; if ($_.PSIsContainer) { $t = 'd' } else { $n = $_.Length }; ` +
+	`'{0} {1} {2} {3}' -f $t, $n, [int64](($_.LastWriteTimeUtc - [datetime]'1970-01-01').TotalSeconds), $_.Name }`
+
+// parseWinRMStat parse a line printed by winrmStatFormat
+func parseWinRMStat(line string) (os.FileInfo, error) {
+	fields := strings.SplitN(strings.TrimRight(line, "\r"), " ", 4)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("Unexpected stat output: %s", line)
+	}
+	size, _ := strconv.ParseInt(fields[1], 10, 64)
+	mtime, _ := strconv.ParseInt(fields[2], 10, 64)
+	mode := os.FileMode(0644)
+	if fields[0] == "d" {
+		mode = os.ModeDir | 0755
+	}
+	return fileInfo{name: fields[3], size: size, mode: mode, modTime: time.Unix(mtime, 0)}, nil
+}
+
+func (wt *winrmTransport) Stat(name string) (os.FileInfo, error) {
+	out, err := wt.output(name, winrmExists(name)+"Get-Item -Force -LiteralPath "+psQuote(name)+" | "+winrmStatFormat)
+	if err != nil {
+		return nil, err
+	}
+	return parseWinRMStat(strings.TrimSpace(string(out)))
+}
+
+func (wt *winrmTransport) ReadDir(name string) ([]os.FileInfo, error) {
+	out, err := wt.output(name, winrmExists(name)+"Get-ChildItem -Force -LiteralPath "+psQuote(name)+" | "+winrmStatFormat)
+	if err != nil {
+		return nil, err
+	}
+	var fis []os.FileInfo
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		fi, err := parseWinRMStat(line)
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+func (wt *winrmTransport) Mkdir(name string) error {
+	_, err := wt.output(name, "New-Item -ItemType Directory -Force -Path "+psQuote(name)+" | Out-Null")
+	return err
+}
+
+// Chmod unix modes are meaningless on windows
+func (wt *winrmTransport) Chmod(name string, mode os.FileMode) error {
+	return nil
+}
+
+func (wt *winrmTransport) Rename(oldname, newname string) error {
+	_, err := wt.output(oldname, winrmExists(oldname)+"Move-Item -Force -LiteralPath "+psQuote(oldname)+" -Destination "+psQuote(newname))
+	return err
+}
+
+func (wt *winrmTransport) Remove(name string) error {
+	_, err := wt.output(name, winrmExists(name)+"Remove-Item -Force -LiteralPath "+psQuote(name))
+	return err
+}
+
+func (wt *winrmTransport) Open(name string) (File, error) {
+	fi, err := wt.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	out, err := wt.output(name, "[Convert]::ToBase64String([IO.File]::ReadAllBytes("+psQuote(name)+"))")
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, err
+	}
+	return &winrmFile{name: name, info: fi, r: strings.NewReader(string(data))}, nil
+}
+
+func (wt *winrmTransport) Create(name string) (File, error) {
+	// content is buffered in a local temp file and sent in chunks when closed
+	tmp, err := ioutil.TempFile("", "optool-"+RunID+"-winrm-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	return &winrmFile{name: name, wt: wt, tmp: tmp}, nil
+}
+
+func (wt *winrmTransport) Close() error {
+	return wt.ws.Close()
+}
+
+// winrmFile file read at once, or written in chunks when closed
+type winrmFile struct {
+	name string
+	info os.FileInfo
+	r    *strings.Reader
+	wt   *winrmTransport
+	tmp  *os.File
+}
+
+func (f *winrmFile) Name() string {
+	return f.name
+}
+
+func (f *winrmFile) Stat() (os.FileInfo, error) {
+	if f.tmp == nil {
+		return f.info, nil
+	}
+	fi, err := f.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{name: f.name, size: fi.Size(), mode: 0644, modTime: time.Now()}, nil
+}
+
+func (f *winrmFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, errors.New("File is opened for writing")
+	}
+	return f.r.Read(p)
+}
+
+func (f *winrmFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.r == nil {
+		return 0, errors.New("File is opened for writing")
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func (f *winrmFile) Write(p []byte) (int, error) {
+	if f.tmp == nil {
+		return 0, errors.New("File is opened for reading")
+	}
+	return f.tmp.Write(p)
+}
+
+func (f *winrmFile) Close() error {
+	if f.tmp == nil {
+		return nil
+	}
+	defer f.tmp.Close()
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.wt.output(f.name, "[IO.File]::WriteAllBytes("+psQuote(f.name)+", [byte[]]@())"); err != nil {
+		return err
+	}
+	buf := make([]byte, winrmChunkSize)
+	for {
+		n, err := io.ReadFull(f.tmp, buf)
+		if n > 0 {
+			script := "$f = [IO.File]::Open(" + psQuote(f.name) + ", 'Append')\n" +
+				"$b = [Convert]::FromBase64String('" + base64.StdEncoding.EncodeToString(buf[:n]) + "')\n" +
+				"$f.Write($b, 0, $b.Length)\n$f.Close()"
+			if _, e := f.wt.output(f.name, script); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+)
+
+const (
+	// VerifyAll read back all uploaded bytes
+	VerifyAll = "all"
+	// VerifySample read back random chunks of uploaded bytes
+	VerifySample = "sample"
+)
+
+const (
+	verifyChunkSize  = 64 << 10
+	verifyChunkCount = 16
+)
+
+// verifyRemote read back remote file and compare it with local file
+func verifyRemote(tr Transport, local, remote, mode string) error {
+	lf, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	rf, err := tr.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	lfi, err := lf.Stat()
+	if err != nil {
+		return err
+	}
+	rfi, err := rf.Stat()
+	if err != nil {
+		return err
+	}
+	if lfi.Size() != rfi.Size() {
+		return fmt.Errorf("Verify %s: size mismatch %d != %d", remote, rfi.Size(), lfi.Size())
+	}
+	ra, ok := rf.(io.ReaderAt)
+	if mode == VerifySample && !ok {
+		// transport cannot read at random offsets
+		mode = VerifyAll
+	}
+	switch mode {
+	case VerifyAll:
+		lh, rh := sha256.New(), sha256.New()
+		if _, err = io.Copy(lh, lf); err != nil {
+			return err
+		}
+		if _, err = io.Copy(rh, rf); err != nil {
+			return err
+		}
+		if !bytes.Equal(lh.Sum(nil), rh.Sum(nil)) {
+			return fmt.Errorf("Verify %s: content mismatch", remote)
+		}
+	case VerifySample:
+		lbuf := make([]byte, verifyChunkSize)
+		rbuf := make([]byte, verifyChunkSize)
+		for i := 0; i < verifyChunkCount && lfi.Size() > 0; i++ {
+			var off int64
+			if lfi.Size() > verifyChunkSize {
+				off = rand.Int63n(lfi.Size() - verifyChunkSize)
+			}
+			ln, err := lf.ReadAt(lbuf, off)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			rn, err := ra.ReadAt(rbuf[:ln], off)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if rn != ln || !bytes.Equal(lbuf[:ln], rbuf[:rn]) {
+				return fmt.Errorf("Verify %s: content mismatch at offset %d", remote, off)
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown verify mode: %s", mode)
+	}
+	return nil
+}
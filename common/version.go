@@ -0,0 +1,85 @@
+package common
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// build info, set at build time:
+//
+//	go build -ldflags "-X github.com/nealwon/optool/common.Version=v0.3.0 -X github.com/nealwon/optool/common.GitCommit=$(git rev-parse --short HEAD) -X github.com/nealwon/optool/common.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "v0.2.1beta"
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+// VersionString version with build info
+func VersionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s %s/%s)", Version, GitCommit, BuildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// sshClientVersion identification sent in ssh handshakes, eg. SSH-2.0-optool_v0.2.1beta
+func sshClientVersion() string {
+	return "SSH-2.0-optool_" + strings.Replace(Version, " ", "_", -1)
+}
+
+// CompareVersion compare dotted versions like v1.2.3, suffix after numbers(eg. beta) sorts before release
+func CompareVersion(a, b string) int {
+	pa, sa := splitVersion(a)
+	pb, sb := splitVersion(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case sa == sb:
+		return 0
+	case sa == "":
+		return 1
+	case sb == "":
+		return -1
+	case sa < sb:
+		return -1
+	}
+	return 1
+}
+
+// splitVersion split v0.2.1beta to [0 2 1] and beta
+func splitVersion(v string) ([]int, string) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	var nums []int
+	for _, p := range strings.Split(v, ".") {
+		i := 0
+		for i < len(p) && p[i] >= '0' && p[i] <= '9' {
+			i++
+		}
+		n, _ := strconv.Atoi(p[:i])
+		nums = append(nums, n)
+		if i < len(p) {
+			return nums, strings.TrimLeft(p[i:], "-+")
+		}
+	}
+	return nums, ""
+}
+
+// CheckMinVersion check running version against min_version of configure
+func CheckMinVersion() error {
+	if C.MinVersion == "" || CompareVersion(Version, C.MinVersion) >= 0 {
+		return nil
+	}
+	return fmt.Errorf("Configure requires optool %s or newer, running %s", C.MinVersion, Version)
+}
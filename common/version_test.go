@@ -0,0 +1,52 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitVersion(t *testing.T) {
+	tests := []struct {
+		v      string
+		nums   []int
+		suffix string
+	}{
+		{"1.2.3", []int{1, 2, 3}, ""},
+		{"v0.2.1", []int{0, 2, 1}, ""},
+		{" v1.10 ", []int{1, 10}, ""},
+		{"v0.2.1beta", []int{0, 2, 1}, "beta"},
+		{"1.2.0-rc1", []int{1, 2, 0}, "rc1"},
+		{"1.2+build.5", []int{1, 2}, "build"},
+		{"dev", []int{0}, "dev"},
+	}
+	for _, tt := range tests {
+		nums, suffix := splitVersion(tt.v)
+		if !reflect.DeepEqual(nums, tt.nums) || suffix != tt.suffix {
+			t.Errorf("splitVersion(%q) = %v, %q, want %v, %q", tt.v, nums, suffix, tt.nums, tt.suffix)
+		}
+	}
+}
+
+func TestCompareVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"2.0", "1.99.99", 1},
+		{"1.2.0-rc1", "1.2.0", -1},
+		{"1.2.0", "1.2.0-rc1", 1},
+		{"1.2.0-beta", "1.2.0-rc1", -1},
+		{"1.2.0-rc2", "1.2.0-rc1", 1},
+		{"1.3.0-rc1", "1.2.9", 1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersion(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersion(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
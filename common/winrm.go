@@ -0,0 +1,247 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	// HostWinRM windows host reached by winrm over http, configured as winrm://address:port
+	HostWinRM = "winrm"
+	// HostWinRMS windows host reached by winrm over https, configured as winrms://address:port
+	HostWinRMS = "winrms"
+)
+
+// WinRMConfig auth of winrm hosts, user and password of auth are used if empty
+// only basic auth is supported, it must be enabled on hosts(and AllowUnencrypted for winrm://)
+type WinRMConfig struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"` // encrypted unless auth.plain_password
+	Insecure bool   `yaml:"insecure"` // skip verifying certificate of winrms hosts
+}
+
+const (
+	wsmanShellURI   = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd"
+	wsmanCreate     = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	wsmanDelete     = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	wsmanCommand    = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Command"
+	wsmanReceive    = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Receive"
+	wsmanSignal     = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Signal"
+	wsmanTerminate  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/terminate"
+	wsmanDone       = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"
+	wsmanTimeoutErr = "2150858793" // receive timed out while command is still running
+)
+
+// winrmShell a remote shell on a winrm host, commands run by powershell
+type winrmShell struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+	id       string
+}
+
+// dialWinRM open a shell on winrm host
+func dialWinRM(h Host) (*winrmShell, error) {
+	scheme := "http"
+	if h.Type == HostWinRMS {
+		scheme = "https"
+	}
+	user, password := credentials(C.WinRM.User, C.WinRM.Password)
+	ws := &winrmShell{
+		url:      (&url.URL{Scheme: scheme, Host: h.Addr(), Path: "/wsman"}).String(),
+		user:     user,
+		password: password,
+		client: &http.Client{
+			Timeout:   120 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: C.WinRM.Insecure}},
+		},
+	}
+	var resp struct {
+		ShellID string `xml:"Body>Shell>ShellId"`
+		Created string `xml:"Body>ResourceCreated>ReferenceParameters>SelectorSet>Selector"`
+	}
+	options := `<w:OptionSet><w:Option Name="WINRS_NOPROFILE">TRUE</w:Option><w:Option Name="WINRS_CODEPAGE">65001</w:Option></w:OptionSet>`
+	body := `<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>`
+	if err := ws.call(wsmanCreate, options, body, &resp); err != nil {
+		return nil, err
+	}
+	ws.id = resp.ShellID
+	if ws.id == "" {
+		ws.id = resp.Created
+	}
+	if ws.id == "" {
+		return nil, errors.New("WinRM: no shell id in response")
+	}
+	return ws, nil
+}
+
+// call post a ws-man request and decode response into v
+func (ws *winrmShell) call(action, options, body string, v interface{}) error {
+	selector := ""
+	if ws.id != "" {
+		selector = `<w:SelectorSet><w:Selector Name="ShellId">` + ws.id + `</w:Selector></w:SelectorSet>`
+	}
+	envelope := `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" ` +
+		`xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd" xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell">` +
+		`<s:Header><a:To>` + ws.url + `</a:To>` +
+		`<w:ResourceURI s:mustUnderstand="true">` + wsmanShellURI + `</w:ResourceURI>` +
+		`<a:ReplyTo><a:Address s:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>` +
+		`<a:Action s:mustUnderstand="true">` + action + `</a:Action>` +
+		`<w:MaxEnvelopeSize s:mustUnderstand="true">153600</w:MaxEnvelopeSize>` +
+		`<a:MessageID>uuid:` + newUUID() + `</a:MessageID>` +
+		`<w:Locale xml:lang="en-US" s:mustUnderstand="false"/><w:OperationTimeout>PT60S</w:OperationTimeout>` +
+		selector + options + `</s:Header><s:Body>` + body + `</s:Body></s:Envelope>`
+	req, err := http.NewRequest("POST", ws.url, strings.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	req.SetBasicAuth(ws.user, ws.password)
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Reason string `xml:"Body>Fault>Reason>Text"`
+			Detail struct {
+				WSManFault struct {
+					Code string `xml:"Code,attr"`
+				}
+			} `xml:"Body>Fault>Detail"`
+		}
+		xml.Unmarshal(data, &fault)
+		if code := fault.Detail.WSManFault.Code; code != "" || fault.Reason != "" {
+			return &winrmFault{Code: code, Reason: strings.TrimSpace(fault.Reason)}
+		}
+		return fmt.Errorf("WinRM: %s", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// winrmFault soap fault of winrm
+type winrmFault struct {
+	Code   string
+	Reason string
+}
+
+func (f *winrmFault) Error() string {
+	return fmt.Sprintf("WinRM fault %s: %s", f.Code, f.Reason)
+}
+
+// Run run powershell script, output of streams and exit code are returned
+func (ws *winrmShell) Run(script string) (stdout, stderr []byte, code int, err error) {
+	var cmd struct {
+		ID string `xml:"Body>CommandResponse>CommandId"`
+	}
+	options := `<w:OptionSet><w:Option Name="WINRS_CONSOLEMODE_STDIN">TRUE</w:Option><w:Option Name="WINRS_SKIP_CMD_SHELL">TRUE</w:Option></w:OptionSet>`
+	body := `<rsp:CommandLine><rsp:Command>powershell.exe</rsp:Command>` +
+		`<rsp:Arguments>-NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand ` + encodePowerShell(script) + `</rsp:Arguments></rsp:CommandLine>`
+	if err = ws.call(wsmanCommand, options, body, &cmd); err != nil {
+		return
+	}
+	defer ws.call(wsmanSignal, "", `<rsp:Signal CommandId="`+cmd.ID+`"><rsp:Code>`+wsmanTerminate+`</rsp:Code></rsp:Signal>`, nil)
+	var out, errOut bytes.Buffer
+	for {
+		var resp struct {
+			Streams []struct {
+				Name  string `xml:"Name,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"Body>ReceiveResponse>Stream"`
+			State struct {
+				State    string `xml:"State,attr"`
+				ExitCode int    `xml:"ExitCode"`
+			} `xml:"Body>ReceiveResponse>CommandState"`
+		}
+		err = ws.call(wsmanReceive, "", `<rsp:Receive><rsp:DesiredStream CommandId="`+cmd.ID+`">stdout stderr</rsp:DesiredStream></rsp:Receive>`, &resp)
+		if f, ok := err.(*winrmFault); ok && f.Code == wsmanTimeoutErr {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, s := range resp.Streams {
+			b, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(s.Value))
+			if s.Name == "stderr" {
+				errOut.Write(b)
+			} else {
+				out.Write(b)
+			}
+		}
+		if resp.State.State == wsmanDone {
+			return out.Bytes(), errOut.Bytes(), resp.State.ExitCode, nil
+		}
+	}
+}
+
+// Output run script and get stdout, an error is returned if exit code is not 0
+func (ws *winrmShell) Output(script string) ([]byte, error) {
+	stdout, stderr, code, err := ws.Run(script)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return stdout, &winrmExitError{Code: code, Stderr: strings.TrimSpace(string(stderr))}
+	}
+	return stdout, nil
+}
+
+// winrmExitError script exited with non zero code
+type winrmExitError struct {
+	Code   int
+	Stderr string
+}
+
+func (e *winrmExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %d %s", e.Code, e.Stderr)
+}
+
+// Close delete the shell
+func (ws *winrmShell) Close() error {
+	return ws.call(wsmanDelete, "", "", nil)
+}
+
+// encodePowerShell encode script for powershell -EncodedCommand
+func encodePowerShell(script string) string {
+	u := utf16.Encode([]rune(script))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// psQuote quote s as powershell literal string
+func psQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// newUUID random uuid of ws-man message ids
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
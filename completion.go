@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nealwon/optool/common"
+)
+
+const bashCompletion = `# optool bash completion, load with: source <(optool completion bash)
+_optool() {
+    local cur prev words
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    case "$prev" in
+        -g) words=$(optool __complete groups 2>/dev/null) ;;
+        -t) words=$(optool __complete tags 2>/dev/null) ;;
+        run) words=$(optool __complete profiles 2>/dev/null) ;;
+        promote) words=$(optool __complete groups 2>/dev/null) ;;
+        completion) words="bash zsh fish" ;;
+        help) words=$(optool __complete commands 2>/dev/null) ;;
+        -config|-o|-s|-key|-get|-put|-path|-hosts-file) COMPREPLY=(); return ;;
+        *)
+            if [[ "$cur" == -* ]]; then
+                words=$(optool __complete flags 2>/dev/null)
+            elif [[ " ${COMP_WORDS[*]:1:COMP_CWORD-1} " == *" promote "* ]]; then
+                words=$(optool __complete groups 2>/dev/null)
+            else
+                words=$(optool __complete commands 2>/dev/null)
+            fi
+            ;;
+    esac
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -o default -F _optool optool
+`
+
+const zshCompletion = `# optool zsh completion, load with: source <(optool completion zsh)
+autoload -U +X bashcompinit && bashcompinit
+`
+
+const fishCompletion = `# optool fish completion, load with: optool completion fish | source
+complete -c optool -f -n '__fish_use_subcommand' -a '(optool __complete commands 2>/dev/null)'
+complete -c optool -f -n '__fish_seen_subcommand_from run' -a '(optool __complete profiles 2>/dev/null)'
+complete -c optool -f -n '__fish_seen_subcommand_from promote' -a '(optool __complete groups 2>/dev/null)'
+complete -c optool -f -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'
+complete -c optool -f -n '__fish_seen_subcommand_from help' -a '(optool __complete commands 2>/dev/null)'
+`
+
+func runCompletion(hosts []string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion + bashCompletion)
+	case "fish":
+		fmt.Print(fishCompletion)
+		flag.VisitAll(func(f *flag.Flag) {
+			usage := strings.Replace(strings.SplitN(f.Usage, "\n", 2)[0], "'", "", -1)
+			line := fmt.Sprintf("complete -c optool -o %s -d '%s'", f.Name, usage)
+			switch f.Name {
+			case "g":
+				line += " -x -a '(optool __complete groups 2>/dev/null)'"
+			case "t":
+				line += " -x -a '(optool __complete tags 2>/dev/null)'"
+			}
+			fmt.Println(line)
+		})
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// runComplete print words for shell completion
+func runComplete(hosts []string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var words []string
+	switch args[0] {
+	case "commands":
+		words = commandNames()
+	case "flags":
+		flag.VisitAll(func(f *flag.Flag) {
+			words = append(words, "-"+f.Name)
+		})
+	case "groups":
+		for g := range common.C.Server.Hosts {
+			words = append(words, g)
+		}
+	case "tags":
+		for t := range common.C.Tags {
+			words = append(words, t)
+		}
+	case "profiles":
+		for p := range common.C.Profiles {
+			words = append(words, p)
+		}
+	default:
+		return errUsage
+	}
+	sort.Strings(words)
+	fmt.Println(strings.Join(words, "\n"))
+	return nil
+}
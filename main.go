@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -24,9 +27,6 @@ const (
 	NoServer = 1 << 1
 )
 
-// OptoolVersion define current version
-const OptoolVersion = "v0.2.1beta"
-
 var (
 	pConfigFile   = flag.String("config", "/optool.yml", "set config file path")
 	pTag          = flag.String("t", "", "set tagged command")
@@ -40,28 +40,77 @@ var (
 	pCommand      = flag.String("x", "", "execute command directly")
 	pScript       = flag.String("s", "", "read commands from script")
 	pNoHeader     = flag.Int("nh", 0, "(1)1<<0=no header,(2)1<<1=no server ip,3=none")
-	pHost         = flag.String("host", "", "set run host")
+	pHost         = flag.String("host", "", "set run host, multiple hosts are separated by comma(,)")
+	pHostsFile    = flag.String("hosts-file", "", "read run hosts from file, - for stdin")
 	pPort         = flag.Int("port", 0, "set default ssh port")
 	pPrivateKey   = flag.String("key", "", "set private key")
 	pVerbose      = flag.Bool("v", false, "verbose all configs")
 	pSampleConfig = flag.Bool("V", false, "print sample configure")
 	pVersion      = flag.Bool("version", false, "print version and exit")
 	pEncrypt      = flag.Bool("encrypt", false, "encrypt a password/phrase")
+	pAtomic       = flag.Bool("atomic", false, "roll back all hosts to previous release if any host failed deploying")
+	pConcurrency  = flag.Int("concurrency", 0, "max hosts run at the same time, 0 for unlimited")
 	//@todo
-	pGet      = flag.String("get", "", "get a file from remote host")
-	pPut      = flag.String("put", "", "put a file to remote host")
-	pPath     = flag.String("path", "", "set path.if get is set this is local path,if put is set this is remote path")
-	pOverride = flag.Bool("override", false, "Override remote file if exists")
+	pGet       = flag.String("get", "", "get a file from remote host")
+	pPut       = flag.String("put", "", "put a file to remote host")
+	pPath      = flag.String("path", "", "set path.if get is set this is local path,if put is set this is remote path")
+	pOverride  = flag.Bool("override", false, "Override remote file if exists")
+	pRecurse   = flag.Bool("r", false, "put a dir recursively")
+	pMode      = flag.String("mode", "", "chmod put files after upload, eg. 0755")
+	pVerify    = flag.String("verify", "", "read back put files and compare with local: all or sample")
+	pStaged    = flag.Bool("staged", false, "put to a staging path on all hosts, move into place only if all hosts succeeded")
+	pSync      = flag.Bool("sync", false, "recursive put only files changed since the last sync, by a checksum index in remote dir")
+	pMerge     = flag.String("merge", "", "get files of all hosts into one file at path (- for stdout): lines prefixed by host, or sections per host")
+	pFrom      = flag.String("from", "", "read put file from this host and relay it to hosts, it never lands locally")
+	pExtract   = flag.Bool("extract", false, "extract put tar, tar.gz, tar.zst or tar.lz4, or a dir packed on the fly, into remote path(dir), -put - reads from stdin")
+	pTransport = flag.String("transport", "", "file transport: sftp or scp")
+	pForce     = flag.Bool("force", false, "dial hosts skipped as unreachable within reachability.skip_minutes")
+	pChange    = flag.String("change", "", "change ticket of deploys, eg. CHG12345. required by protected groups of change configure")
+	pExclude   = flag.String("exclude", "", "skip hosts, multiple hosts are separated by comma(,)")
+	pHostLogs  = flag.String("host-logs", "", "log commands, transfers and output of every host into <dir>/<run id>/<host>.log")
+	pDedupe    = flag.Bool("dedupe", false, "skip hosts with the same ssh host key as an earlier host, eg. one machine listed by name and ip")
+	pCI        = flag.Bool("ci", false, "ci mode: log sections, masked secrets and error annotations of GitHub Actions/GitLab CI, exit 2 if only some hosts failed")
+	pRecord    = flag.String("record", "", "record remote commands and output of every host as asciicast or typescript, stored with the run record")
+	pBecome    = flag.Bool("become", false, "run commands on ssh hosts as root by sudo")
+	pAskPass   = flag.Bool("ask-pass", false, "prompt for ssh password, it is never echoed or logged")
+	pAskBecome = flag.Bool("ask-become-pass", false, "prompt for sudo password of -become, implies -become")
 )
 
+// stringList repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var pHostTags stringList
+
+// wo output of remote commands, set by -o
+var wo = common.Stdout
+
+func init() {
+	flag.Usage = printUsage
+	flag.Var(&pHostTags, "hosttag", "tag hosts into an ad-hoc group selected by -g, eg. role=web:10.0.0.1,10.0.0.2. repeatable")
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Llongfile)
+	log.SetOutput(common.Stderr)
+	log.SetPrefix("[" + common.RunID + "] ")
 	flag.Parse()
 	if *pVersion {
-		fmt.Println("Opstool", OptoolVersion)
+		fmt.Println("Opstool", common.VersionString())
 		os.Exit(0)
 	}
 	if *pEncrypt {
+		if *pCI {
+			log.Fatalln("Encrypt reads from a terminal, not available in ci mode")
+		}
 		doEncryption()
 		os.Exit(0)
 	}
@@ -85,7 +134,28 @@ func main() {
 	}
 
 	if err = common.ParseConfig(*pConfigFile); err != nil {
-		log.Fatalln("ParseConfig: ", err)
+		// completion works without configure, lint reports it
+		if _, ok := earlyCommands[flag.Arg(0)]; !ok || flag.Arg(0) == "lint" {
+			log.Fatalln("ParseConfig: ", err)
+		}
+	} else if err = common.CheckMinVersion(); err != nil {
+		log.Println("Warning:", err)
+	}
+	common.RegisterConfigSecrets()
+	if err = common.LoadReplay(); err != nil {
+		log.Fatalln("Replay: ", err)
+	}
+	if *pCI {
+		common.EnableCI()
+	}
+	if cmd, ok := earlyCommands[flag.Arg(0)]; ok {
+		if err = cmd.run(nil, flag.Args()[1:]); err != nil {
+			if err == errUsage {
+				log.Fatalln("Usage: optool [flags] " + cmd.usage)
+			}
+			log.Fatalln(err)
+		}
+		os.Exit(0)
 	}
 	// tag list,print,arg parse
 	if *pTagList {
@@ -99,13 +169,13 @@ func main() {
 		tagArgs = strings.Split(*pTagArgs, ",")
 	}
 	// output handle
-	wo := os.Stdout
 	if *pOutput != "-" {
-		wo, err = os.OpenFile(*pOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0755)
+		f, err := os.OpenFile(*pOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0755)
 		if err != nil {
 			log.Fatalln("Open output: ", err)
 		}
-		defer wo.Close()
+		defer f.Close()
+		wo = common.RedactWriter(f)
 	}
 	// gzip or not
 	common.C.Gzip = *pGzip
@@ -115,14 +185,38 @@ func main() {
 	}
 	// hosts
 	var hosts []string
-	if *pHost != "" {
-		hosts = []string{*pHost}
+	var tagged []string
+	group := ""
+	for _, spec := range pHostTags {
+		_, th, err := common.AddHostTag(spec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tagged = append(tagged, th...)
+	}
+	if *pHostsFile != "" {
+		if *pHostsFile == "-" && *pPut == common.TransferStdin {
+			log.Fatalln("Hosts file and put content cannot both be read from stdin")
+		}
+		if hosts, err = common.ReadHostFile(*pHostsFile); err != nil {
+			log.Fatalln("Hosts file: ", err)
+		}
+		if len(hosts) == 0 {
+			log.Fatalln("No host found in hosts file")
+		}
+	} else if *pHost != "" {
+		hosts = common.SplitHosts(*pHost)
+	} else if *pGroup == "" && len(tagged) > 0 {
+		// all tagged hosts if no group is selected
+		hosts = common.UniqueHosts(tagged)
 	} else {
 		var ok bool
 		if *pGroup != "" {
 			common.C.Server.DefaultGroup = *pGroup
 		}
-		if hosts, ok = common.C.Server.Hosts[common.C.Server.DefaultGroup]; !ok {
+		group = common.C.Server.DefaultGroup
+		cmd, isCmd := commands[flag.Arg(0)]
+		if hosts, ok = common.C.Server.Hosts[common.C.Server.DefaultGroup]; !ok && !(isCmd && cmd.ownHosts) {
 			log.Fatalln("Host group not found. Group: ", common.C.Server.DefaultGroup)
 		}
 	}
@@ -130,35 +224,81 @@ func main() {
 	if *pPort > 0 && *pPort < 65536 {
 		common.C.Server.DefaultPort = *pPort
 	}
+	if *pDedupe {
+		common.C.DedupeHosts = true
+	}
+	if *pHostLogs != "" {
+		common.C.HostLogDir = *pHostLogs
+	}
+	if *pRecord != "" {
+		common.C.Record = *pRecord
+	}
+	if err = common.CheckRecord(); err != nil {
+		log.Fatalln(err)
+	}
+	common.C.Exclude = append(common.C.Exclude, common.SplitHosts(*pExclude)...)
+	if hosts, err = common.ExpandHosts(hosts); err != nil {
+		log.Fatalln(err)
+	}
+	common.NotePolicyGroup(group, hosts)
+	if replayed := common.ReplayHosts(); replayed != nil {
+		hosts = replayed
+	}
+	if cmd, isCmd := commands[flag.Arg(0)]; len(hosts) == 0 && !(isCmd && cmd.ownHosts) {
+		log.Fatalln("No host left to run, all hosts are excluded or quarantined")
+	}
+	// concurrency
+	if *pConcurrency > 0 {
+		common.C.Concurrency = *pConcurrency
+	}
 	// private key
 	if *pPrivateKey != "" {
 		common.C.Auth.PrivateKey = *pPrivateKey
 		common.C.Auth.PrivateKeyPhrase = ""
 	}
-	// Get/Put files
-	if *pGet != "" && *pPut != "" {
-		log.Fatalln("Get or put cannot be set at once")
+	if *pTransport != "" {
+		common.C.Transport = *pTransport
 	}
-	transfer := &common.Transfer{
-		Inited: false,
+	common.C.Force = *pForce
+	if *pAskPass {
+		if common.C.Auth.AskedPassword, err = askPass("SSH password: "); err != nil {
+			log.Fatalln(err)
+		}
 	}
-	if *pGet != "" {
-		transfer = common.NewTransfer(common.TransferGet, *pPath, *pGet, hosts)
-	} else if *pPut != "" {
-		transfer = common.NewTransfer(common.TransferPut, *pPut, *pPath, hosts)
+	if *pBecome || *pAskBecome {
+		common.C.Become = true
 	}
-	if transfer.Inited {
-		if common.C.TransferMaxSize < 1 {
-			common.C.TransferMaxSize = common.TransferDefaultMaxSize
-		}
-		if *pOverride {
-			transfer.Override = true
-		}
-		if err = transfer.Start(); err != nil {
+	if *pAskBecome {
+		if common.C.BecomePassword, err = askPass("BECOME password: "); err != nil {
 			log.Fatalln(err)
 		}
-		transfer.PrettyPrint()
-		os.Exit(0)
+	}
+	if *pAtomic {
+		common.C.Deploy.Atomic = true
+		common.C.Deploy.Staged = true
+	}
+	if err = authorize(); err != nil {
+		log.Fatalln(err)
+	}
+	if err = common.StartRunRecord(*pConfigFile, os.Args[1:], hosts); err != nil {
+		log.Println("Warning: record run:", err)
+	}
+	// sub commands
+	if flag.NArg() > 0 {
+		exit(runCommand(hosts, flag.Args()))
+	}
+	// Get/Put files
+	if *pGet != "" && *pPut != "" {
+		log.Fatalln("Get or put cannot be set at once")
+	}
+	if *pGet != "" || *pPut != "" {
+		var transfer *common.Transfer
+		if *pGet != "" {
+			transfer = common.NewTransfer(common.TransferGet, *pPath, *pGet, hosts)
+		} else {
+			transfer = common.NewTransfer(common.TransferPut, *pPut, *pPath, hosts)
+		}
+		exit(startTransfer(transfer))
 	}
 	// command
 	var cmd string
@@ -203,16 +343,92 @@ func main() {
 		fmt.Println("Config file: ", *pConfigFile)
 		fmt.Println("================================ Config ===================================")
 		ox, _ := yaml.Marshal(common.C)
-		os.Stdout.Write(ox)
+		common.Stdout.Write(ox)
 		os.Exit(0)
 	}
 	// run
 	//cmd := "/bin/cat /data/tmp/phalcon-cli.log"
+	exit(execCommand(hosts, cmd))
+}
+
+// exit exit with result of run. in ci mode failed hosts fail the run too, exit code tells partial from total failure
+func exit(err error) {
+	common.CloseShared()
+	common.CloseHostLogs()
+	common.CloseRecordings()
+	common.RemoveControl()
+	if e := common.SaveDurations(); e != nil {
+		log.Println("Warning: save durations:", e)
+	}
+	if e := common.SaveHashes(); e != nil {
+		log.Println("Warning: save hashes:", e)
+	}
+	if e := common.FinishRunRecord(err); e != nil {
+		log.Println("Warning: record run:", e)
+	}
+	if e := common.SendRunEmail(); e != nil {
+		log.Println("Email:", e)
+	}
+	if common.C.HostLogDir != "" {
+		log.Println("Host logs:", filepath.Join(common.C.HostLogDir, common.RunID))
+	}
+	if common.C.Record != "" {
+		log.Println("Session recordings:", filepath.Join(common.StateDir, "runs", common.RunID))
+	}
+	if common.CI != "" {
+		os.Exit(common.CIExitCode(err))
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Exit(0)
+}
+
+// startTransfer apply transfer flags, start transfer and print result
+func startTransfer(transfer *common.Transfer) error {
+	if common.C.TransferMaxSize < 1 {
+		common.C.TransferMaxSize = common.TransferDefaultMaxSize
+	}
+	if *pOverride {
+		transfer.Override = true
+	}
+	transfer.Extract = *pExtract
+	transfer.Recursive = *pRecurse
+	transfer.Staged = *pStaged
+	transfer.Sync = *pSync
+	if *pMerge != "" {
+		if transfer.Method != common.TransferGet {
+			return errors.New("-merge is only supported by get")
+		}
+		transfer.Merge = *pMerge
+	}
+	if *pFrom != "" {
+		if transfer.Method != common.TransferPut {
+			return errors.New("-from is only supported by put")
+		}
+		transfer.From = *pFrom
+	}
+	transfer.Verify = *pVerify
+	if *pMode != "" {
+		mode, err := strconv.ParseUint(*pMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid mode: %s", *pMode)
+		}
+		transfer.Mode = os.FileMode(mode)
+	}
+	err := transfer.Start()
+	transfer.PrettyPrint()
+	return err
+}
+
+// execCommand run command on hosts and print output to -o
+func execCommand(hosts []string, cmd string) error {
 	rc := common.NewRemoteCommand(hosts, cmd)
 	if err := rc.Start(); err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	rc.PrettyPrint(wo, os.Stderr, (*pNoHeader&NoHeader) > 0, (*pNoHeader&NoServer) > 0)
+	rc.PrettyPrint(wo, common.Stderr, (*pNoHeader&NoHeader) > 0, (*pNoHeader&NoServer) > 0)
+	return nil
 }
 
 func printSample() {
@@ -241,6 +457,21 @@ tags:
 `)
 }
 
+// askPass prompt for a password on terminal without echo, it is registered as secret so that it is never logged
+func askPass(prompt string) (string, error) {
+	if !terminal.IsTerminal(int(syscall.Stdin)) {
+		return "", errors.New("Password prompt needs a terminal on stdin")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	common.RegisterSecret(string(p))
+	return string(p), nil
+}
+
 func doEncryption() {
 	var str string
 	var restr string